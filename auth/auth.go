@@ -2,17 +2,18 @@ package auth
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/wangxso/backuptool/config"
 	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/handler"
 	openapiclient "github.com/wangxso/backuptool/openxpanapi"
+	"github.com/wangxso/backuptool/utils"
 )
 
 type authReturnType struct {
@@ -29,39 +30,94 @@ const (
 	AccessCodeValidity = 30 * 24 * time.Hour // Access Code 有效期
 )
 
-func getAcessToken(authCode string, clientId string, clientSecret string, redirectUri string) string {
+func init() {
+	handler.TokenRefresher = RefreshToken
+}
+
+func getAcessToken(ctx context.Context, authCode string, clientId string, clientSecret string, redirectUri string) ([]byte, error) {
 
-	configuration := openapiclient.NewConfiguration()
+	configuration := utils.APIConfiguration()
 	api_client := openapiclient.NewAPIClient(configuration)
-	resp, r, err := api_client.AuthApi.OauthTokenCode2token(context.Background()).Code(authCode).ClientId(clientId).ClientSecret(clientSecret).RedirectUri(redirectUri).Execute()
+	ctx, cancel := context.WithTimeout(ctx, config.RequestTimeout())
+	defer cancel()
+	_, r, err := api_client.AuthApi.OauthTokenCode2token(ctx).Code(authCode).ClientId(clientId).ClientSecret(clientSecret).RedirectUri(redirectUri).Execute()
+	bodyBytes, err := utils.ReadResponseBody(r, err)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error when calling `AuthApi.OauthTokenCode2token``: %v\n", err)
-		fmt.Fprintf(os.Stderr, "Full HTTP response: %v\n", r)
-	}
-	// response from `OauthTokenCode2token`: OauthTokenAuthorizationCodeResponse
-	fmt.Fprintf(os.Stdout, "Response from `AuthApi.OauthTokenCode2token`: %v\n", resp)
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "err: %v\n", r)
+		return nil, err
 	}
-	return string(bodyBytes)
+	return bodyBytes, handler.DecodeErrno(bodyBytes)
 }
 
-func Login(authCode string) authReturnType {
-	ctx := db.Client.Context()
-	appKey := config.BackUpConfig.BaiduDisk.AppKey
-	appSecret := config.BackUpConfig.BaiduDisk.SecretKey
-	redirectUri := config.BackUpConfig.BaiduDisk.RedirectUri
-
-	respStr := getAcessToken(authCode, appKey, appSecret, redirectUri)
+func Login(ctx context.Context, authCode string) (authReturnType, error) {
+	baidu := config.Get().BaiduDisk
+	appKey := baidu.AppKey
+	appSecret := baidu.SecretKey
+	redirectUri := baidu.RedirectUri
 
 	var resp authReturnType
-	err := json.Unmarshal([]byte(respStr), &resp)
+	respBytes, err := getAcessToken(ctx, authCode, appKey, appSecret, redirectUri)
 	if err != nil {
-		log.Fatal(err)
+		return resp, err
 	}
-	logrus.Info("Login Success AccessCode: ", resp.AccessToken)
+
+	if err = utils.DecodeJSON("oauth token", respBytes, &resp); err != nil {
+		return resp, err
+	}
+	logrus.Info("Login Success, scope: ", resp.Scope)
 	db.Client.Set(ctx, "AccessCode", resp.AccessToken, AccessCodeValidity)
 	db.Client.Set(ctx, "RefreshCode", resp.RefreshToken, AccessCodeValidity*2)
-	return resp
+	return resp, nil
+}
+
+// AccessToken returns the current access token from Redis.
+func AccessToken() string {
+	accessToken, _ := db.Client.Get(db.Client.Context(), "AccessCode").Result()
+	return accessToken
+}
+
+var (
+	refreshMu   sync.Mutex
+	lastRefresh time.Time
+)
+
+// refreshDebounce 并发请求同时遇到 token 失效时只刷新一次
+const refreshDebounce = time.Minute
+
+// RefreshToken exchanges the stored refresh token for a new access token.
+func RefreshToken(ctx context.Context) error {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	if time.Since(lastRefresh) < refreshDebounce {
+		return nil
+	}
+	refreshToken, err := db.Client.Get(ctx, "RefreshCode").Result()
+	if err != nil {
+		return fmt.Errorf("no refresh token, please login again: %w", err)
+	}
+	baidu := config.Get().BaiduDisk
+	configuration := utils.APIConfiguration()
+	api_client := openapiclient.NewAPIClient(configuration)
+	ctx, cancel := context.WithTimeout(ctx, config.RequestTimeout())
+	defer cancel()
+	resp, r, err := api_client.AuthApi.OauthTokenRefreshToken(ctx).RefreshToken(refreshToken).ClientId(baidu.AppKey).ClientSecret(baidu.SecretKey).Execute()
+	if err != nil {
+		if body, readErr := utils.ReadResponseBody(r, err); readErr == nil {
+			if apiErr := handler.DecodeErrno(body); apiErr != nil {
+				err = apiErr
+			}
+		}
+		logrus.Error("Error when calling `AuthApi.OauthTokenRefreshToken``: ", err)
+		return err
+	}
+	if resp.AccessToken == nil || *resp.AccessToken == "" {
+		return errors.New("refresh token response has no access token")
+	}
+	db.Client.Set(ctx, "AccessCode", *resp.AccessToken, AccessCodeValidity)
+	if resp.RefreshToken != nil && *resp.RefreshToken != "" {
+		db.Client.Set(ctx, "RefreshCode", *resp.RefreshToken, AccessCodeValidity*2)
+	}
+	lastRefresh = time.Now()
+	logrus.Info("Access token refreshed")
+	return nil
 }
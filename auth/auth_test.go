@@ -0,0 +1,49 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/wangxso/backuptool/auth"
+	"github.com/wangxso/backuptool/cassette"
+	"github.com/wangxso/backuptool/cassette/cassettetest"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/handler"
+)
+
+// TestReplayAuth parses the oauth responses in the shape Baidu returns
+// them. The subtests run in order, after a successful refresh the next one
+// is debounced for a minute.
+func TestReplayAuth(t *testing.T) {
+	ctx := context.Background()
+	t.Run("refresh expired", func(t *testing.T) {
+		cassettetest.Replay(t, "testdata/refresh_expired.json")
+		err := auth.RefreshToken(ctx)
+		if !errors.Is(err, handler.ClassAuth) {
+			t.Fatalf("got %v, want an auth error", err)
+		}
+	})
+	t.Run("login", func(t *testing.T) {
+		cassettetest.Replay(t, "testdata/auth.json")
+		db.Client.Del(ctx, "AccessCode", "RefreshCode")
+		resp, err := auth.Login(ctx, "code")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Scope != "basic netdisk" || resp.ExpiresIn != 2592000 {
+			t.Fatalf("token: %+v", resp)
+		}
+		if auth.AccessToken() != cassette.Scrubbed {
+			t.Fatal("access token not stored")
+		}
+
+		db.Client.Del(ctx, "AccessCode")
+		if err := auth.RefreshToken(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if auth.AccessToken() != cassette.Scrubbed {
+			t.Fatal("refreshed access token not stored")
+		}
+	})
+}
@@ -0,0 +1,306 @@
+// Package cassette records the requests sent to Baidu Pan and their
+// responses into cassette files, with the tokens scrubbed, and replays them
+// in tests so that changes in the shape of the responses are caught without
+// network access.
+package cassette
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/wangxso/backuptool/utils"
+)
+
+// Scrubbed 替换录制内容中的 token 和密钥
+const Scrubbed = "SCRUBBED"
+
+// maxRequestBody 以上的请求体 (例如分片) 只记录长度
+const maxRequestBody = 4096
+
+// maxResponseBody 以上的响应体 (例如下载的文件内容) 只记录长度, 不缓存在内存中
+const maxResponseBody = 64 << 10
+
+// secretParams 是请求参数和响应 JSON 中需要替换的字段
+var secretParams = []string{
+	"access_token", "refresh_token", "code", "client_id", "client_secret",
+	"session_key", "session_secret",
+}
+
+// keptHeaders 是录制的响应头, 其他头 (例如 Set-Cookie) 丢弃
+var keptHeaders = []string{"Content-Type", "Content-Range", "Accept-Ranges"}
+
+// Request is a recorded request, secret query and form values are scrubbed.
+type Request struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+	// BodySize is set instead of Body for large or binary bodies
+	BodySize int64 `json:"bodySize,omitempty"`
+}
+
+// Response is a recorded response. Binary bodies are stored in BodyBase64.
+type Response struct {
+	Status     int               `json:"status"`
+	Header     map[string]string `json:"header,omitempty"`
+	Body       string            `json:"body,omitempty"`
+	BodyBase64 string            `json:"bodyBase64,omitempty"`
+	// BodySize is set instead of the body for large bodies, e.g. downloads
+	BodySize int64 `json:"bodySize,omitempty"`
+}
+
+// Interaction is one request and its response.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Cassette is the content of a cassette file.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Load reads the cassette file at path.
+func Load(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("cassette %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Save writes c to path, creating the parent directory. The & of urls is
+// not escaped so that the file stays readable.
+func (c *Cassette) Save(path string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// Recorder forwards requests to Base and records them with their responses.
+type Recorder struct {
+	Base http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// Record wraps the shared HTTP client of utils with a Recorder, it takes
+// effect on the next utils.LoadHTTPClient.
+func Record() *Recorder {
+	r := &Recorder{}
+	utils.WrapTransport = func(base http.RoundTripper) http.RoundTripper {
+		r.mu.Lock()
+		r.Base = base
+		r.mu.Unlock()
+		return r
+	}
+	return r
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorded, err := recordRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	base := r.Base
+	r.mu.Unlock()
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	in := Interaction{Request: recorded, Response: Response{Status: resp.StatusCode, Header: make(map[string]string)}}
+	for _, h := range keptHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			in.Response.Header[h] = v
+		}
+	}
+	// 响应体边读边记录, 读完或关闭时才加入录制内容
+	resp.Body = &recordingBody{ReadCloser: resp.Body, r: r, in: in, size: resp.ContentLength}
+	return resp, nil
+}
+
+// recordingBody passes a response body through to the caller and records
+// it when it is read to the end or closed, large bodies only by size.
+type recordingBody struct {
+	io.ReadCloser
+	r   *Recorder
+	in  Interaction
+	buf bytes.Buffer
+	n   int64
+	// size 是响应头中的长度, 未知时为 -1
+	size int64
+	once sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if keep := maxResponseBody + 1 - b.buf.Len(); keep > 0 {
+		b.buf.Write(p[:min(n, keep)])
+	}
+	b.n += int64(n)
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+// Close records the rest of a small body that the caller did not read, a
+// large body is not drained.
+func (b *recordingBody) Close() error {
+	if b.n <= maxResponseBody {
+		io.Copy(io.Discard, io.LimitReader(b, maxResponseBody+1-b.n))
+	}
+	if b.n > maxResponseBody && b.size > b.n {
+		b.n = b.size
+	}
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+func (b *recordingBody) finish() {
+	b.once.Do(func() {
+		body := b.buf.Bytes()
+		switch {
+		case b.n > maxResponseBody:
+			b.in.Response.BodySize = b.n
+		case utf8.Valid(body):
+			b.in.Response.Body = string(scrubJSON(body))
+		default:
+			b.in.Response.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+		}
+		b.r.mu.Lock()
+		b.r.cassette.Interactions = append(b.r.cassette.Interactions, b.in)
+		b.r.mu.Unlock()
+	})
+}
+
+// Save writes the interactions recorded so far to path.
+func (r *Recorder) Save(path string) error {
+	r.mu.Lock()
+	c := Cassette{Interactions: append([]Interaction(nil), r.cassette.Interactions...)}
+	r.mu.Unlock()
+	return c.Save(path)
+}
+
+// recordRequest reads the body of req, which is restored for the real
+// round trip, and scrubs the secrets of the url and form body.
+func recordRequest(req *http.Request) (Request, error) {
+	recorded := Request{Method: req.Method, URL: scrubURL(req.URL)}
+	if req.Body == nil || req.Body == http.NoBody {
+		return recorded, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return recorded, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	switch {
+	case len(body) > maxRequestBody || !utf8.Valid(body):
+		recorded.BodySize = int64(len(body))
+	case strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded"):
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			recorded.BodySize = int64(len(body))
+			break
+		}
+		scrubValues(form)
+		recorded.Body = form.Encode()
+	default:
+		recorded.Body = string(scrubJSON(body))
+	}
+	return recorded, nil
+}
+
+func scrubURL(u *url.URL) string {
+	scrubbed := *u
+	q := scrubbed.Query()
+	scrubValues(q)
+	scrubbed.RawQuery = q.Encode()
+	return scrubbed.String()
+}
+
+func scrubValues(v url.Values) {
+	for _, key := range secretParams {
+		if _, ok := v[key]; ok {
+			v.Set(key, Scrubbed)
+		}
+	}
+}
+
+// scrubJSON replaces the secret fields of a JSON body, other bodies are
+// returned as is. Numbers are kept verbatim, fs_id does not fit a float64.
+func scrubJSON(body []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return body
+	}
+	if !scrubValue(v) {
+		return body
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return data
+}
+
+// scrubValue reports whether v contained a secret.
+func scrubValue(v interface{}) bool {
+	found := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if isSecret(key) {
+				if s, ok := value.(string); ok && s != "" {
+					v[key] = Scrubbed
+					found = true
+				}
+				continue
+			}
+			found = scrubValue(value) || found
+		}
+	case []interface{}:
+		for _, value := range v {
+			found = scrubValue(value) || found
+		}
+	}
+	return found
+}
+
+func isSecret(key string) bool {
+	for _, s := range secretParams {
+		if key == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package cassette
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordScrubs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "BDUSS=secret")
+		switch r.URL.Path {
+		case "/oauth/2.0/token":
+			io.WriteString(w, `{"access_token":"at-secret","refresh_token":"rt-secret","session_key":"","expires_in":2592000}`)
+		default:
+			io.WriteString(w, `{"errno":0,"list":[{"fs_id":657059106724647123}],"request_id":"1"}`)
+		}
+	}))
+	defer srv.Close()
+
+	rec := &Recorder{Base: http.DefaultTransport}
+	client := &http.Client{Transport: rec}
+	resp, err := client.Get(srv.URL + "/oauth/2.0/token?grant_type=refresh_token&refresh_token=rt-old&client_secret=cs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "at-secret") {
+		t.Fatal("the caller must get the real response")
+	}
+	form := url.Values{"access_token": {"at-secret"}, "path": {"/apps/a.txt"}}
+	resp, err = client.PostForm(srv.URL+"/rest/2.0/xpan/file?method=list&access_token=at-secret", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	path := filepath.Join(t.TempDir(), "c.json")
+	if err := rec.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Interactions) != 2 {
+		t.Fatalf("recorded %d interactions", len(c.Interactions))
+	}
+	for _, in := range c.Interactions {
+		all := in.Request.URL + in.Request.Body + in.Response.Body
+		for _, secret := range []string{"at-secret", "rt-secret", "rt-old", "cs&", "BDUSS"} {
+			if strings.Contains(all, secret) {
+				t.Errorf("%q not scrubbed: %+v", secret, in)
+			}
+		}
+		if in.Response.Header["Set-Cookie"] != "" {
+			t.Error("Set-Cookie recorded")
+		}
+	}
+	if !strings.Contains(c.Interactions[1].Request.Body, "path=%2Fapps%2Fa.txt") {
+		t.Fatalf("form body: %q", c.Interactions[1].Request.Body)
+	}
+	if !strings.Contains(c.Interactions[1].Response.Body, "657059106724647123") {
+		t.Fatalf("fs_id changed: %s", c.Interactions[1].Response.Body)
+	}
+
+}
+
+func TestRecordLargeBody(t *testing.T) {
+	big := strings.Repeat("x", maxResponseBody+1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, big)
+	}))
+	defer srv.Close()
+
+	rec := &Recorder{Base: http.DefaultTransport}
+	client := &http.Client{Transport: rec}
+	resp, err := client.Get(srv.URL + "/file/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != big {
+		t.Fatalf("the caller got %d bytes, want %d", len(body), len(big))
+	}
+	// 没有读完就关闭的响应也要录制
+	resp, err = client.Get(srv.URL + "/file/b.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	path := filepath.Join(t.TempDir(), "c.json")
+	if err := rec.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Interactions) != 2 {
+		t.Fatalf("recorded %d interactions", len(c.Interactions))
+	}
+	got := c.Interactions[0].Response
+	if got.Body != "" || got.BodyBase64 != "" || got.BodySize != int64(len(big)) {
+		t.Fatalf("large body recorded as body=%d base64=%d size=%d", len(got.Body), len(got.BodyBase64), got.BodySize)
+	}
+	if got := c.Interactions[1].Response; got.Body != "" || got.BodySize != int64(len(big)) {
+		t.Fatalf("closed body recorded as body=%d size=%d", len(got.Body), got.BodySize)
+	}
+}
@@ -0,0 +1,149 @@
+// Package cassettetest replays cassette files recorded by package cassette
+// in tests.
+package cassettetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/wangxso/backuptool/cassette"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/utils"
+)
+
+// Replayer answers requests with the recorded responses. A request matches
+// an interaction with the same method, path, method and grant_type query
+// parameters. Interactions of the same api are replayed in recorded order.
+type Replayer struct {
+	mu       sync.Mutex
+	cassette *cassette.Cassette
+	used     []bool
+}
+
+// NewReplayer returns a Replayer of c.
+func NewReplayer(c *cassette.Cassette) *Replayer {
+	return &Replayer{cassette: c, used: make([]bool, len(c.Interactions))}
+}
+
+// matchKey identifies the api of a request, the host is ignored so that a
+// cassette recorded against Baidu replays with any configured base URL.
+func matchKey(method, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return method + " " + rawURL
+	}
+	q := u.Query()
+	return method + " " + u.Path + "?method=" + q.Get("method") + "&grant_type=" + q.Get("grant_type")
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	key := matchKey(req.Method, req.URL.String())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, in := range r.cassette.Interactions {
+		if r.used[i] || matchKey(in.Request.Method, in.Request.URL) != key {
+			continue
+		}
+		r.used[i] = true
+		return response(in.Response, req)
+	}
+	return nil, fmt.Errorf("cassette: no recorded interaction for %s", key)
+}
+
+// Unused returns the interactions that were not replayed.
+func (r *Replayer) Unused() []cassette.Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ret []cassette.Interaction
+	for i, in := range r.cassette.Interactions {
+		if !r.used[i] {
+			ret = append(ret, in)
+		}
+	}
+	return ret
+}
+
+func response(resp cassette.Response, req *http.Request) (*http.Response, error) {
+	body := []byte(resp.Body)
+	switch {
+	case resp.BodyBase64 != "":
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(resp.BodyBase64); err != nil {
+			return nil, err
+		}
+	case resp.BodySize > 0:
+		// 没有录制的大响应体 (例如下载的文件内容) 回放为同样长度的零字节
+		body = make([]byte, resp.BodySize)
+	}
+	header := make(http.Header)
+	for k, v := range resp.Header {
+		header.Set(k, v)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", resp.Status, http.StatusText(resp.Status)),
+		StatusCode:    resp.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// Replay serves the cassette at path to the shared HTTP client of utils for
+// the length of the test. It also starts an in-memory Redis holding scrubbed
+// tokens, as the recorded session was logged in. The test fails when an
+// interaction was not replayed.
+func Replay(t testing.TB, path string) *Replayer {
+	t.Helper()
+	c, err := cassette.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReplayer(c)
+
+	mr := miniredis.RunT(t)
+	savedConfig := config.BackUpConfig
+	savedClient := db.Client
+	savedWrap := utils.WrapTransport
+	t.Cleanup(func() {
+		db.Client.Close()
+		db.Client = savedClient
+		config.BackUpConfig = savedConfig
+		utils.WrapTransport = savedWrap
+		utils.LoadHTTPClient()
+		if !t.Failed() {
+			for _, in := range r.Unused() {
+				t.Errorf("cassette %s: %s %s was not replayed", path, in.Request.Method, in.Request.URL)
+			}
+		}
+	})
+
+	config.BackUpConfig.General.TmpDir = t.TempDir()
+	config.BackUpConfig.HTTP = config.HTTPConfig{}
+	utils.WrapTransport = func(http.RoundTripper) http.RoundTripper { return r }
+	if err := utils.LoadHTTPClient(); err != nil {
+		t.Fatal(err)
+	}
+	db.Client = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	db.Client.Set(ctx, "AccessCode", cassette.Scrubbed, 0)
+	db.Client.Set(ctx, "RefreshCode", cassette.Scrubbed, 0)
+	return r
+}
@@ -0,0 +1,54 @@
+package cassettetest
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/wangxso/backuptool/cassette"
+)
+
+func TestReplayer(t *testing.T) {
+	c := &cassette.Cassette{Interactions: []cassette.Interaction{
+		{
+			Request:  cassette.Request{Method: "GET", URL: "https://openapi.baidu.com/oauth/2.0/token?grant_type=refresh_token&refresh_token=SCRUBBED"},
+			Response: cassette.Response{Status: 200, Body: `{"access_token":"SCRUBBED","expires_in":2592000}`},
+		},
+		{
+			Request:  cassette.Request{Method: "GET", URL: "https://d.pcs.baidu.com/file/a.bin"},
+			Response: cassette.Response{Status: 200, BodySize: 100},
+		},
+		{
+			Request:  cassette.Request{Method: "POST", URL: "https://pan.baidu.com/rest/2.0/xpan/file?method=list&access_token=SCRUBBED"},
+			Response: cassette.Response{Status: 200, Body: `{"errno":0}`},
+		},
+	}}
+
+	// 回放时忽略 host 和 token
+	r := NewReplayer(c)
+	client := &http.Client{Transport: r}
+	resp, err := client.Get("http://127.0.0.1:1/oauth/2.0/token?grant_type=refresh_token&refresh_token=other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `"access_token":"SCRUBBED"`) {
+		t.Fatalf("replayed %s", body)
+	}
+	if _, err := client.Get("https://openapi.baidu.com/oauth/2.0/token?grant_type=refresh_token"); err == nil {
+		t.Fatal("an interaction was replayed twice")
+	}
+	// 只记录了长度的响应体回放为同样长度
+	resp, err = client.Get("https://d.pcs.baidu.com/file/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if len(body) != 100 {
+		t.Fatalf("replayed %d bytes, want 100", len(body))
+	}
+	if n := len(r.Unused()); n != 1 {
+		t.Fatalf("unused: got %d, want 1", n)
+	}
+}
@@ -0,0 +1,106 @@
+// Package chunker splits content into variable sized chunks at positions
+// chosen by the content itself (content-defined chunking), so an insert or
+// a change in a large file only changes the chunks around it and the rest
+// still deduplicate.
+//
+// A cut point is where a gear rolling hash of the last bytes has its low
+// bits zero, between Min and Max bytes after the previous cut.
+package chunker
+
+import (
+	"errors"
+	"io"
+)
+
+// Params are the chunk sizes, Avg must be a power of two.
+type Params struct {
+	Min int
+	Avg int
+	Max int
+}
+
+// DefaultParams 平均 1 MiB, 改动一个字节通常只需要上传一两个块
+var DefaultParams = Params{Min: 256 << 10, Avg: 1 << 20, Max: 4 << 20}
+
+// gear 由固定的种子生成, 所有版本切分同样的内容得到同样的块
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x6261636b7570746f)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker reads chunks from r.
+type Chunker struct {
+	r    io.Reader
+	p    Params
+	mask uint64
+	buf  []byte
+	// buf[start:end] 是读取了但还没有返回的数据
+	start, end int
+	eof        bool
+}
+
+// New returns a chunker of r with p.
+func New(r io.Reader, p Params) (*Chunker, error) {
+	if p.Min <= 0 || p.Avg&(p.Avg-1) != 0 || p.Min > p.Avg || p.Avg > p.Max {
+		return nil, errors.New("chunker: invalid params")
+	}
+	return &Chunker{r: r, p: p, mask: uint64(p.Avg - 1), buf: make([]byte, p.Max)}, nil
+}
+
+// Next returns the next chunk, io.EOF after the last one. The chunk is
+// only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	data := c.buf[c.start:c.end]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+	n := c.cut(data)
+	c.start += n
+	return data[:n], nil
+}
+
+// fill 把未返回的数据移到开头并读满缓冲区
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.p.Max {
+		return nil
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	n, err := io.ReadFull(c.r, c.buf[c.end:])
+	c.end += n
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		c.eof = true
+		return nil
+	}
+	return err
+}
+
+func (c *Chunker) cut(data []byte) int {
+	if len(data) <= c.p.Min {
+		return len(data)
+	}
+	if len(data) > c.p.Max {
+		data = data[:c.p.Max]
+	}
+	var h uint64
+	for i := c.p.Min; i < len(data); i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
@@ -0,0 +1,74 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var testParams = Params{Min: 2 << 10, Avg: 8 << 10, Max: 32 << 10}
+
+func split(t *testing.T, data []byte) [][32]byte {
+	t.Helper()
+	c, err := New(bytes.NewReader(data), testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sums [][32]byte
+	var joined []byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > testParams.Max {
+			t.Fatalf("chunk of %d bytes", len(chunk))
+		}
+		joined = append(joined, chunk...)
+		sums = append(sums, sha256.Sum256(chunk))
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("chunks do not add up to the content")
+	}
+	return sums
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	sums := split(t, data)
+	if n := len(sums); n < 64 || n > 256 {
+		t.Fatalf("%d chunks for 1 MiB", n)
+	}
+
+	// 中间插入几个字节, 只有附近的块改变
+	edited := append(append(append([]byte(nil), data[:500000]...), "inserted"...), data[500000:]...)
+	known := make(map[[32]byte]bool)
+	for _, s := range sums {
+		known[s] = true
+	}
+	changed := 0
+	for _, s := range split(t, edited) {
+		if !known[s] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 3 {
+		t.Fatalf("%d chunks changed by an insert", changed)
+	}
+
+	if len(split(t, nil)) != 0 {
+		t.Fatal("chunks for empty content")
+	}
+	if sums := split(t, data[:100]); len(sums) != 1 {
+		t.Fatalf("%d chunks for 100 bytes", len(sums))
+	}
+	if _, err := New(nil, Params{Min: 1, Avg: 3, Max: 4}); err == nil {
+		t.Fatal("invalid params accepted")
+	}
+}
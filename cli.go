@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/wangxso/backuptool/cloudsync"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/restore"
+	"github.com/wangxso/backuptool/scrub"
+	"github.com/wangxso/backuptool/snapshot"
+)
+
+// 以下命令执行后退出, 不启动调度和 web 服务
+var (
+	jobName       = flag.String("job", "", "job used by the snapshot commands, the first job by default")
+	listSnapshots = flag.Bool("snapshots", false, "list the snapshots of -job and exit")
+	diffSnapshots = flag.String("diff", "", "print the changes between two snapshots of -job and exit, e.g. 20240101T000000Z,latest")
+	prune         = flag.Bool("prune", false, "delete the snapshots of -job outside its retention rules and the versions only they reference")
+	dryRun        = flag.Bool("dry-run", false, "with -prune, only print what would be deleted")
+
+	runRestore = flag.Bool("restore", false, "restore a snapshot of -job and exit, the latest one by default")
+	snapshotID = flag.String("snapshot", "", "with -restore, the snapshot ID to restore")
+	restoreAt  = flag.String("at", "", "with -restore, restore the newest snapshot taken at or before this time, e.g. \"2024-01-02 15:04\"")
+	include    = flag.String("include", "", "with -restore, only restore the paths matching these comma separated globs, e.g. docs,*.txt")
+	restoreTo  = flag.String("target", "", "with -restore, the folder to restore to, the source folder of the snapshot by default")
+	overwrite  = flag.Bool("overwrite", false, "with -restore, replace the local files that differ from the snapshot instead of keeping them")
+	parallel   = flag.Int("parallel", restore.DefaultParallel, "with -restore, the number of files downloaded at the same time")
+
+	genKey      = flag.String("genkey", "", "write a new random encryption key to this file and exit")
+	genIdentity = flag.String("gen-identity", "", "write a new X25519 private key to this file, print its public key and exit")
+	rotateKeys  = flag.Bool("rotate-keys", false, "wrap the file keys of the encrypted versions of -job again for the configured keys, without uploading the content again")
+
+	runScrub = flag.Bool("scrub", false, "download the content of -job again, check it against the local index and requeue what is damaged or missing")
+	sample   = flag.Float64("sample", -1, "with -scrub, the fraction of the content to check, e.g. 0.1, Scrub.sample by default")
+	bwLimit  = flag.String("bwlimit", "", "with -scrub, the download limit per second, e.g. 10MiB, Scrub.bandwidth by default")
+
+	rebuildState = flag.Bool("rebuild-state", false, "rebuild the state of -job in Redis, sync state or snapshot index, from the latest manifest in its cloud folder, e.g. on a new machine")
+)
+
+// runCommand runs the command given on the command line, it reports false
+// when there is none. ctx is cancelled on Ctrl-C.
+func runCommand(ctx context.Context) (bool, error) {
+	switch {
+	case *listSnapshots:
+		return true, printSnapshots()
+	case *diffSnapshots != "":
+		return true, printDiff(*diffSnapshots)
+	case *prune:
+		return true, runPrune(ctx, *dryRun)
+	case *runRestore:
+		return true, runRestoreCommand(ctx)
+	case *genKey != "":
+		return true, crypt.GenerateKeyFile(*genKey)
+	case *genIdentity != "":
+		return true, runGenIdentity(*genIdentity)
+	case *rotateKeys:
+		return true, runRotate(ctx)
+	case *runScrub:
+		return true, runScrubCommand(ctx)
+	case *rebuildState:
+		return true, runRebuildState(ctx)
+	}
+	return false, nil
+}
+
+// selectJob returns the job named -job.
+func selectJob() (config.Job, error) {
+	jobs := config.GetJobs()
+	if *jobName == "" {
+		return jobs[0], nil
+	}
+	for _, j := range jobs {
+		if j.Name == *jobName {
+			return j, nil
+		}
+	}
+	return config.Job{}, fmt.Errorf("job %q not found", *jobName)
+}
+
+func printSnapshots() error {
+	job, err := selectJob()
+	if err != nil {
+		return err
+	}
+	list, err := snapshot.List(job.Name)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tFILES\tSIZE\t")
+	for _, m := range list {
+		partial := ""
+		if m.Partial {
+			partial = "partial"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", m.ID, m.Created.Format("2006-01-02 15:04:05"), len(m.Files), m.Size(), partial)
+	}
+	return w.Flush()
+}
+
+func printDiff(arg string) error {
+	ids := strings.Split(arg, ",")
+	if len(ids) != 2 {
+		return errors.New("-diff needs two snapshot IDs separated by a comma")
+	}
+	job, err := selectJob()
+	if err != nil {
+		return err
+	}
+	a, err := snapshot.Load(job.Name, strings.TrimSpace(ids[0]))
+	if err != nil {
+		return err
+	}
+	b, err := snapshot.Load(job.Name, strings.TrimSpace(ids[1]))
+	if err != nil {
+		return err
+	}
+	for _, c := range snapshot.Diff(a, b) {
+		switch c.Kind {
+		case snapshot.Added:
+			fmt.Printf("+ %s (%d bytes)\n", c.Path, c.New.Size)
+		case snapshot.Removed:
+			fmt.Printf("- %s\n", c.Path)
+		case snapshot.Modified:
+			fmt.Printf("M %s (%d -> %d bytes)\n", c.Path, c.Old.Size, c.New.Size)
+		}
+	}
+	return nil
+}
+
+func runPrune(ctx context.Context, dryRun bool) error {
+	job, err := selectJob()
+	if err != nil {
+		return err
+	}
+	if job.Retention.Empty() {
+		return fmt.Errorf("job %s has no retention rules", job.Name)
+	}
+	plan, err := snapshot.PlanPrune(job)
+	if err != nil {
+		return err
+	}
+	for _, m := range plan.Keep {
+		fmt.Printf("keep    %s  %s\n", m.ID, strings.Join(plan.Reasons[m.ID], ","))
+	}
+	for _, m := range plan.Remove {
+		fmt.Printf("remove  %s\n", m.ID)
+	}
+	fmt.Printf("%d snapshots to remove, %d versions and %d packs (%d bytes) to delete\n", len(plan.Remove), len(plan.Objects), len(plan.Packs), plan.Bytes())
+	if dryRun {
+		for _, o := range plan.Objects {
+			fmt.Printf("delete  %s\n", o.Path)
+		}
+		for _, pk := range plan.Packs {
+			fmt.Printf("delete  %s\n", pk.Path)
+		}
+		return nil
+	}
+	return snapshot.Prune(ctx, plan)
+}
+
+func runRestoreCommand(ctx context.Context) error {
+	job, err := selectJob()
+	if err != nil {
+		return err
+	}
+	opts := restore.Options{
+		Job:       job.Name,
+		Snapshot:  *snapshotID,
+		Target:    *restoreTo,
+		Overwrite: *overwrite,
+		Parallel:  *parallel,
+	}
+	if *restoreAt != "" {
+		if opts.At, err = restore.ParseTime(*restoreAt); err != nil {
+			return err
+		}
+	}
+	for _, g := range strings.Split(*include, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			opts.Globs = append(opts.Globs, g)
+		}
+	}
+	m, result, err := restore.Restore(ctx, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("snapshot %s: %d restored, %d skipped, %d failed\n", m.ID, result.Downloaded, result.Skipped, len(result.Failed))
+	for _, f := range result.Failed {
+		fmt.Printf("failed  %s: %s\n", f.Path, f.Error)
+	}
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d files failed to restore", len(result.Failed))
+	}
+	return nil
+}
+
+func runGenIdentity(path string) error {
+	id, err := crypt.WriteIdentityFile(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("public key: %s\n", id.Recipient())
+	return nil
+}
+
+func runRotate(ctx context.Context) error {
+	job, err := selectJob()
+	if err != nil {
+		return err
+	}
+	result, err := snapshot.Rotate(ctx, job)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d versions rewrapped, %d failed\n", result.Rotated, len(result.Failed))
+	for _, f := range result.Failed {
+		fmt.Printf("failed  %s: %s\n", f.Path, f.Error)
+	}
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d versions failed to rotate", len(result.Failed))
+	}
+	return nil
+}
+
+func runScrubCommand(ctx context.Context) error {
+	job, err := selectJob()
+	if err != nil {
+		return err
+	}
+	c := config.Get().Scrub
+	opts := scrub.Options{Sample: c.Sample, Limit: config.ParseSize(c.Bandwidth, 0)}
+	if *sample >= 0 {
+		opts.Sample = *sample
+	}
+	if *bwLimit != "" {
+		opts.Limit = config.ParseSize(*bwLimit, 0)
+	}
+	report, err := scrub.Scrub(ctx, job, opts)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		fmt.Printf("%-8s  %s  %s\n", p.Kind, p.Path, strings.Join(p.Files, ","))
+	}
+	for _, f := range report.Failed {
+		fmt.Printf("failed    %s: %s\n", f.Path, f.Error)
+	}
+	for _, p := range report.PrefixOnly {
+		fmt.Printf("prefix    %s\n", p)
+	}
+	for _, p := range report.Repaired {
+		fmt.Printf("repaired  %s\n", p)
+	}
+	fmt.Printf("%d checked (%d bytes), %d only checked up to 4 KiB, %d repaired by parity, %d damaged or missing, %d requeued, %d failed\n",
+		report.Checked, report.Bytes, len(report.PrefixOnly), len(report.Repaired), len(report.Problems), report.Requeued, len(report.Failed))
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%d objects damaged or missing, the next run of %s uploads them again", len(report.Problems), job.Name)
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d objects could not be checked", len(report.Failed))
+	}
+	return nil
+}
+
+func runRebuildState(ctx context.Context) error {
+	job, err := selectJob()
+	if err != nil {
+		return err
+	}
+	if job.Snapshots() {
+		rebuilt, err := snapshot.RebuildState(ctx, job)
+		if err != nil {
+			return err
+		}
+		for _, p := range rebuilt.Missing {
+			fmt.Printf("missing %s\n", p)
+		}
+		fmt.Printf("manifest %s (%s): %d snapshots, %d objects, %d packs restored, %d missing in the cloud\n",
+			rebuilt.Manifest, rebuilt.Created.Local().Format("2006-01-02 15:04:05"), rebuilt.Snapshots, rebuilt.Objects, rebuilt.Packs, len(rebuilt.Missing))
+		return nil
+	}
+	rebuilt, err := cloudsync.RebuildState(ctx, job)
+	if err != nil {
+		return err
+	}
+	for _, p := range rebuilt.Stale {
+		fmt.Printf("stale   %s\n", p)
+	}
+	fmt.Printf("manifest %s (%s): %d files restored, %d changed in the cloud since\n",
+		rebuilt.Manifest, rebuilt.Created.Local().Format("2006-01-02 15:04:05"), rebuilt.Restored, len(rebuilt.Stale))
+	return nil
+}
@@ -0,0 +1,92 @@
+package cloudsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wangxso/backuptool/faultinject"
+)
+
+// TestSyncConvergesUnderFaults syncs a folder over a flaky network: every
+// sync may leave files in Result.Failed, but repeating it must end with the
+// cloud folder matching the local one.
+func TestSyncConvergesUnderFaults(t *testing.T) {
+	cases := map[string][]*faultinject.Rule{
+		"latency":       {{Kind: faultinject.Latency, Latency: 10 * time.Millisecond, Rate: 0.3}},
+		"reset":         {{Kind: faultinject.Reset, Rate: 0.3}},
+		"reset-after":   {{Kind: faultinject.ResetAfter, Rate: 0.3}},
+		"server-error":  {{Kind: faultinject.ServerError, Rate: 0.3}},
+		"truncate":      {{Kind: faultinject.Truncate, Rate: 0.3}},
+		"rate-limit":    {{Kind: faultinject.Errno, Errno: 31034, Rate: 0.3}},
+		"token-expired": {{Kind: faultinject.Errno, Errno: 111, Rate: 0.3}},
+		"mixed": {
+			{Kind: faultinject.Latency, Latency: 5 * time.Millisecond, Rate: 0.1},
+			{Kind: faultinject.Reset, Rate: 0.1},
+			{Kind: faultinject.ResetAfter, Rate: 0.1},
+			{Kind: faultinject.ServerError, Status: 502, Rate: 0.1},
+			{Kind: faultinject.Truncate, Rate: 0.1},
+			{Kind: faultinject.Errno, Errno: 31034, Rate: 0.1},
+		},
+	}
+	for name, rules := range cases {
+		t.Run(name, func(t *testing.T) {
+			pan, dir := setupSync(t)
+			t.Cleanup(faultinject.FastRetry())
+
+			r := rand.New(rand.NewSource(1))
+			local := make(map[string][]byte)
+			for i := 0; i < 6; i++ {
+				data := make([]byte, 1024*(i+1))
+				r.Read(data)
+				local[fmt.Sprintf("sub%d/file%d.txt", i%2, i)] = data
+			}
+			big := make([]byte, 9*1024*1024)
+			r.Read(big)
+			local["big.bin"] = big
+			for p, data := range local {
+				writeFile(t, filepath.Join(dir, p), data)
+			}
+
+			tr, restore, err := faultinject.Install(int64(len(name)), rules...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(restore)
+			converged := false
+			for i := 0; i < 8 && !converged; i++ {
+				result, err := SyncFolder(context.Background())
+				converged = err == nil && len(result.Failed) == 0
+			}
+			if !converged {
+				t.Fatal("sync did not converge")
+			}
+			injected := 0
+			for _, rule := range rules {
+				injected += tr.Injected(rule.Kind)
+			}
+			if injected == 0 {
+				t.Fatal("no fault injected")
+			}
+			restore()
+
+			for p, data := range local {
+				if got, ok := pan.Get("/apps/backup/" + p); !ok || !bytes.Equal(got, data) {
+					t.Fatalf("%s: cloud content differs", p)
+				}
+			}
+			if files := syncedFiles(pan); len(files) != len(local) {
+				t.Fatalf("cloud has %d files, want %d: %v", len(files), len(local), files)
+			}
+			// 收敛后再同步不再上传
+			result, err := SyncFolder(context.Background())
+			if err != nil || result.Uploaded != 0 || result.Skipped != len(local) {
+				t.Fatalf("sync after convergence: %+v %v", result, err)
+			}
+		})
+	}
+}
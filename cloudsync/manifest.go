@@ -0,0 +1,312 @@
+package cloudsync
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/download"
+	"github.com/wangxso/backuptool/filemanager"
+	"github.com/wangxso/backuptool/upload"
+)
+
+const (
+	// MANIFEST_DIR 是目标目录下保存同步清单的目录, 同步时忽略
+	MANIFEST_DIR = ".backuptool"
+	// manifestKeep 云端保留的清单数量, 最新的清单损坏时使用之前的
+	manifestKeep   = 3
+	manifestPrefix = "manifest-"
+	manifestLayout = "20060102T150405Z"
+	// manifestEncrypted 是加密清单的后缀, 读取时据此解密
+	manifestEncrypted = ".enc"
+)
+
+var (
+	ErrNoManifest = errors.New("no valid sync manifest in the cloud folder")
+	// ErrManifestKey 表示没有配置签名清单的密钥, 不写入也不读取清单
+	ErrManifestKey = errors.New("sync manifests need Encryption.keyFile or passphrase to be signed")
+)
+
+var noKeyOnce sync.Once
+
+// ManifestFile is a source file that matched its cloud copy after a sync.
+type ManifestFile struct {
+	// Path 是相对源目录的路径, 以 / 分隔
+	Path      string `json:"path"`
+	Cloud     string `json:"cloud"`
+	CloudMD5  string `json:"cloudMd5"`
+	SourceMD5 string `json:"sourceMd5"`
+	Size      int64  `json:"size"`
+	// Meta 是上传时记录的 UPLOAD_META, 旧版本上传的文件为空
+	Meta
+}
+
+// Manifest is the state of a job that is otherwise only in Redis: the
+// files of a completed sync, or the snapshot index of a snapshot or
+// repository job. It is written to the cloud folder, so another machine
+// can rebuild the state of the job with RebuildState. A partial manifest
+// misses the files that failed.
+type Manifest struct {
+	Job     string         `json:"job"`
+	Source  string         `json:"source"`
+	Target  string         `json:"target"`
+	Created time.Time      `json:"created"`
+	Partial bool           `json:"partial,omitempty"`
+	Files   []ManifestFile `json:"files"`
+	// State 是快照任务的 Redis hash, 按 key 的前缀 (不含任务名) 保存全部字段
+	State map[string]map[string]string `json:"state,omitempty"`
+	// LongNames 是云端路径中 "~" 短名称对应的加密文件名, 见 crypt.LongNames
+	LongNames map[string]string `json:"longNames,omitempty"`
+}
+
+// signedManifest 是云端保存的格式, Signature 是 Manifest 原始 JSON 的 HMAC
+type signedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Key       string          `json:"key,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// isManifest reports whether the cloud path p is in the manifest folder of
+// targetFolder.
+func isManifest(targetFolder, p string) bool {
+	return strings.HasPrefix(p, path.Join(targetFolder, MANIFEST_DIR)+"/")
+}
+
+// WriteManifest uploads m, the state of job, to the manifest folder of job
+// and deletes the older manifests. It is signed with the key file or
+// passphrase and encrypted like the files of the job, or with that key
+// when only names are encrypted. Without a key file or passphrase nothing
+// is written and ErrManifestKey is returned.
+func WriteManifest(ctx context.Context, job config.Job, m *Manifest) error {
+	key, err := crypt.LoadKey()
+	if errors.Is(err, crypt.ErrNoKey) {
+		noKeyOnce.Do(func() {
+			logrus.Warn("[Manifest] no Encryption.keyFile or passphrase, manifests are not written and rebuild-state is not possible")
+		})
+		return ErrManifestKey
+	}
+	if err != nil {
+		return err
+	}
+	ring, _, err := JobKeys(job)
+	if err != nil {
+		return err
+	}
+	// 清单不压缩, 读取时只需要从文件名知道是否加密
+	var t upload.Transform
+	if ring != nil {
+		t.Recipients = ring.Recipients
+	}
+	// 清单包含文件名, 加密文件名时即使内容不加密, 清单也要加密, JobKeys 保证此时有密钥
+	if job.EncryptNames && len(t.Recipients) == 0 {
+		t.Recipients = []crypt.Recipient{key}
+	}
+	m.Job, m.Source, m.Target, m.Created = job.Name, job.SourceDir, job.TargetDir, time.Now().UTC()
+	if m.Files == nil {
+		m.Files = make([]ManifestFile, 0)
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	sig, err := key.Sign(body)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(signedManifest{Manifest: body, Key: key.KeyID(), Signature: hex.EncodeToString(sig)})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(config.Get().General.TmpDir, "manifest-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	dir := path.Join(job.TargetDir, MANIFEST_DIR)
+	target := path.Join(dir, manifestPrefix+m.Created.Format(manifestLayout)+".json")
+	if len(t.Recipients) > 0 {
+		target += manifestEncrypted
+	}
+	if _, err := upload.UploadTransformed(ctx, target, tmp.Name(), upload.OndupOverwrite, t); err != nil {
+		return err
+	}
+	logrus.Infof("[Manifest %s] wrote %s with %d files", job.Name, target, len(m.Files))
+
+	list, err := manifests(ctx, dir)
+	if err != nil || len(list) <= manifestKeep {
+		return err
+	}
+	old := make([]string, 0, len(list)-manifestKeep)
+	for _, v := range list[manifestKeep:] {
+		old = append(old, v.Path)
+	}
+	_, err = filemanager.Delete(ctx, old)
+	return err
+}
+
+// manifests lists the manifests in dir, newest first.
+func manifests(ctx context.Context, dir string) ([]download.FileItem, error) {
+	all, err := ListCloudFiles(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []download.FileItem
+	for _, v := range all {
+		if v.IsDir == 0 && path.Dir(v.Path) == dir && strings.HasPrefix(v.ServerFilename, manifestPrefix) {
+			list = append(list, v)
+		}
+	}
+	// 文件名中的时间按字符串排序即按时间排序
+	sort.Slice(list, func(i, j int) bool { return list[i].ServerFilename > list[j].ServerFilename })
+	return list, nil
+}
+
+// LoadManifest returns the newest manifest of the cloud folder of job with
+// a valid signature and its cloud path. Unsigned manifests are rejected,
+// without a key file or passphrase it returns ErrManifestKey.
+func LoadManifest(ctx context.Context, job config.Job) (*Manifest, string, error) {
+	key, err := crypt.LoadKey()
+	if errors.Is(err, crypt.ErrNoKey) {
+		return nil, "", ErrManifestKey
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	list, err := manifests(ctx, path.Join(job.TargetDir, MANIFEST_DIR))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, v := range list {
+		m, err := readManifest(ctx, key, v)
+		if err != nil {
+			logrus.Warnf("[Sync %s] skip manifest %s: %v", job.Name, v.Path, err)
+			continue
+		}
+		return m, v.Path, nil
+	}
+	return nil, "", ErrNoManifest
+}
+
+func readManifest(ctx context.Context, key *crypt.Key, v download.FileItem) (*Manifest, error) {
+	body, err := download.Open(ctx, uint64(v.FsID), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	plain, err := download.Decode(body, download.Encoding{Encrypted: strings.HasSuffix(v.ServerFilename, manifestEncrypted)})
+	if err != nil {
+		return nil, err
+	}
+	defer plain.Close()
+	data, err := io.ReadAll(plain)
+	if err != nil {
+		return nil, err
+	}
+	var signed signedManifest
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, err
+	}
+	if signed.Signature == "" {
+		return nil, errors.New("manifest is not signed")
+	}
+	sig, err := hex.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if err := key.Verify(signed.Manifest, sig); err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(signed.Manifest, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Rebuilt is the result of RebuildState.
+type Rebuilt struct {
+	Manifest string    `json:"manifest"`
+	Created  time.Time `json:"created"`
+	Restored int       `json:"restored"`
+	// Stale 是清单之后在云端被修改或删除的文件, 下次同步时重新比较
+	Stale []string `json:"stale,omitempty"`
+}
+
+// RebuildState rebuilds the sync state of job in Redis, UPLOAD_PATHS,
+// UPLOAD_META and MD5_FILE_MAP, from the newest manifest in its cloud
+// folder and a listing of the folder, so the next sync on this machine
+// skips the files that are already uploaded. Only files whose cloud copy
+// still has the md5 the manifest recorded are restored. Snapshot jobs are
+// rebuilt by snapshot.RebuildState.
+func RebuildState(ctx context.Context, job config.Job) (*Rebuilt, error) {
+	if job.Snapshots() {
+		return nil, fmt.Errorf("job %s: use snapshot.RebuildState for %s mode", job.Name, job.Mode)
+	}
+	if db.Client == nil {
+		return nil, errors.New("rebuild-state needs Redis")
+	}
+	m, p, err := LoadManifest(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	// 先恢复长文件名, 否则云端的短名称无法解密
+	if err := crypt.SaveLongNames(m.LongNames); err != nil {
+		return nil, err
+	}
+	list, err := ListCloudFiles(ctx, job.TargetDir)
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]download.FileItem, len(list))
+	for _, v := range list {
+		byPath[v.Path] = v
+	}
+	ret := &Rebuilt{Manifest: p, Created: m.Created}
+	var uploads, md5s []interface{}
+	for _, f := range m.Files {
+		v, ok := byPath[f.Cloud]
+		if !ok || v.IsDir != 0 || v.MD5 != f.CloudMD5 {
+			ret.Stale = append(ret.Stale, f.Path)
+			continue
+		}
+		uploads = append(uploads, v.MD5, f.SourceMD5)
+		if f.Meta != (Meta{}) {
+			if err := saveMeta(ctx, v.MD5, f.Meta); err != nil {
+				return nil, err
+			}
+		}
+		md5s = append(md5s, filepath.Join(job.SourceDir, filepath.FromSlash(f.Path)), f.SourceMD5)
+		ret.Restored++
+	}
+	if len(uploads) > 0 {
+		if err := db.Client.HSet(ctx, UPLOAD_PATHS, uploads...).Err(); err != nil {
+			return nil, err
+		}
+		if err := db.Client.HSet(ctx, MD5_FILE_MAP, md5s...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	logrus.Infof("[Sync %s] rebuilt state from %s: %d files, %d stale", job.Name, p, ret.Restored, len(ret.Stale))
+	return ret, nil
+}
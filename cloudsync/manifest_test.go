@@ -0,0 +1,156 @@
+package cloudsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/db"
+)
+
+func TestRebuildState(t *testing.T) {
+	pan, dir := setupSync(t)
+	config.BackUpConfig.Encryption.Passphrase = "docs"
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup", EncryptNames: true}
+	writeFile(t, filepath.Join(dir, "a.txt"), []byte("a"))
+	writeFile(t, filepath.Join(dir, "docs", "b.txt"), []byte("b"))
+	writeFile(t, filepath.Join(dir, "docs", "c.txt"), []byte("c"))
+	ctx := context.Background()
+	if _, err := SyncJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	var manifest string
+	for _, p := range pan.Files() {
+		if strings.HasPrefix(p, "/apps/backup/"+MANIFEST_DIR+"/") {
+			manifest = p
+		}
+	}
+	// 文件名加密时清单也加密
+	if data, _ := pan.Get(manifest); manifest == "" || bytes.Contains(data, []byte("b.txt")) {
+		t.Fatalf("manifest %q: %q", manifest, data)
+	}
+
+	// 新机器: 没有同步状态, 云端文件在其他机器修改过一个
+	db.Client.Del(ctx, UPLOAD_PATHS, MD5_FILE_MAP)
+	_, names, _ := JobKeys(job)
+	remote, _ := names.EncryptPath("/apps/backup", "docs/c.txt")
+	pan.Put(remote, []byte("c from elsewhere"))
+	rebuilt, err := RebuildState(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.Manifest != manifest || rebuilt.Restored != 2 || len(rebuilt.Stale) != 1 || rebuilt.Stale[0] != "docs/c.txt" {
+		t.Fatalf("rebuilt: %+v", rebuilt)
+	}
+	if md5, _ := db.Client.HGet(ctx, MD5_FILE_MAP, filepath.Join(dir, "a.txt")).Result(); md5 == "" {
+		t.Fatal("md5_file_map not rebuilt")
+	}
+	result, err := SyncJob(ctx, job)
+	if err != nil || result.Uploaded != 1 || result.Skipped != 2 || result.Downloaded != 0 {
+		t.Fatalf("sync after rebuild: %+v %v", result, err)
+	}
+}
+
+func TestRebuildStateRejectsForgedManifest(t *testing.T) {
+	pan, dir := setupSync(t)
+	config.BackUpConfig.Encryption.Passphrase = "docs"
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup"}
+	writeFile(t, filepath.Join(dir, "a.txt"), []byte("a"))
+	ctx := context.Background()
+	if _, err := SyncJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pan.Files() {
+		if strings.HasPrefix(p, "/apps/backup/"+MANIFEST_DIR+"/") {
+			data, _ := pan.Get(p)
+			pan.Put(p, bytes.Replace(data, []byte(`"size":1`), []byte(`"size":2`), 1))
+		}
+	}
+	if _, err := RebuildState(ctx, job); !errors.Is(err, ErrNoManifest) {
+		t.Fatalf("forged manifest: %v", err)
+	}
+	// 其他口令签名的清单同样无效
+	config.BackUpConfig.Encryption.Passphrase = "other"
+	if _, err := RebuildState(ctx, job); !errors.Is(err, ErrNoManifest) {
+		t.Fatalf("other key: %v", err)
+	}
+}
+
+func TestRebuildStateUnsigned(t *testing.T) {
+	pan, dir := setupSync(t)
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup", Compress: "gzip"}
+	writeFile(t, filepath.Join(dir, "a.txt"), bytes.Repeat([]byte("a"), 10000))
+	ctx := context.Background()
+	if _, err := SyncJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	// 没有密钥时不写清单, 也不能从清单恢复
+	for _, p := range pan.Files() {
+		if isManifest(job.TargetDir, p) {
+			t.Fatalf("manifest written without a key: %s", p)
+		}
+	}
+	if _, err := RebuildState(ctx, job); !errors.Is(err, ErrManifestKey) {
+		t.Fatalf("rebuild without a key: %v", err)
+	}
+
+	// 去掉签名的清单不被接受
+	config.BackUpConfig.Encryption.Passphrase = "docs"
+	writeFile(t, filepath.Join(dir, "b.txt"), []byte("b"))
+	if _, err := SyncJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	stripped := 0
+	for _, p := range pan.Files() {
+		if !isManifest(job.TargetDir, p) {
+			continue
+		}
+		data, _ := pan.Get(p)
+		var signed signedManifest
+		if err := json.Unmarshal(data, &signed); err != nil {
+			t.Fatal(err)
+		}
+		signed.Signature = ""
+		data, _ = json.Marshal(signed)
+		pan.Put(p, data)
+		stripped++
+	}
+	if stripped == 0 {
+		t.Fatal("no manifest written with a key")
+	}
+	if _, err := RebuildState(ctx, job); !errors.Is(err, ErrNoManifest) {
+		t.Fatalf("unsigned manifest: %v", err)
+	}
+}
+
+func TestRebuildStateLongNames(t *testing.T) {
+	pan, dir := setupSync(t)
+	config.BackUpConfig.Encryption.Passphrase = "docs"
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup", EncryptNames: true}
+	long := strings.Repeat("meeting-notes-", 5) + ".txt"
+	writeFile(t, filepath.Join(dir, long), []byte("notes"))
+	ctx := context.Background()
+	if _, err := SyncJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if files := syncedFiles(pan); len(files) != 1 || !strings.HasPrefix(files[0], "/apps/backup/~") {
+		t.Fatalf("cloud: %v", files)
+	}
+
+	// 新机器: 没有长文件名, 云端的短名称只能从清单恢复
+	db.Client.Del(ctx, UPLOAD_PATHS, MD5_FILE_MAP, UPLOAD_META, crypt.LONG_NAMES)
+	rebuilt, err := RebuildState(ctx, job)
+	if err != nil || rebuilt.Restored != 1 {
+		t.Fatalf("rebuilt: %+v %v", rebuilt, err)
+	}
+	result, err := SyncJob(ctx, job)
+	if err != nil || result.Uploaded != 0 || result.Skipped != 1 || result.Downloaded != 0 {
+		t.Fatalf("sync after rebuild: %+v %v", result, err)
+	}
+}
@@ -0,0 +1,52 @@
+package cloudsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/download"
+)
+
+// Meta describes a file uploaded by a sync, recorded in UPLOAD_META by its
+// cloud md5.
+type Meta struct {
+	// SHA256 是源文件全部内容的 sha256, UPLOAD_PATHS 中的 md5 只覆盖前 4096 字节
+	SHA256 string `json:"sha256,omitempty"`
+	// Encrypted 为 true 时云端保存的是密文, 文件密钥在文件头中
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Codec 是上传前使用的压缩算法, 为空时没有压缩
+	Codec string `json:"codec,omitempty"`
+}
+
+// Encoding returns how the file was transformed before upload.
+func (m Meta) Encoding() download.Encoding {
+	return download.Encoding{Encrypted: m.Encrypted, Codec: m.Codec}
+}
+
+// LoadMeta returns the metadata of the cloud file with md5 cloudMD5, false
+// when none is recorded, e.g. files uploaded before it was.
+func LoadMeta(ctx context.Context, cloudMD5 string) (Meta, bool, error) {
+	var m Meta
+	data, err := db.Client.HGet(ctx, UPLOAD_META, cloudMD5).Result()
+	if errors.Is(err, redis.Nil) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, err
+	}
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return m, false, err
+	}
+	return m, true, nil
+}
+
+func saveMeta(ctx context.Context, cloudMD5 string, m Meta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return db.Client.HSet(ctx, UPLOAD_META, cloudMD5, data).Err()
+}
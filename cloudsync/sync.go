@@ -1,16 +1,24 @@
 package cloudsync
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"github.com/karrick/godirwalk"
 	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/auth"
+	"github.com/wangxso/backuptool/codec"
 	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/crypt"
 	"github.com/wangxso/backuptool/db"
 	"github.com/wangxso/backuptool/download"
+	"github.com/wangxso/backuptool/handler"
+	"github.com/wangxso/backuptool/metrics"
 	"github.com/wangxso/backuptool/upload"
 	"github.com/wangxso/backuptool/utils"
 )
@@ -19,50 +27,171 @@ const (
 	DOWNLOAD_PATHS = "download_paths"
 	UPLOAD_PATHS   = "upload_paths"
 	MD5_FILE_MAP   = "md5_file_map"
+	// UPLOAD_META 保存同步上传的文件的元数据 (Meta), field 同 UPLOAD_PATHS 为云端 md5
+	UPLOAD_META = "upload_meta"
 )
 
-// SyncFolder synchronizes the source folder with the target folder in the BaiduDisk cloud storage.
+// ErrStopped 表示程序正在退出, 同步在两个文件之间停止
+var ErrStopped = errors.New("sync stopped for shutdown")
+
+var stopping atomic.Bool
+
+// Stop makes every running and future sync stop before the next file, the
+// file being transferred is allowed to finish.
+func Stop() {
+	stopping.Store(true)
+}
+
+// Stopping reports whether Stop was called.
+func Stopping() bool {
+	return stopping.Load()
+}
+
+// FileError 记录单个文件同步失败的原因
+type FileError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// Result 是一次同步的统计, 单个文件失败不会中断同步, 记录在 Failed 中
+type Result struct {
+	Waiting    int         `json:"waiting"`
+	Uploaded   int         `json:"uploaded"`
+	Downloaded int         `json:"downloaded"`
+	Skipped    int         `json:"skipped"`
+	Failed     []FileError `json:"failed,omitempty"`
+}
+
+// Fail records that path could not be synced.
+func (r *Result) Fail(path string, err error) {
+	logrus.Errorf("[Sync] %s: %v", path, err)
+	r.Failed = append(r.Failed, FileError{Path: path, Error: err.Error()})
+}
+
+// SyncFolder synchronizes General.syncDir with BaiduDisk.syncDir, see SyncDir.
+func SyncFolder(ctx context.Context) (Result, error) {
+	c := config.Get()
+	return SyncJob(ctx, config.Job{
+		Name:      "default",
+		SourceDir: c.General.SyncDir,
+		TargetDir: c.BaiduDisk.SyncDir,
+	})
+}
+
+// SyncJob runs SyncDir for job and records its duration and last success.
+// The job's timeout, if any, is applied on top of ctx.
+func SyncJob(ctx context.Context, job config.Job) (Result, error) {
+	if timeout := config.ParseDuration(job.Timeout, 0); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	t, names, err := JobTransform(job)
+	if err != nil {
+		return Result{}, err
+	}
+	start := time.Now()
+	result, files, err := syncDir(ctx, job.SourceDir, job.TargetDir, t, names)
+	metrics.SyncSeconds.WithLabelValues(job.Name).Observe(time.Since(start).Seconds())
+	if err == nil && len(result.Failed) == 0 {
+		metrics.LastSuccessfulSync.WithLabelValues(job.Name).SetToCurrentTime()
+	}
+	if err == nil {
+		// 清单写入失败不影响本次同步的结果, 没有密钥时 WriteManifest 已经提示过
+		if mErr := writeSyncManifest(ctx, job, files, len(result.Failed) > 0); mErr != nil && !errors.Is(mErr, ErrManifestKey) {
+			logrus.Errorf("[Sync %s] write manifest: %v", job.Name, mErr)
+		}
+	}
+	return result, err
+}
+
+// SyncDir synchronizes the source folder with the target folder in the BaiduDisk cloud storage.
 //
 // It retrieves the cloud file list, compares it with the local files in the source folder, and performs the following operations:
 // - Uploads the files that are not present in the cloud storage.
 // - Downloads the files that are present in the cloud storage but missing locally.
 //
-// The function takes no parameters and returns an error if any occurs during the synchronization process.
-func SyncFolder() error {
-	waitingCount := 0
-	uploadCount := 0
-	downloadCount := 0
-	skipCount := 0
-	sourceFolder := config.BackUpConfig.General.SyncDir
-	targetFolder := config.BackUpConfig.BaiduDisk.SyncDir
-	fidMap := make(map[string]uint64)
-	redisCli := db.Client
-	accessToken, _ := redisCli.Get(redisCli.Context(), "AccessCode").Result()
-	// 获取云端文件
-	cloudFileList := make([]download.FileItem, 0)
-	resp := download.GetMultiFileList(accessToken, targetFolder, 1, "time", 0, 0, 1000)
-	if resp.Errno != -9 {
-		cloudFileList = append(cloudFileList, resp.List...)
+// A file that fails to upload is recorded in Result.Failed and the sync goes
+// on with the next file. The error is only set when the sync itself cannot
+// run, e.g. the cloud folder cannot be listed, or when ctx is done.
+func SyncDir(ctx context.Context, sourceFolder, targetFolder string) (Result, error) {
+	result, _, err := syncDir(ctx, sourceFolder, targetFolder, upload.Transform{}, nil)
+	return result, err
+}
+
+// JobKeys returns the keys files of job are encrypted to and the filename
+// cipher, each is nil when the job does not use it. Encrypted names need
+// a key file or passphrase, public keys cannot encrypt names.
+func JobKeys(job config.Job) (*crypt.Keyring, *crypt.Names, error) {
+	if !job.Encrypt && !job.EncryptNames {
+		return nil, nil, nil
 	}
-	// 31066错误为文件不存在
-	if resp.Errno != 0 && resp.Errno != 31066 {
-		logrus.Error("ErrorNo: ", resp.Errmsg)
-		logrus.Error("ErrorMsg: ", resp.RequestID)
-		return errors.New("ErrorNo: " + fmt.Sprint(resp.Errno) + " Errormsg: " + fmt.Sprint(resp.Errmsg))
+	ring, err := crypt.LoadKeyring()
+	if err != nil {
+		return nil, nil, err
 	}
-	// 一次获取1000个目录，如果有剩余，继续获取
-	for resp.HasMore == 1 {
-		resp = download.GetMultiFileList(accessToken, targetFolder, 1, "time", 0, resp.Cursor, 1000)
-		if resp.Errno != -9 {
-			cloudFileList = append(cloudFileList, resp.List...)
+	var names *crypt.Names
+	if job.EncryptNames {
+		if ring.Secret == nil {
+			return nil, nil, fmt.Errorf("job %s: encryptNames needs Encryption.keyFile or passphrase", job.Name)
+		}
+		if names, err = ring.Secret.Names(); err != nil {
+			return nil, nil, err
 		}
 	}
+	if !job.Encrypt {
+		ring = nil
+	} else if len(ring.Recipients) == 0 {
+		return nil, nil, crypt.ErrNoKey
+	}
+	return ring, names, nil
+}
+
+// JobTransform returns how files of job are compressed and encrypted
+// before upload and the filename cipher, see JobKeys.
+func JobTransform(job config.Job) (upload.Transform, *crypt.Names, error) {
+	if !codec.Valid(job.Compress) {
+		return upload.Transform{}, nil, fmt.Errorf("job %s: unknown compress %q, use gzip or zstd", job.Name, job.Compress)
+	}
+	ring, names, err := JobKeys(job)
+	if err != nil {
+		return upload.Transform{}, nil, err
+	}
+	t := upload.Transform{Codec: job.Compress}
+	if ring != nil {
+		t.Recipients = ring.Recipients
+	}
+	return t, names, nil
+}
+
+// syncDir is SyncDir, files are compressed and encrypted as t says before
+// upload, and the remote names encrypted with names when it is not nil. It
+// also returns the files that are in sync with the cloud afterwards.
+func syncDir(ctx context.Context, sourceFolder, targetFolder string, t upload.Transform, names *crypt.Names) (Result, []ManifestFile, error) {
+	var result Result
+	var files []ManifestFile
+	fidMap := make(map[string]uint64)
+	cloudPaths := make(map[string]string)
+	redisCli := db.Client
+	// 获取云端文件
+	cloudFileList, err := ListCloudFiles(ctx, targetFolder)
+	if err != nil {
+		return result, nil, err
+	}
 	couldMd5FileMap := make(map[string]string)
 
 	for _, v := range cloudFileList {
-		if v.IsDir == 0 {
-			couldMd5FileMap[v.ServerFilename] = v.MD5
-			fidMap[v.ServerFilename] = uint64(v.FsID)
+		if v.IsDir == 0 && !isManifest(targetFolder, v.Path) {
+			name := v.ServerFilename
+			if names != nil {
+				// 无法解密的文件名不是本任务上传的, 按原名比较
+				if plain, err := names.DecryptName(name); err == nil {
+					name = plain
+				}
+			}
+			couldMd5FileMap[name] = v.MD5
+			fidMap[name] = uint64(v.FsID)
+			cloudPaths[name] = v.Path
 		}
 	}
 
@@ -72,22 +201,38 @@ func SyncFolder() error {
 	sourceFileMap := make(map[string]string)
 
 	// 计算所有需要上传的文件path
-	err := filepath.Walk(sourceFolder, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(sourceFolder, func(path string, info os.FileInfo, err error) error {
+		// 任务被取消或超时
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if stopping.Load() {
+			return ErrStopped
+		}
 		if err != nil {
-			logrus.Error(err)
-			return err
+			// 根目录无法读取时中止, 其他文件或目录记录后跳过
+			if path == sourceFolder {
+				return err
+			}
+			result.Fail(path, err)
+			return nil
 		}
 
 		if info.IsDir() {
 			return nil // 继续遍历子目录
 		}
-		waitingCount++
+		result.Waiting++
 		filename := info.Name()
 		relativePath, err := utils.GetRelativeSubdirectory(sourceFolder, path)
 		if err != nil {
-			logrus.Error(err)
+			result.Fail(path, err)
+			return nil
+		}
+		sourceMD5, err := utils.CalculateMD5(path)
+		if err != nil {
+			result.Fail(path, err)
+			return nil
 		}
-		sourceMD5, _ := utils.CalculateMD5(path)
 		sourceFileMap[filename] = "true"
 		// 对比目录差异
 		// 不在云端的上传
@@ -95,60 +240,121 @@ func SyncFolder() error {
 			relativePath = ""
 		}
 
-		// if _, ok := couldMd5FileMap[filename]; !ok {
 		// 上传文件
 		cloudMD5 := couldMd5FileMap[filename]
 		targetMD5, _ := redisCli.HGet(redisCli.Context(), UPLOAD_PATHS, cloudMD5).Result()
-		if sourceMD5 != targetMD5 {
-			logrus.Info("filename: ", filepath.Join(targetFolder, relativePath, filename), " md5: ", sourceMD5, " Upload File")
-			file, err := os.Open(path)
-			if err != nil {
-				panic(err)
-			}
-			defer file.Close()
-			stat, _ := file.Stat()
-			fileSize := stat.Size()
-			var respMD5 string
-			if fileSize <= 1024*1024*4 {
-				ret, err := upload.UploadSmallFile(accessToken, filepath.Join(targetFolder, relativePath, path), path)
-				respMD5 = ret.MD5
-				if err != nil {
-					panic(err)
-				}
-			} else {
-				respMD5, err = upload.Upload(filepath.Join(targetFolder, relativePath, filename), path)
-				if err != nil {
-					panic(err)
-				}
-			}
-			redisCli.HSet(redisCli.Context(), UPLOAD_PATHS, respMD5, sourceMD5)
-		} else {
+		file := ManifestFile{Path: filepath.ToSlash(filepath.Join(relativePath, filename)), SourceMD5: sourceMD5, Size: info.Size()}
+		if sourceMD5 == targetMD5 {
 			logrus.Info("filename: ", filename, " md5: ", sourceMD5, " File Exsist, Skip Upload")
+			metrics.FileDone(metrics.OpSkip, info.Size())
+			result.Skipped++
+			file.Cloud, file.CloudMD5 = cloudPaths[filename], cloudMD5
+			file.Meta, _, _ = LoadMeta(redisCli.Context(), cloudMD5)
+			files = append(files, file)
+			return nil
+		}
+		targetPath := filepath.Join(targetFolder, relativePath, filename)
+		if names != nil {
+			if targetPath, err = names.EncryptPath(targetFolder, filepath.ToSlash(filepath.Join(relativePath, filename))); err != nil {
+				result.Fail(path, err)
+				return nil
+			}
 		}
+		sum, err := utils.CalculateSHA256(path)
 		if err != nil {
-			return err
+			result.Fail(path, err)
+			return nil
 		}
+		logrus.Info("filename: ", targetPath, " md5: ", sourceMD5, " Upload File")
+		ret, err := upload.UploadTransformed(ctx, targetPath, path, upload.OndupOverwrite, t)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			result.Fail(path, err)
+			return nil
+		}
+		redisCli.HSet(redisCli.Context(), UPLOAD_PATHS, ret.MD5, sourceMD5)
+		file.Meta = Meta{SHA256: sum, Encrypted: len(t.Recipients) > 0, Codec: ret.Codec}
+		if err := saveMeta(redisCli.Context(), ret.MD5, file.Meta); err != nil {
+			logrus.Errorf("[Sync] %s: save meta: %v", path, err)
+		}
+		result.Uploaded++
+		file.Cloud, file.CloudMD5 = targetPath, ret.MD5
+		files = append(files, file)
 		return nil
 	})
 
+	if err != nil && (errors.Is(err, ErrStopped) || ctx.Err() != nil) {
+		logrus.Warn("[Sync] ", err)
+		return result, nil, err
+	}
 	if err != nil {
 		logrus.Error("Error reading directory: ", err)
-		return errors.New("Error reading directory: " + err.Error())
+		return result, nil, errors.New("Error reading directory: " + err.Error())
 	}
 	// 下载本地没有的文件
 	for path := range couldMd5FileMap {
 		if _, ok := sourceFileMap[path]; !ok {
 			logrus.Infof("Download Source File Name [%s]", path)
 			redisCli.HSet(redisCli.Context(), DOWNLOAD_PATHS, fidMap[path], false)
+			result.Downloaded++
+		}
+	}
+	metrics.QueueDepth.WithLabelValues(metrics.QueueDownload).Set(float64(result.Downloaded))
+	logrus.Info("Waiting Count: ", result.Waiting, " Upload Count: ", result.Uploaded, " Download Count: ", result.Downloaded, " Skip Count: ", result.Skipped, " Failed Count: ", len(result.Failed), " CloudFile Count: ", len(couldMd5FileMap))
+	return result, files, nil
+}
+
+// writeSyncManifest writes the manifest of a sync of job with the long
+// names of the cloud paths of files.
+func writeSyncManifest(ctx context.Context, job config.Job, files []ManifestFile, partial bool) error {
+	m := &Manifest{Partial: partial, Files: files}
+	if job.EncryptNames {
+		paths := make([]string, len(files))
+		for i, f := range files {
+			paths[i] = f.Cloud
+		}
+		var err error
+		if m.LongNames, err = crypt.LongNames(paths...); err != nil {
+			return err
+		}
+	}
+	return WriteManifest(ctx, job, m)
+}
+
+// ListCloudFiles lists targetFolder recursively, a missing folder is
+// treated as empty.
+func ListCloudFiles(ctx context.Context, targetFolder string) ([]download.FileItem, error) {
+	cloudFileList := make([]download.FileItem, 0)
+	cursor := 0
+	for {
+		var resp download.FileMultiListReturn
+		err := handler.Retry(ctx, "listall", func() error {
+			var err error
+			resp, err = download.GetMultiFileList(ctx, auth.AccessToken(), targetFolder, 1, "time", 0, cursor, 1000)
+			return err
+		})
+		// 目录不存在 (-9, 31066) 时云端为空
+		if errors.Is(err, handler.ClassNotFound) {
+			return cloudFileList, nil
+		}
+		if err != nil {
+			logrus.Error("List cloud files failed: ", err)
+			return nil, err
+		}
+		cloudFileList = append(cloudFileList, resp.List...)
+		// 一次获取1000个目录，如果有剩余，继续获取
+		if resp.HasMore != 1 {
+			return cloudFileList, nil
 		}
+		cursor = resp.Cursor
 	}
-	logrus.Info("Waiting Count: ", waitingCount, " Upload Count: ", uploadCount, " Download Count: ", downloadCount, " Skip Count: ", skipCount, " CloudFile Count: ", len(couldMd5FileMap))
-	return nil
 }
 
 func CacheFileMD5Map() {
 	logrus.Info("Start Cache File MD5 and it may cost some time, Please waiting")
-	dir := config.BackUpConfig.General.SyncDir // 要遍历的目录路径
+	dir := config.Get().General.SyncDir // 要遍历的目录路径
 	redisCli := db.Client
 	err := godirwalk.Walk(dir, &godirwalk.Options{
 		Callback: func(path string, de *godirwalk.Dirent) error {
@@ -0,0 +1,250 @@
+package cloudsync
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/download"
+	"github.com/wangxso/backuptool/fakepan"
+)
+
+// setupSync creates a local folder synced to /apps/backup on a fake pan.
+func setupSync(t *testing.T) (*fakepan.Server, string) {
+	pan := fakepan.Setup(t)
+	dir := t.TempDir()
+	config.BackUpConfig.General.SyncDir = dir
+	config.BackUpConfig.BaiduDisk.SyncDir = "/apps/backup"
+	return pan, dir
+}
+
+// syncedFiles returns the cloud files outside of the manifest folder.
+func syncedFiles(pan *fakepan.Server) []string {
+	var files []string
+	for _, p := range pan.Files() {
+		if !isManifest("/apps/backup", p) {
+			files = append(files, p)
+		}
+	}
+	return files
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncFolderUploadsAndSkips(t *testing.T) {
+	pan, dir := setupSync(t)
+	config.BackUpConfig.Encryption.Passphrase = "docs"
+	small := []byte("hello backuptool")
+	large := bytes.Repeat([]byte("0123456789abcdef"), 5*1024*1024/16)
+	writeFile(t, filepath.Join(dir, "a.txt"), small)
+	writeFile(t, filepath.Join(dir, "sub", "b.bin"), large)
+
+	result, err := SyncFolder(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Uploaded != 2 || result.Skipped != 0 || len(result.Failed) != 0 {
+		t.Fatalf("first sync: %+v", result)
+	}
+	if got, _ := pan.Get("/apps/backup/a.txt"); !bytes.Equal(got, small) {
+		t.Fatal("a.txt not uploaded")
+	}
+	if got, _ := pan.Get("/apps/backup/sub/b.bin"); !bytes.Equal(got, large) {
+		t.Fatal("sub/b.bin not uploaded")
+	}
+
+	// 未修改的文件跳过
+	uploads := pan.Calls("upload") + pan.Calls("create")
+	result, err = SyncFolder(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Uploaded != 0 || result.Skipped != 2 {
+		t.Fatalf("second sync: %+v", result)
+	}
+	// 只上传新的清单, 清单需要密钥签名
+	if n := pan.Calls("upload") + pan.Calls("create"); n != uploads+1 {
+		t.Fatalf("unchanged files uploaded again: %d calls", n-uploads)
+	}
+
+	// 修改后重新上传并覆盖
+	changed := []byte("changed content")
+	writeFile(t, filepath.Join(dir, "a.txt"), changed)
+	result, err = SyncFolder(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Uploaded != 1 || result.Skipped != 1 {
+		t.Fatalf("sync after change: %+v", result)
+	}
+	if got, _ := pan.Get("/apps/backup/a.txt"); !bytes.Equal(got, changed) {
+		t.Fatal("changed a.txt not uploaded")
+	}
+}
+
+func TestSyncFolderQueuesCloudOnlyFiles(t *testing.T) {
+	pan, dir := setupSync(t)
+	writeFile(t, filepath.Join(dir, "a.txt"), []byte("local"))
+	f := pan.Put("/apps/backup/remote.txt", []byte("remote"))
+
+	result, err := SyncFolder(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Uploaded != 1 || result.Downloaded != 1 {
+		t.Fatalf("sync: %+v", result)
+	}
+	queued, err := db.Client.HExists(context.Background(), DOWNLOAD_PATHS, strconv.FormatInt(f.FsID, 10)).Result()
+	if err != nil || !queued {
+		t.Fatalf("remote.txt not queued for download: %v", err)
+	}
+}
+
+func TestSyncFolderCreatesMissingCloudDir(t *testing.T) {
+	pan, dir := setupSync(t)
+	config.BackUpConfig.BaiduDisk.SyncDir = "/apps/new"
+	writeFile(t, filepath.Join(dir, "a.txt"), []byte("a"))
+
+	result, err := SyncFolder(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Uploaded != 1 {
+		t.Fatalf("sync: %+v", result)
+	}
+	if _, ok := pan.Get("/apps/new/a.txt"); !ok {
+		t.Fatal("a.txt not uploaded")
+	}
+}
+
+func TestSyncFolderCancelled(t *testing.T) {
+	_, dir := setupSync(t)
+	writeFile(t, filepath.Join(dir, "a.txt"), []byte("a"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := SyncFolder(ctx); err == nil {
+		t.Fatal("cancelled sync succeeded")
+	}
+}
+
+func TestSyncJobEncryptsNames(t *testing.T) {
+	pan, dir := setupSync(t)
+	config.BackUpConfig.Encryption.Passphrase = "finance"
+	job := config.Job{Name: "finance", SourceDir: dir, TargetDir: "/apps/backup", Encrypt: true, EncryptNames: true}
+	writeFile(t, filepath.Join(dir, "finance", "layoffs-2026.xlsx"), []byte("names"))
+	writeFile(t, filepath.Join(dir, "a.txt"), []byte("a"))
+
+	result, err := SyncJob(context.Background(), job)
+	if err != nil || result.Uploaded != 2 {
+		t.Fatalf("first sync: %+v %v", result, err)
+	}
+	_, names, err := JobKeys(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pan.Files() {
+		if bytes.Contains([]byte(p), []byte("finance/")) || bytes.Contains([]byte(p), []byte("layoffs")) {
+			t.Fatalf("plain name in the cloud: %s", p)
+		}
+	}
+	remote, err := names.EncryptPath("/apps/backup", "finance/layoffs-2026.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pan.Get(remote); !ok {
+		t.Fatalf("%s not uploaded, cloud has %v", remote, pan.Files())
+	}
+	if rel, err := names.DecryptPath("/apps/backup", remote); err != nil || rel != "finance/layoffs-2026.xlsx" {
+		t.Fatalf("decrypt path: %q %v", rel, err)
+	}
+
+	// 文件名确定性加密, 第二次同步全部跳过
+	result, err = SyncJob(context.Background(), job)
+	if err != nil || result.Uploaded != 0 || result.Skipped != 2 || result.Downloaded != 0 {
+		t.Fatalf("second sync: %+v %v", result, err)
+	}
+}
+
+func TestSyncJobRecordsCodec(t *testing.T) {
+	pan, dir := setupSync(t)
+	job := config.Job{Name: "logs", SourceDir: dir, TargetDir: "/apps/backup", Compress: "zstd"}
+	log := bytes.Repeat([]byte("GET /index.html 200\n"), 5000)
+	writeFile(t, filepath.Join(dir, "access.log"), log)
+	// 太小不值得压缩, 内容恰好以压缩文件头开始
+	raw := []byte("BKTCMP\x00\x01raw")
+	writeFile(t, filepath.Join(dir, "raw.bin"), raw)
+	ctx := context.Background()
+	if _, err := SyncJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]byte{"access.log": log, "raw.bin": raw} {
+		f, _ := pan.Stat("/apps/backup/" + name)
+		meta, ok, err := LoadMeta(ctx, f.MD5)
+		if !ok || err != nil {
+			t.Fatalf("%s: no meta %v", name, err)
+		}
+		if c := map[string]string{"access.log": "zstd", "raw.bin": ""}[name]; meta.Codec != c {
+			t.Fatalf("%s: codec %q", name, meta.Codec)
+		}
+		local := t.TempDir()
+		if err := download.Download(ctx, uint64(f.FsID), local, meta.Encoding()); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(local, name)); !bytes.Equal(got, want) {
+			t.Fatalf("%s: downloaded %q", name, got)
+		}
+	}
+}
+
+func TestSyncJobCompresses(t *testing.T) {
+	pan, dir := setupSync(t)
+	job := config.Job{Name: "logs", SourceDir: dir, TargetDir: "/apps/backup", Compress: "gzip"}
+	log := bytes.Repeat([]byte("GET /index.html 200\n"), 5000)
+	writeFile(t, filepath.Join(dir, "access.log"), log)
+	writeFile(t, filepath.Join(dir, "old.log.gz"), []byte{0x1f, 0x8b, 8, 0, 1, 2, 3})
+
+	result, err := SyncJob(context.Background(), job)
+	if err != nil || result.Uploaded != 2 {
+		t.Fatalf("first sync: %+v %v", result, err)
+	}
+	stored, _ := pan.Get("/apps/backup/access.log")
+	if len(stored)*10 > len(log) || !bytes.HasPrefix(stored, []byte("BKTCMP")) {
+		t.Fatalf("access.log stored with %d bytes", len(stored))
+	}
+	// 已经压缩的文件原样上传
+	if stored, _ := pan.Get("/apps/backup/old.log.gz"); !bytes.Equal(stored, []byte{0x1f, 0x8b, 8, 0, 1, 2, 3}) {
+		t.Fatalf("old.log.gz stored as %q", stored)
+	}
+
+	f, _ := pan.Stat("/apps/backup/access.log")
+	local := t.TempDir()
+	meta, _, _ := LoadMeta(context.Background(), f.MD5)
+	if err := download.Download(context.Background(), uint64(f.FsID), local, meta.Encoding()); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(local, "access.log")); !bytes.Equal(got, log) {
+		t.Fatal("downloaded content differs")
+	}
+
+	result, err = SyncJob(context.Background(), job)
+	if err != nil || result.Uploaded != 0 || result.Skipped != 2 {
+		t.Fatalf("second sync: %+v %v", result, err)
+	}
+	job.Compress = "lz4"
+	if _, err := SyncJob(context.Background(), job); err == nil {
+		t.Fatal("unknown codec accepted")
+	}
+}
@@ -0,0 +1,165 @@
+// Package codec compresses backup content before it is uploaded and
+// decompresses it after download.
+//
+// Compressed content starts with a small header naming the codec, so a
+// download is decompressed without looking anything up and files that
+// were uploaded as is are never touched. Content that is already
+// compressed (by extension or magic bytes) is not compressed again.
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Job.Compress 的取值, 为空时不压缩
+const (
+	NONE = ""
+	GZIP = "gzip"
+	ZSTD = "zstd"
+
+	// magic 之后的一个字节是压缩算法
+	magic = "BKTCMP\x00\x01"
+	// sniffSize 判断是否已经压缩时读取的字节数
+	sniffSize = 16
+)
+
+var (
+	ErrNotCompressed = errors.New("codec: not a compressed file")
+
+	ids = map[string]byte{GZIP: 1, ZSTD: 2}
+
+	// skipExts 已经压缩过的格式, 再次压缩几乎没有收益
+	skipExts = map[string]bool{
+		".gz": true, ".tgz": true, ".zst": true, ".zip": true, ".7z": true, ".xz": true, ".bz2": true,
+		".rar": true, ".lz4": true, ".br": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+		".webp": true, ".heic": true, ".mp3": true, ".aac": true, ".m4a": true, ".ogg": true, ".flac": true,
+		".mp4": true, ".mkv": true, ".mov": true, ".avi": true, ".webm": true, ".docx": true, ".xlsx": true,
+		".pptx": true, ".jar": true, ".apk": true,
+	}
+	skipMagic = [][]byte{
+		{0x1f, 0x8b},             // gzip
+		{0x28, 0xb5, 0x2f, 0xfd}, // zstd
+		[]byte("PK\x03\x04"),     // zip, docx, jar
+		[]byte("7z\xbc\xaf\x27\x1c"),
+		{0xfd, '7', 'z', 'X', 'Z', 0},
+		[]byte("BZh"),
+		[]byte("Rar!"),
+		{0xff, 0xd8, 0xff}, // jpeg
+		[]byte("\x89PNG"),
+		[]byte("BKTENC\x00"), // 已经加密
+		[]byte(magic),
+	}
+)
+
+// Valid reports whether c is a supported codec, NONE included.
+func Valid(c string) bool {
+	_, ok := ids[c]
+	return ok || c == NONE
+}
+
+// Skip reports whether the file p looks already compressed, by its
+// extension or its first bytes.
+func Skip(p string) (bool, error) {
+	if skipExts[strings.ToLower(filepath.Ext(p))] {
+		return true, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, err
+	}
+	for _, m := range skipMagic {
+		if bytes.HasPrefix(head[:n], m) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// NewWriter returns a writer that compresses what is written to it with c
+// into w. Close must be called to flush it; it does not close w.
+func NewWriter(w io.Writer, c string) (io.WriteCloser, error) {
+	id, ok := ids[c]
+	if !ok {
+		return nil, fmt.Errorf("codec: unknown codec %q", c)
+	}
+	if _, err := w.Write(append([]byte(magic), id)); err != nil {
+		return nil, err
+	}
+	if c == GZIP {
+		return gzip.NewWriter(w), nil
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+// NewReader returns a reader that decompresses r and the codec it was
+// written with, ErrNotCompressed when r does not start with the header.
+func NewReader(r io.Reader) (io.ReadCloser, string, error) {
+	head := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, head); err != nil || string(head[:len(magic)]) != magic {
+		if err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, NONE, ErrNotCompressed
+		}
+		return nil, NONE, err
+	}
+	switch head[len(magic)] {
+	case ids[GZIP]:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, GZIP, err
+		}
+		return zr, GZIP, nil
+	case ids[ZSTD]:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, ZSTD, err
+		}
+		return zr.IOReadCloser(), ZSTD, nil
+	}
+	return nil, NONE, fmt.Errorf("codec: unknown codec %d", head[len(magic)])
+}
+
+// Open returns a reader for the content of r, written with the codec c by
+// NewWriter, r itself for NONE. Unlike NewReader the codec is known, so a
+// header of another codec is an error.
+func Open(r io.Reader, c string) (io.ReadCloser, error) {
+	if c == NONE {
+		return io.NopCloser(r), nil
+	}
+	zr, got, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if got != c {
+		zr.Close()
+		return nil, fmt.Errorf("codec: content is %s, want %s", got, c)
+	}
+	return zr, nil
+}
+
+// IsCompressed reports whether the content read from r starts with the
+// header of NewWriter.
+func IsCompressed(r io.Reader) (bool, error) {
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, head); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(head) == magic, nil
+}
@@ -0,0 +1,97 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("2024-01-02 15:04:05 INFO sync done\n"), 10000)
+	for _, c := range []string{GZIP, ZSTD} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len()*10 > len(data) {
+			t.Errorf("%s: %d -> %d bytes", c, len(data), buf.Len())
+		}
+		if ok, _ := IsCompressed(bytes.NewReader(buf.Bytes())); !ok {
+			t.Errorf("%s: no header", c)
+		}
+		r, got, err := NewReader(&buf)
+		if err != nil || got != c {
+			t.Fatalf("%s: %q %v", c, got, err)
+		}
+		plain, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(plain, data) {
+			t.Fatalf("%s: %v", c, err)
+		}
+	}
+	if _, err := NewWriter(io.Discard, "lzma"); err == nil {
+		t.Fatal("unknown codec accepted")
+	}
+	if _, _, err := NewReader(bytes.NewReader(data)); err != ErrNotCompressed {
+		t.Fatalf("plain data: %v", err)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	dir := t.TempDir()
+	for name, c := range map[string]struct {
+		data []byte
+		skip bool
+	}{
+		"app.log":      {[]byte("plain text"), false},
+		"empty.csv":    {nil, false},
+		"photo.JPG":    {[]byte("plain text"), true},
+		"archive.bin":  {[]byte{0x1f, 0x8b, 8, 0}, true},
+		"backup.dump":  {[]byte{0x28, 0xb5, 0x2f, 0xfd, 0}, true},
+		"report.data":  {[]byte("PK\x03\x04rest"), true},
+		"secret.bin":   {[]byte("BKTENC\x00\x02"), true},
+		"notes.gz.txt": {[]byte("not gzip"), false},
+	} {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, c.data, 0644)
+		if skip, err := Skip(p); err != nil || skip != c.skip {
+			t.Errorf("%s: skip %v %v", name, skip, err)
+		}
+	}
+}
+
+func TestDecompressInPlace(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "export.csv")
+	data := bytes.Repeat([]byte("id,name,amount\n"), 1000)
+	os.WriteFile(src, data, 0640)
+	if err := CompressFile(src, src+".z", ZSTD); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecompressInPlace(src+".z", GZIP); err == nil {
+		t.Fatal("decompressed with the wrong codec")
+	}
+	if err := DecompressInPlace(src+".z", ZSTD); err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	if got, _ := os.ReadFile(src + ".z"); !bytes.Equal(got, data) {
+		t.Fatal("content differs")
+	}
+	if err := DecompressInPlace(src, NONE); err != nil {
+		t.Fatalf("plain file: %v", err)
+	}
+	if got, _ := os.ReadFile(src); !bytes.Equal(got, data) {
+		t.Fatal("plain file changed")
+	}
+	// 记录为压缩的文件没有文件头时报错, 不当作原文
+	if err := DecompressInPlace(src, ZSTD); !errors.Is(err, ErrNotCompressed) {
+		t.Fatalf("plain file as zstd: %v", err)
+	}
+}
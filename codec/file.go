@@ -0,0 +1,70 @@
+package codec
+
+import (
+	"io"
+	"os"
+)
+
+// CompressFile compresses the file src with c into dst.
+func CompressFile(src, dst, c string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w, err := NewWriter(out, c)
+	if err == nil {
+		_, err = io.Copy(w, in)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if e := out.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// DecompressInPlace replaces the file p, compressed with c, by its
+// content. A file with the codec NONE is left alone.
+func DecompressInPlace(p, c string) error {
+	if c == NONE {
+		return nil
+	}
+	in, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := Open(in, c)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tmp := p + ".decompressing"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if e := out.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		if info, e := os.Stat(p); e == nil {
+			os.Chmod(tmp, info.Mode().Perm())
+		}
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -1,7 +1,12 @@
 package config
 
 import (
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
@@ -9,8 +14,10 @@ import (
 
 type Config struct {
 	BaiduDisk struct {
-		AppKey      string `yaml:"AppKey"`
-		SecretKey   string `yaml:"SecretKey"`
+		AppKey    string `yaml:"AppKey"`
+		SecretKey string `yaml:"SecretKey"`
+		// DeviceId 是百度开放平台应用的 AppID, 授权链接中的 device_id
+		DeviceId    string `yaml:"DeviceId"`
 		SyncDir     string `yaml:"syncDir"`
 		RedirectUri string `yaml:"RedirectUri"`
 	} `yaml:"BaiduDisk"`
@@ -19,17 +26,192 @@ type Config struct {
 		Debug   bool   `yaml:"debug"`
 		TmpDir  string `yaml:"tmpDir"`
 		SyncDir string `yaml:"syncDir"`
+		// RequestTimeout 单个 API 请求的超时, 默认 60s
+		RequestTimeout string `yaml:"requestTimeout"`
+		// TransferTimeout 单个分片或小文件上传的超时, 默认 10m
+		TransferTimeout string `yaml:"transferTimeout"`
+		// StallTimeout 下载时超过该时间没有收到数据则中断, 默认 60s
+		StallTimeout string `yaml:"stallTimeout"`
+		// ShutdownGrace 退出时等待正在传输的文件完成的时间, 默认 30s
+		ShutdownGrace string `yaml:"shutdownGrace"`
 	} `yaml:"General"`
 
+	// API 百度网盘接口地址, 为空时使用官方地址, 测试时可以指向本地的模拟服务
+	API struct {
+		PanURL   string `yaml:"panURL"`
+		PcsURL   string `yaml:"pcsURL"`
+		OAuthURL string `yaml:"oauthURL"`
+	} `yaml:"API"`
+
+	// HTTP 访问百度网盘接口使用的客户端, 所有请求共用一个连接池
+	HTTP HTTPConfig `yaml:"HTTP"`
+
 	Redis struct {
 		Host     string `yaml:"host"`
 		Port     string `yaml:"port"`
 		Password string `yaml:"password"`
 		Db       int    `yaml:"db"`
 	} `yaml:"Redis"`
+
+	Web struct {
+		// Listen 监听地址, 默认 0.0.0.0:8080
+		Listen string `yaml:"listen"`
+		// 未配置任何 Tokens/Users 时只允许本机访问
+		Tokens []WebToken `yaml:"tokens"`
+		Users  []WebUser  `yaml:"users"`
+		// RestoreRoots 是 /api/restore 可以恢复到的目录, 任务的源目录总是允许
+		RestoreRoots []string `yaml:"restoreRoots"`
+
+		TLS struct {
+			// CertFile 和 KeyFile 都配置时启用 HTTPS, 文件更新后自动重新加载
+			CertFile string `yaml:"certFile"`
+			KeyFile  string `yaml:"keyFile"`
+			// ClientCAFile 配置后校验客户端证书 (mTLS)
+			ClientCAFile string `yaml:"clientCAFile"`
+			// ClientCertOptional 为 true 时客户端可以不提供证书, 提供了则必须有效
+			ClientCertOptional bool `yaml:"clientCertOptional"`
+		} `yaml:"tls"`
+	} `yaml:"Web"`
+
+	// Encryption 客户端加密的密钥, 任务配置 encrypt: true 时上传前加密
+	// KeyFile 为 32 字节的密钥文件 (原始、hex 或 base64), 优先于 Passphrase
+	// Passphrase 也可以通过环境变量 BACKUPTOOL_PASSPHRASE 设置
+	// Recipients 为 X25519 公钥 (bktpub1...), 只有公钥的机器可以备份但不能解密
+	// IdentityFile 为私钥文件, 用于解密发给 Recipients 的文件
+	Encryption struct {
+		KeyFile      string   `yaml:"keyFile"`
+		Passphrase   string   `yaml:"passphrase"`
+		Recipients   []string `yaml:"recipients"`
+		IdentityFile string   `yaml:"identityFile"`
+	} `yaml:"Encryption"`
+
+	// Scrub 是 -scrub 校验云端内容的默认参数, 命令行参数优先
+	// Sample 为抽查的比例 (0~1], 0 表示全部下载校验
+	// Bandwidth 为下载限速, 例如 10MiB 表示每秒 10MiB, 为空时不限速
+	Scrub struct {
+		Sample    float64 `yaml:"sample"`
+		Bandwidth string  `yaml:"bandwidth"`
+	} `yaml:"Scrub"`
+
+	Jobs []Job `yaml:"Jobs"`
+}
+
+// HTTPConfig 配置访问百度网盘的 HTTP 客户端, 时间为空时使用默认值
+type HTTPConfig struct {
+	// Proxy 例如 http://proxy.example.com:3128, 为空时使用 HTTPS_PROXY 等环境变量
+	Proxy string `yaml:"proxy"`
+	// CAFile 额外信任的 CA 证书 (PEM), 和系统证书一起使用
+	CAFile string `yaml:"caFile"`
+	// InsecureSkipVerify 跳过证书校验, 仅用于调试
+	InsecureSkipVerify    bool   `yaml:"insecureSkipVerify"`
+	DialTimeout           string `yaml:"dialTimeout"`
+	TLSHandshakeTimeout   string `yaml:"tlsHandshakeTimeout"`
+	ResponseHeaderTimeout string `yaml:"responseHeaderTimeout"`
+	KeepAlive             string `yaml:"keepAlive"`
+	IdleConnTimeout       string `yaml:"idleConnTimeout"`
+	MaxIdleConnsPerHost   int    `yaml:"maxIdleConnsPerHost"`
+	DisableKeepAlives     bool   `yaml:"disableKeepAlives"`
+}
+
+// WebToken 是一个静态的 Bearer Token, ReadOnly 为 true 时只能调用只读接口
+type WebToken struct {
+	Token    string `yaml:"token"`
+	ReadOnly bool   `yaml:"readOnly"`
+}
+
+// WebUser 是一个 Basic Auth 用户, ReadOnly 为 true 时只能调用只读接口
+type WebUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	ReadOnly bool   `yaml:"readOnly"`
+}
+
+// Job 描述一个同步任务, SourceDir 为本地目录, TargetDir 为云端目录
+// Interval 为空时只能手动触发, 例如 "30m", "6h"
+// Timeout 为单次同步的最长时间, 为空表示不限制
+type Job struct {
+	Name      string `yaml:"name"`
+	SourceDir string `yaml:"sourceDir"`
+	TargetDir string `yaml:"targetDir"`
+	Interval  string `yaml:"interval"`
+	Timeout   string `yaml:"timeout"`
+	// Mode 为 sync (默认, 覆盖云端文件)、snapshot (版本化快照) 或 repository (快照, 文件按内容切块去重)
+	Mode      string    `yaml:"mode"`
+	Retention Retention `yaml:"retention"`
+	// Encrypt 为 true 时上传前使用 Encryption 的密钥加密
+	Encrypt bool `yaml:"encrypt"`
+	// EncryptNames 为 true 时云端的每一级目录和文件名都加密
+	EncryptNames bool `yaml:"encryptNames"`
+	// Compress 为 gzip 或 zstd 时上传前压缩, 已经压缩过的文件 (按扩展名和文件头判断) 不压缩
+	Compress string `yaml:"compress"`
+	// Bundle 配置后 snapshot 模式把小文件打包成 tar 上传, 减少 API 调用
+	Bundle Bundle `yaml:"bundle"`
+	// Parity 配置后 snapshot 和 repository 模式在上传的文件、tar 包和 pack 旁边上传 Reed-Solomon 校验文件
+	Parity Parity `yaml:"parity"`
+}
+
+// Parity 每 DataShards 个 ShardSize 大小的分片生成 ParityShards 个校验分片, 每组最多修复 ParityShards 个损坏的分片
+// ParityShards 为 0 时不生成, DataShards 默认为 10, ShardSize 默认为 64KiB
+type Parity struct {
+	DataShards   int    `yaml:"dataShards"`
+	ParityShards int    `yaml:"parityShards"`
+	ShardSize    string `yaml:"shardSize"`
+}
+
+// Bundle 把不超过 MaxFileSize 的文件合并成约 Size 大小的 tar 包上传, MaxFileSize 为空时不打包
+// 大小可以写成 "64KB"、"32MiB" 等, 按 1024 换算, Size 默认为 64MiB
+type Bundle struct {
+	MaxFileSize string `yaml:"maxFileSize"`
+	Size        string `yaml:"size"`
+}
+
+// Limits returns the largest file that is bundled, 0 when bundling is
+// off, and the size a bundle is uploaded at.
+func (b Bundle) Limits() (maxFile, size int64) {
+	return ParseSize(b.MaxFileSize, 0), ParseSize(b.Size, 64<<20)
+}
+
+// Retention 决定 snapshot 模式保留哪些快照, 全为 0 时保留所有快照
+type Retention struct {
+	KeepLast    int `yaml:"keepLast"`
+	KeepDaily   int `yaml:"keepDaily"`
+	KeepWeekly  int `yaml:"keepWeekly"`
+	KeepMonthly int `yaml:"keepMonthly"`
+	KeepYearly  int `yaml:"keepYearly"`
+}
+
+// Empty reports whether r keeps every snapshot.
+func (r Retention) Empty() bool {
+	return r == Retention{}
+}
+
+// Job.Mode 的取值
+const (
+	MODE_SYNC       = "sync"
+	MODE_SNAPSHOT   = "snapshot"
+	MODE_REPOSITORY = "repository"
+)
+
+// Snapshots reports whether j keeps snapshots, in snapshot or repository
+// mode.
+func (j Job) Snapshots() bool {
+	return j.Mode == MODE_SNAPSHOT || j.Mode == MODE_REPOSITORY
 }
 
-var BackUpConfig Config
+// BackUpConfig 只在启动和测试中直接修改, 运行中读取使用 Get, 替换由 Reload 加锁完成
+var (
+	BackUpConfig Config
+	configMu     sync.RWMutex
+)
+
+// Get returns a copy of the current config. Reload replaces whole sections
+// and never modifies the slices and maps of a copy already returned, so a
+// caller can keep it as a snapshot.
+func Get() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return BackUpConfig
+}
 
 func LoadConfig(configPath string) {
 
@@ -39,8 +221,130 @@ func LoadConfig(configPath string) {
 		logrus.Error("Failed to read YAML file: ", err)
 	}
 
+	configMu.Lock()
+	defer configMu.Unlock()
 	err = yaml.Unmarshal(yamlFile, &BackUpConfig)
 	if err != nil {
 		logrus.Error("Failed to unmarshal YAML ", err)
 	}
 }
+
+// Reload reads configPath again and replaces BackUpConfig only when the
+// file is valid. Redis, the listen address and the TLS files are not
+// changed until restart, the TLS files themselves are reloaded by web.
+func Reload(configPath string) error {
+	yamlFile, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var c Config
+	if err := yaml.Unmarshal(yamlFile, &c); err != nil {
+		return err
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	c.Redis = BackUpConfig.Redis
+	c.Web.Listen = BackUpConfig.Web.Listen
+	c.Web.TLS = BackUpConfig.Web.TLS
+	BackUpConfig = c
+	return nil
+}
+
+// GetJobs returns the configured jobs. When no job is configured, a "default"
+// job built from General.syncDir and BaiduDisk.syncDir is returned.
+func GetJobs() []Job {
+	c := Get()
+	if len(c.Jobs) > 0 {
+		return c.Jobs
+	}
+	return []Job{{
+		Name:      "default",
+		SourceDir: c.General.SyncDir,
+		TargetDir: c.BaiduDisk.SyncDir,
+	}}
+}
+
+// ParseDuration parses value like "30s" or "10m", an empty or invalid
+// value returns def.
+func ParseDuration(value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logrus.Errorf("invalid duration %q, use %s: %v", value, def, err)
+		return def
+	}
+	return d
+}
+
+var sizeUnits = map[string]int64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kb": 1 << 10, "kib": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20, "mib": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30, "gib": 1 << 30,
+}
+
+// ParseSize parses value like "512KB" or "64MiB", units are powers of
+// 1024; an empty, invalid or negative value returns def.
+func ParseSize(value string, def int64) int64 {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return def
+	}
+	i := strings.IndexFunc(value, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(value)
+	}
+	n, err := strconv.ParseInt(value[:i], 10, 64)
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(value[i:]))]
+	if err != nil || !ok || n > math.MaxInt64/unit {
+		logrus.Errorf("invalid size %q, use %d", value, def)
+		return def
+	}
+	return n * unit
+}
+
+func RequestTimeout() time.Duration {
+	return ParseDuration(Get().General.RequestTimeout, 60*time.Second)
+}
+
+func TransferTimeout() time.Duration {
+	return ParseDuration(Get().General.TransferTimeout, 10*time.Minute)
+}
+
+func StallTimeout() time.Duration {
+	return ParseDuration(Get().General.StallTimeout, 60*time.Second)
+}
+
+func ShutdownGrace() time.Duration {
+	return ParseDuration(Get().General.ShutdownGrace, 30*time.Second)
+}
+
+const (
+	DEFAULT_PAN_URL   = "https://pan.baidu.com"
+	DEFAULT_PCS_URL   = "https://d.pcs.baidu.com"
+	DEFAULT_OAUTH_URL = "https://openapi.baidu.com"
+)
+
+func baseURL(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return strings.TrimRight(value, "/")
+}
+
+// PanURL 是 xpan 接口 (列表、创建、文件信息等) 的地址
+func PanURL() string {
+	return baseURL(Get().API.PanURL, DEFAULT_PAN_URL)
+}
+
+// PcsURL 是上传接口的地址
+func PcsURL() string {
+	return baseURL(Get().API.PcsURL, DEFAULT_PCS_URL)
+}
+
+// OAuthURL 是授权接口的地址
+func OAuthURL() string {
+	return baseURL(Get().API.OAuthURL, DEFAULT_OAUTH_URL)
+}
@@ -1,12 +1,151 @@
 package config_test
 
 import (
-	"log"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/wangxso/backuptool/config"
 )
 
+const testConfig = `
+BaiduDisk:
+  AppKey: key
+  syncDir: /apps/backup
+General:
+  syncDir: /data
+  requestTimeout: 5s
+Redis:
+  host: 127.0.0.1
+  port: "6379"
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
 func TestReader(t *testing.T) {
-	log.Fatalf("Config is %v", config.BackUpConfig)
+	saved := config.BackUpConfig
+	defer func() { config.BackUpConfig = saved }()
+	config.BackUpConfig = config.Config{}
+
+	config.LoadConfig(writeConfig(t, testConfig))
+	if config.BackUpConfig.BaiduDisk.AppKey != "key" || config.BackUpConfig.Redis.Port != "6379" {
+		t.Fatalf("config not loaded: %+v", config.BackUpConfig)
+	}
+	if got := config.RequestTimeout(); got != 5*time.Second {
+		t.Fatalf("RequestTimeout: got %s", got)
+	}
+	if got := config.TransferTimeout(); got != 10*time.Minute {
+		t.Fatalf("TransferTimeout default: got %s", got)
+	}
+	jobs := config.GetJobs()
+	if len(jobs) != 1 || jobs[0].SourceDir != "/data" || jobs[0].TargetDir != "/apps/backup" {
+		t.Fatalf("default job: %+v", jobs)
+	}
+	if got := config.PanURL(); got != config.DEFAULT_PAN_URL {
+		t.Fatalf("PanURL default: got %s", got)
+	}
+}
+
+func TestReload(t *testing.T) {
+	saved := config.BackUpConfig
+	defer func() { config.BackUpConfig = saved }()
+	config.BackUpConfig = config.Config{}
+	config.LoadConfig(writeConfig(t, testConfig))
+
+	path := writeConfig(t, `
+BaiduDisk:
+  AppKey: new-key
+Redis:
+  host: 10.0.0.1
+Jobs:
+  - name: photos
+    sourceDir: /photos
+    targetDir: /apps/photos
+`)
+	if err := config.Reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if config.BackUpConfig.BaiduDisk.AppKey != "new-key" {
+		t.Fatal("AppKey not reloaded")
+	}
+	if config.BackUpConfig.Redis.Host != "127.0.0.1" {
+		t.Fatal("Redis settings must not change on reload")
+	}
+	if jobs := config.GetJobs(); len(jobs) != 1 || jobs[0].Name != "photos" {
+		t.Fatalf("jobs: %+v", jobs)
+	}
+
+	if err := config.Reload(writeConfig(t, "BaiduDisk: [")); err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	if config.BackUpConfig.BaiduDisk.AppKey != "new-key" {
+		t.Fatal("invalid config replaced the current one")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	if got := config.ParseDuration("", time.Second); got != time.Second {
+		t.Fatalf("empty: got %s", got)
+	}
+	if got := config.ParseDuration("bad", time.Second); got != time.Second {
+		t.Fatalf("invalid: got %s", got)
+	}
+	if got := config.ParseDuration("90m", time.Second); got != 90*time.Minute {
+		t.Fatalf("90m: got %s", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, want := range map[string]int64{
+		"":       7,
+		"bad":    7,
+		"-1":     7,
+		"12XB":   7,
+		"100":    100,
+		"512KB":  512 << 10,
+		"64MiB":  64 << 20,
+		"2 g":    2 << 30,
+		"1024 B": 1024,
+	} {
+		if got := config.ParseSize(value, 7); got != want {
+			t.Errorf("%q: got %d, want %d", value, got, want)
+		}
+	}
+}
+
+// TestReloadWhileReading runs under -race: readers take snapshots with Get
+// while the config is replaced.
+func TestReloadWhileReading(t *testing.T) {
+	saved := config.BackUpConfig
+	defer func() { config.BackUpConfig = saved }()
+	config.BackUpConfig = config.Config{}
+	config.LoadConfig(writeConfig(t, testConfig))
+	path := writeConfig(t, testConfig)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := config.Reload(path); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if c := config.Get(); c.BaiduDisk.AppKey != "key" {
+			t.Fatalf("snapshot: %+v", c.BaiduDisk)
+		}
+		config.RequestTimeout()
+		config.GetJobs()
+	}
+	<-done
 }
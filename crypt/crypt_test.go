@@ -0,0 +1,242 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wangxso/backuptool/config"
+)
+
+func testKey(t *testing.T) *Key {
+	t.Helper()
+	key, err := NewKey(bytes.Repeat([]byte{7}, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, key *Key, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 分多次写入, 覆盖跨块的写入
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(key *Key, data []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := testKey(t)
+	chunk := 1 << chunkShift
+	for _, size := range []int{0, 1, chunk - 1, chunk, chunk + 1, 3 * chunk} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+		sealed := encrypt(t, key, data)
+		if int64(len(sealed)) != Size(int64(size), key) {
+			t.Errorf("size %d: got %d bytes, Size says %d", size, len(sealed), Size(int64(size), key))
+		}
+		if size > 16 && bytes.Contains(sealed, data) {
+			t.Errorf("size %d: plaintext in the output", size)
+		}
+		got, err := decrypt(key, sealed)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d: %v", size, err)
+		}
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key := testKey(t)
+	chunk := 1 << chunkShift
+	data := bytes.Repeat([]byte("backuptool"), chunk/5)
+	sealed := encrypt(t, key, data)
+	headerLen := int(Size(0, key)) - overhead
+	sealedChunk := chunk + overhead
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[headerLen+10] ^= 1
+	header := append([]byte(nil), sealed...)
+	header[len(magic2)] = 17
+
+	for name, c := range map[string][]byte{
+		"flipped bit":      flipped,
+		"chunk size":       header,
+		"truncated":        sealed[:len(sealed)-1],
+		"last chunk lost":  sealed[:headerLen+sealedChunk],
+		"chunks reordered": append(append(append([]byte(nil), sealed[:headerLen]...), sealed[headerLen+sealedChunk:]...), sealed[headerLen:headerLen+sealedChunk]...),
+	} {
+		if _, err := decrypt(key, c); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	other, _ := NewKey(bytes.Repeat([]byte{8}, keySize))
+	if _, err := decrypt(other, sealed); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("wrong key: %v", err)
+	}
+	if _, err := decrypt(key, data); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("plaintext: %v", err)
+	}
+}
+
+// TestLegacy 第一版格式的文件仍然可以解密
+func TestLegacy(t *testing.T) {
+	key := testKey(t)
+	fileKey := bytes.Repeat([]byte{9}, keySize)
+	header := append([]byte(magic), kdfKeyFile, chunkShift)
+	nonce := make([]byte, nonceSize)
+	aead, _ := newAEAD(key.secret)
+	header = aead.Seal(append(header, nonce...), nonce, fileKey, header)
+	content, _ := newAEAD(fileKey)
+	sealed := content.Seal(header, chunkNonce(0, true), []byte("old backup"), nil)
+
+	if got, err := decrypt(key, sealed); err != nil || string(got) != "old backup" {
+		t.Fatalf("decrypt: %q %v", got, err)
+	}
+	wraps, err := ReadWraps(bytes.NewReader(sealed))
+	if err != nil || wraps.KeyIDs()[0] != "key" {
+		t.Fatalf("wraps: %v %v", wraps, err)
+	}
+	// 轮换后的 wraps 记录在文件之外, 文件头不变
+	id, _ := GenerateIdentity()
+	rotated, err := Rewrap(wraps, []Identity{key}, []Recipient{id.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReaderWith(bytes.NewReader(sealed), rotated, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != "old backup" {
+		t.Fatalf("rotated: %q %v", got, err)
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	key, err := FromPassphrase("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := encrypt(t, key, []byte("hr data"))
+	if int64(len(sealed)) != Size(7, key) {
+		t.Fatalf("size: %d", len(sealed))
+	}
+	// 另一个进程使用另一个 salt, 仍然可以解密
+	again, _ := FromPassphrase("correct horse")
+	if got, err := decrypt(again, sealed); err != nil || string(got) != "hr data" {
+		t.Fatalf("decrypt: %q %v", got, err)
+	}
+	wrong, _ := FromPassphrase("wrong horse")
+	if _, err := decrypt(wrong, sealed); !errors.Is(err, ErrAuth) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	if _, err := decrypt(testKey(t), sealed); err == nil {
+		t.Fatal("key file opened a passphrase file")
+	}
+	// 文件头中过大的 scrypt N 直接拒绝, 不分配内存
+	s, err := key.wrap(make([]byte, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Data[0] = scryptLogN + 2
+	if _, err := key.unwrap(s); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("scrypt N=2^%d: %v", s.Data[0], err)
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	saved := config.BackUpConfig
+	t.Cleanup(func() { config.BackUpConfig = saved })
+	dir := t.TempDir()
+	config.BackUpConfig.Encryption.KeyFile = ""
+	config.BackUpConfig.Encryption.Passphrase = ""
+	t.Setenv(PASSPHRASE_ENV, "")
+	if _, err := LoadKey(); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("no key: %v", err)
+	}
+
+	path := filepath.Join(dir, "backup.key")
+	if err := GenerateKeyFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateKeyFile(path); err == nil {
+		t.Fatal("existing key file overwritten")
+	}
+	config.BackUpConfig.Encryption.KeyFile = path
+	key, err := LoadKey()
+	if err != nil || key.kdf != kdfKeyFile {
+		t.Fatalf("key file: %v", err)
+	}
+	if again, _ := LoadKey(); again != key {
+		t.Fatal("key not cached")
+	}
+
+	src := filepath.Join(dir, "plain.txt")
+	os.WriteFile(src, []byte("payroll"), 0644)
+	wraps, err := EncryptFile(src, src+".enc", key)
+	if err != nil || len(wraps) != 1 || wraps.KeyIDs()[0] != key.KeyID() {
+		t.Fatalf("encrypt: %v %v", wraps.KeyIDs(), err)
+	}
+	if ok, err := DecryptInPlace(src+".enc", nil, key); !ok || err != nil {
+		t.Fatalf("decrypt in place: %v %v", ok, err)
+	}
+	if got, _ := os.ReadFile(src + ".enc"); string(got) != "payroll" {
+		t.Fatalf("decrypted: %q", got)
+	}
+	if ok, err := DecryptInPlace(src, nil, key); ok || err != nil {
+		t.Fatalf("plain file: %v %v", ok, err)
+	}
+
+	os.WriteFile(path, []byte("short"), 0600)
+	if _, err := ReadKeyFile(path); err == nil {
+		t.Fatal("short key accepted")
+	}
+}
+
+func TestSign(t *testing.T) {
+	key, _ := FromPassphrase("correct horse")
+	sig, err := key.Sign([]byte("manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 另一台机器上同一个口令得到同样的签名密钥
+	again, _ := FromPassphrase("correct horse")
+	if err := again.Verify([]byte("manifest"), sig); err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Verify([]byte("manifesT"), sig); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("modified: %v", err)
+	}
+	if err := testKey(t).Verify([]byte("manifest"), sig); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("other key: %v", err)
+	}
+}
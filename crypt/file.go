@@ -0,0 +1,92 @@
+package crypt
+
+import (
+	"io"
+	"os"
+)
+
+// EncryptFile encrypts the file src for recipients into dst and returns
+// the wrapped file key written in its header.
+func EncryptFile(src, dst string, recipients ...Recipient) (Wraps, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w, wraps, err := newWriter(out, recipients)
+	if err == nil {
+		_, err = io.Copy(w, in)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if e := out.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst)
+		return nil, err
+	}
+	return wraps, nil
+}
+
+// DecryptFile decrypts the file src into dst, trying wraps before its
+// header. dst is removed when src fails to authenticate.
+func DecryptFile(src, dst string, wraps Wraps, identities ...Identity) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := NewReaderWith(in, wraps, identities...)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if e := out.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// IsEncryptedFile reports whether the file p starts like an encrypted file.
+func IsEncryptedFile(p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return IsEncrypted(f)
+}
+
+// DecryptInPlace replaces the encrypted file p by its content, a file that
+// is not encrypted is left alone and reported false.
+func DecryptInPlace(p string, wraps Wraps, identities ...Identity) (bool, error) {
+	ok, err := IsEncryptedFile(p)
+	if err != nil || !ok {
+		return false, err
+	}
+	tmp := p + ".decrypting"
+	if err := DecryptFile(p, tmp, wraps, identities...); err != nil {
+		return true, err
+	}
+	if info, err := os.Stat(p); err == nil {
+		os.Chmod(tmp, info.Mode().Perm())
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return true, err
+	}
+	return true, nil
+}
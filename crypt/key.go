@@ -0,0 +1,281 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/wangxso/backuptool/config"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	kdfKeyFile byte = 0
+	kdfScrypt  byte = 1
+
+	keyIDSize = 4
+
+	// scryptLogN 写入时使用的 scrypt 参数 N=2^15, r=8, p=1, 读取时使用文件头中的 N
+	scryptLogN = 15
+	// scryptMaxLog 读取文件头时接受的最大 N, 防止伪造的文件头占用大量内存 (2^16 约 64 MiB)
+	scryptMaxLog = scryptLogN + 1
+
+	// PASSPHRASE_ENV 优先于配置文件中的 Encryption.passphrase
+	PASSPHRASE_ENV = "BACKUPTOOL_PASSPHRASE"
+)
+
+var ErrNoKey = errors.New("crypt: no key configured, set Encryption.keyFile, passphrase or recipients")
+
+// Key is a secret key read from a key file or derived from a passphrase.
+// It is both a Recipient and an Identity and also derives the filename
+// key, see Names.
+type Key struct {
+	kdf    byte
+	secret []byte
+
+	// 口令派生的密钥按 salt 缓存, 写入时整个进程使用同一个 salt
+	mu      sync.Mutex
+	salt    []byte
+	derived map[string][]byte
+
+	namesOnce sync.Once
+	names     *Names
+	namesErr  error
+
+	signOnce sync.Once
+	signKey  []byte
+	signErr  error
+}
+
+// NewKey returns the key made of the 32 bytes secret.
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) != keySize {
+		return nil, fmt.Errorf("crypt: key must be %d bytes, got %d", keySize, len(secret))
+	}
+	return &Key{kdf: kdfKeyFile, secret: secret}, nil
+}
+
+// FromPassphrase returns a key derived from passphrase with scrypt, the
+// salt is random and recorded in every file.
+func FromPassphrase(passphrase string) (*Key, error) {
+	if passphrase == "" {
+		return nil, errors.New("crypt: empty passphrase")
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &Key{kdf: kdfScrypt, secret: []byte(passphrase), salt: salt, derived: make(map[string][]byte)}, nil
+}
+
+// ReadKeyFile reads a key file holding 32 bytes, raw, hex or base64.
+func ReadKeyFile(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == keySize {
+		return NewKey(data)
+	}
+	text := strings.TrimSpace(string(data))
+	if b, err := hex.DecodeString(text); err == nil {
+		return NewKey(b)
+	}
+	if b, err := base64.StdEncoding.DecodeString(text); err == nil {
+		return NewKey(b)
+	}
+	return nil, fmt.Errorf("crypt: %s is not a key file of %d bytes", path, keySize)
+}
+
+// GenerateKeyFile writes a new random key to path in hex, the file must
+// not exist.
+func GenerateKeyFile(path string) error {
+	secret := make([]byte, keySize)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(secret)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var (
+	loadMu    sync.Mutex
+	loaded    *Key
+	loadedFor [2]string
+)
+
+// LoadKey returns the key of the Encryption section, the key file wins
+// over the passphrase. It returns ErrNoKey when neither is configured. The
+// key is cached until the config changes.
+func LoadKey() (*Key, error) {
+	enc := config.Get().Encryption
+	keyFile := enc.KeyFile
+	passphrase := enc.Passphrase
+	if env := os.Getenv(PASSPHRASE_ENV); env != "" {
+		passphrase = env
+	}
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	if loaded != nil && loadedFor == [2]string{keyFile, passphrase} {
+		return loaded, nil
+	}
+	var key *Key
+	var err error
+	switch {
+	case keyFile != "":
+		key, err = ReadKeyFile(keyFile)
+	case passphrase != "":
+		key, err = FromPassphrase(passphrase)
+	default:
+		return nil, ErrNoKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	loaded, loadedFor = key, [2]string{keyFile, passphrase}
+	return key, nil
+}
+
+// master returns the key that wraps file keys for salt and logN.
+func (k *Key) master(salt []byte, logN byte) ([]byte, error) {
+	if k.kdf == kdfKeyFile {
+		return k.secret, nil
+	}
+	if logN > scryptMaxLog {
+		return nil, fmt.Errorf("crypt: scrypt N=2^%d too large", logN)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	cacheKey := fmt.Sprintf("%x/%d", salt, logN)
+	if m, ok := k.derived[cacheKey]; ok {
+		return m, nil
+	}
+	m, err := scrypt.Key(k.secret, salt, 1<<logN, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	k.derived[cacheKey] = m
+	return m, nil
+}
+
+// KeyID identifies k in manifests: key:<hex> for a key file, passphrase
+// for a passphrase.
+func (k *Key) KeyID() string {
+	if k.kdf == kdfScrypt {
+		return "passphrase"
+	}
+	return fmt.Sprintf("key:%x", k.id())
+}
+
+func (k *Key) id() []byte {
+	sum := sha256.Sum256(append([]byte("backuptool key id\x00"), k.secret...))
+	return sum[:keyIDSize]
+}
+
+func (k *Key) stanzaSize() int {
+	if k.kdf == kdfScrypt {
+		return 1 + saltSize + nonceSize + wrappedLen
+	}
+	return keyIDSize + nonceSize + wrappedLen
+}
+
+// wrap 密钥文件的 stanza 为 ID、nonce 和密文, 口令的 stanza 为 scrypt 参数、salt、nonce 和密文
+func (k *Key) wrap(fileKey []byte) (Stanza, error) {
+	s := Stanza{Type: stanzaKeyFile, Data: k.id()}
+	if k.kdf == kdfScrypt {
+		s = Stanza{Type: stanzaScrypt, Data: append([]byte{scryptLogN}, k.salt...)}
+	}
+	master, err := k.master(k.salt, scryptLogN)
+	if err != nil {
+		return Stanza{}, err
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return Stanza{}, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return Stanza{}, err
+	}
+	prefix := append([]byte{s.Type}, s.Data...)
+	s.Data = aead.Seal(append(s.Data, nonce...), nonce, fileKey, prefix)
+	return s, nil
+}
+
+func (k *Key) unwrap(s Stanza) ([]byte, error) {
+	if s.Type == stanzaLegacy {
+		return k.unwrapLegacy(s.Data)
+	}
+	var salt []byte
+	var logN byte
+	switch {
+	case s.Type == stanzaKeyFile && k.kdf == kdfKeyFile:
+		if len(s.Data) != k.stanzaSize() || string(s.Data[:keyIDSize]) != string(k.id()) {
+			return nil, errNoMatch
+		}
+	case s.Type == stanzaScrypt && k.kdf == kdfScrypt:
+		if len(s.Data) != k.stanzaSize() {
+			return nil, errNoMatch
+		}
+		logN, salt = s.Data[0], s.Data[1:1+saltSize]
+	default:
+		return nil, errNoMatch
+	}
+	prefixLen := len(s.Data) - nonceSize - wrappedLen
+	master, err := k.master(salt, logN)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	prefix := append([]byte{s.Type}, s.Data[:prefixLen]...)
+	fileKey, err := aead.Open(nil, s.Data[prefixLen:prefixLen+nonceSize], s.Data[prefixLen+nonceSize:], prefix)
+	if err != nil {
+		return nil, ErrAuth
+	}
+	return fileKey, nil
+}
+
+// unwrapLegacy opens the header of the first format, where the file key
+// is wrapped by the key file or passphrase directly in the header.
+func (k *Key) unwrapLegacy(header []byte) ([]byte, error) {
+	if len(header) < len(magic)+1 || header[len(magic)] != k.kdf {
+		return nil, errNoMatch
+	}
+	var salt []byte
+	var logN byte
+	if k.kdf == kdfScrypt {
+		logN = header[len(magic)+1]
+		salt = header[len(magic)+2 : len(magic)+2+saltSize]
+	}
+	master, err := k.master(salt, logN)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	prefixLen := len(header) - nonceSize - wrappedLen
+	nonce := header[prefixLen : prefixLen+nonceSize]
+	fileKey, err := aead.Open(nil, nonce, header[prefixLen+nonceSize:], header[:prefixLen])
+	if err != nil {
+		return nil, ErrAuth
+	}
+	return fileKey, nil
+}
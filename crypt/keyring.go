@@ -0,0 +1,77 @@
+package crypt
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/wangxso/backuptool/config"
+)
+
+// Keyring is the configured keys: files are encrypted to every recipient
+// and decrypted with any identity.
+type Keyring struct {
+	Recipients []Recipient
+	Identities []Identity
+	// Secret 是密钥文件或口令, 没有配置时为 nil, 加密文件名需要它
+	Secret *Key
+}
+
+// KeyIDs returns the IDs of the recipients.
+func (k *Keyring) KeyIDs() []string {
+	ids := make([]string, 0, len(k.Recipients))
+	for _, r := range k.Recipients {
+		ids = append(ids, r.KeyID())
+	}
+	return ids
+}
+
+var (
+	ringMu  sync.Mutex
+	ring    *Keyring
+	ringFor string
+)
+
+// LoadKeyring returns the keys of the Encryption section: the key file or
+// passphrase, the recipients and the identity file. It returns ErrNoKey
+// when there is nothing to encrypt to. The keyring is cached until the
+// config changes.
+func LoadKeyring() (*Keyring, error) {
+	c := config.Get().Encryption
+	cacheKey := strings.Join(append([]string{c.KeyFile, c.Passphrase, c.IdentityFile}, c.Recipients...), "\x00")
+	secret, err := LoadKey()
+	if err != nil && !errors.Is(err, ErrNoKey) {
+		return nil, err
+	}
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	if ring != nil && ringFor == cacheKey && ring.Secret == secret {
+		return ring, nil
+	}
+	k := &Keyring{Secret: secret}
+	if secret != nil {
+		k.Recipients = append(k.Recipients, secret)
+		k.Identities = append(k.Identities, secret)
+	}
+	for _, s := range c.Recipients {
+		r, err := ParseRecipient(s)
+		if err != nil {
+			return nil, err
+		}
+		k.Recipients = append(k.Recipients, r)
+	}
+	if c.IdentityFile != "" {
+		ids, err := ReadIdentityFile(c.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			k.Identities = append(k.Identities, id)
+		}
+	}
+	if len(k.Recipients) == 0 && len(k.Identities) == 0 {
+		return nil, ErrNoKey
+	}
+	ring, ringFor = k, cacheKey
+	return k, nil
+}
@@ -0,0 +1,251 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/wangxso/backuptool/db"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// LONG_NAMES 保存过长的加密文件名, field 为云端的短名称
+	LONG_NAMES = "long_names"
+
+	// 百度网盘的路径最长 1024 字节, 文件名最长 255 字节
+	MaxPathLen = 1024
+	// maxNameLen 超过该长度的加密文件名在云端使用短名称, 保证深层目录不超过路径长度限制
+	maxNameLen = 96
+	ivSize     = 16
+	longPrefix = "~"
+	longLen    = 32
+)
+
+var (
+	// nameEncoding 只使用小写字母和数字, 云端不区分大小写也不会冲突
+	nameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+	// namesSalt 口令派生文件名密钥时使用固定的 salt, 同一口令总是得到同样的文件名
+	namesSalt = []byte("backuptool filename encryption")
+
+	ErrNotEncryptedName = errors.New("crypt: not an encrypted name")
+	ErrPathTooLong      = errors.New("crypt: encrypted path too long")
+)
+
+// Names encrypts the components of remote paths deterministically: the
+// same name always maps to the same encrypted name, so files can still be
+// found, compared and overwritten. A name is sealed like SIV: the IV is an
+// HMAC of the name, which also authenticates it, and the name is encrypted
+// with AES-CTR under that IV.
+type Names struct {
+	block cipher.Block
+	mac   []byte
+}
+
+// Names returns the filename cipher of k.
+func (k *Key) Names() (*Names, error) {
+	k.namesOnce.Do(func() { k.names, k.namesErr = k.newNames() })
+	return k.names, k.namesErr
+}
+
+func (k *Key) newNames() (*Names, error) {
+	var secret []byte
+	var err error
+	if k.kdf == kdfScrypt {
+		secret, err = k.master(namesSalt, scryptLogN)
+	} else {
+		secret, err = k.master(nil, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := hkdf.New(sha256.New, secret, nil, []byte("backuptool names"))
+	encKey := make([]byte, keySize)
+	macKey := make([]byte, keySize)
+	if _, err := io.ReadFull(r, encKey); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, macKey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Names{block: block, mac: macKey}, nil
+}
+
+func (n *Names) siv(name []byte) []byte {
+	h := hmac.New(sha256.New, n.mac)
+	h.Write(name)
+	return h.Sum(nil)[:ivSize]
+}
+
+// EncryptName returns the encrypted name of the path component name. A
+// name that would be longer than maxNameLen is replaced by a short name
+// starting with "~", the long one is kept in Redis under LONG_NAMES.
+func (n *Names) EncryptName(name string) (string, error) {
+	iv := n.siv([]byte(name))
+	sealed := make([]byte, ivSize+len(name))
+	copy(sealed, iv)
+	cipher.NewCTR(n.block, iv).XORKeyStream(sealed[ivSize:], []byte(name))
+	enc := nameEncoding.EncodeToString(sealed)
+	if len(enc) <= maxNameLen {
+		return enc, nil
+	}
+	h := hmac.New(sha256.New, n.mac)
+	h.Write([]byte("long name\x00"))
+	h.Write(sealed)
+	short := longPrefix + nameEncoding.EncodeToString(h.Sum(nil))[:longLen]
+	if db.Client == nil {
+		return "", fmt.Errorf("crypt: name of %d bytes needs Redis", len(name))
+	}
+	if err := db.Client.HSet(db.Client.Context(), LONG_NAMES, short, enc).Err(); err != nil {
+		return "", err
+	}
+	return short, nil
+}
+
+// LongNames returns the long encrypted names of the short "~" components
+// of the cloud paths, so they can be kept in the cloud with the content,
+// e.g. in a manifest. Without them the short names cannot be decrypted.
+func LongNames(paths ...string) (map[string]string, error) {
+	var shorts []string
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		for _, part := range strings.Split(p, "/") {
+			if strings.HasPrefix(part, longPrefix) && !seen[part] {
+				seen[part] = true
+				shorts = append(shorts, part)
+			}
+		}
+	}
+	if len(shorts) == 0 {
+		return nil, nil
+	}
+	if db.Client == nil {
+		return nil, fmt.Errorf("crypt: long names need Redis")
+	}
+	longs, err := db.Client.HMGet(db.Client.Context(), LONG_NAMES, shorts...).Result()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string, len(shorts))
+	for i, v := range longs {
+		if long, ok := v.(string); ok {
+			ret[shorts[i]] = long
+		}
+	}
+	return ret, nil
+}
+
+// SaveLongNames records long encrypted names returned by LongNames, e.g.
+// when rebuilding the state on a new machine.
+func SaveLongNames(names map[string]string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if db.Client == nil {
+		return fmt.Errorf("crypt: long names need Redis")
+	}
+	fields := make([]interface{}, 0, 2*len(names))
+	for short, long := range names {
+		if !strings.HasPrefix(short, longPrefix) {
+			return fmt.Errorf("crypt: %q is not a short name", short)
+		}
+		fields = append(fields, short, long)
+	}
+	return db.Client.HSet(db.Client.Context(), LONG_NAMES, fields...).Err()
+}
+
+// DecryptName reverses EncryptName, it returns ErrNotEncryptedName for a
+// name that was not encrypted with n.
+func (n *Names) DecryptName(enc string) (string, error) {
+	if strings.HasPrefix(enc, longPrefix) {
+		if db.Client == nil {
+			return "", ErrNotEncryptedName
+		}
+		long, err := db.Client.HGet(db.Client.Context(), LONG_NAMES, enc).Result()
+		if errors.Is(err, redis.Nil) {
+			return "", ErrNotEncryptedName
+		}
+		if err != nil {
+			return "", err
+		}
+		enc = long
+	}
+	sealed, err := nameEncoding.DecodeString(enc)
+	if err != nil || len(sealed) < ivSize {
+		return "", ErrNotEncryptedName
+	}
+	iv := sealed[:ivSize]
+	name := make([]byte, len(sealed)-ivSize)
+	cipher.NewCTR(n.block, iv).XORKeyStream(name, sealed[ivSize:])
+	if !hmac.Equal(iv, n.siv(name)) {
+		return "", ErrNotEncryptedName
+	}
+	return string(name), nil
+}
+
+// EncryptPath encrypts every component of the relative path rel, the
+// result with root must fit in MaxPathLen.
+func (n *Names) EncryptPath(root, rel string) (string, error) {
+	parts := strings.Split(strings.Trim(path.Clean("/"+rel), "/"), "/")
+	for i, p := range parts {
+		if p == "" {
+			continue
+		}
+		enc, err := n.EncryptName(p)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = enc
+	}
+	ret := path.Join(root, path.Join(parts...))
+	if len(ret) > MaxPathLen {
+		return "", fmt.Errorf("%s: %w", rel, ErrPathTooLong)
+	}
+	return ret, nil
+}
+
+// DecryptPath reverses EncryptPath for the path p under root.
+func (n *Names) DecryptPath(root, p string) (string, error) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(path.Clean(p), path.Clean(root)), "/")
+	if rel == "" {
+		return "", nil
+	}
+	parts := strings.Split(rel, "/")
+	for i, enc := range parts {
+		name, err := n.DecryptName(enc)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", enc, err)
+		}
+		parts[i] = name
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// DisplayName returns the plain name of enc when a key is configured and
+// enc was encrypted with it, otherwise enc itself.
+func DisplayName(enc string) string {
+	key, err := LoadKey()
+	if err != nil {
+		return enc
+	}
+	names, err := key.Names()
+	if err != nil {
+		return enc
+	}
+	if name, err := names.DecryptName(enc); err == nil {
+		return name
+	}
+	return enc
+}
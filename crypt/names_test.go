@@ -0,0 +1,89 @@
+package crypt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/wangxso/backuptool/db"
+)
+
+func TestNames(t *testing.T) {
+	names, err := testKey(t).Names()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := names.EncryptName("layoffs-2026.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := names.EncryptName("layoffs-2026.xlsx"); again != enc {
+		t.Fatal("encryption is not deterministic")
+	}
+	if strings.Contains(enc, "layoffs") || strings.ToLower(enc) != enc {
+		t.Fatalf("encrypted name: %s", enc)
+	}
+	if name, err := names.DecryptName(enc); err != nil || name != "layoffs-2026.xlsx" {
+		t.Fatalf("decrypt: %q %v", name, err)
+	}
+	for _, plain := range []string{"report.txt", "~$report.docx", enc[:len(enc)-1] + "a"} {
+		if _, err := names.DecryptName(plain); !errors.Is(err, ErrNotEncryptedName) {
+			t.Errorf("%s: %v", plain, err)
+		}
+	}
+	other, _ := NewKey(make([]byte, keySize))
+	otherNames, _ := other.Names()
+	if _, err := otherNames.DecryptName(enc); !errors.Is(err, ErrNotEncryptedName) {
+		t.Fatalf("other key: %v", err)
+	}
+
+	// 同一口令在不同进程得到同样的文件名
+	a, _ := FromPassphrase("secret")
+	b, _ := FromPassphrase("secret")
+	na, _ := a.Names()
+	nb, _ := b.Names()
+	ea, _ := na.EncryptName("x")
+	eb, _ := nb.EncryptName("x")
+	if ea != eb {
+		t.Fatal("passphrase names differ")
+	}
+}
+
+func TestLongNames(t *testing.T) {
+	mr := miniredis.RunT(t)
+	saved := db.Client
+	db.Client = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		db.Client.Close()
+		db.Client = saved
+	})
+	names, _ := testKey(t).Names()
+
+	long := strings.Repeat("quarterly-report-", 12) + ".xlsx"
+	enc, err := names.EncryptName(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enc) > maxNameLen || !strings.HasPrefix(enc, longPrefix) {
+		t.Fatalf("long name: %s", enc)
+	}
+	if name, err := names.DecryptName(enc); err != nil || name != long {
+		t.Fatalf("decrypt long name: %q %v", name, err)
+	}
+
+	// 每一级都是长名称时路径仍在限制之内
+	rel := strings.TrimSuffix(strings.Repeat(long+"/", 20), "/")
+	remote, err := names.EncryptPath("/apps/backup", rel)
+	if err != nil || len(remote) > MaxPathLen {
+		t.Fatalf("deep path: %d bytes, %v", len(remote), err)
+	}
+	if got, err := names.DecryptPath("/apps/backup", remote); err != nil || got != rel {
+		t.Fatalf("decrypt deep path: %v", err)
+	}
+	medium := strings.TrimSuffix(strings.Repeat("abcdefghijklmnopqrstuvwxyz0123456789abcd/", 20), "/")
+	if _, err := names.EncryptPath("/apps/backup", medium); !errors.Is(err, ErrPathTooLong) {
+		t.Fatalf("path over the limit: %v", err)
+	}
+}
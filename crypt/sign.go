@@ -0,0 +1,56 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var ErrBadSignature = errors.New("crypt: bad signature, wrong key or modified data")
+
+// Sign returns an HMAC-SHA256 of data under a key derived from k, so only
+// the holders of the key file or passphrase can write data Verify accepts.
+// Like the filename key it is the same on every machine.
+func (k *Key) Sign(data []byte) ([]byte, error) {
+	k.signOnce.Do(func() { k.signKey, k.signErr = k.newSignKey() })
+	if k.signErr != nil {
+		return nil, k.signErr
+	}
+	m := hmac.New(sha256.New, k.signKey)
+	m.Write(data)
+	return m.Sum(nil), nil
+}
+
+// Verify returns ErrBadSignature when sig is not the signature of data.
+func (k *Key) Verify(data, sig []byte) error {
+	want, err := k.Sign(data)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(want, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func (k *Key) newSignKey() ([]byte, error) {
+	var secret []byte
+	var err error
+	// 口令和文件名密钥使用同一个固定 salt 派生, 只需要一次 scrypt
+	if k.kdf == kdfScrypt {
+		secret, err = k.master(namesSalt, scryptLogN)
+	} else {
+		secret, err = k.master(nil, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("backuptool signature")), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,327 @@
+// Package crypt encrypts backup content on the client before it is
+// uploaded, so the cloud provider only stores ciphertext.
+//
+// An encrypted file starts with a header holding a random file key wrapped
+// for each recipient (see Wraps), followed by the content in chunks of
+// 64 KiB sealed with AES-256-GCM under the file key. The nonce of a chunk is its counter
+// and a flag marking the last chunk, so reordered, dropped or truncated
+// chunks fail to open. The content is processed one chunk at a time and
+// never held in memory.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// magic 开头的 8 个字节, 最后一个字节是格式版本
+	// 第一版只有一个密钥, 第二版的文件头为 magic2、块大小和 Wraps
+	magic  = "BKTENC\x00\x01"
+	magic2 = "BKTENC\x00\x02"
+
+	chunkShift = 16
+	keySize    = 32
+	saltSize   = 16
+	nonceSize  = 12
+	overhead   = 16
+	wrappedLen = keySize + overhead
+)
+
+var (
+	ErrNotEncrypted = errors.New("crypt: not an encrypted file")
+	// ErrAuth 密钥错误, 或者密文被修改、截断
+	ErrAuth = errors.New("crypt: authentication failed, wrong key or corrupted data")
+)
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce 由 11 字节的计数和最后一块的标记组成
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	out     []byte
+	counter uint64
+	closed  bool
+}
+
+// NewWriter returns a writer that encrypts what is written to it for
+// recipients into w. Close must be called to write the last chunk; it does
+// not close w.
+func NewWriter(w io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
+	ew, _, err := newWriter(w, recipients)
+	if err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+// NewWriterWraps is NewWriter that also returns the wrapped file key
+// written in the header.
+func NewWriterWraps(w io.Writer, recipients ...Recipient) (io.WriteCloser, Wraps, error) {
+	ew, wraps, err := newWriter(w, recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ew, wraps, nil
+}
+
+func newWriter(w io.Writer, recipients []Recipient) (*writer, Wraps, error) {
+	fileKey, wraps, err := wrap(recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := append([]byte(magic2), chunkShift)
+	if _, err := w.Write(append(header, wraps.encode()...)); err != nil {
+		return nil, nil, err
+	}
+	size := 1 << chunkShift
+	return &writer{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, size),
+		out:  make([]byte, 0, size+overhead),
+	}, wraps, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("crypt: write after close")
+	}
+	n := 0
+	for len(p) > 0 {
+		// 缓冲区满且还有数据时, 这一块不是最后一块
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *writer) flush(last bool) error {
+	w.out = w.aead.Seal(w.out[:0], chunkNonce(w.counter, last), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(w.out)
+	return err
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+type reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	carry   int
+	out     []byte
+	plain   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+// NewReader returns a reader that decrypts r with the first identity that
+// can open its header. Read returns ErrAuth when the content was modified
+// or truncated.
+func NewReader(r io.Reader, identities ...Identity) (io.Reader, error) {
+	return NewReaderWith(r, nil, identities...)
+}
+
+// NewReaderWith is NewReader trying the wraps recorded outside of the
+// file first, e.g. after the keys were rotated.
+func NewReaderWith(r io.Reader, wraps Wraps, identities ...Identity) (io.Reader, error) {
+	header, err := ReadWraps(r)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := Unwrap(append(append(Wraps(nil), wraps...), header...), identities...)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	// 多读一个字节, 判断当前块是否是最后一块
+	return &reader{
+		r:    r,
+		aead: aead,
+		buf:  make([]byte, (1<<chunkShift)+overhead+1),
+		out:  make([]byte, 0, 1<<chunkShift),
+	}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *reader) next() error {
+	n, err := io.ReadFull(r.r, r.buf[r.carry:])
+	n += r.carry
+	last := false
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	default:
+		return err
+	}
+	chunk := r.buf[:n]
+	if !last {
+		chunk = r.buf[:n-1]
+	}
+	plain, err := r.aead.Open(r.out[:0], chunkNonce(r.counter, last), chunk, nil)
+	if err != nil {
+		return ErrAuth
+	}
+	if last && len(plain) == 0 && r.counter > 0 {
+		// 只有空文件的最后一块为空
+		return ErrAuth
+	}
+	r.counter++
+	r.plain = plain
+	r.done = last
+	if !last {
+		r.buf[0] = r.buf[n-1]
+		r.carry = 1
+	}
+	return nil
+}
+
+// IsEncrypted reports whether the content read from r starts like an
+// encrypted file.
+func IsEncrypted(r io.Reader) (bool, error) {
+	_, err := readMagic(r)
+	if errors.Is(err, ErrNotEncrypted) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func readMagic(r io.Reader) (string, error) {
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, head); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", ErrNotEncrypted
+		}
+		return "", err
+	}
+	if m := string(head); m == magic || m == magic2 {
+		return m, nil
+	}
+	return "", ErrNotEncrypted
+}
+
+// Size returns the size of the encrypted content of plainSize bytes
+// written for recipients.
+func Size(plainSize int64, recipients ...Recipient) int64 {
+	chunk := int64(1) << chunkShift
+	chunks := plainSize / chunk
+	if plainSize%chunk != 0 || plainSize == 0 {
+		chunks++
+	}
+	header := int64(len(magic2) + 1 + 1)
+	for _, r := range recipients {
+		header += 3 + int64(r.stanzaSize())
+	}
+	return header + plainSize + chunks*overhead
+}
+
+// ReadWraps reads the header of the encrypted content r and returns the
+// file key wrapped for the recipients it was written for, r is left at
+// the start of the content.
+func ReadWraps(r io.Reader) (Wraps, error) {
+	m, err := readMagic(r)
+	if err != nil {
+		return nil, err
+	}
+	if m == magic {
+		header, err := readLegacyHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		return Wraps{{Type: stanzaLegacy, Data: header}}, nil
+	}
+	shift := make([]byte, 1)
+	if _, err := io.ReadFull(r, shift); err != nil {
+		return nil, fmt.Errorf("crypt: header: %w", err)
+	}
+	if shift[0] != chunkShift {
+		return nil, fmt.Errorf("crypt: unsupported chunk size 2^%d", shift[0])
+	}
+	return decodeWraps(r)
+}
+
+// readLegacyHeader 读取第一版的文件头, magic 已经读取
+func readLegacyHeader(r io.Reader) ([]byte, error) {
+	kdf := make([]byte, 1)
+	if _, err := io.ReadFull(r, kdf); err != nil {
+		return nil, fmt.Errorf("crypt: header: %w", err)
+	}
+	header := append([]byte(magic), kdf...)
+	var rest int
+	switch kdf[0] {
+	case kdfKeyFile:
+		rest = 1 + nonceSize + wrappedLen
+	case kdfScrypt:
+		rest = 1 + saltSize + 1 + nonceSize + wrappedLen
+	default:
+		return nil, fmt.Errorf("crypt: unknown key derivation %d", kdf[0])
+	}
+	buf := make([]byte, rest)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("crypt: header: %w", err)
+	}
+	header = append(header, buf...)
+	if shift := header[len(header)-nonceSize-wrappedLen-1]; shift != chunkShift {
+		return nil, fmt.Errorf("crypt: unsupported chunk size 2^%d", shift)
+	}
+	return header, nil
+}
@@ -0,0 +1,191 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Stanza 的类型
+const (
+	stanzaKeyFile byte = 0
+	stanzaScrypt  byte = 1
+	stanzaX25519  byte = 2
+	// stanzaLegacy 是第一版格式的文件头, 只读取不写入
+	stanzaLegacy byte = 0xff
+
+	maxStanzas = 64
+)
+
+var (
+	// ErrNoIdentity 没有任何已配置的密钥可以解密
+	ErrNoIdentity = errors.New("crypt: no configured key can decrypt this file")
+	errNoMatch    = errors.New("crypt: stanza is not for this key")
+)
+
+// Stanza is the file key wrapped for one recipient.
+type Stanza struct {
+	Type byte
+	Data []byte
+}
+
+// Recipient is a key files are encrypted to.
+type Recipient interface {
+	// KeyID 标识密钥, 记录在快照清单中, 不包含任何秘密
+	KeyID() string
+	wrap(fileKey []byte) (Stanza, error)
+	stanzaSize() int
+}
+
+// Identity is a key that decrypts files, unwrap returns errNoMatch for a
+// stanza of another key.
+type Identity interface {
+	unwrap(s Stanza) ([]byte, error)
+}
+
+// Wraps holds the file key of an encrypted file wrapped for each of its
+// recipients. It is stored in the file header and in the snapshot index,
+// where Rewrap can replace it without touching the content.
+type Wraps []Stanza
+
+// KeyIDs returns the IDs of the keys that can open w.
+func (w Wraps) KeyIDs() []string {
+	ids := make([]string, 0, len(w))
+	for _, s := range w {
+		ids = append(ids, s.keyID())
+	}
+	return ids
+}
+
+func (s Stanza) keyID() string {
+	switch s.Type {
+	case stanzaKeyFile:
+		if len(s.Data) >= keyIDSize {
+			return fmt.Sprintf("key:%x", s.Data[:keyIDSize])
+		}
+	case stanzaScrypt:
+		return "passphrase"
+	case stanzaX25519:
+		if len(s.Data) >= x25519IDSize {
+			return fmt.Sprintf("x25519:%x", s.Data[:x25519IDSize])
+		}
+	case stanzaLegacy:
+		if len(s.Data) > len(magic) && s.Data[len(magic)] == kdfScrypt {
+			return "passphrase"
+		}
+		return "key"
+	}
+	return "unknown"
+}
+
+// encode 格式: 数量 1 字节, 每个 stanza 为类型 1 字节、长度 2 字节和内容
+func (w Wraps) encode() []byte {
+	buf := []byte{byte(len(w))}
+	for _, s := range w {
+		buf = append(buf, s.Type, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(len(s.Data)))
+		buf = append(buf, s.Data...)
+	}
+	return buf
+}
+
+func decodeWraps(r io.Reader) (Wraps, error) {
+	count := make([]byte, 1)
+	if _, err := io.ReadFull(r, count); err != nil {
+		return nil, fmt.Errorf("crypt: header: %w", err)
+	}
+	if count[0] == 0 || count[0] > maxStanzas {
+		return nil, fmt.Errorf("crypt: header: %d keys", count[0])
+	}
+	w := make(Wraps, 0, count[0])
+	head := make([]byte, 3)
+	for i := 0; i < int(count[0]); i++ {
+		if _, err := io.ReadFull(r, head); err != nil {
+			return nil, fmt.Errorf("crypt: header: %w", err)
+		}
+		data := make([]byte, binary.BigEndian.Uint16(head[1:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("crypt: header: %w", err)
+		}
+		w = append(w, Stanza{Type: head[0], Data: data})
+	}
+	return w, nil
+}
+
+// MarshalText encodes w in base64 for JSON.
+func (w Wraps) MarshalText() ([]byte, error) {
+	return []byte(base64.StdEncoding.EncodeToString(w.encode())), nil
+}
+
+// UnmarshalText decodes what MarshalText returned.
+func (w *Wraps) UnmarshalText(text []byte) error {
+	data, err := base64.StdEncoding.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*w, err = decodeWraps(bytes.NewReader(data))
+	return err
+}
+
+// wrap wraps a new file key for every recipient.
+func wrap(recipients []Recipient) ([]byte, Wraps, error) {
+	if len(recipients) == 0 {
+		return nil, nil, ErrNoKey
+	}
+	if len(recipients) > maxStanzas {
+		return nil, nil, fmt.Errorf("crypt: more than %d recipients", maxStanzas)
+	}
+	fileKey := make([]byte, keySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, nil, err
+	}
+	w, err := Wrap(fileKey, recipients...)
+	return fileKey, w, err
+}
+
+// Wrap wraps fileKey for every recipient.
+func Wrap(fileKey []byte, recipients ...Recipient) (Wraps, error) {
+	w := make(Wraps, 0, len(recipients))
+	for _, r := range recipients {
+		s, err := r.wrap(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		w = append(w, s)
+	}
+	return w, nil
+}
+
+// Unwrap returns the file key of w opened by the first identity that can.
+func Unwrap(w Wraps, identities ...Identity) ([]byte, error) {
+	failed := false
+	for _, s := range w {
+		for _, id := range identities {
+			fileKey, err := id.unwrap(s)
+			if err == nil {
+				return fileKey, nil
+			}
+			if !errors.Is(err, errNoMatch) {
+				failed = true
+			}
+		}
+	}
+	if failed {
+		return nil, ErrAuth
+	}
+	return nil, ErrNoIdentity
+}
+
+// Rewrap opens w with identities and wraps the file key again for
+// recipients, the content encrypted under it stays valid.
+func Rewrap(w Wraps, identities []Identity, recipients []Recipient) (Wraps, error) {
+	fileKey, err := Unwrap(w, identities...)
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(fileKey, recipients...)
+}
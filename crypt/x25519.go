@@ -0,0 +1,216 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// 公钥可以公开, 例如 bktpub1xxxx; 私钥只放在需要恢复的机器上
+	publicPrefix = "bktpub1"
+	secretPrefix = "BKT-SECRET-KEY-1"
+
+	x25519IDSize = 8
+	x25519Size   = 32
+)
+
+var upperBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// X25519Recipient encrypts to a public key, a host that only has the
+// public key can back up but not restore.
+type X25519Recipient struct {
+	pub *ecdh.PublicKey
+}
+
+// X25519Identity is the private key of an X25519Recipient.
+type X25519Identity struct {
+	priv *ecdh.PrivateKey
+}
+
+// GenerateIdentity returns a new random X25519 identity.
+func GenerateIdentity() (*X25519Identity, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Identity{priv: priv}, nil
+}
+
+// ParseRecipient parses a public key like bktpub1....
+func ParseRecipient(s string) (*X25519Recipient, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, publicPrefix) {
+		return nil, fmt.Errorf("crypt: %q is not a public key", s)
+	}
+	b, err := nameEncoding.DecodeString(strings.TrimPrefix(s, publicPrefix))
+	if err != nil || len(b) != x25519Size {
+		return nil, fmt.Errorf("crypt: invalid public key %q", s)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Recipient{pub: pub}, nil
+}
+
+// ParseIdentity parses a private key like BKT-SECRET-KEY-1....
+func ParseIdentity(s string) (*X25519Identity, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, secretPrefix) {
+		return nil, errors.New("crypt: not a private key")
+	}
+	b, err := upperBase32.DecodeString(strings.TrimPrefix(s, secretPrefix))
+	if err != nil || len(b) != x25519Size {
+		return nil, errors.New("crypt: invalid private key")
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Identity{priv: priv}, nil
+}
+
+// ReadIdentityFile reads the private keys of path, one per line, empty
+// lines and lines starting with # are ignored.
+func ReadIdentityFile(path string) ([]*X25519Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ids []*X25519Identity
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := ParseIdentity(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%s: no private key", path)
+	}
+	return ids, nil
+}
+
+// WriteIdentityFile writes a new identity to path, which must not exist,
+// and returns it.
+func WriteIdentityFile(path string) (*X25519Identity, error) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(f, "# public key: %s\n%s\n", id.Recipient(), id)
+	if e := f.Close(); e != nil && err == nil {
+		err = e
+	}
+	return id, err
+}
+
+func (i *X25519Identity) String() string {
+	return secretPrefix + upperBase32.EncodeToString(i.priv.Bytes())
+}
+
+// Recipient returns the public key of i.
+func (i *X25519Identity) Recipient() *X25519Recipient {
+	return &X25519Recipient{pub: i.priv.PublicKey()}
+}
+
+func (r *X25519Recipient) String() string {
+	return publicPrefix + nameEncoding.EncodeToString(r.pub.Bytes())
+}
+
+func (r *X25519Recipient) id() []byte {
+	sum := sha256.Sum256(r.pub.Bytes())
+	return sum[:x25519IDSize]
+}
+
+func (r *X25519Recipient) KeyID() string {
+	return fmt.Sprintf("x25519:%x", r.id())
+}
+
+func (r *X25519Recipient) stanzaSize() int {
+	return x25519IDSize + x25519Size + wrappedLen
+}
+
+// x25519Wrapper 由共享密钥和两个公钥派生, 每个 stanza 的临时密钥不同, nonce 可以固定为 0
+func x25519Wrapper(shared, ephemeral, pub []byte) ([]byte, error) {
+	salt := append(append([]byte(nil), ephemeral...), pub...)
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("backuptool x25519")), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (r *X25519Recipient) wrap(fileKey []byte) (Stanza, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Stanza{}, err
+	}
+	shared, err := eph.ECDH(r.pub)
+	if err != nil {
+		return Stanza{}, err
+	}
+	key, err := x25519Wrapper(shared, eph.PublicKey().Bytes(), r.pub.Bytes())
+	if err != nil {
+		return Stanza{}, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return Stanza{}, err
+	}
+	data := append(r.id(), eph.PublicKey().Bytes()...)
+	data = aead.Seal(data, make([]byte, nonceSize), fileKey, nil)
+	return Stanza{Type: stanzaX25519, Data: data}, nil
+}
+
+func (i *X25519Identity) unwrap(s Stanza) ([]byte, error) {
+	r := i.Recipient()
+	if s.Type != stanzaX25519 || len(s.Data) != r.stanzaSize() || string(s.Data[:x25519IDSize]) != string(r.id()) {
+		return nil, errNoMatch
+	}
+	ephBytes := s.Data[x25519IDSize : x25519IDSize+x25519Size]
+	eph, err := ecdh.X25519().NewPublicKey(ephBytes)
+	if err != nil {
+		return nil, ErrAuth
+	}
+	shared, err := i.priv.ECDH(eph)
+	if err != nil {
+		return nil, ErrAuth
+	}
+	key, err := x25519Wrapper(shared, ephBytes, r.pub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aead.Open(nil, make([]byte, nonceSize), s.Data[x25519IDSize+x25519Size:], nil)
+	if err != nil {
+		return nil, ErrAuth
+	}
+	return fileKey, nil
+}
@@ -0,0 +1,97 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecipients(t *testing.T) {
+	alice, _ := GenerateIdentity()
+	bob, _ := GenerateIdentity()
+	key := testKey(t)
+
+	// 备份机只有公钥
+	pub, err := ParseRecipient(alice.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, pub, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("ledger"))
+	w.Close()
+	sealed := buf.Bytes()
+	if int64(len(sealed)) != Size(6, pub, key) {
+		t.Fatalf("size: %d != %d", len(sealed), Size(6, pub, key))
+	}
+
+	for name, id := range map[string]Identity{"identity": alice, "key": key} {
+		r, err := NewReader(bytes.NewReader(sealed), id)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, err := io.ReadAll(r); err != nil || string(got) != "ledger" {
+			t.Fatalf("%s: %q %v", name, got, err)
+		}
+	}
+	if _, err := NewReader(bytes.NewReader(sealed), bob); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("other identity: %v", err)
+	}
+
+	wraps, err := ReadWraps(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := wraps.KeyIDs(); len(ids) != 2 || ids[0] != pub.KeyID() || ids[1] != key.KeyID() {
+		t.Fatalf("key ids: %v", ids)
+	}
+	// 轮换给 bob, 不需要重新加密内容
+	rotated, err := Rewrap(wraps, []Identity{alice}, []Recipient{bob.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(rotated)
+	var decoded Wraps
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReaderWith(bytes.NewReader(sealed), decoded, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "ledger" {
+		t.Fatalf("rotated: %q", got)
+	}
+	decoded[0].Data[len(decoded[0].Data)-1] ^= 1
+	if _, err := NewReaderWith(bytes.NewReader(sealed), decoded, bob); !errors.Is(err, ErrAuth) {
+		t.Fatalf("tampered wraps: %v", err)
+	}
+}
+
+func TestIdentityFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.identity")
+	id, err := WriteIdentityFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteIdentityFile(path); err == nil {
+		t.Fatal("existing identity file overwritten")
+	}
+	ids, err := ReadIdentityFile(path)
+	if err != nil || len(ids) != 1 || ids[0].String() != id.String() {
+		t.Fatalf("read: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Fatalf("mode: %v", info.Mode())
+	}
+	if _, err := ParseRecipient(id.String()); err == nil {
+		t.Fatal("private key parsed as a public key")
+	}
+}
@@ -13,11 +13,12 @@ var (
 )
 
 func LoadRedis() {
-	Addr := fmt.Sprintf("%s:%s", config.BackUpConfig.Redis.Host, config.BackUpConfig.Redis.Port)
+	c := config.Get().Redis
+	Addr := fmt.Sprintf("%s:%s", c.Host, c.Port)
 	Client = redis.NewClient(&redis.Options{
-		Addr:     Addr,                               // Redis 服务器地址
-		Password: config.BackUpConfig.Redis.Password, // Redis 服务器密码（如果有的话）
-		DB:       config.BackUpConfig.Redis.Db,       // 使用的 Redis 数据库索引
+		Addr:     Addr,       // Redis 服务器地址
+		Password: c.Password, // Redis 服务器密码（如果有的话）
+		DB:       c.Db,       // 使用的 Redis 数据库索引
 	})
 	_, err := Client.Ping(Client.Context()).Result()
 
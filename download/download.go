@@ -1,18 +1,28 @@
 package download
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 
 	"github.com/cheggaaa/pb/v3"
 	"github.com/sirupsen/logrus"
-	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/auth"
+	"github.com/wangxso/backuptool/codec"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/handler"
+	"github.com/wangxso/backuptool/metrics"
 	openapiclient "github.com/wangxso/backuptool/openxpanapi"
+	"github.com/wangxso/backuptool/parity"
+	"github.com/wangxso/backuptool/progress"
+	"github.com/wangxso/backuptool/utils"
 )
 
 type FileReturn struct {
@@ -94,55 +104,48 @@ func (pw *ProgressWriter) DisplayProgress() {
 // GetFileList
 // dir: /来自：back设备
 // limit: int; desc int; order string(time); start string("0");forlder string("0");
-func GetFileList(accessToken, dir, order, start, folder string, limit, desc int32) FileListReturn {
+func GetFileList(ctx context.Context, accessToken, dir, order, start, folder string, limit, desc int32) (FileListReturn, error) {
 	web := "" // string |  (optional)
+	var response FileListReturn
 
-	configuration := openapiclient.NewConfiguration()
+	configuration := utils.APIConfiguration()
 	api_client := openapiclient.NewAPIClient(configuration)
-	_, r, err := api_client.FileinfoApi.Xpanfilelist(context.Background()).AccessToken(accessToken).Folder(folder).Web(web).Start(start).Limit(limit).Dir(dir).Order(order).Desc(desc).Execute()
+	ctx, cancel := context.WithTimeout(ctx, config.RequestTimeout())
+	defer cancel()
+	_, r, err := api_client.FileinfoApi.Xpanfilelist(ctx).AccessToken(accessToken).Folder(folder).Web(web).Start(start).Limit(limit).Dir(dir).Order(order).Desc(desc).Execute()
+	bodyBytes, err := utils.ReadResponseBody(r, err)
 	if err != nil {
 		logrus.Error("Error when calling `FileinfoApi.Xpanfilelist``: ", err)
-		logrus.Error("Full HTTP response: ", r)
+		return response, err
 	}
-	// logrus.Info("Response from `FileinfoApi.Xpanfilelist`: ", resp)
-
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		logrus.Error("err: ", r)
+	if err = utils.DecodeJSON("xpanfilelist", bodyBytes, &response); err != nil {
+		return response, err
 	}
-	var response FileListReturn
-	err = json.Unmarshal(bodyBytes, &response)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return response
+	metrics.ObserveErrno("list", response.ErrorNo)
+	return response, handler.FromErrno(response.ErrorNo, "")
 }
 
-func GetMultiFileList(accessToken, path string, recursion int, order string, desc int, start int, limit int) FileMultiListReturn {
+func GetMultiFileList(ctx context.Context, accessToken, path string, recursion int, order string, desc int, start int, limit int) (FileMultiListReturn, error) {
+	var response FileMultiListReturn
 
-	configuration := openapiclient.NewConfiguration()
-	configuration.Debug = true
+	configuration := utils.APIConfiguration()
 	api_client := openapiclient.NewAPIClient(configuration)
-	_, r, err := api_client.MultimediafileApi.Xpanfilelistall(context.Background()).AccessToken(accessToken).Path(path).Recursion(int32(recursion)).Start(int32(start)).Limit(int32(limit)).Order(order).Desc(int32(desc)).Execute()
+	ctx, cancel := context.WithTimeout(ctx, config.RequestTimeout())
+	defer cancel()
+	_, r, err := api_client.MultimediafileApi.Xpanfilelistall(ctx).AccessToken(accessToken).Path(path).Recursion(int32(recursion)).Start(int32(start)).Limit(int32(limit)).Order(order).Desc(int32(desc)).Execute()
+	bodyBytes, err := utils.ReadResponseBody(r, err)
 	if err != nil {
 		logrus.Error("Error when calling `MultimediafileApi.Xpanfilelistall``: ", err)
-		logrus.Error("Full HTTP response: ", r)
+		return response, err
 	}
-	// logrus.Info("Response from `MultimediafileApi.Xpanfilelistall`: ", resp)
-
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		logrus.Error("err: ", r)
+	if err = utils.DecodeJSON("xpanfilelistall", bodyBytes, &response); err != nil {
+		return response, err
 	}
-	var response FileMultiListReturn
-	err = json.Unmarshal(bodyBytes, &response)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return response
+	metrics.ObserveErrno("listall", response.Errno)
+	return response, handler.FromErrno(response.Errno, response.Errmsg)
 }
 
-func GetDlink(accessToken string, fsids []uint64) ([]map[string]string, error) {
+func GetDlink(ctx context.Context, fsids []uint64) ([]map[string]string, error) {
 
 	// 如果是查询共享目录或专属空间内文件时需要path，可结合官网文档
 	path := ""
@@ -150,7 +153,12 @@ func GetDlink(accessToken string, fsids []uint64) ([]map[string]string, error) {
 
 	// call Api
 	arg := NewFileMetasArg(fsids, path)
-	ret, err := FileMetas(accessToken, arg)
+	var ret FileMetasReturn
+	err := handler.Retry(ctx, "filemetas", func() error {
+		var err error
+		ret, err = FileMetas(ctx, auth.AccessToken(), arg)
+		return err
+	})
 	if err != nil {
 		logrus.Error("[msg: filemetas error] err:", err.Error())
 		return nil, err
@@ -168,19 +176,350 @@ func GetDlink(accessToken string, fsids []uint64) ([]map[string]string, error) {
 	return dlinks, nil
 }
 
-func Download(fid uint64, targetPath string) error {
-	redisCli := db.Client
-	accessToken, _ := redisCli.Get(redisCli.Context(), "AccessCode").Result()
+// Encoding is how a file was transformed before upload, as recorded in
+// the backup metadata. Downloads are decoded by it and never by sniffing
+// the content, so a plain file that starts like a header stays intact.
+type Encoding struct {
+	// Encrypted 为 true 时云端保存的是密文, Wraps 在文件头之前尝试
+	Encrypted bool
+	Wraps     crypt.Wraps
+	// Codec 是上传前使用的压缩算法, 为空时没有压缩
+	Codec string
+}
+
+// Download downloads fid, uploaded with enc, into the targetPath folder.
+// The download is aborted when ctx is done or no data arrives for
+// General.stallTimeout, network errors and 5xx responses are retried.
+func Download(ctx context.Context, fid uint64, targetPath string, enc Encoding) error {
+	dlink, err := dlinkOf(ctx, fid)
+	if err != nil {
+		return err
+	}
+	// 加密的文件名解密后保存
+	return fetch(ctx, dlink["dlink"], filepath.Join(targetPath, filepath.Base(crypt.DisplayName(dlink["filename"]))), "", enc)
+}
+
+// DownloadTo downloads the plain file fid into the file localPath, like
+// Download.
+func DownloadTo(ctx context.Context, fid uint64, localPath string) error {
+	return DownloadObject(ctx, fid, localPath, Encoding{})
+}
+
+// DownloadObject downloads fid, uploaded with enc, into the file
+// localPath.
+func DownloadObject(ctx context.Context, fid uint64, localPath string, enc Encoding) error {
+	dlink, err := dlinkOf(ctx, fid)
+	if err != nil {
+		return err
+	}
+	return fetch(ctx, dlink["dlink"], localPath, "", enc)
+}
+
+// DownloadRange downloads length bytes at offset of fid to localPath and
+// decrypts and decompresses them like DownloadObject, e.g. one file of a
+// bundle.
+func DownloadRange(ctx context.Context, fid uint64, offset, length int64, localPath string, enc Encoding) error {
+	if offset < 0 || length <= 0 {
+		return fmt.Errorf("invalid range %d+%d", offset, length)
+	}
+	dlink, err := dlinkOf(ctx, fid)
+	if err != nil {
+		return err
+	}
+	return fetch(ctx, dlink["dlink"], localPath, fmt.Sprintf("bytes=%d-%d", offset, offset+length-1), enc)
+}
+
+// ReadHead returns the first n bytes of fid, e.g. the header of an
+// encrypted file, without downloading the rest.
+func ReadHead(ctx context.Context, fid uint64, n int) ([]byte, error) {
+	dlink, err := dlinkOf(ctx, fid)
+	if err != nil {
+		return nil, err
+	}
+	var head []byte
+	err = handler.Retry(ctx, "download", func() error {
+		uri := fmt.Sprintf("%s&access_token=%s", dlink["dlink"], auth.AccessToken())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+		resp, err := utils.HTTPClient().Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		// 不支持 Range 时返回 200, 只读取前 n 个字节
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			return handler.StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		head, err = io.ReadAll(io.LimitReader(resp.Body, int64(n)))
+		return err
+	})
+	return head, err
+}
 
-	dlink, err := GetDlink(accessToken, []uint64{fid})
+func dlinkOf(ctx context.Context, fid uint64) (map[string]string, error) {
+	dlink, err := GetDlink(ctx, []uint64{fid})
 	if err != nil {
 		logrus.Error(err)
+		return nil, err
+	}
+	if len(dlink) == 0 {
+		return nil, fmt.Errorf("no dlink for fs_id %d: %w", fid, handler.ErrFileNotExist)
+	}
+	return dlink[0], nil
+}
+
+// fetch downloads dlink, or only the bytes of rng when it is not empty.
+func fetch(ctx context.Context, dlink, localPath, rng string, enc Encoding) error {
+	if err := fetchRaw(ctx, dlink, localPath, rng); err != nil {
 		return err
 	}
-	uri := fmt.Sprintf("%s&access_token=%s", dlink[0]["dlink"], accessToken)
-	filename := dlink[0]["filename"]
+	return decode(localPath, enc)
+}
+
+func fetchRaw(ctx context.Context, dlink, localPath, rng string) error {
+	return handler.Retry(ctx, "download", func() error {
+		// 每次重试读取 token, 刷新后使用新的 token
+		uri := fmt.Sprintf("%s&access_token=%s", dlink, auth.AccessToken())
+		return downloadFile(ctx, uri, localPath, rng)
+	})
+}
+
+// decode decrypts and decompresses the downloaded file localPath as enc
+// says.
+func decode(localPath string, enc Encoding) error {
+	if enc.Encrypted {
+		if err := decrypt(localPath, enc.Wraps); err != nil {
+			return err
+		}
+	}
+	// 先解密再解压, 上传时先压缩再加密
+	if err := codec.DecompressInPlace(localPath, enc.Codec); err != nil {
+		return fmt.Errorf("decompress %s: %w", localPath, err)
+	}
+	return nil
+}
+
+// DownloadRepaired downloads the whole object fid and its parity object
+// parityFid, repairs the damaged blocks of the object and then decrypts
+// and decompresses it like DownloadObject, or only the length bytes at
+// offset like DownloadRange when length is not 0, e.g. one file of a
+// bundle. The parity is only downloaded when needed, e.g. after the
+// content failed its hash check.
+func DownloadRepaired(ctx context.Context, fid, parityFid uint64, offset, length int64, localPath string, enc Encoding) error {
+	dir := filepath.Dir(localPath)
+	raw := localPath
+	if length != 0 {
+		f, err := os.CreateTemp(dir, ".repair-*")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		raw = f.Name()
+		defer os.Remove(raw)
+	}
+	par, err := os.CreateTemp(dir, ".parity-*")
+	if err != nil {
+		return err
+	}
+	par.Close()
+	defer os.Remove(par.Name())
+	for _, obj := range []struct {
+		fid  uint64
+		path string
+	}{{fid, raw}, {parityFid, par.Name()}} {
+		dlink, err := dlinkOf(ctx, obj.fid)
+		if err != nil {
+			return err
+		}
+		if err := fetchRaw(ctx, dlink["dlink"], obj.path, ""); err != nil {
+			return err
+		}
+	}
+	n, err := parity.Repair(raw, par.Name())
+	if err != nil {
+		return fmt.Errorf("repair fs_id %d: %w", fid, err)
+	}
+	if n > 0 {
+		logrus.Warnf("[Download] repaired %d damaged blocks of fs_id %d", n, fid)
+	}
+	if length != 0 {
+		if err := copyRange(raw, localPath, offset, length); err != nil {
+			return err
+		}
+	}
+	return decode(localPath, enc)
+}
+
+// Range is Length bytes at Offset of a cloud file, e.g. one file of a
+// bundle. Length may be 0.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// Open starts downloading fid, or only rng when it is not nil, and returns
+// the content as it is stored in the cloud, without writing it to disk.
+// Only starting the download is retried. The caller closes it.
+func Open(ctx context.Context, fid uint64, rng *Range) (io.ReadCloser, error) {
+	if rng != nil && (rng.Offset < 0 || rng.Length < 0) {
+		return nil, fmt.Errorf("invalid range %d+%d", rng.Offset, rng.Length)
+	}
+	if rng != nil && rng.Length == 0 {
+		// HTTP 的 Range 不能表示 0 字节
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	dlink, err := dlinkOf(ctx, fid)
+	if err != nil {
+		return nil, err
+	}
+	ctx, watch := utils.WithStallTimeout(ctx, config.StallTimeout())
+	var resp *http.Response
+	err = handler.Retry(ctx, "download", func() error {
+		uri := fmt.Sprintf("%s&access_token=%s", dlink["dlink"], auth.AccessToken())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return err
+		}
+		want := http.StatusOK
+		if rng != nil {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rng.Offset, rng.Offset+rng.Length-1))
+			want = http.StatusPartialContent
+		}
+		if resp, err = utils.HTTPClient().Do(req); err != nil {
+			return err
+		}
+		if resp.StatusCode != want {
+			resp.Body.Close()
+			return fmt.Errorf("download fs_id %d: %w", fid, handler.StatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+		}
+		return nil
+	})
+	if err != nil {
+		watch.Stop()
+		return nil, err
+	}
+	return &stream{r: watch.Reader(resp.Body), body: resp.Body, ctx: ctx, watch: watch}, nil
+}
+
+type stream struct {
+	r     io.Reader
+	body  io.Closer
+	ctx   context.Context
+	watch *utils.StallWatch
+}
+
+// Read reports a stalled or cancelled download as the context error.
+func (s *stream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF && s.ctx.Err() != nil {
+		err = fmt.Errorf("download: %w", s.ctx.Err())
+	}
+	return n, err
+}
+
+func (s *stream) Close() error {
+	s.watch.Stop()
+	return s.body.Close()
+}
+
+// sniffSize 猜测旧文件是否压缩时读取的字节数, 不小于压缩文件头
+const sniffSize = 16
+
+// Sniff guesses whether a file is encrypted from its first bytes. It is
+// only for files uploaded before their encoding was recorded, Decode with
+// the result still guesses the codec after decrypting.
+func Sniff(head []byte) Encoding {
+	ok, _ := crypt.IsEncrypted(bytes.NewReader(head))
+	return Encoding{Encrypted: ok, Codec: sniffCodec}
+}
+
+// sniffCodec 表示压缩算法未知, 由解密后的文件头判断
+const sniffCodec = "?"
+
+// Decode returns the content of r, as stored in the cloud with enc,
+// decrypted with the configured identities and decompressed, like a
+// download. Unlike a download, encrypted content without a key that can
+// open it is an error. Closing the result does not close r.
+func Decode(r io.Reader, enc Encoding) (io.ReadCloser, error) {
+	plain := r
+	if enc.Encrypted {
+		ring, err := crypt.LoadKeyring()
+		if err != nil {
+			return nil, err
+		}
+		if plain, err = crypt.NewReaderWith(r, enc.Wraps, ring.Identities...); err != nil {
+			return nil, err
+		}
+	}
+	if enc.Codec == sniffCodec {
+		pr := bufio.NewReader(plain)
+		head, _ := pr.Peek(sniffSize)
+		if ok, _ := codec.IsCompressed(bytes.NewReader(head)); !ok {
+			return io.NopCloser(pr), nil
+		}
+		zr, _, err := codec.NewReader(pr)
+		return zr, err
+	}
+	return codec.Open(plain, enc.Codec)
+}
+
+// copyRange writes length bytes at offset of the file src to dst.
+func copyRange(src, dst string, offset, length int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, io.NewSectionReader(in, offset, length))
+	if err == nil && n != length {
+		err = fmt.Errorf("range %d+%d of %s: %w", offset, length, src, io.ErrUnexpectedEOF)
+	}
+	if e := out.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// decrypt replaces the encrypted file localPath by its content, trying
+// wraps before its header. Without a configured key that can decrypt, e.g.
+// on a host that only has public keys, the ciphertext is kept.
+func decrypt(localPath string, wraps crypt.Wraps) error {
+	ring, err := crypt.LoadKeyring()
+	if errors.Is(err, crypt.ErrNoKey) || err == nil && len(ring.Identities) == 0 {
+		logrus.Warnf("%s is encrypted but no key is configured, keep the ciphertext", localPath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := crypt.DecryptInPlace(localPath, wraps, ring.Identities...); err != nil {
+		return fmt.Errorf("decrypt %s: %w", localPath, err)
+	}
+	return nil
+}
+
+func downloadFile(ctx context.Context, uri, filename, rng string) error {
+	ctx, watch := utils.WithStallTimeout(ctx, config.StallTimeout())
+	defer watch.Stop()
 	// 发起HTTP GET请求
-	resp, err := http.Get(uri)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	want := http.StatusOK
+	if rng != "" {
+		// 只下载一部分时服务端必须返回 206, 返回 200 说明不支持 Range
+		req.Header.Set("Range", rng)
+		want = http.StatusPartialContent
+	}
+	resp, err := utils.HTTPClient().Do(req)
 	if err != nil {
 		logrus.Error("无法下载文件:", err)
 		return err
@@ -188,13 +527,12 @@ func Download(fid uint64, targetPath string) error {
 	defer resp.Body.Close()
 
 	// 检查HTTP响应状态码
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != want {
 		logrus.Error("下载请求失败:", resp.Status)
-		return err
+		return fmt.Errorf("download %s: %w", filename, handler.StatusError{StatusCode: resp.StatusCode, Status: resp.Status})
 	}
 
 	// 创建保存文件的本地文件
-	filename = fmt.Sprintf("%s/%s", targetPath, filename)
 	out, err := os.Create(filename) // 替换为您要保存的本地文件路径
 	if err != nil {
 		logrus.Error("无法创建文件:", err)
@@ -207,20 +545,29 @@ func Download(fid uint64, targetPath string) error {
 	progressBar := pb.Full.Start64(fileSize)
 	progressBar.Set(pb.Bytes, true)
 
+	tr := progress.Start(progress.KindDownload, filename, fileSize)
+
 	// 创建一个多写器，用于同时将数据写入文件和进度条
-	writer := io.MultiWriter(out, progressBar.NewProxyWriter(io.Discard))
+	writer := io.MultiWriter(out, progressBar.NewProxyWriter(io.Discard), tr)
 
 	// 创建一个限速读取器，用于限制下载速度（可选）
 	limitReader := &io.LimitedReader{
-		R: resp.Body,
+		R: watch.Reader(resp.Body),
 		N: fileSize,
 	}
 
 	// 将HTTP响应体复制到本地文件，并显示下载进度
-	_, err = io.Copy(writer, limitReader)
+	written, err := io.Copy(writer, limitReader)
+	if err == nil && fileSize > 0 && written < fileSize {
+		err = fmt.Errorf("download %s: got %d of %d bytes: %w", filename, written, fileSize, io.ErrUnexpectedEOF)
+	}
+	tr.Finish(err)
 	if err != nil {
 		logrus.Error(err)
+		progressBar.Finish()
+		return err
 	}
+	metrics.FileDone(metrics.OpDownload, written)
 	// 完成进度条
 	progressBar.Finish()
 	return nil
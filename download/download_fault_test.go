@@ -0,0 +1,46 @@
+package download_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wangxso/backuptool/download"
+	"github.com/wangxso/backuptool/fakepan"
+	"github.com/wangxso/backuptool/faultinject"
+)
+
+func TestDownloadConvergesUnderFaults(t *testing.T) {
+	pan := fakepan.Setup(t)
+	t.Cleanup(faultinject.FastRetry())
+
+	data := bytes.Repeat([]byte("backuptool"), 100000)
+	f := pan.Put("/apps/backup/docs/report.txt", data)
+	tr, restore, err := faultinject.Install(1,
+		&faultinject.Rule{API: "download", Kind: faultinject.Truncate, Times: 2},
+		&faultinject.Rule{API: "download", Kind: faultinject.ServerError, Times: 1},
+		&faultinject.Rule{API: "filemetas", Kind: faultinject.Reset, Times: 1},
+		&faultinject.Rule{API: "filemetas", Kind: faultinject.Errno, Errno: 31034, Times: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(restore)
+
+	dir := t.TempDir()
+	if err := download.Download(context.Background(), uint64(f.FsID), dir, download.Encoding{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "report.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded content differs")
+	}
+	if tr.Injected(faultinject.Truncate) != 2 || tr.Injected(faultinject.ServerError) != 1 {
+		t.Fatalf("injected %d truncations and %d server errors", tr.Injected(faultinject.Truncate), tr.Injected(faultinject.ServerError))
+	}
+}
@@ -0,0 +1,76 @@
+package download_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wangxso/backuptool/auth"
+	"github.com/wangxso/backuptool/download"
+	"github.com/wangxso/backuptool/fakepan"
+)
+
+func TestDownload(t *testing.T) {
+	pan := fakepan.Setup(t)
+	data := bytes.Repeat([]byte("backuptool"), 100000)
+	f := pan.Put("/apps/backup/docs/report.txt", data)
+
+	dir := t.TempDir()
+	if err := download.Download(context.Background(), uint64(f.FsID), dir, download.Encoding{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "report.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded content differs")
+	}
+}
+
+func TestDownloadUnknownFile(t *testing.T) {
+	fakepan.Setup(t)
+	if err := download.Download(context.Background(), 42, t.TempDir(), download.Encoding{}); err == nil {
+		t.Fatal("download of an unknown fs_id succeeded")
+	}
+}
+
+func TestFileLists(t *testing.T) {
+	pan := fakepan.Setup(t)
+	pan.Put("/apps/backup/a.txt", []byte("a"))
+	pan.Put("/apps/backup/sub/b.txt", []byte("b"))
+	ctx := context.Background()
+
+	list, err := download.GetFileList(ctx, auth.AccessToken(), "/apps/backup", "name", "0", "0", 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.List) != 2 {
+		t.Fatalf("list: got %d entries, want 2", len(list.List))
+	}
+
+	// 请求不能打印到日志, 其中包含 access_token
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	all, err := download.GetMultiFileList(ctx, auth.AccessToken(), "/apps/backup", 1, "time", 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(logged.Bytes(), []byte(auth.AccessToken())) {
+		t.Fatal("access token logged")
+	}
+	if len(all.List) != 1 || all.HasMore != 1 {
+		t.Fatalf("listall page: got %d entries, has_more %d", len(all.List), all.HasMore)
+	}
+	all, err = download.GetMultiFileList(ctx, auth.AccessToken(), "/apps/backup", 1, "time", 0, all.Cursor, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.List) != 2 || all.HasMore != 0 {
+		t.Fatalf("listall rest: got %d entries, has_more %d", len(all.List), all.HasMore)
+	}
+}
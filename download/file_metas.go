@@ -1,21 +1,23 @@
 package download
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/url"
 
 	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/handler"
+	"github.com/wangxso/backuptool/metrics"
 	utils "github.com/wangxso/backuptool/utils"
 )
 
-func FileMetas(accessToken string, arg *FileMetasArg) (FileMetasReturn, error) {
+func FileMetas(ctx context.Context, accessToken string, arg *FileMetasArg) (FileMetasReturn, error) {
 	var ret FileMetasReturn
-	protocal := "https"
-	host := "pan.baidu.com"
 	router := "/rest/2.0/xpan/multimedia?method=filemetas&"
-	uri := protocal + "://" + host + router
+	uri := config.PanURL() + router
 
 	params := url.Values{}
 	params.Set("access_token", accessToken)
@@ -32,12 +34,13 @@ func FileMetas(accessToken string, arg *FileMetasArg) (FileMetasReturn, error) {
 	uri += params.Encode()
 
 	headers := map[string]string{
-		"Host":         host,
 		"Content-Type": "application/x-www-form-urlencoded",
 	}
 
 	var postBody io.Reader
-	body, _, err := utils.DoHTTPRequest(uri, postBody, headers)
+	ctx, cancel := context.WithTimeout(ctx, config.RequestTimeout())
+	defer cancel()
+	body, _, err := utils.DoHTTPRequest(ctx, uri, postBody, headers)
 	if err != nil {
 		return ret, err
 	}
@@ -45,8 +48,9 @@ func FileMetas(accessToken string, arg *FileMetasArg) (FileMetasReturn, error) {
 		logrus.Error("[msg: unmarshal filemetas body failed] err:", err.Error())
 		return ret, errors.New("unmarshal filemetas body failed,body")
 	}
+	metrics.ObserveErrno("filemetas", ret.Errno)
 	if ret.Errno != 0 {
-		return ret, errors.New("call filemetas failed")
+		return ret, handler.FromErrno(ret.Errno, ret.Errmsg)
 	}
 	return ret, nil
 }
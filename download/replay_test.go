@@ -0,0 +1,60 @@
+package download_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wangxso/backuptool/auth"
+	"github.com/wangxso/backuptool/cassette/cassettetest"
+	"github.com/wangxso/backuptool/download"
+)
+
+// TestReplayDownload parses responses in the shape Baidu returns them, see
+// testdata/download.json.
+func TestReplayDownload(t *testing.T) {
+	cassettetest.Replay(t, "testdata/download.json")
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	if err := download.Download(ctx, 657059106724647, dir, download.Encoding{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "replay.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("backuptool replay\n")) {
+		t.Fatalf("downloaded %q", got)
+	}
+
+	all, err := download.GetMultiFileList(ctx, auth.AccessToken(), "/apps/backuptool", 1, "time", 0, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.List) != 2 || all.HasMore != 1 || all.Cursor != 2 {
+		t.Fatalf("listall: %d entries, has_more %d, cursor %d", len(all.List), all.HasMore, all.Cursor)
+	}
+	if f := all.List[0]; f.FsID != 657059106724647 || f.MD5 != "7e5a4b1c0d8e6f1c2b3a4d5e6f708192" || f.Size != 18 || f.ServerFilename != "replay.txt" {
+		t.Fatalf("listall entry: %+v", f)
+	}
+	if all.List[1].Thumbs["url1"] == "" {
+		t.Fatal("listall thumbs not parsed")
+	}
+
+	list, err := download.GetFileList(ctx, auth.AccessToken(), "/apps/backuptool", "name", "0", "0", 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.List) != 2 || list.RequestId == 0 {
+		t.Fatalf("list: %d entries, request_id %d", len(list.List), list.RequestId)
+	}
+	if d := list.List[0]; d.Isdir != 1 || d.Path != "/apps/backuptool/photos" {
+		t.Fatalf("list dir entry: %+v", d)
+	}
+	if f := list.List[1]; f.FsId != 657059106724647 || f.MD5 != "7e5a4b1c0d8e6f1c2b3a4d5e6f708192" || f.Size != 18 {
+		t.Fatalf("list file entry: %+v", f)
+	}
+}
@@ -0,0 +1,947 @@
+// Package fakepan is an in-memory stand-in of the Baidu Pan open API for
+// tests. It serves the oauth, upload, list, filemetas, download,
+// filemanager, quota and uinfo endpoints used by the tool.
+package fakepan
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_ACCESS_TOKEN  = "fake-access-token"
+	DEFAULT_REFRESH_TOKEN = "fake-refresh-token"
+	DEFAULT_AUTH_CODE     = "fake-auth-code"
+	DEFAULT_QUOTA         = 2 << 40 // 2TB
+)
+
+// File 是网盘中的一个文件或目录
+type File struct {
+	Path  string
+	FsID  int64
+	IsDir bool
+	Data  []byte
+	MD5   string
+	Ctime int64
+	Mtime int64
+}
+
+func (f *File) name() string {
+	return path.Base(f.Path)
+}
+
+// pendingUpload 是 precreate 之后, create 之前的分片上传
+type pendingUpload struct {
+	path      string
+	size      int64
+	blockList []string
+	parts     map[int][]byte
+}
+
+// Server 是模拟的百度网盘服务, 所有接口共用一个地址
+type Server struct {
+	*httptest.Server
+
+	AppKey    string
+	SecretKey string
+	AuthCode  string
+	Quota     int64
+
+	mu            sync.Mutex
+	accessToken   string
+	refreshToken  string
+	expiredTokens map[string]bool
+	files         map[string]*File
+	uploads       map[string]*pendingUpload
+	nextID        int64
+	calls         map[string]int
+}
+
+// New starts a fake server with an empty disk.
+func New() *Server {
+	s := &Server{
+		AppKey:        "fake-app-key",
+		SecretKey:     "fake-secret-key",
+		AuthCode:      DEFAULT_AUTH_CODE,
+		Quota:         DEFAULT_QUOTA,
+		accessToken:   DEFAULT_ACCESS_TOKEN,
+		refreshToken:  DEFAULT_REFRESH_TOKEN,
+		expiredTokens: make(map[string]bool),
+		files:         make(map[string]*File),
+		uploads:       make(map[string]*pendingUpload),
+		nextID:        1000,
+		calls:         make(map[string]int),
+	}
+	s.files["/"] = &File{Path: "/", IsDir: true}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/2.0/token", s.handleToken)
+	mux.HandleFunc("/oauth/2.0/authorize", s.handleAuthorize)
+	mux.HandleFunc("/rest/2.0/xpan/file", s.handleXpanFile)
+	mux.HandleFunc("/rest/2.0/xpan/multimedia", s.handleMultimedia)
+	mux.HandleFunc("/rest/2.0/xpan/nas", s.handleNas)
+	mux.HandleFunc("/rest/2.0/pcs/superfile2", s.handleSuperfile2)
+	mux.HandleFunc("/rest/2.0/pcs/file", s.handlePcsUpload)
+	mux.HandleFunc("/api/quota", s.handleQuota)
+	mux.HandleFunc("/file/", s.handleDownload)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AccessToken returns the access token the server currently accepts.
+func (s *Server) AccessToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accessToken
+}
+
+// ExpireToken makes the current access token answer errno 111, the client
+// has to refresh it.
+func (s *Server) ExpireToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiredTokens[s.accessToken] = true
+	s.accessToken = fmt.Sprintf("%s-%d", DEFAULT_ACCESS_TOKEN, s.newID())
+}
+
+// Calls returns how many requests api received, e.g. "precreate",
+// "superfile2", "create", "upload", "listall", "download".
+func (s *Server) Calls(api string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[api]
+}
+
+// Put stores data at p, missing parent directories are created.
+func (s *Server) Put(p string, data []byte) *File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(cleanPath(p), data)
+}
+
+// Mkdir creates the directory p and its parents.
+func (s *Server) Mkdir(p string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mkdir(cleanPath(p))
+}
+
+// Get returns the content of the file at p.
+func (s *Server) Get(p string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[cleanPath(p)]
+	if !ok || f.IsDir {
+		return nil, false
+	}
+	return f.Data, true
+}
+
+// Stat returns a copy of the entry at p.
+func (s *Server) Stat(p string) (File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[cleanPath(p)]
+	if !ok {
+		return File{}, false
+	}
+	return *f, true
+}
+
+// Files returns the paths of every file, sorted.
+func (s *Server) Files() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]string, 0, len(s.files))
+	for p, f := range s.files {
+		if !f.IsDir {
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Remove deletes the file or directory tree at p.
+func (s *Server) Remove(p string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(cleanPath(p))
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) newID() int64 {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *Server) mkdir(p string) *File {
+	if f, ok := s.files[p]; ok {
+		return f
+	}
+	s.mkdir(path.Dir(p))
+	now := time.Now().Unix()
+	f := &File{Path: p, FsID: s.newID(), IsDir: true, Ctime: now, Mtime: now}
+	s.files[p] = f
+	return f
+}
+
+func (s *Server) put(p string, data []byte) *File {
+	s.mkdir(path.Dir(p))
+	now := time.Now().Unix()
+	f := &File{
+		Path:  p,
+		FsID:  s.newID(),
+		Data:  append([]byte(nil), data...),
+		MD5:   md5Hex(data),
+		Ctime: now,
+		Mtime: now,
+	}
+	if old, ok := s.files[p]; ok {
+		f.Ctime = old.Ctime
+	}
+	s.files[p] = f
+	return f
+}
+
+func (s *Server) remove(p string) {
+	for k := range s.files {
+		if k == p || strings.HasPrefix(k, p+"/") {
+			delete(s.files, k)
+		}
+	}
+}
+
+// children returns the entries under dir, recursive or not, sorted by path.
+func (s *Server) children(dir string, recursive bool) []*File {
+	ret := make([]*File, 0)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for p, f := range s.files {
+		if p == dir || !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		if !recursive && strings.Contains(p[len(prefix):], "/") {
+			continue
+		}
+		ret = append(ret, f)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return ret
+}
+
+// resolveConflict returns the path a new file is stored at, following the
+// rtype/ondup rules: overwrite, rename to a new copy, or fail.
+func (s *Server) resolveConflict(p string, md5sum string, mode string) (string, bool) {
+	old, ok := s.files[p]
+	if !ok {
+		return p, true
+	}
+	switch mode {
+	case "overwrite":
+		return p, true
+	case "fail":
+		return "", false
+	case "same":
+		// 内容相同时不产生新文件
+		if !old.IsDir && old.MD5 == md5sum {
+			return p, true
+		}
+	}
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	stamp := time.Now().Format("20060102_150405")
+	for i := 0; ; i++ {
+		candidate := fmt.Sprintf("%s_%s%s", base, stamp, ext)
+		if i > 0 {
+			candidate = fmt.Sprintf("%s_%s_%d%s", base, stamp, i, ext)
+		}
+		if _, exists := s.files[candidate]; !exists {
+			return candidate, true
+		}
+	}
+}
+
+// rtypeMode maps the rtype of precreate/create to a conflict mode.
+func rtypeMode(rtype string) string {
+	switch rtype {
+	case "1":
+		return "rename"
+	case "2":
+		return "same"
+	case "3":
+		return "overwrite"
+	}
+	return "fail"
+}
+
+// ondupMode maps the ondup of the pcs upload api to a conflict mode.
+func ondupMode(ondup string) string {
+	switch ondup {
+	case "overwrite":
+		return "overwrite"
+	case "newcopy":
+		return "rename"
+	}
+	return "fail"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeErrno answers an xpan error. request_id is left out, it is a number
+// in some apis and a string in others.
+func writeErrno(w http.ResponseWriter, errno int, errmsg string) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errno":  errno,
+		"errmsg": errmsg,
+	})
+}
+
+// writePcsError answers like the pcs upload hosts, with error_code and a
+// non 2xx status.
+func writePcsError(w http.ResponseWriter, status int, code int, msg string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error_code": code,
+		"error_msg":  msg,
+		"request_id": time.Now().UnixNano(),
+	})
+}
+
+func (s *Server) count(api string) {
+	s.mu.Lock()
+	s.calls[api]++
+	s.mu.Unlock()
+}
+
+// checkToken returns the errno for the access token of r, 0 when valid.
+func (s *Server) checkToken(r *http.Request) int {
+	token := r.URL.Query().Get("access_token")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token == s.accessToken {
+		return 0
+	}
+	if s.expiredTokens[token] {
+		return 111
+	}
+	return -6
+}
+
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if errno := s.checkToken(r); errno != 0 {
+		writeErrno(w, errno, "access token invalid or no longer valid")
+		return false
+	}
+	return true
+}
+
+func (s *Server) pcsAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	switch s.checkToken(r) {
+	case 0:
+		return true
+	case 111:
+		writePcsError(w, http.StatusUnauthorized, 111, "Access token expired")
+	default:
+		writePcsError(w, http.StatusUnauthorized, 31045, "user not exists")
+	}
+	return false
+}
+
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	s.count("authorize")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><body>authorization code: <code>%s</code></body></html>", s.AuthCode)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	s.count("token")
+	q := r.URL.Query()
+	if q.Get("client_id") != s.AppKey || q.Get("client_secret") != s.SecretKey {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{
+			"error":             "invalid_client",
+			"error_description": "unknown client id",
+		})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch q.Get("grant_type") {
+	case "authorization_code":
+		if q.Get("code") != s.AuthCode {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error":             "invalid_grant",
+				"error_description": "Invalid Authorization Code",
+			})
+			return
+		}
+	case "refresh_token":
+		if q.Get("refresh_token") != s.refreshToken {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error":             "expired_token",
+				"error_description": "refresh token has been used",
+			})
+			return
+		}
+		s.expiredTokens[s.accessToken] = true
+		s.accessToken = fmt.Sprintf("%s-%d", DEFAULT_ACCESS_TOKEN, s.newID())
+		s.refreshToken = fmt.Sprintf("%s-%d", DEFAULT_REFRESH_TOKEN, s.newID())
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error":             "unsupported_grant_type",
+			"error_description": "unsupported grant type",
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"expires_in":     2592000,
+		"refresh_token":  s.refreshToken,
+		"access_token":   s.accessToken,
+		"session_secret": "",
+		"session_key":    "",
+		"scope":          "basic netdisk",
+	})
+}
+
+func (s *Server) handleXpanFile(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Query().Get("method")
+	s.count(method)
+	if !s.authorized(w, r) {
+		return
+	}
+	switch method {
+	case "precreate":
+		s.precreate(w, r)
+	case "create":
+		s.create(w, r)
+	case "list":
+		s.list(w, r)
+	case "filemanager":
+		s.filemanager(w, r)
+	default:
+		writeErrno(w, 2, "unknown method "+method)
+	}
+}
+
+func (s *Server) handleMultimedia(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Query().Get("method")
+	s.count(method)
+	if !s.authorized(w, r) {
+		return
+	}
+	switch method {
+	case "listall":
+		s.listall(w, r)
+	case "filemetas":
+		s.filemetas(w, r)
+	default:
+		writeErrno(w, 2, "unknown method "+method)
+	}
+}
+
+func (s *Server) precreate(w http.ResponseWriter, r *http.Request) {
+	p := cleanPath(r.FormValue("path"))
+	if r.FormValue("isdir") == "1" {
+		s.mu.Lock()
+		s.mkdir(p)
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"errno": 0, "path": p, "return_type": 2})
+		return
+	}
+	var blockList []string
+	if err := json.Unmarshal([]byte(r.FormValue("block_list")), &blockList); err != nil || len(blockList) == 0 {
+		writeErrno(w, 2, "invalid block_list")
+		return
+	}
+	size, _ := strconv.ParseInt(r.FormValue("size"), 10, 64)
+
+	s.mu.Lock()
+	uploadID := fmt.Sprintf("N1-%d", s.newID())
+	s.uploads[uploadID] = &pendingUpload{path: p, size: size, blockList: blockList, parts: make(map[int][]byte)}
+	s.mu.Unlock()
+
+	seqs := make([]int, len(blockList))
+	for i := range seqs {
+		seqs[i] = i
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errno":       0,
+		"path":        p,
+		"uploadid":    uploadID,
+		"return_type": 1,
+		"block_list":  seqs,
+		"request_id":  time.Now().UnixNano(),
+	})
+}
+
+// readFormFile returns the content of the multipart field "file".
+func readFormFile(r *http.Request) ([]byte, error) {
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func (s *Server) handleSuperfile2(w http.ResponseWriter, r *http.Request) {
+	s.count("superfile2")
+	if !s.pcsAuthorized(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	partseq, err := strconv.Atoi(q.Get("partseq"))
+	if err != nil {
+		writePcsError(w, http.StatusBadRequest, 31023, "param error")
+		return
+	}
+	data, err := readFormFile(r)
+	if err != nil {
+		writePcsError(w, http.StatusBadRequest, 31023, "no file")
+		return
+	}
+	s.mu.Lock()
+	u, ok := s.uploads[q.Get("uploadid")]
+	if ok {
+		u.parts[partseq] = data
+	}
+	s.mu.Unlock()
+	if !ok {
+		writePcsError(w, http.StatusNotFound, 31363, "upload id not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"md5":        md5Hex(data),
+		"request_id": time.Now().UnixNano(),
+	})
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	p := cleanPath(r.FormValue("path"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.FormValue("isdir") == "1" {
+		f := s.mkdir(p)
+		writeJSON(w, http.StatusOK, fileCreated(f))
+		return
+	}
+	uploadID := r.FormValue("uploadid")
+	u, ok := s.uploads[uploadID]
+	if !ok {
+		writeErrno(w, 31363, "upload id not found")
+		return
+	}
+	var buf bytes.Buffer
+	for i, block := range u.blockList {
+		part, ok := u.parts[i]
+		if !ok || md5Hex(part) != block {
+			writeErrno(w, 31363, fmt.Sprintf("block %d missing", i))
+			return
+		}
+		buf.Write(part)
+	}
+	if int64(buf.Len()) != u.size {
+		writeErrno(w, 31190, "size mismatch")
+		return
+	}
+	if s.used()+int64(buf.Len()) > s.Quota {
+		writeErrno(w, -10, "quota exceeded")
+		return
+	}
+	data := buf.Bytes()
+	target, ok := s.resolveConflict(p, md5Hex(data), rtypeMode(r.FormValue("rtype")))
+	if !ok {
+		writeErrno(w, -8, "file already exists")
+		return
+	}
+	delete(s.uploads, uploadID)
+	f := s.put(target, data)
+	writeJSON(w, http.StatusOK, fileCreated(f))
+}
+
+func fileCreated(f *File) map[string]interface{} {
+	isdir := 0
+	if f.IsDir {
+		isdir = 1
+	}
+	return map[string]interface{}{
+		"errno":           0,
+		"fs_id":           f.FsID,
+		"md5":             f.MD5,
+		"server_filename": f.name(),
+		"category":        6,
+		"path":            f.Path,
+		"size":            len(f.Data),
+		"ctime":           f.Ctime,
+		"mtime":           f.Mtime,
+		"isdir":           isdir,
+		"name":            f.Path,
+	}
+}
+
+func (s *Server) used() int64 {
+	var used int64
+	for _, f := range s.files {
+		used += int64(len(f.Data))
+	}
+	return used
+}
+
+func (s *Server) handlePcsUpload(w http.ResponseWriter, r *http.Request) {
+	s.count("upload")
+	if !s.pcsAuthorized(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	data, err := readFormFile(r)
+	if err != nil {
+		writePcsError(w, http.StatusBadRequest, 31023, "no file")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used()+int64(len(data)) > s.Quota {
+		writePcsError(w, http.StatusBadRequest, 31112, "exceed quota")
+		return
+	}
+	target, ok := s.resolveConflict(cleanPath(q.Get("path")), md5Hex(data), ondupMode(q.Get("ondup")))
+	if !ok {
+		writePcsError(w, http.StatusBadRequest, 31061, "file already exists")
+		return
+	}
+	f := s.put(target, data)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ctime":      f.Ctime,
+		"fs_id":      f.FsID,
+		"md5":        f.MD5,
+		"mtime":      f.Mtime,
+		"path":       f.Path,
+		"request_id": time.Now().UnixNano(),
+		"size":       len(f.Data),
+	})
+}
+
+// listEntry is the common part of list and listall items.
+func listEntry(f *File) map[string]interface{} {
+	isdir := 0
+	if f.IsDir {
+		isdir = 1
+	}
+	return map[string]interface{}{
+		"fs_id":           f.FsID,
+		"path":            f.Path,
+		"server_filename": f.name(),
+		"size":            len(f.Data),
+		"isdir":           isdir,
+		"md5":             f.MD5,
+		"category":        6,
+		"server_ctime":    f.Ctime,
+		"server_mtime":    f.Mtime,
+		"local_ctime":     f.Ctime,
+		"local_mtime":     f.Mtime,
+	}
+}
+
+func paging(r *http.Request, total int) (int, int) {
+	start, _ := strconv.Atoi(r.FormValue("start"))
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 1000
+	}
+	if start > total {
+		start = total
+	}
+	end := start + limit
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	dir := cleanPath(r.FormValue("dir"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[dir]; !ok || !f.IsDir {
+		writeErrno(w, -9, "directory not found")
+		return
+	}
+	files := s.children(dir, false)
+	if r.FormValue("folder") == "1" {
+		dirs := files[:0]
+		for _, f := range files {
+			if f.IsDir {
+				dirs = append(dirs, f)
+			}
+		}
+		files = dirs
+	}
+	start, end := paging(r, len(files))
+	list := make([]map[string]interface{}, 0, end-start)
+	for _, f := range files[start:end] {
+		list = append(list, listEntry(f))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errno":      0,
+		"guid_info":  "",
+		"list":       list,
+		"request_id": time.Now().UnixNano(),
+		"guid":       0,
+	})
+}
+
+func (s *Server) listall(w http.ResponseWriter, r *http.Request) {
+	dir := cleanPath(r.FormValue("path"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[dir]; !ok || !f.IsDir {
+		writeErrno(w, 31066, "file does not exist")
+		return
+	}
+	files := s.children(dir, r.FormValue("recursion") == "1")
+	start, end := paging(r, len(files))
+	list := make([]map[string]interface{}, 0, end-start)
+	for _, f := range files[start:end] {
+		list = append(list, listEntry(f))
+	}
+	hasMore := 0
+	if end < len(files) {
+		hasMore = 1
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errno":      0,
+		"errmsg":     "succ",
+		"has_more":   hasMore,
+		"cursor":     end,
+		"list":       list,
+		"request_id": strconv.FormatInt(time.Now().UnixNano(), 10),
+	})
+}
+
+func (s *Server) filemetas(w http.ResponseWriter, r *http.Request) {
+	var fsids []int64
+	if err := json.Unmarshal([]byte(r.FormValue("fsids")), &fsids); err != nil {
+		writeErrno(w, 2, "invalid fsids")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byID := make(map[int64]*File, len(s.files))
+	for _, f := range s.files {
+		byID[f.FsID] = f
+	}
+	list := make([]map[string]interface{}, 0, len(fsids))
+	for _, id := range fsids {
+		f, ok := byID[id]
+		if !ok {
+			writeErrno(w, -9, fmt.Sprintf("fs_id %d not found", id))
+			return
+		}
+		item := listEntry(f)
+		item["filename"] = f.name()
+		if !f.IsDir && r.FormValue("dlink") == "1" {
+			item["dlink"] = fmt.Sprintf("%s/file/%d?fid=%d", s.URL, f.FsID, f.FsID)
+		}
+		list = append(list, item)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errno":      0,
+		"errmsg":     "succ",
+		"list":       list,
+		"names":      map[string]interface{}{},
+		"request_id": strconv.FormatInt(time.Now().UnixNano(), 10),
+	})
+}
+
+// handleDownload serves a dlink, Range requests are supported.
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	s.count("download")
+	if errno := s.checkToken(r); errno != 0 {
+		http.Error(w, "invalid access token", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/file/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	var found *File
+	for _, f := range s.files {
+		if f.FsID == id && !f.IsDir {
+			found = f
+			break
+		}
+	}
+	s.mu.Unlock()
+	if found == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-MD5", found.MD5)
+	http.ServeContent(w, r, found.name(), time.Unix(found.Mtime, 0), bytes.NewReader(found.Data))
+}
+
+// filemanagerItem 是 filelist 中的一项, delete 时只有 path
+type filemanagerItem struct {
+	Path    string `json:"path"`
+	Dest    string `json:"dest"`
+	Newname string `json:"newname"`
+	Ondup   string `json:"ondup"`
+}
+
+func (s *Server) filemanager(w http.ResponseWriter, r *http.Request) {
+	opera := r.URL.Query().Get("opera")
+	raw := []byte(r.FormValue("filelist"))
+	var items []filemanagerItem
+	if opera == "delete" {
+		var paths []string
+		if err := json.Unmarshal(raw, &paths); err != nil {
+			writeErrno(w, 2, "invalid filelist")
+			return
+		}
+		for _, p := range paths {
+			items = append(items, filemanagerItem{Path: p})
+		}
+	} else if err := json.Unmarshal(raw, &items); err != nil {
+		writeErrno(w, 2, "invalid filelist")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := make([]map[string]interface{}, 0, len(items))
+	failed := false
+	for _, item := range items {
+		errno := s.fileOperation(opera, item)
+		if errno != 0 {
+			failed = true
+		}
+		info = append(info, map[string]interface{}{"errno": errno, "path": item.Path})
+	}
+	errno := 0
+	if failed {
+		// 部分失败时百度返回 errno 12, 具体原因在 info 中
+		errno = 12
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errno":      errno,
+		"info":       info,
+		"taskid":     0,
+		"request_id": time.Now().UnixNano(),
+	})
+}
+
+func (s *Server) fileOperation(opera string, item filemanagerItem) int {
+	src := cleanPath(item.Path)
+	f, ok := s.files[src]
+	if !ok || src == "/" {
+		return -9
+	}
+	switch opera {
+	case "delete":
+		s.remove(src)
+		return 0
+	case "rename":
+		item.Dest = path.Dir(src)
+	case "copy", "move":
+	default:
+		return 2
+	}
+	name := item.Newname
+	if name == "" {
+		name = f.name()
+	}
+	dest := cleanPath(path.Join(item.Dest, name))
+	mode := "fail"
+	if item.Ondup != "" {
+		mode = ondupMode(item.Ondup)
+	}
+	dest, ok = s.resolveConflict(dest, f.MD5, mode)
+	if !ok {
+		return -8
+	}
+	s.mkdir(path.Dir(dest))
+	moved := make(map[string]*File)
+	for p, child := range s.files {
+		if p != src && !strings.HasPrefix(p, src+"/") {
+			continue
+		}
+		c := *child
+		c.Path = dest + strings.TrimPrefix(p, src)
+		if opera == "copy" {
+			c.FsID = s.newID()
+		}
+		moved[c.Path] = &c
+	}
+	if opera != "copy" {
+		s.remove(src)
+	}
+	for p, c := range moved {
+		s.files[p] = c
+	}
+	return 0
+}
+
+func (s *Server) handleQuota(w http.ResponseWriter, r *http.Request) {
+	s.count("quota")
+	if !s.authorized(w, r) {
+		return
+	}
+	s.mu.Lock()
+	used := s.used()
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errno":      0,
+		"total":      s.Quota,
+		"used":       used,
+		"free":       s.Quota - used,
+		"expire":     false,
+		"request_id": time.Now().UnixNano(),
+	})
+}
+
+func (s *Server) handleNas(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Query().Get("method")
+	s.count(method)
+	if !s.authorized(w, r) {
+		return
+	}
+	if method != "uinfo" {
+		writeErrno(w, 2, "unknown method "+method)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"errno":        0,
+		"errmsg":       "succ",
+		"uk":           20230101,
+		"request_id":   strconv.FormatInt(time.Now().UnixNano(), 10),
+		"avatar_url":   "",
+		"baidu_name":   "fakepan",
+		"netdisk_name": "fakepan",
+		"vip_type":     2,
+	})
+}
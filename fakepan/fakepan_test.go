@@ -0,0 +1,77 @@
+package fakepan
+
+import (
+	"context"
+	"testing"
+
+	openapiclient "github.com/wangxso/backuptool/openxpanapi"
+	"github.com/wangxso/backuptool/utils"
+)
+
+func TestFilemanager(t *testing.T) {
+	s := Setup(t)
+	s.Put("/apps/backup/a.txt", []byte("a"))
+	s.Put("/apps/backup/old/b.txt", []byte("b"))
+	client := openapiclient.NewAPIClient(utils.APIConfiguration())
+	ctx := context.Background()
+
+	_, err := client.FilemanagerApi.Filemanagermove(ctx).AccessToken(s.AccessToken()).Async(0).
+		Filelist(`[{"path":"/apps/backup/old","dest":"/apps/backup","newname":"new"}]`).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("/apps/backup/new/b.txt"); !ok {
+		t.Fatal("directory not moved")
+	}
+	if _, ok := s.Stat("/apps/backup/old"); ok {
+		t.Fatal("source of move still exists")
+	}
+
+	_, err = client.FilemanagerApi.Filemanagerdelete(ctx).AccessToken(s.AccessToken()).Async(0).
+		Filelist(`["/apps/backup/a.txt"]`).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := s.Files(); len(files) != 1 || files[0] != "/apps/backup/new/b.txt" {
+		t.Fatalf("files after delete: %v", files)
+	}
+}
+
+func TestQuotaAndUinfo(t *testing.T) {
+	s := Setup(t)
+	s.Put("/a.txt", []byte("12345"))
+	client := openapiclient.NewAPIClient(utils.APIConfiguration())
+	ctx := context.Background()
+
+	quota, _, err := client.UserinfoApi.Apiquota(ctx).AccessToken(s.AccessToken()).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.GetUsed() != 5 || quota.GetTotal() != DEFAULT_QUOTA {
+		t.Fatalf("quota: used %d total %d", quota.GetUsed(), quota.GetTotal())
+	}
+	uinfo, _, err := client.UserinfoApi.Xpannasuinfo(ctx).AccessToken(s.AccessToken()).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uinfo.GetNetdiskName() != "fakepan" {
+		t.Fatalf("uinfo: %+v", uinfo)
+	}
+}
+
+func TestConflictModes(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Put("/a.txt", []byte("a"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.resolveConflict("/a.txt", md5Hex([]byte("b")), "fail"); ok {
+		t.Fatal("fail mode accepted a conflict")
+	}
+	if p, _ := s.resolveConflict("/a.txt", md5Hex([]byte("a")), "same"); p != "/a.txt" {
+		t.Fatalf("same content got a new copy %s", p)
+	}
+	if p, _ := s.resolveConflict("/a.txt", md5Hex([]byte("b")), "rename"); p == "/a.txt" {
+		t.Fatal("rename mode overwrote the file")
+	}
+}
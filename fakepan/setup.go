@@ -0,0 +1,50 @@
+package fakepan
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/wangxso/backuptool/auth"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/utils"
+)
+
+// Setup starts a fake server and an in-memory Redis, points the config
+// and the shared HTTP client at them and logs in with the fake auth code.
+// Everything is restored when the test ends.
+func Setup(t testing.TB) *Server {
+	t.Helper()
+	s := New()
+	t.Cleanup(s.Close)
+
+	mr := miniredis.RunT(t)
+	savedConfig := config.BackUpConfig
+	savedClient := db.Client
+	t.Cleanup(func() {
+		db.Client.Close()
+		db.Client = savedClient
+		config.BackUpConfig = savedConfig
+		utils.LoadHTTPClient()
+	})
+
+	config.BackUpConfig.API.PanURL = s.URL
+	config.BackUpConfig.API.PcsURL = s.URL
+	config.BackUpConfig.API.OAuthURL = s.URL
+	config.BackUpConfig.BaiduDisk.AppKey = s.AppKey
+	config.BackUpConfig.BaiduDisk.SecretKey = s.SecretKey
+	config.BackUpConfig.BaiduDisk.RedirectUri = "oob"
+	config.BackUpConfig.General.TmpDir = t.TempDir()
+	config.BackUpConfig.HTTP = config.HTTPConfig{}
+	if err := utils.LoadHTTPClient(); err != nil {
+		t.Fatal(err)
+	}
+	db.Client = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	if _, err := auth.Login(context.Background(), s.AuthCode); err != nil {
+		t.Fatalf("fakepan login: %v", err)
+	}
+	return s
+}
@@ -0,0 +1,285 @@
+// Package faultinject provides an http.RoundTripper that makes requests to
+// Baidu Pan fail in the ways a flaky network and a busy server do, to test
+// that uploads, downloads and syncs still converge.
+package faultinject
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wangxso/backuptool/handler"
+	"github.com/wangxso/backuptool/utils"
+)
+
+// Kind 是注入的故障类型
+type Kind string
+
+const (
+	// Latency 延迟 Rule.Latency 后正常转发
+	Latency Kind = "latency"
+	// Reset 请求在发送前连接被重置
+	Reset Kind = "reset"
+	// ResetAfter 请求已被服务端处理, 但响应在返回途中连接被重置
+	ResetAfter Kind = "reset-after"
+	// ServerError 返回 Rule.Status (默认 503) 和一个 HTML 页面
+	ServerError Kind = "server-error"
+	// Truncate 响应体只返回一半, Content-Length 不变
+	Truncate Kind = "truncate"
+	// Errno 返回百度的错误码 Rule.Errno, 例如 31034 (频控) 和 111 (token 失效)
+	Errno Kind = "errno"
+)
+
+// Rule 描述一种故障, 对匹配的请求按概率注入
+type Rule struct {
+	// API 为空时匹配所有请求, 否则匹配 APIName 的返回值, 例如 "superfile2"
+	API string
+	// Match 不为空时只对返回 true 的请求注入
+	Match func(req *http.Request) bool
+	Kind  Kind
+	// Rate 是注入的概率, 0 表示每次都注入
+	Rate float64
+	// Times 是最多注入的次数, 0 表示不限制
+	Times int
+
+	Latency time.Duration
+	Status  int
+	Errno   int
+
+	injected int
+}
+
+// Transport injects the faults of Rules into the requests sent by Base.
+// Rules are checked in order and at most one fault is injected per request.
+type Transport struct {
+	Base  http.RoundTripper
+	Rules []*Rule
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	injected map[Kind]int
+}
+
+// New returns a Transport with a fixed seed, so a test run is repeatable.
+func New(base http.RoundTripper, seed int64, rules ...*Rule) *Transport {
+	return &Transport{
+		Base:     base,
+		Rules:    rules,
+		rand:     rand.New(rand.NewSource(seed)),
+		injected: make(map[Kind]int),
+	}
+}
+
+// Install wraps the shared HTTP client of utils with a Transport, the
+// returned function restores the client. It fails when the client cannot
+// be built from the config, nothing is changed then.
+func Install(seed int64, rules ...*Rule) (*Transport, func(), error) {
+	var t *Transport
+	saved := utils.WrapTransport
+	utils.WrapTransport = func(base http.RoundTripper) http.RoundTripper {
+		t = New(base, seed, rules...)
+		return t
+	}
+	if err := utils.LoadHTTPClient(); err != nil {
+		utils.WrapTransport = saved
+		return nil, nil, err
+	}
+	return t, func() {
+		utils.WrapTransport = saved
+		utils.LoadHTTPClient()
+	}, nil
+}
+
+// FastRetry shortens the retry backoffs of handler so that injected faults
+// are retried at once, the returned function restores them.
+func FastRetry() func() {
+	retry, rateLimit := handler.RetryBackoff, handler.RateLimitBackoff
+	handler.RetryBackoff, handler.RateLimitBackoff = time.Millisecond, time.Millisecond
+	return func() { handler.RetryBackoff, handler.RateLimitBackoff = retry, rateLimit }
+}
+
+// Injected returns how many faults of kind were injected.
+func (t *Transport) Injected(kind Kind) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.injected[kind]
+}
+
+// APIName names the Baidu Pan api of req: the method query parameter of
+// the xpan apis, "superfile2", "token", "quota" or "download" for dlinks.
+func APIName(req *http.Request) string {
+	p := req.URL.Path
+	switch {
+	case strings.HasSuffix(p, "/pcs/superfile2"):
+		return "superfile2"
+	case strings.HasPrefix(p, "/oauth/"):
+		return "token"
+	case p == "/api/quota":
+		return "quota"
+	case strings.HasPrefix(p, "/rest/2.0/"):
+		return req.URL.Query().Get("method")
+	}
+	return "download"
+}
+
+// pick returns the rule to inject for req, nil when the request passes.
+func (t *Transport) pick(req *http.Request) *Rule {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	api := APIName(req)
+	for _, r := range t.Rules {
+		if r.API != "" && r.API != api {
+			continue
+		}
+		if r.Match != nil && !r.Match(req) {
+			continue
+		}
+		if r.Times > 0 && r.injected >= r.Times {
+			continue
+		}
+		if r.Rate > 0 && t.rand.Float64() >= r.Rate {
+			continue
+		}
+		r.injected++
+		t.injected[r.Kind]++
+		return r
+	}
+	return nil
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+func resetError() error {
+	return &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := t.pick(req)
+	if r == nil {
+		return t.base().RoundTrip(req)
+	}
+	switch r.Kind {
+	case Latency:
+		if err := sleep(req.Context(), r.Latency); err != nil {
+			return nil, err
+		}
+		return t.base().RoundTrip(req)
+	case Reset:
+		drain(req)
+		return nil, resetError()
+	case ResetAfter:
+		resp, err := t.base().RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, resetError()
+	case ServerError:
+		drain(req)
+		status := r.Status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		body := fmt.Sprintf("<html><body><h1>%d %s</h1></body></html>", status, http.StatusText(status))
+		return response(req, status, "text/html", body), nil
+	case Truncate:
+		resp, err := t.base().RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = &truncatedBody{r: bytes.NewReader(data[:len(data)/2])}
+		resp.ContentLength = int64(len(data))
+		return resp, nil
+	case Errno:
+		drain(req)
+		return errnoResponse(req, r.Errno), nil
+	}
+	return t.base().RoundTrip(req)
+}
+
+// errnoResponse answers the way the api of req reports errno: error_code
+// on the pcs hosts and dlinks, errno on the xpan apis.
+func errnoResponse(req *http.Request, errno int) *http.Response {
+	switch APIName(req) {
+	case "superfile2", "download":
+		body := fmt.Sprintf(`{"error_code":%d,"error_msg":"injected","request_id":1}`, errno)
+		return response(req, http.StatusForbidden, "application/json", body)
+	case "upload":
+		if strings.Contains(req.URL.Path, "/pcs/") {
+			body := fmt.Sprintf(`{"error_code":%d,"error_msg":"injected","request_id":1}`, errno)
+			return response(req, http.StatusForbidden, "application/json", body)
+		}
+	}
+	body := fmt.Sprintf(`{"errno":%d,"errmsg":"injected"}`, errno)
+	return response(req, http.StatusOK, "application/json", body)
+}
+
+func response(req *http.Request, status int, contentType, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// drain consumes the request body like a real round trip would.
+func drain(req *http.Request) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// truncatedBody returns io.ErrUnexpectedEOF after the data, as a body cut
+// by a dropped connection does.
+type truncatedBody struct {
+	r *bytes.Reader
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *truncatedBody) Close() error {
+	return nil
+}
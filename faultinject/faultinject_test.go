@@ -0,0 +1,194 @@
+package faultinject
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/utils"
+)
+
+func newServer(t *testing.T, hits *int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*hits++
+		io.WriteString(w, `{"errno":0,"list":[]}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(t *testing.T, tr *Transport, url string) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr.RoundTrip(req)
+}
+
+func TestAPIName(t *testing.T) {
+	cases := map[string]string{
+		"/rest/2.0/xpan/file?method=precreate":      "precreate",
+		"/rest/2.0/xpan/multimedia?method=listall":  "listall",
+		"/rest/2.0/pcs/superfile2?method=upload":    "superfile2",
+		"/rest/2.0/pcs/file?method=upload":          "upload",
+		"/oauth/2.0/token?grant_type=refresh_token": "token",
+		"/api/quota":      "quota",
+		"/file/12?fid=12": "download",
+	}
+	for path, want := range cases {
+		req, _ := http.NewRequest(http.MethodGet, "http://pan"+path, nil)
+		if got := APIName(req); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	var hits int
+	srv := newServer(t, &hits)
+	tr := New(http.DefaultTransport, 1, &Rule{Kind: Reset, Times: 1})
+
+	if _, err := get(t, tr, srv.URL); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("got %v, want ECONNRESET", err)
+	}
+	if hits != 0 {
+		t.Fatal("reset request reached the server")
+	}
+	// Times 用完后正常转发
+	resp, err := get(t, tr, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if hits != 1 || tr.Injected(Reset) != 1 {
+		t.Fatalf("hits %d, injected %d", hits, tr.Injected(Reset))
+	}
+}
+
+func TestResetAfter(t *testing.T) {
+	var hits int
+	srv := newServer(t, &hits)
+	tr := New(http.DefaultTransport, 1, &Rule{Kind: ResetAfter})
+
+	if _, err := get(t, tr, srv.URL); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("got %v, want ECONNRESET", err)
+	}
+	if hits != 1 {
+		t.Fatal("request did not reach the server")
+	}
+}
+
+func TestServerError(t *testing.T) {
+	var hits int
+	srv := newServer(t, &hits)
+	tr := New(http.DefaultTransport, 1, &Rule{Kind: ServerError, Status: http.StatusBadGateway})
+
+	resp, err := get(t, tr, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), "<html>") {
+		t.Fatalf("got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	var hits int
+	srv := newServer(t, &hits)
+	tr := New(http.DefaultTransport, 1, &Rule{Kind: Truncate})
+
+	resp, err := get(t, tr, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+	if int64(len(body)) >= resp.ContentLength {
+		t.Fatalf("body of %d bytes is not truncated", len(body))
+	}
+}
+
+func TestErrno(t *testing.T) {
+	var hits int
+	srv := newServer(t, &hits)
+	tr := New(http.DefaultTransport, 1,
+		&Rule{API: "superfile2", Kind: Errno, Errno: 111},
+		&Rule{API: "listall", Kind: Errno, Errno: 31034})
+
+	resp, err := get(t, tr, srv.URL+"/rest/2.0/xpan/multimedia?method=listall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"errno":31034`) {
+		t.Fatalf("listall: got %d %s", resp.StatusCode, body)
+	}
+
+	resp, err = get(t, tr, srv.URL+"/rest/2.0/pcs/superfile2?method=upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `"error_code":111`) {
+		t.Fatalf("superfile2: got %d %s", resp.StatusCode, body)
+	}
+
+	// 不匹配的 api 正常转发
+	resp, err = get(t, tr, srv.URL+"/rest/2.0/xpan/file?method=precreate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if hits != 1 || tr.Injected(Errno) != 2 {
+		t.Fatalf("hits %d, injected %d", hits, tr.Injected(Errno))
+	}
+}
+
+func TestLatencyAndRate(t *testing.T) {
+	var hits int
+	srv := newServer(t, &hits)
+	tr := New(http.DefaultTransport, 1, &Rule{Kind: Latency, Latency: 20 * time.Millisecond, Rate: 0.5})
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		resp, err := get(t, tr, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	n := tr.Injected(Latency)
+	if n == 0 || n == 20 {
+		t.Fatalf("rate 0.5 injected %d of 20", n)
+	}
+	if elapsed := time.Since(start); elapsed < time.Duration(n)*20*time.Millisecond {
+		t.Fatalf("%d delays took %v", n, elapsed)
+	}
+	if hits != 20 {
+		t.Fatalf("hits %d, want 20", hits)
+	}
+}
+
+func TestInstallInvalidConfig(t *testing.T) {
+	saved := config.BackUpConfig.HTTP
+	defer func() { config.BackUpConfig.HTTP = saved }()
+	config.BackUpConfig.HTTP.CAFile = filepath.Join(t.TempDir(), "missing.pem")
+
+	if _, _, err := Install(1, &Rule{Kind: Reset}); err == nil {
+		t.Fatal("Install ignored an invalid HTTP config")
+	}
+	if utils.WrapTransport != nil {
+		t.Fatal("WrapTransport left installed")
+	}
+}
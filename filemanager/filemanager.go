@@ -0,0 +1,96 @@
+// Package filemanager wraps the filemanager api of Baidu Pan, which copies,
+// moves, renames and deletes cloud files.
+package filemanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/auth"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/handler"
+	"github.com/wangxso/backuptool/metrics"
+	openapiclient "github.com/wangxso/backuptool/openxpanapi"
+	"github.com/wangxso/backuptool/utils"
+)
+
+// BatchSize 是每个 filemanager 请求包含的文件数
+var BatchSize = 100
+
+// errnoPartial 表示部分文件操作失败, 原因在 info 中
+const errnoPartial = 12
+
+// Info is the result of one file of a filemanager request.
+type Info struct {
+	Errno int    `json:"errno"`
+	Path  string `json:"path"`
+}
+
+type filemanagerReturn struct {
+	Errno  int    `json:"errno"`
+	Info   []Info `json:"info"`
+	Taskid int64  `json:"taskid"`
+}
+
+// Delete deletes paths in batches of BatchSize. A path that does not exist
+// counts as deleted, so a retried request succeeds. It returns the deleted
+// paths, which are all of paths unless err is set.
+func Delete(ctx context.Context, paths []string) ([]string, error) {
+	deleted := make([]string, 0, len(paths))
+	for start := 0; start < len(paths); start += BatchSize {
+		end := start + BatchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+		var ret filemanagerReturn
+		err := handler.Retry(ctx, "filemanager", func() error {
+			var err error
+			ret, err = deleteBatch(ctx, auth.AccessToken(), paths[start:end])
+			return err
+		})
+		if err != nil {
+			return deleted, err
+		}
+		var failed []Info
+		for _, info := range ret.Info {
+			if info.Errno == 0 || handler.ClassOf(handler.FromErrno(info.Errno, "")) == handler.ClassNotFound {
+				deleted = append(deleted, info.Path)
+				continue
+			}
+			failed = append(failed, info)
+		}
+		if len(failed) > 0 {
+			return deleted, fmt.Errorf("%d files not deleted, %s: %w", len(failed), failed[0].Path, handler.FromErrno(failed[0].Errno, ""))
+		}
+		logrus.Infof("[Filemanager] deleted %d files", end-start)
+	}
+	return deleted, nil
+}
+
+func deleteBatch(ctx context.Context, accessToken string, paths []string) (filemanagerReturn, error) {
+	var ret filemanagerReturn
+	filelist, err := json.Marshal(paths)
+	if err != nil {
+		return ret, err
+	}
+	configuration := utils.APIConfiguration()
+	api_client := openapiclient.NewAPIClient(configuration)
+	ctx, cancel := context.WithTimeout(ctx, config.RequestTimeout())
+	defer cancel()
+	r, err := api_client.FilemanagerApi.Filemanagerdelete(ctx).AccessToken(accessToken).Async(0).Filelist(string(filelist)).Execute()
+	bodyBytes, err := utils.ReadResponseBody(r, err)
+	if err != nil {
+		logrus.Error("Error when calling `FilemanagerApi.Filemanagerdelete``: ", err)
+		return ret, err
+	}
+	if err = utils.DecodeJSON("filemanager delete", bodyBytes, &ret); err != nil {
+		return ret, err
+	}
+	metrics.ObserveErrno("filemanager", ret.Errno)
+	if ret.Errno != 0 && ret.Errno != errnoPartial {
+		return ret, handler.FromErrno(ret.Errno, "")
+	}
+	return ret, nil
+}
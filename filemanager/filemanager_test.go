@@ -0,0 +1,39 @@
+package filemanager
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/wangxso/backuptool/fakepan"
+)
+
+func TestDeleteBatches(t *testing.T) {
+	pan := fakepan.Setup(t)
+	defer func(n int) { BatchSize = n }(BatchSize)
+	BatchSize = 2
+
+	var paths []string
+	for i := 0; i < 5; i++ {
+		p := fmt.Sprintf("/apps/backup/%d.txt", i)
+		pan.Put(p, []byte("x"))
+		paths = append(paths, p)
+	}
+	pan.Put("/apps/backup/keep.txt", []byte("keep"))
+	// 已经不存在的文件算作删除成功
+	paths = append(paths, "/apps/backup/missing.txt")
+
+	deleted, err := Delete(context.Background(), paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != len(paths) {
+		t.Fatalf("deleted %d of %d", len(deleted), len(paths))
+	}
+	if n := pan.Calls("filemanager"); n != 3 {
+		t.Fatalf("filemanager calls: got %d, want 3", n)
+	}
+	if files := pan.Files(); len(files) != 1 {
+		t.Fatalf("left: %v", files)
+	}
+}
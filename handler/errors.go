@@ -1,7 +1,10 @@
 package handler
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 
 	"github.com/sirupsen/logrus"
 )
@@ -16,6 +19,42 @@ func (e CustomError) Error() string {
 	return fmt.Sprintf("错误码: %d, 描述: %s", e.Errno, e.ErrorMsg)
 }
 
+// Is reports whether target is a CustomError with the same errno, or the
+// ErrorClass of this errno, so both errors.Is(err, ErrAccessTokenExpired)
+// and errors.Is(err, ClassAuth) work on decoded API errors.
+func (e CustomError) Is(target error) bool {
+	switch t := target.(type) {
+	case CustomError:
+		return t.Errno == e.Errno
+	case ErrorClass:
+		return t == e.Class()
+	}
+	return false
+}
+
+// Class returns how callers should react to this errno.
+func (e CustomError) Class() ErrorClass {
+	return errnoClasses[e.Errno]
+}
+
+// ErrorClass 错误分类, 决定重试和刷新 token 等处理方式
+type ErrorClass string
+
+const (
+	ClassNone      ErrorClass = ""
+	ClassRetryable ErrorClass = "retryable"
+	ClassAuth      ErrorClass = "auth"
+	ClassQuota     ErrorClass = "quota"
+	ClassRateLimit ErrorClass = "rate-limit"
+	ClassNotFound  ErrorClass = "not-found"
+	// ClassPermission 路径或权限错误 (例如上传到应用目录之外), 刷新 token 和重试都没有用
+	ClassPermission ErrorClass = "permission"
+)
+
+func (c ErrorClass) Error() string {
+	return string(c)
+}
+
 // 定义错误常量
 var (
 	ErrSuccess                = CustomError{Errno: 0, ErrorMsg: "请求成功"}
@@ -32,10 +71,195 @@ var (
 	ErrExcessiveTransferCount = CustomError{Errno: 255, ErrorMsg: "转存数量太多"}
 	ErrBatchTransferError     = CustomError{Errno: 12, ErrorMsg: "批量转存出错"}
 	ErrExpiredRights          = CustomError{Errno: -1, ErrorMsg: "权益已过期"}
+
+	ErrPathNotExist       = CustomError{Errno: -9, ErrorMsg: "文件或目录不存在"}
+	ErrPathExist          = CustomError{Errno: -8, ErrorMsg: "文件或目录已存在"}
+	ErrInvalidPathName    = CustomError{Errno: -7, ErrorMsg: "文件或目录名错误或无权访问"}
+	ErrQuotaExceeded      = CustomError{Errno: -10, ErrorMsg: "云端容量已满"}
+	ErrListFileNotExist   = CustomError{Errno: 31066, ErrorMsg: "文件不存在"}
+	ErrPcsParameter       = CustomError{Errno: 31023, ErrorMsg: "参数错误"}
+	ErrPcsNoPermission    = CustomError{Errno: 31024, ErrorMsg: "没有访问权限"}
+	ErrPcsTokenInvalid    = CustomError{Errno: 31045, ErrorMsg: "access_token 验证未通过"}
+	ErrPcsFileExist       = CustomError{Errno: 31061, ErrorMsg: "文件已存在"}
+	ErrPcsUploadForbidden = CustomError{Errno: 31064, ErrorMsg: "上传路径权限"}
+	ErrPcsSliceMissing    = CustomError{Errno: 31190, ErrorMsg: "文件不存在或分片缺失"}
+	ErrPcsSliceLost       = CustomError{Errno: 31363, ErrorMsg: "分片缺失"}
+	ErrTooFrequent        = CustomError{Errno: 42000, ErrorMsg: "访问过于频繁"}
+	ErrShareDirAuthFailed = CustomError{Errno: 42213, ErrorMsg: "共享目录鉴权失败"}
+	ErrFileInfoFailed     = CustomError{Errno: 42214, ErrorMsg: "文件基础信息查询失败"}
 )
 
+var knownErrors = []CustomError{
+	ErrInvalidParameter, ErrAccessTokenExpired, ErrAuthenticationFailed, ErrUnauthorizedUserAccess,
+	ErrApiRateLimitExceeded, ErrShareNotFound, ErrDuplicateFile, ErrFileNotFound, ErrFileNotExist,
+	ErrSelfSentShare, ErrExcessiveTransferCount, ErrBatchTransferError, ErrExpiredRights,
+	ErrPathNotExist, ErrPathExist, ErrInvalidPathName, ErrQuotaExceeded, ErrListFileNotExist,
+	ErrPcsParameter, ErrPcsNoPermission, ErrPcsTokenInvalid, ErrPcsFileExist, ErrPcsUploadForbidden,
+	ErrPcsSliceMissing, ErrPcsSliceLost, ErrTooFrequent, ErrShareDirAuthFailed, ErrFileInfoFailed,
+}
+
+var errnoClasses = map[int]ErrorClass{
+	ErrAccessTokenExpired.Errno:     ClassAuth,
+	ErrAuthenticationFailed.Errno:   ClassAuth,
+	ErrUnauthorizedUserAccess.Errno: ClassAuth,
+	ErrPcsTokenInvalid.Errno:        ClassAuth,
+	ErrShareDirAuthFailed.Errno:     ClassAuth,
+
+	ErrPcsNoPermission.Errno:    ClassPermission,
+	ErrPcsUploadForbidden.Errno: ClassPermission,
+
+	ErrQuotaExceeded.Errno: ClassQuota,
+	ErrExpiredRights.Errno: ClassQuota,
+
+	ErrApiRateLimitExceeded.Errno: ClassRateLimit,
+	ErrTooFrequent.Errno:          ClassRateLimit,
+
+	ErrFileNotFound.Errno:     ClassNotFound,
+	ErrFileNotExist.Errno:     ClassNotFound,
+	ErrPathNotExist.Errno:     ClassNotFound,
+	ErrListFileNotExist.Errno: ClassNotFound,
+	ErrShareNotFound.Errno:    ClassNotFound,
+
+	ErrPcsSliceMissing.Errno: ClassRetryable,
+	ErrPcsSliceLost.Errno:    ClassRetryable,
+	ErrFileInfoFailed.Errno:  ClassRetryable,
+}
+
+var errnoErrors = func() map[int]CustomError {
+	m := make(map[int]CustomError, len(knownErrors))
+	for _, e := range knownErrors {
+		m[e.Errno] = e
+	}
+	return m
+}()
+
+// FromErrno decodes a Baidu errno into a CustomError, errmsg is used for
+// errnos that are not in the table. It returns nil for 0.
+func FromErrno(errno int, errmsg string) error {
+	if errno == 0 {
+		return nil
+	}
+	if e, ok := errnoErrors[errno]; ok {
+		return e
+	}
+	if errmsg == "" {
+		errmsg = "未知错误"
+	}
+	return CustomError{Errno: errno, ErrorMsg: errmsg}
+}
+
+// OAuthError is the error returned by the openapi.baidu.com oauth endpoints,
+// which use an error string instead of an errno.
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e OAuthError) Error() string {
+	return fmt.Sprintf("oauth 错误: %s, 描述: %s", e.Code, e.Description)
+}
+
+func (e OAuthError) Is(target error) bool {
+	switch t := target.(type) {
+	case OAuthError:
+		return t.Code == e.Code
+	case ErrorClass:
+		return t == e.Class()
+	}
+	return false
+}
+
+func (e OAuthError) Class() ErrorClass {
+	switch e.Code {
+	case "invalid_grant", "expired_token", "invalid_client", "unauthorized_client", "access_denied":
+		return ClassAuth
+	case "slow_down":
+		return ClassRateLimit
+	case "authorization_pending":
+		return ClassRetryable
+	}
+	return ClassNone
+}
+
+// StatusError 是没有 errno 的 HTTP 错误, 例如网关返回的 502 页面
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e StatusError) Error() string {
+	return "http 错误: " + e.Status
+}
+
+func (e StatusError) Is(target error) bool {
+	t, ok := target.(ErrorClass)
+	return ok && t == e.Class()
+}
+
+func (e StatusError) Class() ErrorClass {
+	switch {
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ClassRateLimit
+	case e.StatusCode >= 500:
+		return ClassRetryable
+	}
+	return ClassNone
+}
+
+// ClassOf returns the ErrorClass of err, ClassNone if err is not an API error.
+func ClassOf(err error) ErrorClass {
+	var e CustomError
+	if errors.As(err, &e) {
+		return e.Class()
+	}
+	var oe OAuthError
+	if errors.As(err, &oe) {
+		return oe.Class()
+	}
+	var se StatusError
+	if errors.As(err, &se) {
+		return se.Class()
+	}
+	return ClassNone
+}
+
 func HandlerGlobalErrors() {
 	if r := recover(); r != nil {
 		logrus.Error("Error Occured: ", r)
 	}
 }
+
+type apiStatus struct {
+	Errno     int    `json:"errno"`
+	Errmsg    string `json:"errmsg"`
+	ErrorCode int    `json:"error_code"`
+	ErrorMsg  string `json:"error_msg"`
+	// oauth 接口
+	OAuthCode        string `json:"error"`
+	OAuthDescription string `json:"error_description"`
+}
+
+// DecodeErrno extracts the errno of an xpan response, the error_code of a
+// pcs response or the error of an oauth response from body.
+func DecodeErrno(body []byte) error {
+	var status apiStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil
+	}
+	if status.OAuthCode != "" {
+		return OAuthError{Code: status.OAuthCode, Description: status.OAuthDescription}
+	}
+	if status.Errno != 0 {
+		return FromErrno(status.Errno, status.Errmsg)
+	}
+	return FromErrno(status.ErrorCode, status.ErrorMsg)
+}
+
+// Errno returns the errno carried by err, 0 if err is not an API error.
+func Errno(err error) int {
+	var e CustomError
+	if errors.As(err, &e) {
+		return e.Errno
+	}
+	return 0
+}
@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFromErrno(t *testing.T) {
+	if err := FromErrno(0, ""); err != nil {
+		t.Fatalf("errno 0 should be nil, got %v", err)
+	}
+	cases := []struct {
+		errno int
+		is    error
+		class ErrorClass
+	}{
+		{111, ErrAccessTokenExpired, ClassAuth},
+		{-6, ErrAuthenticationFailed, ClassAuth},
+		{31034, ErrApiRateLimitExceeded, ClassRateLimit},
+		{-9, ErrPathNotExist, ClassNotFound},
+		{31066, ErrListFileNotExist, ClassNotFound},
+		{-10, ErrQuotaExceeded, ClassQuota},
+		{31363, ErrPcsSliceLost, ClassRetryable},
+		{31064, ErrPcsUploadForbidden, ClassPermission},
+		{31024, ErrPcsNoPermission, ClassPermission},
+	}
+	for _, tc := range cases {
+		err := fmt.Errorf("wrapped: %w", FromErrno(tc.errno, ""))
+		if !errors.Is(err, tc.is) {
+			t.Errorf("errno %d: errors.Is(%v) = false", tc.errno, tc.is)
+		}
+		if !errors.Is(err, tc.class) {
+			t.Errorf("errno %d: errors.Is(class %s) = false", tc.errno, tc.class)
+		}
+		if ClassOf(err) != tc.class {
+			t.Errorf("errno %d: class %q, want %q", tc.errno, ClassOf(err), tc.class)
+		}
+	}
+
+	unknown := FromErrno(99999, "something")
+	if ClassOf(unknown) != ClassNone || Errno(unknown) != 99999 {
+		t.Errorf("unknown errno decoded as %v", unknown)
+	}
+}
+
+func TestDecodeErrno(t *testing.T) {
+	cases := map[string]error{
+		`{"errno":0,"list":[]}`:                                     nil,
+		`{"errno":-9,"errmsg":"not found"}`:                         ErrPathNotExist,
+		`{"error_code":31064,"error_msg":"file is not authorized"}`: ErrPcsUploadForbidden,
+		`{"error":"expired_token","error_description":"x"}`:         OAuthError{Code: "expired_token"},
+		`<html>maintenance</html>`:                                  nil,
+	}
+	for body, want := range cases {
+		err := DecodeErrno([]byte(body))
+		if want == nil {
+			if err != nil {
+				t.Errorf("%s: got %v, want nil", body, err)
+			}
+			continue
+		}
+		if !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", body, err, want)
+		}
+	}
+	if !errors.Is(DecodeErrno([]byte(`{"error":"invalid_grant"}`)), ClassAuth) {
+		t.Error("invalid_grant should be an auth error")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(b, r time.Duration, f func(context.Context) error) {
+		RetryBackoff, RateLimitBackoff, TokenRefresher = b, r, f
+	}(RetryBackoff, RateLimitBackoff, TokenRefresher)
+	RetryBackoff, RateLimitBackoff = time.Millisecond, time.Millisecond
+
+	calls := 0
+	err := Retry(context.Background(), "test", func() error {
+		calls++
+		if calls < 3 {
+			return ErrApiRateLimitExceeded
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("rate limit: err %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = Retry(context.Background(), "test", func() error {
+		calls++
+		return ErrQuotaExceeded
+	})
+	if !errors.Is(err, ErrQuotaExceeded) || calls != 1 {
+		t.Fatalf("quota: err %v after %d calls, want no retry", err, calls)
+	}
+
+	refreshed := 0
+	TokenRefresher = func(context.Context) error {
+		refreshed++
+		return nil
+	}
+	calls = 0
+	err = Retry(context.Background(), "test", func() error {
+		calls++
+		if refreshed == 0 {
+			return ErrAccessTokenExpired
+		}
+		return nil
+	})
+	if err != nil || refreshed != 1 || calls != 2 {
+		t.Fatalf("auth: err %v, refreshed %d, calls %d", err, refreshed, calls)
+	}
+
+	calls = 0
+	err = Retry(context.Background(), "test", func() error {
+		calls++
+		return ErrAccessTokenExpired
+	})
+	if !errors.Is(err, ClassAuth) || calls != 2 {
+		t.Fatalf("auth after refresh: err %v after %d calls, want 2 calls", err, calls)
+	}
+
+	// 路径权限错误不刷新 token, 也不重试
+	calls, refreshed = 0, 0
+	err = Retry(context.Background(), "test", func() error {
+		calls++
+		return ErrPcsUploadForbidden
+	})
+	if !errors.Is(err, ClassPermission) || calls != 1 || refreshed != 0 {
+		t.Fatalf("permission: err %v, refreshed %d, calls %d", err, refreshed, calls)
+	}
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	defer func(b time.Duration) { RetryBackoff = b }(RetryBackoff)
+	RetryBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	calls := 0
+	start := time.Now()
+	err := Retry(ctx, "test", func() error {
+		calls++
+		return ErrPcsSliceLost
+	})
+	if !errors.Is(err, ErrPcsSliceLost) || calls != 1 {
+		t.Fatalf("err %v after %d calls", err, calls)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Retry did not stop when the context was cancelled")
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	cases := map[int]ErrorClass{
+		http.StatusServiceUnavailable: ClassRetryable,
+		http.StatusBadGateway:         ClassRetryable,
+		http.StatusTooManyRequests:    ClassRateLimit,
+		http.StatusNotFound:           ClassNone,
+	}
+	for code, class := range cases {
+		err := fmt.Errorf("download: %w", StatusError{StatusCode: code, Status: http.StatusText(code)})
+		if ClassOf(err) != class {
+			t.Errorf("%d: class %q, want %q", code, ClassOf(err), class)
+		}
+	}
+}
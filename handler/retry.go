@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// RetryAttempts 每个操作最多尝试的次数
+	RetryAttempts = 5
+	// RetryBackoff 可重试错误和网络错误的初始等待时间, 每次翻倍
+	RetryBackoff = 500 * time.Millisecond
+	// RateLimitBackoff 命中频控后的初始等待时间, 每次翻倍
+	RateLimitBackoff = 5 * time.Second
+
+	// TokenRefresher is set by the auth package. Retry calls it once per
+	// operation when a call fails with an auth error.
+	TokenRefresher func(ctx context.Context) error
+)
+
+// Retry calls fn until it succeeds or fails with an error that should not
+// be retried. Rate-limit and retryable errnos back off exponentially, auth
+// errors refresh the access token once, quota and not-found errors are
+// returned at once. fn must read the access token on every call so that a
+// refreshed token is picked up. Retry stops as soon as ctx is done.
+func Retry(ctx context.Context, op string, fn func() error) error {
+	refreshed := false
+	var err error
+	for attempt := 1; attempt <= RetryAttempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		var wait time.Duration
+		switch ClassOf(err) {
+		case ClassAuth:
+			if refreshed || TokenRefresher == nil {
+				return err
+			}
+			refreshed = true
+			if refreshErr := TokenRefresher(ctx); refreshErr != nil {
+				logrus.Errorf("[%s] refresh access token failed: %v", op, refreshErr)
+				return err
+			}
+			continue
+		case ClassRateLimit:
+			wait = RateLimitBackoff << (attempt - 1)
+		case ClassRetryable:
+			wait = RetryBackoff << (attempt - 1)
+		default:
+			if !IsNetworkError(err) {
+				return err
+			}
+			wait = RetryBackoff << (attempt - 1)
+		}
+		if attempt < RetryAttempts {
+			logrus.Warnf("[%s] attempt %d/%d failed: %v, retry in %s", op, attempt, RetryAttempts, err, wait)
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+	}
+	return err
+}
+
+// IsNetworkError reports whether err is a transport level failure such as
+// a timeout, a reset connection or a truncated body.
+func IsNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
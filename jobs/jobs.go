@@ -0,0 +1,421 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/cloudsync"
+	"github.com/wangxso/backuptool/codec"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/snapshot"
+)
+
+const (
+	SYNC_HISTORY = "sync_history"
+	// historyLimit 在 Redis 中保留的同步记录条数
+	historyLimit = 200
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobRunning  = errors.New("job is already running")
+	ErrJobIdle     = errors.New("job is not running")
+	ErrStopping    = errors.New("shutting down")
+)
+
+// cleanupTimeout 是宽限期结束、取消任务之后等待其保存断点的时间
+const cleanupTimeout = 10 * time.Second
+
+// Run 是一次同步的记录
+type Run struct {
+	Job      string           `json:"job"`
+	Start    time.Time        `json:"start"`
+	End      time.Time        `json:"end"`
+	Duration string           `json:"duration"`
+	Result   cloudsync.Result `json:"result"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// Status 描述一个任务当前的状态
+type Status struct {
+	Name      string    `json:"name"`
+	SourceDir string    `json:"sourceDir"`
+	TargetDir string    `json:"targetDir"`
+	Interval  string    `json:"interval"`
+	Mode      string    `json:"mode"`
+	Running   bool      `json:"running"`
+	LastRun   *Run      `json:"lastRun,omitempty"`
+	NextRun   time.Time `json:"nextRun,omitempty"`
+}
+
+type job struct {
+	cfg      config.Job
+	interval time.Duration
+	running  bool
+	cancel   context.CancelFunc
+	lastRun  *Run
+	nextRun  time.Time
+}
+
+var (
+	mu   sync.Mutex
+	list []*job
+	// active 统计正在运行的任务, Shutdown 等待它们结束
+	active   sync.WaitGroup
+	stopping bool
+
+	schedulerCtx  context.Context
+	stopScheduler context.CancelFunc
+)
+
+// Load builds the job list from config.GetJobs. A job that keeps its name
+// keeps its running state and last run.
+func Load() {
+	mu.Lock()
+	defer mu.Unlock()
+	old := make(map[string]*job, len(list))
+	for _, j := range list {
+		old[j.cfg.Name] = j
+	}
+	list = nil
+	for _, c := range config.GetJobs() {
+		j := old[c.Name]
+		if j == nil {
+			j = &job{}
+		}
+		j.cfg = c
+		j.interval = 0
+		j.nextRun = time.Time{}
+		if c.Interval != "" {
+			d, err := time.ParseDuration(c.Interval)
+			if err != nil {
+				logrus.Errorf("[Job %s] invalid interval %q: %v", c.Name, c.Interval, err)
+			} else {
+				j.interval = d
+			}
+		}
+		if c.Mode != "" && c.Mode != config.MODE_SYNC && !c.Snapshots() {
+			logrus.Errorf("[Job %s] unknown mode %q, use %s", c.Name, c.Mode, config.MODE_SYNC)
+		}
+		if !codec.Valid(c.Compress) {
+			logrus.Errorf("[Job %s] unknown compress %q, the job fails until it is gzip or zstd", c.Name, c.Compress)
+		}
+		if c.Bundle.MaxFileSize != "" && c.Mode != config.MODE_SNAPSHOT {
+			logrus.Warnf("[Job %s] bundle is only used in %s mode", c.Name, config.MODE_SNAPSHOT)
+		}
+		list = append(list, j)
+	}
+}
+
+// Reload rebuilds the job list after the config changed and restarts the
+// scheduler. Running syncs are not interrupted.
+func Reload() {
+	mu.Lock()
+	if stopScheduler != nil {
+		stopScheduler()
+	}
+	ctx := schedulerCtx
+	mu.Unlock()
+
+	Load()
+	if ctx != nil {
+		StartScheduler(ctx)
+	}
+	logrus.Infof("[Job] reloaded %d jobs", len(List()))
+}
+
+// StartScheduler runs every job that has an interval in the background
+// until ctx is done or the scheduler is restarted by Reload.
+func StartScheduler(ctx context.Context) {
+	mu.Lock()
+	defer mu.Unlock()
+	schedulerCtx = ctx
+	// 同步使用 base, Reload 停止调度时不会中断正在运行的同步
+	base := ctx
+	ctx, stopScheduler = context.WithCancel(ctx)
+	for _, j := range list {
+		if j.interval <= 0 {
+			continue
+		}
+		j.nextRun = time.Now().Add(j.interval)
+		go schedule(ctx, base, j)
+	}
+}
+
+func schedule(ctx, base context.Context, j *job) {
+	for {
+		mu.Lock()
+		wait := time.Until(j.nextRun)
+		mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		mu.Lock()
+		j.nextRun = time.Now().Add(j.interval)
+		mu.Unlock()
+		if err := runJob(base, j); err != nil && err != ErrJobRunning && err != ErrStopping {
+			logrus.Errorf("[Job %s] %v", j.cfg.Name, err)
+		}
+	}
+}
+
+// Trigger runs the named job synchronously. The run stops when ctx is done
+// or Cancel is called.
+func Trigger(ctx context.Context, name string) error {
+	j := find(name)
+	if j == nil {
+		return ErrJobNotFound
+	}
+	return runJob(ctx, j)
+}
+
+// Start runs the named job in the background. It returns once the run is
+// started, or ErrJobNotFound, ErrJobRunning or ErrStopping when it cannot
+// start. The run stops when ctx is done or Cancel is called, its result
+// goes to the history.
+func Start(ctx context.Context, name string) error {
+	j := find(name)
+	if j == nil {
+		return ErrJobNotFound
+	}
+	ctx, cfg, err := reserve(ctx, j)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := runReserved(ctx, j, cfg); err != nil {
+			logrus.Errorf("[Job %s] %v", name, err)
+		}
+	}()
+	return nil
+}
+
+// Cancel stops the running sync of the named job.
+func Cancel(name string) error {
+	j := find(name)
+	if j == nil {
+		return ErrJobNotFound
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !j.running || j.cancel == nil {
+		return ErrJobIdle
+	}
+	j.cancel()
+	return nil
+}
+
+func find(name string) *job {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, j := range list {
+		if j.cfg.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+func runJob(ctx context.Context, j *job) error {
+	ctx, cfg, err := reserve(ctx, j)
+	if err != nil {
+		return err
+	}
+	return runReserved(ctx, j, cfg)
+}
+
+// reserve marks j running and returns the context and the config of the
+// run, or why it cannot run now.
+func reserve(ctx context.Context, j *job) (context.Context, config.Job, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if stopping {
+		return nil, config.Job{}, ErrStopping
+	}
+	if j.running {
+		return nil, config.Job{}, ErrJobRunning
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	j.running = true
+	j.cancel = cancel
+	active.Add(1)
+	// 使用 Load 时复制的任务配置, 运行中 Reload 不会改变本次同步
+	return ctx, j.cfg, nil
+}
+
+// runReserved runs cfg after reserve and releases j.
+func runReserved(ctx context.Context, j *job, cfg config.Job) error {
+	defer active.Done()
+
+	run := Run{Job: cfg.Name, Start: time.Now()}
+	logrus.Infof("[Job %s] start sync %s -> %s", cfg.Name, cfg.SourceDir, cfg.TargetDir)
+	result, err := syncJob(ctx, cfg)
+	run.Result = result
+	run.End = time.Now()
+	run.Duration = run.End.Sub(run.Start).Round(time.Millisecond).String()
+	if err != nil {
+		run.Error = err.Error()
+	} else if len(result.Failed) > 0 {
+		err = fmt.Errorf("%d files failed", len(result.Failed))
+	}
+	saveRun(run)
+
+	mu.Lock()
+	j.cancel()
+	j.running = false
+	j.cancel = nil
+	j.lastRun = &run
+	mu.Unlock()
+	return err
+}
+
+// Shutdown stops the scheduler and refuses new runs. Running syncs stop
+// before their next file; when ctx is done before they finish, they are
+// cancelled and the interrupted uploads save a checkpoint.
+func Shutdown(ctx context.Context) error {
+	mu.Lock()
+	stopping = true
+	if stopScheduler != nil {
+		stopScheduler()
+	}
+	mu.Unlock()
+	cloudsync.Stop()
+
+	finished := make(chan struct{})
+	go func() {
+		active.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+
+	logrus.Warn("[Job] grace period is over, cancel running syncs")
+	mu.Lock()
+	for _, j := range list {
+		if j.cancel != nil {
+			j.cancel()
+		}
+	}
+	mu.Unlock()
+	select {
+	case <-finished:
+		return ctx.Err()
+	case <-time.After(cleanupTimeout):
+		return errors.New("running syncs did not stop")
+	}
+}
+
+// syncJob runs cloudsync.SyncJob, or snapshot.Take and the retention rules
+// for a job in snapshot or repository mode, and turns a panic into an error,
+// so a bug in one job does not take down the scheduler and the web server.
+func syncJob(ctx context.Context, job config.Job) (result cloudsync.Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("[Job %s] panic: %v\n%s", job.Name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	if job.Snapshots() {
+		var m *snapshot.Manifest
+		m, result, err = snapshot.Take(ctx, job)
+		// 只在完整的快照之后清理, 清理失败不影响本次备份的结果
+		if err == nil && !m.Partial {
+			if _, pruneErr := snapshot.ApplyRetention(ctx, job); pruneErr != nil {
+				logrus.Errorf("[Job %s] prune: %v", job.Name, pruneErr)
+			}
+		}
+		return result, err
+	}
+	return cloudsync.SyncJob(ctx, job)
+}
+
+func saveRun(run Run) {
+	if db.Client == nil {
+		return
+	}
+	data, err := json.Marshal(run)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	ctx := db.Client.Context()
+	db.Client.LPush(ctx, SYNC_HISTORY, data)
+	db.Client.LTrim(ctx, SYNC_HISTORY, 0, historyLimit-1)
+}
+
+// List returns the status of every configured job.
+func List() []Status {
+	mu.Lock()
+	ret := make([]Status, 0, len(list))
+	missing := false
+	for _, j := range list {
+		ret = append(ret, Status{
+			Name:      j.cfg.Name,
+			SourceDir: j.cfg.SourceDir,
+			TargetDir: j.cfg.TargetDir,
+			Interval:  j.cfg.Interval,
+			Mode:      j.cfg.Mode,
+			Running:   j.running,
+			LastRun:   j.lastRun,
+			NextRun:   j.nextRun,
+		})
+		missing = missing || j.lastRun == nil
+	}
+	mu.Unlock()
+
+	// 还没有运行过的任务从历史中找最近一次, 不持有锁访问 Redis
+	if !missing {
+		return ret
+	}
+	runs, err := History(historyLimit)
+	if err != nil {
+		return ret
+	}
+	for i := range ret {
+		if ret[i].LastRun != nil {
+			continue
+		}
+		for _, r := range runs {
+			if r.Job == ret[i].Name {
+				ret[i].LastRun = &r
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// History returns at most limit sync runs, newest first.
+func History(limit int) ([]Run, error) {
+	runs := make([]Run, 0)
+	if db.Client == nil {
+		return runs, nil
+	}
+	items, err := db.Client.LRange(db.Client.Context(), SYNC_HISTORY, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		var r Run
+		if err := json.Unmarshal([]byte(item), &r); err != nil {
+			continue
+		}
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
@@ -0,0 +1,117 @@
+package jobs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/fakepan"
+)
+
+func TestReloadKeepsState(t *testing.T) {
+	config.BackUpConfig.Jobs = []config.Job{{Name: "a", Interval: "1h"}, {Name: "b"}}
+	Load()
+	a := find("a")
+	a.lastRun = &Run{Job: "a"}
+
+	config.BackUpConfig.Jobs = []config.Job{{Name: "a", Interval: "2h"}, {Name: "c"}}
+	Load()
+	if find("a") != a || a.lastRun == nil || a.interval != 2*time.Hour {
+		t.Fatal("job a lost its state after reload")
+	}
+	if find("b") != nil || find("c") == nil {
+		t.Fatal("job list not updated")
+	}
+}
+
+func TestTriggerRecordsHistory(t *testing.T) {
+	fakepan.Setup(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.BackUpConfig.Jobs = []config.Job{{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup"}}
+	Load()
+	ctx := context.Background()
+	if err := Trigger(ctx, "docs"); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := History(10)
+	if err != nil || len(runs) != 1 || runs[0].Job != "docs" || runs[0].Result.Uploaded != 1 {
+		t.Fatalf("history: %+v %v", runs, err)
+	}
+	list := List()
+	if len(list) != 1 || list[0].Running || list[0].LastRun == nil || list[0].LastRun.Error != "" {
+		t.Fatalf("status: %+v", list)
+	}
+
+	if err := Cancel("docs"); err != ErrJobIdle {
+		t.Fatalf("Cancel idle job: %v", err)
+	}
+	if err := Cancel("nope"); err != ErrJobNotFound {
+		t.Fatalf("Cancel unknown job: %v", err)
+	}
+	if err := Trigger(ctx, "nope"); err != ErrJobNotFound {
+		t.Fatalf("Trigger unknown job: %v", err)
+	}
+}
+
+func TestStartReservesTheJob(t *testing.T) {
+	config.BackUpConfig.Jobs = []config.Job{{Name: "a"}}
+	Load()
+	// 已经在运行的任务在启动 goroutine 之前就被拒绝
+	ctx, cfg, err := reserve(context.Background(), find("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Start(context.Background(), "a"); err != ErrJobRunning {
+		t.Fatalf("Start running job: %v", err)
+	}
+	if err := Start(context.Background(), "nope"); err != ErrJobNotFound {
+		t.Fatalf("Start unknown job: %v", err)
+	}
+	if err := Cancel("a"); err != nil {
+		t.Fatal(err)
+	}
+	runReserved(ctx, find("a"), cfg)
+	if list := List(); list[0].Running || list[0].LastRun == nil {
+		t.Fatalf("status: %+v", list)
+	}
+}
+
+// TestShutdownRefusesNewRuns stops every sync of the process, it runs last.
+func TestListReadsLastRunFromHistory(t *testing.T) {
+	fakepan.Setup(t)
+	config.BackUpConfig.Jobs = []config.Job{{Name: "logs"}, {Name: "mail"}, {Name: "photos"}}
+	Load()
+	// 新加载的任务内存中没有上次运行, 从历史中取每个任务最新的一次
+	saveRun(Run{Job: "logs", Error: "old"})
+	saveRun(Run{Job: "mail"})
+	saveRun(Run{Job: "logs", Error: "new"})
+	got := make(map[string]*Run)
+	for _, s := range List() {
+		got[s.Name] = s.LastRun
+	}
+	if got["logs"] == nil || got["logs"].Error != "new" || got["mail"] == nil || got["mail"].Job != "mail" || got["photos"] != nil {
+		t.Fatalf("last runs: %+v", got)
+	}
+}
+
+func TestShutdownRefusesNewRuns(t *testing.T) {
+	config.BackUpConfig.Jobs = []config.Job{{Name: "a"}}
+	Load()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := Trigger(context.Background(), "a"); err != ErrStopping {
+		t.Fatalf("Trigger after Shutdown: %v", err)
+	}
+	if err := Start(context.Background(), "a"); err != ErrStopping {
+		t.Fatalf("Start after Shutdown: %v", err)
+	}
+}
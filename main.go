@@ -1,12 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/cassette"
 	"github.com/wangxso/backuptool/config"
 	"github.com/wangxso/backuptool/db"
 	"github.com/wangxso/backuptool/handler"
+	"github.com/wangxso/backuptool/jobs"
+	"github.com/wangxso/backuptool/restore"
+	"github.com/wangxso/backuptool/upload"
+	"github.com/wangxso/backuptool/utils"
 	"github.com/wangxso/backuptool/web"
 )
 
@@ -14,7 +25,17 @@ const (
 	DEFAULT_CONFIG_PATH = "./config.yaml"
 )
 
+var (
+	configPath = flag.String("config", DEFAULT_CONFIG_PATH, "config file path")
+	syncMode   = flag.Bool("sync", false, "run every job once and exit")
+	recordPath = flag.String("record", "", "record the Baidu Pan requests into this cassette file, tokens are scrubbed")
+
+	recorder *cassette.Recorder
+	recordMu sync.Mutex
+)
+
 func main() {
+	flag.Parse()
 	defer handler.HandlerGlobalErrors()
 	defer db.CloseRedis()
 	// 创建一个新的日志记录器实例
@@ -29,7 +50,148 @@ func main() {
 
 	// 设置控制台日志钩子为日志记录器的输出
 
-	config.LoadConfig(DEFAULT_CONFIG_PATH)
+	config.LoadConfig(*configPath)
+	if *recordPath != "" {
+		recorder = cassette.Record()
+		// 子命令、logrus.Fatal 和 os.Exit 退出时也保存录制内容
+		defer saveRecording()
+		logrus.RegisterExitHandler(saveRecording)
+	}
+	if err := utils.LoadHTTPClient(); err != nil {
+		logrus.Fatal("[HTTP] ", err)
+	}
 	db.LoadRedis()
-	web.StartWeb()
+	// 子命令在 Ctrl-C 或 SIGTERM 时取消, 释放任务锁后退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ran, err := runCommand(ctx)
+	stop()
+	if ran {
+		if err != nil {
+			logrus.Error(err)
+			exit(1)
+		}
+		return
+	}
+	// 清理上次异常退出留下的分片
+	if err := upload.CleanChunks(); err != nil {
+		logrus.Error(err)
+	}
+	jobs.Load()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	done := make(chan error, 1)
+	if *syncMode {
+		go func() { done <- syncAll(context.Background()) }()
+	} else {
+		jobs.StartScheduler(context.Background())
+		go func() { done <- web.StartWeb() }()
+	}
+
+	for {
+		select {
+		case err := <-done:
+			shutdown(signals)
+			if err != nil {
+				logrus.Error(err)
+				exit(1)
+			}
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reload()
+				continue
+			}
+			logrus.Infof("Received %s, shutting down", sig)
+			if err := shutdown(signals); err != nil {
+				logrus.Error(err)
+			}
+			return
+		}
+	}
+}
+
+// reload reads the config file again and applies the jobs.
+func reload() {
+	if err := config.Reload(*configPath); err != nil {
+		logrus.Error("Reload config failed: ", err)
+		return
+	}
+	if err := utils.LoadHTTPClient(); err != nil {
+		logrus.Error("[HTTP] keep the previous client: ", err)
+	}
+	jobs.Reload()
+}
+
+// shutdown stops accepting requests and new syncs, waits at most
+// General.shutdownGrace for the running transfers and removes the temporary
+// chunks once they stopped, then saves the cassette when recording. A second signal exits
+// immediately, the cassette is still saved.
+func shutdown(signals <-chan os.Signal) error {
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				logrus.Warnf("Received %s again, exit now", sig)
+				exit(1)
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownGrace())
+	defer cancel()
+
+	webErr := make(chan error, 1)
+	go func() { webErr <- web.Shutdown(ctx) }()
+	err := jobs.Shutdown(ctx)
+	// 同步没有停止时仍可能在读分片, 留给下次启动时清理
+	if err == nil {
+		if e := upload.CleanChunks(); e != nil {
+			logrus.Error(e)
+		}
+	}
+	if e := restore.Cancel(ctx); e != nil && err == nil {
+		err = e
+	}
+	if e := <-webErr; e != nil && err == nil {
+		err = e
+	}
+	saveRecording()
+	return err
+}
+
+// saveRecording saves the cassette when recording, it runs on every exit.
+func saveRecording() {
+	if recorder == nil {
+		return
+	}
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	if err := recorder.Save(*recordPath); err != nil {
+		logrus.Error("Save cassette failed: ", err)
+	} else {
+		logrus.Info("Cassette saved to ", *recordPath)
+	}
+}
+
+// exit saves the cassette and closes Redis before os.Exit, which skips the
+// deferred calls of main.
+func exit(code int) {
+	saveRecording()
+	db.CloseRedis()
+	os.Exit(code)
+}
+
+// syncAll runs every configured job once, it returns the last error.
+func syncAll(ctx context.Context) error {
+	var last error
+	for _, j := range config.GetJobs() {
+		if err := jobs.Trigger(ctx, j.Name); err != nil {
+			logrus.Errorf("[Job %s] %v", j.Name, err)
+			last = err
+		}
+		if errors.Is(last, jobs.ErrStopping) || ctx.Err() != nil {
+			return last
+		}
+	}
+	return last
 }
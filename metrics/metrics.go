@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	namespace = "backuptool"
+
+	OpUpload   = "upload"
+	OpDownload = "download"
+	OpSkip     = "skip"
+
+	QueueUploadSlices = "upload_slices"
+	QueueDownload     = "download"
+
+	// errnoRateLimit 百度接口频控错误码
+	errnoRateLimit = 31034
+)
+
+var (
+	Files = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "files_total",
+		Help:      "Files uploaded, downloaded or skipped.",
+	}, []string{"op"})
+
+	Bytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_total",
+		Help:      "Bytes uploaded, downloaded or skipped.",
+	}, []string{"op"})
+
+	APIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_errors_total",
+		Help:      "Baidu API responses with a non-zero errno.",
+	}, []string{"api", "errno"})
+
+	RateLimitHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_hits_total",
+		Help:      "Baidu API calls rejected by rate limiting (errno 31034).",
+	})
+
+	SliceUploadSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "slice_upload_duration_seconds",
+		Help:      "Latency of a single 4MB slice upload.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+
+	SyncSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of a sync run.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"job"})
+
+	QueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Items waiting or in flight per queue.",
+	}, []string{"queue"})
+
+	LastSuccessfulSync = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last successful sync per job.",
+	}, []string{"job"})
+)
+
+// FileDone counts one file of size bytes for op.
+func FileDone(op string, size int64) {
+	Files.WithLabelValues(op).Inc()
+	Bytes.WithLabelValues(op).Add(float64(size))
+}
+
+// ObserveErrno records a Baidu API errno, zero is ignored.
+func ObserveErrno(api string, errno int) {
+	if errno == 0 {
+		return
+	}
+	APIErrors.WithLabelValues(api, strconv.Itoa(errno)).Inc()
+	if errno == errnoRateLimit {
+		RateLimitHits.Inc()
+	}
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollectorsRegistered(t *testing.T) {
+	// Vec 在有标签值之后才出现在输出中
+	FileDone(OpUpload, 0)
+	ObserveErrno("list", 1)
+	SyncSeconds.WithLabelValues("docs").Observe(0)
+	QueueDepth.WithLabelValues(QueueDownload).Set(0)
+	LastSuccessfulSync.WithLabelValues("docs").Set(0)
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+	for _, name := range []string{
+		"backuptool_files_total",
+		"backuptool_bytes_total",
+		"backuptool_api_errors_total",
+		"backuptool_rate_limit_hits_total",
+		"backuptool_slice_upload_duration_seconds",
+		"backuptool_sync_duration_seconds",
+		"backuptool_queue_depth",
+		"backuptool_last_successful_sync_timestamp_seconds",
+	} {
+		if !names[name] {
+			t.Errorf("%s is not registered", name)
+		}
+	}
+}
+
+func TestFileDone(t *testing.T) {
+	files := testutil.ToFloat64(Files.WithLabelValues(OpDownload))
+	bytes := testutil.ToFloat64(Bytes.WithLabelValues(OpDownload))
+	FileDone(OpDownload, 1024)
+	FileDone(OpDownload, 10)
+	if got := testutil.ToFloat64(Files.WithLabelValues(OpDownload)) - files; got != 2 {
+		t.Fatalf("files: got %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(Bytes.WithLabelValues(OpDownload)) - bytes; got != 1034 {
+		t.Fatalf("bytes: got %v, want 1034", got)
+	}
+}
+
+func TestObserveErrno(t *testing.T) {
+	hits := testutil.ToFloat64(RateLimitHits)
+	apiErrors := testutil.ToFloat64(APIErrors.WithLabelValues("precreate", "31034"))
+	ObserveErrno("precreate", 0)
+	ObserveErrno("precreate", errnoRateLimit)
+	ObserveErrno("precreate", -6)
+	if got := testutil.ToFloat64(APIErrors.WithLabelValues("precreate", "31034")) - apiErrors; got != 1 {
+		t.Fatalf("api errors: got %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(APIErrors.WithLabelValues("precreate", "-6")); got != 1 {
+		t.Fatalf("errno -6: got %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(RateLimitHits) - hits; got != 1 {
+		t.Fatalf("rate limit hits: got %v, want 1", got)
+	}
+}
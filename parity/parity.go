@@ -0,0 +1,260 @@
+// Package parity protects uploaded content with Reed-Solomon parity, so
+// blocks the cloud corrupted or cut off can be rebuilt after download.
+//
+// The content is split into stripes of Data shards of ShardSize bytes,
+// the last one padded with zeros. The parity file holds, per stripe, the
+// SHA-256 of every data and parity shard followed by the Parity parity
+// shards. A shard whose hash does not match is treated as lost, a stripe
+// with up to Parity lost shards is repaired.
+package parity
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	// magic 之后是数据分片数、校验分片数 (各一个字节)、分片大小 (4 字节) 和内容大小 (8 字节)
+	magic      = "BKTPAR\x00\x01"
+	headerSize = len(magic) + 1 + 1 + 4 + 8
+
+	maxShardSize = 16 << 20
+)
+
+var (
+	ErrNotParity    = errors.New("parity: not a parity file")
+	ErrUnrepairable = errors.New("parity: too many damaged blocks")
+)
+
+// Params is how content is split, Parity shards more per Data shards
+// cost Parity/Data of the content in storage.
+type Params struct {
+	Data      int
+	Parity    int
+	ShardSize int
+}
+
+// DefaultParams 每 10 个 64 KiB 的分片有 2 个校验分片, 多占用 20% 的空间
+var DefaultParams = Params{Data: 10, Parity: 2, ShardSize: 64 << 10}
+
+// Enabled reports whether p writes parity.
+func (p Params) Enabled() bool {
+	return p.Parity > 0
+}
+
+func (p Params) check() error {
+	if p.Data < 1 || p.Parity < 1 || p.Data+p.Parity > 256 || p.ShardSize < 1 || p.ShardSize > maxShardSize {
+		return fmt.Errorf("parity: invalid parameters %d+%d shards of %d bytes", p.Data, p.Parity, p.ShardSize)
+	}
+	return nil
+}
+
+// stripe is the data of one stripe, hashes and parity of its record.
+func (p Params) stripe() int64 {
+	return int64(p.Data) * int64(p.ShardSize)
+}
+
+func (p Params) record() int64 {
+	return int64(p.Data+p.Parity)*sha256.Size + int64(p.Parity)*int64(p.ShardSize)
+}
+
+// Size returns the size of the parity of size bytes of content.
+func Size(size int64, p Params) int64 {
+	stripes := (size + p.stripe() - 1) / p.stripe()
+	return int64(headerSize) + stripes*p.record()
+}
+
+// split points shards at their part of buf, the data shards come first.
+func split(buf []byte, shards [][]byte, p Params) {
+	for i := range shards {
+		shards[i] = buf[i*p.ShardSize : (i+1)*p.ShardSize : (i+1)*p.ShardSize]
+	}
+}
+
+// Encode writes the parity of the size bytes read from r to w.
+func Encode(w io.Writer, r io.Reader, size int64, p Params) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	enc, err := reedsolomon.New(p.Data, p.Parity)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[len(magic)] = byte(p.Data)
+	header[len(magic)+1] = byte(p.Parity)
+	binary.BigEndian.PutUint32(header[len(magic)+2:], uint32(p.ShardSize))
+	binary.BigEndian.PutUint64(header[len(magic)+6:], uint64(size))
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	buf := make([]byte, (p.Data+p.Parity)*p.ShardSize)
+	shards := make([][]byte, p.Data+p.Parity)
+	split(buf, shards, p)
+	data := buf[:p.stripe()]
+	for off := int64(0); off < size; off += p.stripe() {
+		n := min(size-off, p.stripe())
+		if _, err := io.ReadFull(r, data[:n]); err != nil {
+			return err
+		}
+		clear(data[n:])
+		if err := enc.Encode(shards); err != nil {
+			return err
+		}
+		for _, s := range shards {
+			sum := sha256.Sum256(s)
+			bw.Write(sum[:])
+		}
+		for _, s := range shards[p.Data:] {
+			bw.Write(s)
+		}
+	}
+	return bw.Flush()
+}
+
+// EncodeFile writes the parity of the file src to dst.
+func EncodeFile(src, dst string, p Params) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = Encode(out, in, info.Size(), p)
+	if e := out.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+func readHeader(r io.Reader) (Params, int64, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(magic)]) != magic {
+		return Params{}, 0, ErrNotParity
+	}
+	p := Params{
+		Data:      int(header[len(magic)]),
+		Parity:    int(header[len(magic)+1]),
+		ShardSize: int(binary.BigEndian.Uint32(header[len(magic)+2:])),
+	}
+	size := int64(binary.BigEndian.Uint64(header[len(magic)+6:]))
+	if err := p.check(); err != nil || size < 0 {
+		return Params{}, 0, ErrNotParity
+	}
+	return p, size, nil
+}
+
+// Repair checks the file path against the parity file parityPath and
+// rebuilds its damaged shards in place; a file that is too long is cut,
+// one that was cut off is rebuilt. It returns how many data shards were
+// repaired, and ErrUnrepairable when a stripe lost more shards than it
+// has parity.
+func Repair(path, parityPath string) (int, error) {
+	pf, err := os.Open(parityPath)
+	if err != nil {
+		return 0, err
+	}
+	defer pf.Close()
+	pr := bufio.NewReader(pf)
+	p, size, err := readHeader(pr)
+	if err != nil {
+		return 0, err
+	}
+	enc, err := reedsolomon.New(p.Data, p.Parity)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	repaired := 0
+	sums := make([]byte, (p.Data+p.Parity)*sha256.Size)
+	buf := make([]byte, (p.Data+p.Parity)*p.ShardSize)
+	shards := make([][]byte, p.Data+p.Parity)
+	data := buf[:p.stripe()]
+	for off := int64(0); off < size; off += p.stripe() {
+		split(buf, shards, p)
+		if _, err := io.ReadFull(pr, sums); err != nil {
+			return repaired, fmt.Errorf("parity of stripe at %d: %w", off, ErrNotParity)
+		}
+		for _, s := range shards[p.Data:] {
+			if _, err := io.ReadFull(pr, s); err != nil {
+				return repaired, fmt.Errorf("parity of stripe at %d: %w", off, ErrNotParity)
+			}
+		}
+		// 截断的部分读不到, 当作损坏的分片
+		n := min(size-off, p.stripe())
+		got, err := f.ReadAt(data[:n], off)
+		if err != nil && err != io.EOF {
+			return repaired, err
+		}
+		clear(data[got:])
+		var lost []int
+		for i, s := range shards {
+			sum := sha256.Sum256(s)
+			if !bytes.Equal(sum[:], sums[i*sha256.Size:(i+1)*sha256.Size]) {
+				lost = append(lost, i)
+				shards[i] = s[:0]
+			}
+		}
+		if len(lost) == 0 {
+			continue
+		}
+		if len(lost) > p.Parity {
+			return repaired, fmt.Errorf("stripe at %d: %d of %d shards damaged: %w", off, len(lost), p.Data+p.Parity, ErrUnrepairable)
+		}
+		if err := enc.ReconstructData(shards); err != nil {
+			return repaired, fmt.Errorf("stripe at %d: %w", off, err)
+		}
+		for _, i := range lost {
+			if i >= p.Data {
+				continue
+			}
+			sum := sha256.Sum256(shards[i])
+			if !bytes.Equal(sum[:], sums[i*sha256.Size:(i+1)*sha256.Size]) {
+				return repaired, fmt.Errorf("stripe at %d: %w", off, ErrUnrepairable)
+			}
+			start := off + int64(i)*int64(p.ShardSize)
+			if start >= size {
+				continue
+			}
+			if _, err := f.WriteAt(shards[i][:min(size-start, int64(p.ShardSize))], start); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return repaired, err
+	}
+	if info.Size() > size {
+		if err := f.Truncate(size); err != nil {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
@@ -0,0 +1,95 @@
+package parity
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testParams = Params{Data: 4, Parity: 2, ShardSize: 4 << 10}
+
+func setup(t *testing.T, size int) (string, string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	dir := t.TempDir()
+	path, par := filepath.Join(dir, "data"), filepath.Join(dir, "data.par")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeFile(path, par, testParams); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(par)
+	if info.Size() != Size(int64(size), testParams) {
+		t.Fatalf("parity of %d bytes: %d, Size says %d", size, info.Size(), Size(int64(size), testParams))
+	}
+	return path, par, data
+}
+
+func damage(t *testing.T, path string, offsets ...int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, off := range offsets {
+		f.WriteAt([]byte("damaged"), off)
+	}
+}
+
+func check(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("content differs after repair: %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestRepair(t *testing.T) {
+	path, par, data := setup(t, 100<<10+123)
+
+	if n, err := Repair(path, par); err != nil || n != 0 {
+		t.Fatalf("intact file: %d %v", n, err)
+	}
+	// 同一组中两个分片损坏, 另一组中一个
+	damage(t, path, 100, 5000, 40000)
+	if n, err := Repair(path, par); err != nil || n != 3 {
+		t.Fatalf("repair: %d %v", n, err)
+	}
+	check(t, path, data)
+
+	// 截断的 5000 字节跨过三个分片, 多出来的内容删除
+	os.Truncate(path, int64(len(data)-5000))
+	if n, err := Repair(path, par); err != nil || n != 3 {
+		t.Fatalf("truncated: %d %v", n, err)
+	}
+	check(t, path, data)
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte("garbage"))
+	f.Close()
+	if _, err := Repair(path, par); err != nil {
+		t.Fatal(err)
+	}
+	check(t, path, data)
+
+	damage(t, path, 0, 5000, 9000)
+	if _, err := Repair(path, par); !errors.Is(err, ErrUnrepairable) {
+		t.Fatalf("three shards of a stripe: %v", err)
+	}
+	if _, err := Repair(par, path); !errors.Is(err, ErrNotParity) {
+		t.Fatalf("not a parity file: %v", err)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	path, par, data := setup(t, 0)
+	if n, err := Repair(path, par); err != nil || n != 0 {
+		t.Fatalf("empty: %d %v", n, err)
+	}
+	check(t, path, data)
+}
@@ -0,0 +1,116 @@
+package progress
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	KindUpload   = "upload"
+	KindDownload = "download"
+)
+
+// finishedKeep 传输完成后在列表中保留的时间, 方便页面看到最终状态
+const finishedKeep = 30 * time.Second
+
+// Transfer 记录一个正在进行的上传或下载
+type Transfer struct {
+	ID       uint64
+	Kind     string
+	Name     string
+	Total    int64
+	done     int64
+	Started  time.Time
+	Finished time.Time
+	Err      string
+}
+
+// TransferStatus 是 Transfer 在某一时刻的快照
+type TransferStatus struct {
+	ID       uint64    `json:"id"`
+	Kind     string    `json:"kind"`
+	Name     string    `json:"name"`
+	Total    int64     `json:"total"`
+	Done     int64     `json:"done"`
+	Percent  float64   `json:"percent"`
+	Started  time.Time `json:"started"`
+	Finished bool      `json:"finished"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var (
+	mu        sync.Mutex
+	nextID    uint64
+	transfers = make(map[uint64]*Transfer)
+)
+
+// Start registers a new transfer of total bytes and returns it.
+func Start(kind, name string, total int64) *Transfer {
+	mu.Lock()
+	defer mu.Unlock()
+	nextID++
+	t := &Transfer{
+		ID:      nextID,
+		Kind:    kind,
+		Name:    name,
+		Total:   total,
+		Started: time.Now(),
+	}
+	transfers[t.ID] = t
+	return t
+}
+
+// Add marks n more bytes as transferred.
+func (t *Transfer) Add(n int64) {
+	atomic.AddInt64(&t.done, n)
+}
+
+// Write implements io.Writer so a Transfer can be used with io.MultiWriter.
+func (t *Transfer) Write(p []byte) (int, error) {
+	t.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Finish marks the transfer as completed, err may be nil.
+func (t *Transfer) Finish(err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	t.Finished = time.Now()
+	if err != nil {
+		t.Err = err.Error()
+	}
+}
+
+// List returns the running transfers and the recently finished ones,
+// oldest first.
+func List() []TransferStatus {
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	list := make([]TransferStatus, 0, len(transfers))
+	for id, t := range transfers {
+		if !t.Finished.IsZero() && now.Sub(t.Finished) > finishedKeep {
+			delete(transfers, id)
+			continue
+		}
+		done := atomic.LoadInt64(&t.done)
+		status := TransferStatus{
+			ID:       t.ID,
+			Kind:     t.Kind,
+			Name:     t.Name,
+			Total:    t.Total,
+			Done:     done,
+			Started:  t.Started,
+			Finished: !t.Finished.IsZero(),
+			Error:    t.Err,
+		}
+		if t.Total > 0 {
+			status.Percent = float64(done) / float64(t.Total) * 100
+		}
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
@@ -0,0 +1,56 @@
+package progress
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func find(id uint64) (TransferStatus, bool) {
+	for _, s := range List() {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return TransferStatus{}, false
+}
+
+func TestTransfer(t *testing.T) {
+	up := Start(KindUpload, "a.txt", 200)
+	down := Start(KindDownload, "b.txt", 0)
+	up.Add(50)
+	io.Copy(up, strings.NewReader(strings.Repeat("x", 50)))
+
+	s, ok := find(up.ID)
+	if !ok || s.Done != 100 || s.Percent != 50 || s.Finished {
+		t.Fatalf("upload: %+v", s)
+	}
+	// 大小未知时不计算百分比
+	if s, _ := find(down.ID); s.Percent != 0 {
+		t.Fatalf("download: %+v", s)
+	}
+	list := List()
+	for i := 1; i < len(list); i++ {
+		if list[i-1].ID > list[i].ID {
+			t.Fatal("list not oldest first")
+		}
+	}
+
+	down.Finish(errors.New("stalled"))
+	if s, _ := find(down.ID); !s.Finished || s.Error != "stalled" {
+		t.Fatalf("finished download: %+v", s)
+	}
+	// 完成超过 finishedKeep 的传输从列表中移除
+	mu.Lock()
+	down.Finished = time.Now().Add(-finishedKeep - time.Second)
+	mu.Unlock()
+	if _, ok := find(down.ID); ok {
+		t.Fatal("old transfer still listed")
+	}
+	up.Finish(nil)
+	if s, ok := find(up.ID); !ok || !s.Finished || s.Error != "" {
+		t.Fatalf("finished upload: %+v", s)
+	}
+}
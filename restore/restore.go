@@ -0,0 +1,333 @@
+// Package restore downloads the files of a snapshot back to a local folder
+// as they were when the snapshot was taken.
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/cloudsync"
+	"github.com/wangxso/backuptool/download"
+	"github.com/wangxso/backuptool/snapshot"
+)
+
+// DefaultParallel 是同时下载的文件数
+const DefaultParallel = 4
+
+var (
+	ErrHashMismatch = errors.New("content does not match the snapshot")
+	ErrUnsafePath   = errors.New("path escapes the target folder")
+	ErrTargetDenied = errors.New("target is not an absolute path under a restore root")
+)
+
+// Options selects what to restore and where.
+type Options struct {
+	Job string `json:"job"`
+	// Snapshot 为快照 ID 或 latest; 为空时使用 At 之前最新的快照, 都为空时使用最新的快照
+	Snapshot string    `json:"snapshot"`
+	At       time.Time `json:"at"`
+	// Globs 过滤相对路径, 例如 docs/*.txt; 匹配目录时恢复其下所有文件, 不含 / 的模式也匹配文件名
+	Globs []string `json:"globs"`
+	// Target 为空时恢复到快照的源目录
+	Target string `json:"target"`
+	// Overwrite 为 false 时跳过本地已存在的文件, 为 true 时覆盖内容不同的文件
+	Overwrite bool `json:"overwrite"`
+	Parallel  int  `json:"parallel"`
+}
+
+// Find returns the snapshot selected by opts.
+func Find(opts Options) (*snapshot.Manifest, error) {
+	switch {
+	case opts.Snapshot != "":
+		return snapshot.Load(opts.Job, opts.Snapshot)
+	case !opts.At.IsZero():
+		return snapshot.At(opts.Job, opts.At)
+	}
+	return snapshot.Load(opts.Job, snapshot.Latest)
+}
+
+// Restore downloads the files of the snapshot selected by opts that match
+// opts.Globs into opts.Target with their relative layout. Every file is
+// downloaded to a temporary file next to it and checked against the hash
+// of the manifest before it replaces the local file, then gets the mode
+// and modification time of the snapshot. A file that fails is recorded in
+// Result.Failed and the others go on. Prune and Rotate of the job wait
+// until the restore is done, see snapshot.LockRead.
+func Restore(ctx context.Context, opts Options) (*snapshot.Manifest, cloudsync.Result, error) {
+	var result cloudsync.Result
+	if err := checkGlobs(opts.Globs); err != nil {
+		return nil, result, err
+	}
+	// 恢复期间 prune 和 rotate 不能删除或改写要下载的内容
+	ctx, unlock, err := snapshot.LockRead(ctx, opts.Job)
+	if err != nil {
+		return nil, result, err
+	}
+	defer unlock()
+	m, err := Find(opts)
+	if err != nil {
+		return nil, result, err
+	}
+	target := opts.Target
+	if target == "" {
+		target = m.Source
+	}
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = DefaultParallel
+	}
+	logrus.Infof("[Restore %s] snapshot %s -> %s", m.Job, m.ID, target)
+	// 轮换过密钥的内容使用索引中的 wraps 解密
+	objects, err := snapshot.Objects(m.Job)
+	if err != nil {
+		return m, result, err
+	}
+	// repository 模式的文件由块拼接, 每个 pack 只下载一次
+	var asm *snapshot.Assembler
+	for _, e := range m.Files {
+		if e.Chunked() && Match(e.Path, opts.Globs) {
+			if asm, err = snapshot.NewAssembler(m.Job); err != nil {
+				return m, result, err
+			}
+			defer asm.Close()
+			break
+		}
+	}
+
+	var mu sync.Mutex
+	entries := make(chan snapshot.Entry)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				obj, _ := snapshot.ObjectOf(objects, e)
+				fetch := func(dst string) error {
+					if obj.Bundle != nil {
+						if obj.Bundle.Length == 0 {
+							// 旧版本打包的空文件, dst 已经是空文件
+							return nil
+						}
+						// tar 包中的文件只下载自己的部分
+						return download.DownloadRange(ctx, uint64(e.FsID), obj.Bundle.Offset, obj.Bundle.Length, dst, obj.Encoding())
+					}
+					return download.DownloadObject(ctx, uint64(e.FsID), dst, obj.Encoding())
+				}
+				if e.Chunked() {
+					fetch = func(dst string) error { return assemble(ctx, asm, e, dst) }
+				}
+				restored, err := restoreFile(e, target, opts.Overwrite, fetch)
+				if err != nil && obj.ParityFsID != 0 && ctx.Err() == nil {
+					// 内容损坏时下载校验文件修复后再试一次
+					logrus.Warnf("[Restore %s] %s: %v, repair with parity", m.Job, e.Path, err)
+					restored, err = restoreFile(e, target, opts.Overwrite, func(dst string) error {
+						var offset, length int64
+						if obj.Bundle != nil {
+							offset, length = obj.Bundle.Offset, obj.Bundle.Length
+						}
+						return download.DownloadRepaired(ctx, uint64(e.FsID), uint64(obj.ParityFsID), offset, length, dst, obj.Encoding())
+					})
+				}
+				mu.Lock()
+				switch {
+				case err != nil:
+					result.Fail(e.Path, err)
+				case restored:
+					result.Downloaded++
+				default:
+					result.Skipped++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, e := range m.Files {
+		if !Match(e.Path, opts.Globs) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		result.Waiting++
+		entries <- e
+	}
+	close(entries)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return m, result, err
+	}
+	logrus.Infof("[Restore %s] %s: %d restored, %d skipped, %d failed",
+		m.Job, m.ID, result.Downloaded, result.Skipped, len(result.Failed))
+	return m, result, nil
+}
+
+func checkGlobs(globs []string) error {
+	for _, g := range globs {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("glob %q: %w", g, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the relative path p is selected by globs, every
+// path is selected when there are none.
+func Match(p string, globs []string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, g := range globs {
+		g = strings.Trim(g, "/")
+		for dir := p; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if ok, _ := path.Match(g, dir); ok {
+				return true
+			}
+		}
+		if !strings.Contains(g, "/") {
+			if ok, _ := path.Match(g, path.Base(p)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// assemble writes the chunks of e into the file dst.
+func assemble(ctx context.Context, asm *snapshot.Assembler, e snapshot.Entry, dst string) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = asm.Assemble(ctx, e, f)
+	if e := f.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// restoreFile restores e under target with the content fetch writes into
+// a temporary file, it reports false when the local file was kept.
+func restoreFile(e snapshot.Entry, target string, overwrite bool, fetch func(dst string) error) (bool, error) {
+	rel := filepath.FromSlash(e.Path)
+	if !filepath.IsLocal(rel) {
+		return false, ErrUnsafePath
+	}
+	// 目标目录中的符号链接可能指向目录之外
+	if err := checkSymlinks(target, rel); err != nil {
+		return false, err
+	}
+	dst := filepath.Join(target, rel)
+	if _, err := os.Lstat(dst); err == nil {
+		if !overwrite {
+			return false, nil
+		}
+		// 内容相同的文件不再下载
+		if sum, err := snapshot.HashFile(dst); err == nil && sum == e.SHA256 {
+			return false, nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".restore-*")
+	if err != nil {
+		return false, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := fetch(tmp.Name()); err != nil {
+		return false, err
+	}
+	sum, err := snapshot.HashFile(tmp.Name())
+	if err != nil {
+		return false, err
+	}
+	if sum != e.SHA256 {
+		return false, fmt.Errorf("%s: %w", e.Path, ErrHashMismatch)
+	}
+	if e.Mode != 0 {
+		if err := os.Chmod(tmp.Name(), os.FileMode(e.Mode)); err != nil {
+			return false, err
+		}
+	}
+	if err := os.Chtimes(tmp.Name(), e.ModTime, e.ModTime); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CheckTarget reports whether target may be restored to: an absolute path
+// inside one of roots, with no symlink between the root and the target.
+// Roots themselves are trusted.
+func CheckTarget(target string, roots []string) error {
+	if !filepath.IsAbs(target) {
+		return ErrTargetDenied
+	}
+	target = filepath.Clean(target)
+	for _, root := range roots {
+		if !filepath.IsAbs(root) {
+			continue
+		}
+		rel, err := filepath.Rel(filepath.Clean(root), target)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		return checkSymlinks(root, rel)
+	}
+	return ErrTargetDenied
+}
+
+// checkSymlinks returns ErrUnsafePath when an existing component of rel
+// under root is a symlink.
+func checkSymlinks(root, rel string) error {
+	p := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if name == "." || name == "" {
+			continue
+		}
+		p = filepath.Join(p, name)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink: %w", p, ErrUnsafePath)
+		}
+	}
+	return nil
+}
+
+// ParseTime parses the time of a point-in-time restore in local time:
+// RFC 3339, "2006-01-02 15:04:05", "2006-01-02 15:04" or "2006-01-02",
+// a date alone means the end of that day.
+func ParseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
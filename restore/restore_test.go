@@ -0,0 +1,590 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangxso/backuptool/chunker"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/fakepan"
+	"github.com/wangxso/backuptool/snapshot"
+)
+
+func writeFile(t *testing.T, path string, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// takeTwo takes a snapshot of a.txt and docs/b.txt, changes both and takes
+// another one.
+func takeTwo(t *testing.T) (first, second *snapshot.Manifest) {
+	t.Helper()
+	dir := t.TempDir()
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup"}
+	writeFile(t, filepath.Join(dir, "a.txt"), "a version 1")
+	writeFile(t, filepath.Join(dir, "docs", "b.txt"), "b version 1")
+	writeFile(t, filepath.Join(dir, "docs", "c.md"), "c")
+	ctx := context.Background()
+	first, _, err := snapshot.Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "a.txt"), "a version 2")
+	writeFile(t, filepath.Join(dir, "docs", "b.txt"), "b version 2")
+	second, _, err = snapshot.Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return first, second
+}
+
+func TestRestore(t *testing.T) {
+	fakepan.Setup(t)
+	first, second := takeTwo(t)
+	ctx := context.Background()
+
+	target := t.TempDir()
+	m, result, err := Restore(ctx, Options{Job: "docs", Snapshot: first.ID, Target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != first.ID || result.Downloaded != 3 || len(result.Failed) != 0 {
+		t.Fatalf("restore %s: %+v", m.ID, result)
+	}
+	if got := readFile(t, filepath.Join(target, "docs", "b.txt")); got != "b version 1" {
+		t.Fatalf("b.txt: %q", got)
+	}
+	info, err := os.Stat(filepath.Join(target, "a.txt"))
+	if err != nil || !info.ModTime().Equal(entry(t, first, "a.txt").ModTime) {
+		t.Fatalf("a.txt modification time: %v %v", info, err)
+	}
+
+	// 默认跳过本地已有的文件
+	_, result, err = Restore(ctx, Options{Job: "docs", Target: target})
+	if err != nil || result.Downloaded != 0 || result.Skipped != 3 {
+		t.Fatalf("restore without overwrite: %+v %v", result, err)
+	}
+	if got := readFile(t, filepath.Join(target, "a.txt")); got != "a version 1" {
+		t.Fatalf("a.txt overwritten: %q", got)
+	}
+	// 覆盖时内容相同的 c.md 不再下载
+	_, result, err = Restore(ctx, Options{Job: "docs", Target: target, Overwrite: true})
+	if err != nil || result.Downloaded != 2 || result.Skipped != 1 {
+		t.Fatalf("restore with overwrite: %+v %v", result, err)
+	}
+	if got := readFile(t, filepath.Join(target, "a.txt")); got != "a version 2" {
+		t.Fatalf("a.txt: %q", got)
+	}
+
+	// 按时间选择快照
+	m, err = Find(Options{Job: "docs", At: second.Created.Add(-time.Nanosecond)})
+	if err != nil || m.ID != first.ID {
+		t.Fatalf("at: %v %v", m, err)
+	}
+	if _, err := Find(Options{Job: "docs", At: first.Created.Add(-time.Second)}); !errors.Is(err, snapshot.ErrNotFound) {
+		t.Fatalf("before the first snapshot: %v", err)
+	}
+}
+
+func TestRestoreGlobs(t *testing.T) {
+	fakepan.Setup(t)
+	takeTwo(t)
+	for _, tc := range []struct {
+		globs []string
+		want  []string
+	}{
+		{[]string{"docs"}, []string{"docs/b.txt", "docs/c.md"}},
+		{[]string{"*.txt"}, []string{"a.txt", "docs/b.txt"}},
+		{[]string{"docs/*.md", "a.txt"}, []string{"a.txt", "docs/c.md"}},
+		{[]string{"nothing"}, nil},
+	} {
+		target := t.TempDir()
+		_, result, err := Restore(context.Background(), Options{Job: "docs", Globs: tc.globs, Target: target, Parallel: 1})
+		if err != nil || result.Downloaded != len(tc.want) {
+			t.Fatalf("%v: %+v %v", tc.globs, result, err)
+		}
+		for _, p := range tc.want {
+			if _, err := os.Stat(filepath.Join(target, p)); err != nil {
+				t.Errorf("%v: %v", tc.globs, err)
+			}
+		}
+	}
+	if _, _, err := Restore(context.Background(), Options{Job: "docs", Globs: []string{"["}}); err == nil {
+		t.Fatal("bad glob accepted")
+	}
+}
+
+func TestRestoreHashMismatch(t *testing.T) {
+	pan := fakepan.Setup(t)
+	_, second := takeTwo(t)
+	// 云端内容被篡改
+	pan.Put(entry(t, second, "a.txt").Object, []byte("tampered"))
+	target := t.TempDir()
+	_, result, err := Restore(context.Background(), Options{Job: "docs", Target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].Path != "a.txt" || result.Downloaded != 2 {
+		t.Fatalf("result: %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(target, "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("tampered file restored: %v", err)
+	}
+	left, _ := filepath.Glob(filepath.Join(target, ".a.txt.restore-*"))
+	if len(left) != 0 {
+		t.Fatalf("temporary files left: %v", left)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		glob string
+		want bool
+	}{
+		{"docs/b.txt", "docs", true},
+		{"docs/b.txt", "docs/", true},
+		{"docs/b.txt", "*.txt", true},
+		{"docs/b.txt", "doc", false},
+		{"docs/sub/b.txt", "docs/*", true},
+		{"a.txt", "docs/*.txt", false},
+	} {
+		if got := Match(tc.path, []string{tc.glob}); got != tc.want {
+			t.Errorf("Match(%q, %q) = %v", tc.path, tc.glob, got)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	day, err := ParseTime("2024-01-02")
+	if err != nil || day.Format("2006-01-02 15:04:05") != "2024-01-02 23:59:59" {
+		t.Fatalf("date: %v %v", day, err)
+	}
+	if _, err := ParseTime("2024-01-02T15:04:05+08:00"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseTime("yesterday"); err == nil {
+		t.Fatal("invalid time accepted")
+	}
+}
+
+func entry(t *testing.T, m *snapshot.Manifest, p string) snapshot.Entry {
+	t.Helper()
+	for _, f := range m.Files {
+		if f.Path == p {
+			return f
+		}
+	}
+	t.Fatalf("%s not in snapshot %s", p, m.ID)
+	return snapshot.Entry{}
+}
+
+func TestRestoreEncrypted(t *testing.T) {
+	pan := fakepan.Setup(t)
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if err := crypt.GenerateKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	config.BackUpConfig.Encryption.KeyFile = keyFile
+	dir := t.TempDir()
+	job := config.Job{Name: "hr", SourceDir: dir, TargetDir: "/apps/backup", Encrypt: true}
+	writeFile(t, filepath.Join(dir, "salaries.csv"), "alice,100")
+	// 大于 4MB 的文件分片上传
+	big := bytes.Repeat([]byte("confidential"), 500000)
+	writeFile(t, filepath.Join(dir, "big.bin"), string(big))
+
+	m, _, err := snapshot.Take(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range m.Files {
+		data, _ := pan.Get(f.Object)
+		if ok, _ := crypt.IsEncrypted(bytes.NewReader(data)); !ok || bytes.Contains(data, []byte("alice")) {
+			t.Fatalf("%s stored in the clear", f.Object)
+		}
+	}
+	if pan.Calls("superfile2") == 0 {
+		t.Fatal("big file not uploaded in slices")
+	}
+
+	target := t.TempDir()
+	_, result, err := Restore(context.Background(), Options{Job: "hr", Target: target})
+	if err != nil || result.Downloaded != 2 {
+		t.Fatalf("restore: %+v %v", result, err)
+	}
+	if got := readFile(t, filepath.Join(target, "salaries.csv")); got != "alice,100" {
+		t.Fatalf("salaries.csv: %q", got)
+	}
+	if got := readFile(t, filepath.Join(target, "big.bin")); got != string(big) {
+		t.Fatal("big.bin differs")
+	}
+
+	// 密钥不对时不恢复任何文件
+	other := filepath.Join(t.TempDir(), "other.key")
+	crypt.GenerateKeyFile(other)
+	config.BackUpConfig.Encryption.KeyFile = other
+	_, result, err = Restore(context.Background(), Options{Job: "hr", Target: t.TempDir()})
+	if err != nil || len(result.Failed) != 2 {
+		t.Fatalf("restore with another key: %+v %v", result, err)
+	}
+}
+
+func TestRestoreEncryptedNames(t *testing.T) {
+	pan := fakepan.Setup(t)
+	config.BackUpConfig.Encryption.Passphrase = "hr"
+	dir := t.TempDir()
+	job := config.Job{Name: "hr", SourceDir: dir, TargetDir: "/apps/backup", EncryptNames: true}
+	// 加密后超过 96 字节的文件名在云端使用 "~" 短名称
+	long := strings.Repeat("quarterly-salaries-", 4) + "2024.csv"
+	writeFile(t, filepath.Join(dir, "salaries", long), "alice,100")
+	ctx := context.Background()
+	if _, _, err := snapshot.Take(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	short := false
+	for _, p := range pan.Files() {
+		if strings.Contains(p, "salaries") {
+			t.Fatalf("plain name in the cloud: %s", p)
+		}
+		short = short || strings.Contains(p, "/~")
+	}
+	if !short {
+		t.Fatalf("no short name in the cloud: %v", pan.Files())
+	}
+
+	// 新机器: 长文件名和快照索引都从云端清单恢复
+	db.Client.Del(ctx, crypt.LONG_NAMES, snapshot.SNAPSHOTS+":hr", snapshot.SNAPSHOT_OBJECTS+":hr")
+	if _, err := snapshot.RebuildState(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := db.Client.HLen(ctx, crypt.LONG_NAMES).Result(); n == 0 {
+		t.Fatal("long names not rebuilt")
+	}
+	target := t.TempDir()
+	if _, result, err := Restore(ctx, Options{Job: "hr", Target: target}); err != nil || result.Downloaded != 1 {
+		t.Fatalf("restore: %+v %v", result, err)
+	}
+	if got := readFile(t, filepath.Join(target, "salaries", long)); got != "alice,100" {
+		t.Fatalf("%s: %q", long, got)
+	}
+}
+
+func TestRestoreLooksEncrypted(t *testing.T) {
+	fakepan.Setup(t)
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if err := crypt.GenerateKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	config.BackUpConfig.Encryption.KeyFile = keyFile
+	dir := t.TempDir()
+	job := config.Job{Name: "raw", SourceDir: dir, TargetDir: "/apps/backup"}
+	// 没有加密的文件, 内容恰好以加密文件头开始
+	data := "BKTENC\x00\x01 not really encrypted"
+	writeFile(t, filepath.Join(dir, "fake.bin"), data)
+	if _, _, err := snapshot.Take(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	if _, result, err := Restore(context.Background(), Options{Job: "raw", Target: target}); err != nil || result.Downloaded != 1 {
+		t.Fatalf("restore: %+v %v", result, err)
+	}
+	if got := readFile(t, filepath.Join(target, "fake.bin")); got != data {
+		t.Fatalf("fake.bin: %q", got)
+	}
+}
+
+func TestRestoreCompressed(t *testing.T) {
+	pan := fakepan.Setup(t)
+	config.BackUpConfig.Encryption.Passphrase = "exports"
+	dir := t.TempDir()
+	job := config.Job{Name: "exports", SourceDir: dir, TargetDir: "/apps/backup", Encrypt: true, Compress: "zstd"}
+	// 十六进制文本压缩后仍大于 4MB, 分片上传
+	random := make([]byte, 6<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+	big := hex.EncodeToString(random)
+	writeFile(t, filepath.Join(dir, "export.csv"), big)
+	writeFile(t, filepath.Join(dir, "photo.jpg"), "not really a jpeg")
+
+	m, _, err := snapshot.Take(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, _ := snapshot.Objects("exports")
+	csv, photo := entry(t, m, "export.csv"), entry(t, m, "photo.jpg")
+	if obj, _ := snapshot.ObjectOf(objects, csv); obj.Codec != "zstd" {
+		t.Fatalf("export.csv codec %q", obj.Codec)
+	}
+	if obj, _ := snapshot.ObjectOf(objects, photo); obj.Codec != "" {
+		t.Fatalf("photo.jpg compressed with %q", obj.Codec)
+	}
+	if stored, _ := pan.Get(csv.Object); len(stored) >= len(big)*3/4 {
+		t.Fatalf("export.csv stored with %d of %d bytes", len(stored), len(big))
+	}
+	if pan.Calls("superfile2") == 0 {
+		t.Fatal("compressed file not uploaded in slices")
+	}
+
+	target := t.TempDir()
+	_, result, err := Restore(context.Background(), Options{Job: "exports", Target: target})
+	if err != nil || result.Downloaded != 2 {
+		t.Fatalf("restore: %+v %v", result, err)
+	}
+	if got := readFile(t, filepath.Join(target, "export.csv")); got != big {
+		t.Fatal("export.csv differs")
+	}
+	if got := readFile(t, filepath.Join(target, "photo.jpg")); got != "not really a jpeg" {
+		t.Fatalf("photo.jpg: %q", got)
+	}
+}
+
+func TestRestoreRepository(t *testing.T) {
+	fakepan.Setup(t)
+	params, size := snapshot.ChunkParams, snapshot.PackSize
+	snapshot.ChunkParams = chunker.Params{Min: 4 << 10, Avg: 16 << 10, Max: 64 << 10}
+	snapshot.PackSize = 128 << 10
+	t.Cleanup(func() { snapshot.ChunkParams, snapshot.PackSize = params, size })
+	config.BackUpConfig.Encryption.Passphrase = "db"
+	dir := t.TempDir()
+	job := config.Job{Name: "db", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_REPOSITORY, Encrypt: true, Compress: "zstd"}
+	random := make([]byte, 300<<10)
+	rand.New(rand.NewSource(2)).Read(random)
+	dump := hex.EncodeToString(random)
+	writeFile(t, filepath.Join(dir, "db.dump"), dump)
+	writeFile(t, filepath.Join(dir, "conf", "my.cnf"), "[mysqld]")
+	writeFile(t, filepath.Join(dir, "empty"), "")
+
+	if _, _, err := snapshot.Take(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	_, result, err := Restore(context.Background(), Options{Job: "db", Target: target, Parallel: 3})
+	if err != nil || result.Downloaded != 3 || len(result.Failed) != 0 {
+		t.Fatalf("restore: %+v %v", result, err)
+	}
+	if got := readFile(t, filepath.Join(target, "db.dump")); got != dump {
+		t.Fatal("db.dump differs")
+	}
+	if got := readFile(t, filepath.Join(target, "conf", "my.cnf")); got != "[mysqld]" {
+		t.Fatalf("my.cnf: %q", got)
+	}
+	if got := readFile(t, filepath.Join(target, "empty")); got != "" {
+		t.Fatalf("empty: %q", got)
+	}
+}
+
+func TestRestoreBundled(t *testing.T) {
+	fakepan.Setup(t)
+	config.BackUpConfig.Encryption.Passphrase = "mail"
+	dir := t.TempDir()
+	job := config.Job{Name: "mail", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_SNAPSHOT,
+		Encrypt: true, Compress: "gzip", Bundle: config.Bundle{MaxFileSize: "4KB", Size: "16KB"}}
+	want := make(map[string]string)
+	for i := 0; i < 12; i++ {
+		p := "inbox/" + strings.Repeat("m", i+1) + ".eml"
+		want[p] = strings.Repeat("Subject: hello\n", 10*(i+1))
+		writeFile(t, filepath.Join(dir, filepath.FromSlash(p)), want[p])
+	}
+	m, _, err := snapshot.Take(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, _ := snapshot.Objects("mail")
+	obj, _ := snapshot.ObjectOf(objects, entry(t, m, "inbox/mmm.eml"))
+	if obj.Bundle == nil || obj.Codec != "gzip" || len(obj.Wraps) == 0 {
+		t.Fatalf("inbox/mmm.eml: %+v", obj)
+	}
+
+	// 只恢复一个文件, 按偏移从 tar 包中读取后解密、解压
+	target := t.TempDir()
+	_, result, err := Restore(context.Background(), Options{Job: "mail", Target: target, Globs: []string{"mmm.eml"}})
+	if err != nil || result.Downloaded != 1 {
+		t.Fatalf("restore one: %+v %v", result, err)
+	}
+	if got := readFile(t, filepath.Join(target, "inbox", "mmm.eml")); got != want["inbox/mmm.eml"] {
+		t.Fatalf("mmm.eml: %q", got)
+	}
+	_, result, err = Restore(context.Background(), Options{Job: "mail", Target: target, Overwrite: true})
+	if err != nil || result.Downloaded != 11 || len(result.Failed) != 0 {
+		t.Fatalf("restore all: %+v %v", result, err)
+	}
+	for p, data := range want {
+		if got := readFile(t, filepath.Join(target, filepath.FromSlash(p))); got != data {
+			t.Fatalf("%s: %q", p, got)
+		}
+	}
+}
+
+func TestRestoreBundledEmpty(t *testing.T) {
+	fakepan.Setup(t)
+	dir := t.TempDir()
+	job := config.Job{Name: "mail", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_SNAPSHOT,
+		Bundle: config.Bundle{MaxFileSize: "4KB"}}
+	writeFile(t, filepath.Join(dir, "empty.txt"), "")
+	writeFile(t, filepath.Join(dir, "a.txt"), "a")
+	m, _, err := snapshot.Take(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, _ := snapshot.Objects("mail")
+	obj, _ := snapshot.ObjectOf(objects, entry(t, m, "empty.txt"))
+	if obj.Bundle != nil {
+		t.Fatalf("empty.txt bundled: %+v", obj.Bundle)
+	}
+	target := t.TempDir()
+	if _, result, err := Restore(context.Background(), Options{Job: "mail", Target: target}); err != nil || result.Downloaded != 2 {
+		t.Fatalf("restore: %+v %v", result, err)
+	}
+	if got := readFile(t, filepath.Join(target, "empty.txt")); got != "" {
+		t.Fatalf("empty.txt: %q", got)
+	}
+
+	// 旧版本把空文件作为长度为 0 的成员打包
+	obj.Bundle = &snapshot.Member{ID: "legacy"}
+	data, _ := json.Marshal(obj)
+	db.Client.HSet(context.Background(), snapshot.SNAPSHOT_OBJECTS+":mail", obj.SHA256, data)
+	target = t.TempDir()
+	if _, result, err := Restore(context.Background(), Options{Job: "mail", Target: target, Globs: []string{"empty.txt"}}); err != nil || result.Downloaded != 1 {
+		t.Fatalf("restore legacy: %+v %v", result, err)
+	}
+	if got := readFile(t, filepath.Join(target, "empty.txt")); got != "" {
+		t.Fatalf("legacy empty.txt: %q", got)
+	}
+}
+
+// damage changes the stored content of p in place, keeping its fs_id.
+func damage(pan *fakepan.Server, p string, change func([]byte) []byte) {
+	data, _ := pan.Get(p)
+	old, _ := pan.Stat(p)
+	pan.Put(p, change(append([]byte(nil), data...))).FsID = old.FsID
+}
+
+func TestRestoreRepaired(t *testing.T) {
+	pan := fakepan.Setup(t)
+	config.BackUpConfig.Encryption.Passphrase = "photos"
+	dir := t.TempDir()
+	par := config.Parity{ParityShards: 2, ShardSize: "4KB"}
+	random := make([]byte, 100<<10)
+	rand.New(rand.NewSource(3)).Read(random)
+	writeFile(t, filepath.Join(dir, "big.bin"), string(random))
+	writeFile(t, filepath.Join(dir, "notes", "a.txt"), strings.Repeat("a", 1000))
+	writeFile(t, filepath.Join(dir, "notes", "b.txt"), strings.Repeat("b", 1000))
+	jobs := []config.Job{
+		{Name: "photos", SourceDir: dir, TargetDir: "/apps/backup/photos", Mode: config.MODE_SNAPSHOT, Encrypt: true,
+			Parity: par, Bundle: config.Bundle{MaxFileSize: "2KB"}},
+		{Name: "vm", SourceDir: dir, TargetDir: "/apps/backup/vm", Mode: config.MODE_REPOSITORY, Parity: par},
+	}
+	for _, job := range jobs {
+		m, _, err := snapshot.Take(context.Background(), job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stored []string
+		if job.Mode == config.MODE_REPOSITORY {
+			packs, _ := snapshot.Packs(job.Name)
+			for _, pk := range packs {
+				stored = append(stored, pk.Path)
+				if pk.ParityFsID == 0 {
+					t.Fatalf("pack without parity: %+v", pk)
+				}
+			}
+		} else {
+			objects, _ := snapshot.Objects(job.Name)
+			big, _ := snapshot.ObjectOf(objects, entry(t, m, "big.bin"))
+			a, _ := snapshot.ObjectOf(objects, entry(t, m, "notes/a.txt"))
+			if big.ParityFsID == 0 || a.Bundle == nil || a.Parity != a.Path+".par" {
+				t.Fatalf("parity not recorded: %+v %+v", big, a)
+			}
+			stored = []string{big.Path, a.Path}
+		}
+		// 改掉开头的内容并截掉最后 3000 字节
+		for _, p := range stored {
+			damage(pan, p, func(data []byte) []byte {
+				copy(data[600:], "damaged")
+				return data[:len(data)-3000]
+			})
+		}
+
+		target := t.TempDir()
+		_, result, err := Restore(context.Background(), Options{Job: job.Name, Target: target})
+		if err != nil || result.Downloaded != 3 || len(result.Failed) != 0 {
+			t.Fatalf("%s: restore: %+v %v", job.Name, result, err)
+		}
+		if got := readFile(t, filepath.Join(target, "big.bin")); got != string(random) {
+			t.Fatalf("%s: big.bin differs", job.Name)
+		}
+		if got := readFile(t, filepath.Join(target, "notes", "a.txt")); got != strings.Repeat("a", 1000) {
+			t.Fatalf("%s: a.txt: %q", job.Name, got)
+		}
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	roots := []string{root}
+	cases := []struct {
+		target string
+		want   error
+	}{
+		{root, nil},
+		{filepath.Join(root, "docs", "new"), nil},
+		{filepath.Join(root, "..", "etc"), ErrTargetDenied},
+		{outside, ErrTargetDenied},
+		{"docs", ErrTargetDenied},
+		{filepath.Join(root, "link", "docs"), ErrUnsafePath},
+	}
+	for _, tc := range cases {
+		if err := CheckTarget(tc.target, roots); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.target, err, tc.want)
+		}
+	}
+}
+
+func TestRestoreSymlinkInTarget(t *testing.T) {
+	fakepan.Setup(t)
+	takeTwo(t)
+	target := t.TempDir()
+	outside := t.TempDir()
+	// 目标目录中的 docs 指向其他目录时不能写到目录之外
+	if err := os.Symlink(outside, filepath.Join(target, "docs")); err != nil {
+		t.Fatal(err)
+	}
+	_, result, err := Restore(context.Background(), Options{Job: "docs", Target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Downloaded != 1 || len(result.Failed) != 2 {
+		t.Fatalf("result: %+v", result)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Fatalf("restored through the symlink: %v", entries)
+	}
+}
@@ -0,0 +1,103 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/cloudsync"
+)
+
+// ErrRunning 同一时间只运行一个后台恢复
+var ErrRunning = errors.New("a restore is already running")
+
+// Status is the state of the background restore started by Start.
+type Status struct {
+	Options  Options          `json:"options"`
+	Snapshot string           `json:"snapshot,omitempty"`
+	Running  bool             `json:"running"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished,omitempty"`
+	Result   cloudsync.Result `json:"result"`
+	Error    string           `json:"error,omitempty"`
+}
+
+var (
+	mu      sync.Mutex
+	current *Status
+	cancel  context.CancelFunc
+	done    chan struct{}
+)
+
+// Start runs Restore in the background. The snapshot is looked up first,
+// so an unknown snapshot is reported at once.
+func Start(opts Options) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if current != nil && current.Running {
+		return ErrRunning
+	}
+	if err := checkGlobs(opts.Globs); err != nil {
+		return err
+	}
+	m, err := Find(opts)
+	if err != nil {
+		return err
+	}
+	// 固定为找到的快照, 运行期间新拍的快照不影响本次恢复
+	opts.Snapshot = m.ID
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	done = make(chan struct{})
+	status := &Status{Options: opts, Snapshot: m.ID, Running: true, Started: time.Now()}
+	current = status
+	go func(done chan struct{}) {
+		defer close(done)
+		_, result, err := Restore(ctx, opts)
+		if err != nil {
+			logrus.Errorf("[Restore %s] %v", opts.Job, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		status.Running = false
+		status.Finished = time.Now()
+		status.Result = result
+		if err != nil {
+			status.Error = err.Error()
+		}
+	}(done)
+	return nil
+}
+
+// Current returns a copy of the status of the last background restore, or
+// nil when none was started.
+func Current() *Status {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		return nil
+	}
+	s := *current
+	return &s
+}
+
+// Cancel stops the background restore and waits for it until ctx is done.
+// It does nothing when no restore is running.
+func Cancel(ctx context.Context) error {
+	mu.Lock()
+	if current == nil || !current.Running {
+		mu.Unlock()
+		return nil
+	}
+	cancel()
+	wait := done
+	mu.Unlock()
+	select {
+	case <-wait:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,453 @@
+// Package scrub downloads backed-up content again and checks it against
+// the local index, without writing it to disk. Content that is damaged or
+// missing in the cloud is marked in the index, so the next run of the job
+// uploads it again.
+package scrub
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/cloudsync"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/download"
+	"github.com/wangxso/backuptool/handler"
+	"github.com/wangxso/backuptool/snapshot"
+	"github.com/wangxso/backuptool/utils"
+)
+
+// Problem 的类型
+const (
+	MISMATCH = "mismatch"
+	MISSING  = "missing"
+)
+
+// md5Size 是同步模式记录源文件 md5 时读取的字节数
+const md5Size = 4096
+
+// sniffSize 猜测旧文件是否加密时读取的字节数
+const sniffSize = 16
+
+// errMismatch 表示下载的内容和索引中的哈希不同
+var errMismatch = errors.New("content does not match the index")
+
+// Options of a scrub.
+type Options struct {
+	// Sample 是抽查的比例, 0 或不小于 1 时检查全部内容
+	Sample float64
+	// Limit 是下载限速, 字节每秒, 0 表示不限速
+	Limit int64
+}
+
+// Problem is content that is damaged or missing in the cloud.
+type Problem struct {
+	Kind string `json:"kind"`
+	// Path 是云端路径, Files 是内容对应的本地文件 (相对源目录)
+	Path  string   `json:"path"`
+	Files []string `json:"files,omitempty"`
+	Error string   `json:"error"`
+}
+
+// Report is the result of a scrub. Content that could not be checked,
+// e.g. after a network error, is in Failed and not requeued.
+type Report struct {
+	Job      string                `json:"job"`
+	Checked  int                   `json:"checked"`
+	Bytes    int64                 `json:"bytes"`
+	Problems []Problem             `json:"problems,omitempty"`
+	Requeued int                   `json:"requeued"`
+	Failed   []cloudsync.FileError `json:"failed,omitempty"`
+	// Repaired 是损坏但可以用校验文件修复的内容, 恢复时自动修复, 不重新上传
+	Repaired []string `json:"repaired,omitempty"`
+	// PrefixOnly 是同步模式中没有记录 sha256 的文件, 只校验了前 4096 字节, 不计入 Checked
+	PrefixOnly []string `json:"prefixOnly,omitempty"`
+}
+
+type scrubber struct {
+	job    config.Job
+	opts   Options
+	limit  *utils.Limiter
+	rand   *rand.Rand
+	report *Report
+}
+
+// Scrub checks the content job uploaded: the versions or packs of a
+// snapshot or repository job, the files of the target folder of a sync
+// job. Each object is checked with probability opts.Sample.
+func Scrub(ctx context.Context, job config.Job, opts Options) (*Report, error) {
+	if db.Client == nil {
+		return nil, snapshot.ErrNoRedis
+	}
+	s := &scrubber{
+		job:    job,
+		opts:   opts,
+		limit:  utils.NewLimiter(opts.Limit),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		report: &Report{Job: job.Name},
+	}
+	var err error
+	switch {
+	case job.Mode == config.MODE_REPOSITORY:
+		err = s.repository(ctx)
+	case job.Snapshots():
+		err = s.snapshots(ctx)
+	default:
+		err = s.sync(ctx)
+	}
+	logrus.Infof("[Scrub %s] %d checked, %d prefix only, %d bytes, %d problems, %d requeued, %d failed",
+		job.Name, s.report.Checked, len(s.report.PrefixOnly), s.report.Bytes, len(s.report.Problems), s.report.Requeued, len(s.report.Failed))
+	return s.report, err
+}
+
+func (s *scrubber) sampled() bool {
+	if s.opts.Sample <= 0 || s.opts.Sample >= 1 {
+		return true
+	}
+	return s.rand.Float64() < s.opts.Sample
+}
+
+// read streams the content fid, or only rng when it is not nil, decoded
+// as enc says, to fn. A nil enc is guessed from the content, for files
+// uploaded before their encoding was recorded.
+func (s *scrubber) read(ctx context.Context, fid int64, rng *download.Range, enc *download.Encoding, fn func(io.Reader) error) error {
+	body, err := download.Open(ctx, uint64(fid), rng)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	cr := &countReader{r: s.limit.Reader(ctx, body)}
+	defer func() { s.report.Bytes += cr.n }()
+	r := io.Reader(cr)
+	if enc == nil {
+		br := bufio.NewReader(cr)
+		head, _ := br.Peek(sniffSize)
+		guess := download.Sniff(head)
+		r, enc = br, &guess
+	}
+	plain, err := download.Decode(r, *enc)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	return fn(plain)
+}
+
+// record adds the outcome err of checking path to the report and calls
+// requeue for a problem.
+func (s *scrubber) record(path string, files []string, err error, requeue func() error) {
+	kind := classify(err)
+	switch kind {
+	case "":
+		s.report.Checked++
+		return
+	case MISMATCH, MISSING:
+		s.report.Checked++
+	default:
+		logrus.Warnf("[Scrub %s] %s: %v", s.job.Name, path, err)
+		s.report.Failed = append(s.report.Failed, cloudsync.FileError{Path: path, Error: err.Error()})
+		return
+	}
+	logrus.Errorf("[Scrub %s] %s %s: %v", s.job.Name, kind, path, err)
+	s.report.Problems = append(s.report.Problems, Problem{Kind: kind, Path: path, Files: files, Error: err.Error()})
+	if e := requeue(); e != nil {
+		logrus.Errorf("[Scrub %s] requeue %s: %v", s.job.Name, path, e)
+		return
+	}
+	s.report.Requeued++
+}
+
+// classify returns MISMATCH or MISSING when err shows the content is
+// damaged or gone, "" for nil and "failed" when the check could not be
+// finished, e.g. a network error or a missing key, which is not requeued.
+func classify(err error) string {
+	var se handler.StatusError
+	var ne net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, handler.ClassNotFound),
+		errors.As(err, &se) && (se.StatusCode == http.StatusNotFound || se.StatusCode == http.StatusGone):
+		return MISSING
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, crypt.ErrNoKey), errors.Is(err, crypt.ErrNoIdentity),
+		errors.As(err, &se), errors.As(err, &ne):
+		return "failed"
+	}
+	var ce handler.CustomError
+	if errors.As(err, &ce) {
+		return "failed"
+	}
+	// 其他错误来自解密或解压, 例如 crypt.ErrAuth, 说明内容已损坏
+	return MISMATCH
+}
+
+// snapshots checks every version of a snapshot job against its sha256.
+func (s *scrubber) snapshots(ctx context.Context) error {
+	objects, err := snapshot.Objects(s.job.Name)
+	if err != nil {
+		return err
+	}
+	files := s.latestFiles(func(e snapshot.Entry) []string { return []string{e.SHA256} })
+	sums := make([]string, 0, len(objects))
+	for sum := range objects {
+		sums = append(sums, sum)
+	}
+	sort.Strings(sums)
+	for _, sum := range sums {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !s.sampled() {
+			continue
+		}
+		obj := objects[sum]
+		if obj.Damaged {
+			// 已经标记损坏, 等待下次快照重新上传
+			continue
+		}
+		var rng *download.Range
+		if obj.Bundle != nil {
+			rng = &download.Range{Offset: obj.Bundle.Offset, Length: obj.Bundle.Length}
+		}
+		enc := obj.Encoding()
+		err := s.read(ctx, obj.FsID, rng, &enc, func(r io.Reader) error {
+			h := sha256.New()
+			if _, err := io.Copy(h, r); err != nil {
+				return err
+			}
+			if hex.EncodeToString(h.Sum(nil)) != obj.SHA256 {
+				return errMismatch
+			}
+			return nil
+		})
+		if classify(err) == MISMATCH && obj.ParityFsID != 0 {
+			rerr := s.repair(ctx, obj)
+			if rerr == nil {
+				logrus.Warnf("[Scrub %s] %s damaged, repaired by its parity: %v", s.job.Name, obj.Path, err)
+				s.report.Checked++
+				s.report.Repaired = append(s.report.Repaired, obj.Path)
+				continue
+			}
+			logrus.Warnf("[Scrub %s] repair %s: %v", s.job.Name, obj.Path, rerr)
+		}
+		s.record(obj.Path, files[obj.SHA256], err, func() error { return snapshot.MarkDamaged(s.job.Name, sum) })
+	}
+	return ctx.Err()
+}
+
+// repair downloads obj with its parity file, repairs it like a restore
+// would and checks the result against its sha256.
+func (s *scrubber) repair(ctx context.Context, obj snapshot.Object) error {
+	dir, err := os.MkdirTemp(config.Get().General.TmpDir, "scrub-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	var offset, length int64
+	if obj.Bundle != nil {
+		offset, length = obj.Bundle.Offset, obj.Bundle.Length
+	}
+	local := filepath.Join(dir, "content")
+	if err := download.DownloadRepaired(ctx, uint64(obj.FsID), uint64(obj.ParityFsID), offset, length, local, obj.Encoding()); err != nil {
+		return err
+	}
+	sum, err := snapshot.HashFile(local)
+	if err != nil {
+		return err
+	}
+	if sum != obj.SHA256 {
+		return errMismatch
+	}
+	return nil
+}
+
+// repository checks the chunks of every pack of a repository job against
+// their sha256, reading each pack once.
+func (s *scrubber) repository(ctx context.Context) error {
+	packs, err := snapshot.Packs(s.job.Name)
+	if err != nil {
+		return err
+	}
+	chunks, err := snapshot.Chunks(s.job.Name)
+	if err != nil {
+		return err
+	}
+	files := s.latestFiles(func(e snapshot.Entry) []string { return e.Chunks })
+	ids := make([]string, 0, len(packs))
+	for id := range packs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !s.sampled() {
+			continue
+		}
+		pk := packs[id]
+		// 只检查索引指向这个 pack 的块, 已经重新上传到其他 pack 的块跳过
+		var own []string
+		for _, sum := range pk.Chunks {
+			if c, ok := chunks[sum]; ok && c.Pack == id {
+				own = append(own, sum)
+			}
+		}
+		if len(own) == 0 {
+			continue
+		}
+		sort.Slice(own, func(i, j int) bool { return chunks[own[i]].Offset < chunks[own[j]].Offset })
+		bad := own
+		enc := pk.Encoding()
+		err := s.read(ctx, pk.FsID, nil, &enc, func(r io.Reader) error {
+			bad = nil
+			var pos int64
+			for i, sum := range own {
+				c := chunks[sum]
+				if _, err := io.CopyN(io.Discard, r, c.Offset-pos); err != nil {
+					bad = own[i:]
+					return err
+				}
+				h := sha256.New()
+				if _, err := io.CopyN(h, r, c.Length); err != nil {
+					bad = own[i:]
+					return err
+				}
+				if hex.EncodeToString(h.Sum(nil)) != sum {
+					bad = append(bad, sum)
+				}
+				pos = c.Offset + c.Length
+			}
+			if len(bad) > 0 {
+				return fmt.Errorf("%d of %d chunks: %w", len(bad), len(own), errMismatch)
+			}
+			return nil
+		})
+		var affected []string
+		seen := make(map[string]bool)
+		for _, sum := range bad {
+			for _, f := range files[sum] {
+				if !seen[f] {
+					seen[f] = true
+					affected = append(affected, f)
+				}
+			}
+		}
+		sort.Strings(affected)
+		s.record(pk.Path, affected, err, func() error { return snapshot.DropChunks(s.job.Name, bad...) })
+	}
+	return ctx.Err()
+}
+
+// latestFiles maps the sums keys returns for each file of the latest
+// snapshot to the paths of the files.
+func (s *scrubber) latestFiles(keys func(snapshot.Entry) []string) map[string][]string {
+	ret := make(map[string][]string)
+	m, err := snapshot.Load(s.job.Name, snapshot.Latest)
+	if err != nil {
+		return ret
+	}
+	for _, f := range m.Files {
+		for _, sum := range keys(f) {
+			ret[sum] = append(ret[sum], f.Path)
+		}
+	}
+	return ret
+}
+
+// sync checks the files of the target folder of a sync job against the
+// sha256 of the source file recorded when it was uploaded and the md5 of
+// its first 4096 bytes. Files without a record were not uploaded by this
+// job and are skipped, files uploaded before the sha256 was recorded are
+// reported in PrefixOnly.
+func (s *scrubber) sync(ctx context.Context) error {
+	list, err := cloudsync.ListCloudFiles(ctx, s.job.TargetDir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	for _, v := range list {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if v.IsDir != 0 {
+			continue
+		}
+		want, err := db.Client.HGet(ctx, cloudsync.UPLOAD_PATHS, v.MD5).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !s.sampled() {
+			continue
+		}
+		meta, ok, err := cloudsync.LoadMeta(ctx, v.MD5)
+		if err != nil {
+			return err
+		}
+		var enc *download.Encoding
+		if ok {
+			e := meta.Encoding()
+			enc = &e
+		}
+		cloudMD5 := v.MD5
+		err = s.read(ctx, v.FsID, nil, enc, func(r io.Reader) error {
+			// 同 utils.CalculateMD5, UPLOAD_PATHS 记录的是前 4096 字节的 md5
+			h := md5.New()
+			full := sha256.New()
+			if _, err := io.CopyN(io.MultiWriter(h, full), r, md5Size); err != nil && err != io.EOF {
+				return err
+			}
+			if _, err := io.Copy(full, r); err != nil {
+				return err
+			}
+			if hex.EncodeToString(h.Sum(nil)) != want {
+				return errMismatch
+			}
+			if meta.SHA256 != "" && hex.EncodeToString(full.Sum(nil)) != meta.SHA256 {
+				return errMismatch
+			}
+			return nil
+		})
+		if err == nil && meta.SHA256 == "" {
+			// 没有记录 sha256 的文件 (旧版本上传) 只校验了前 4096 字节和能否解密、解压
+			s.report.PrefixOnly = append(s.report.PrefixOnly, v.Path)
+			continue
+		}
+		// 删除记录后下次同步时源文件和云端不一致, 重新上传覆盖
+		s.record(v.Path, nil, err, func() error {
+			return db.Client.HDel(ctx, cloudsync.UPLOAD_PATHS, cloudMD5).Err()
+		})
+	}
+	return ctx.Err()
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,245 @@
+package scrub
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wangxso/backuptool/cloudsync"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/fakepan"
+	"github.com/wangxso/backuptool/snapshot"
+)
+
+func writeFile(t *testing.T, path string, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// damage flips a byte of the stored content of p, keeping its fs_id and
+// the md5 the listing reports, like bit rot on the server.
+func damage(pan *fakepan.Server, p string) {
+	data, _ := pan.Get(p)
+	old, _ := pan.Stat(p)
+	data = append([]byte(nil), data...)
+	data[len(data)/2] ^= 0xff
+	f := pan.Put(p, data)
+	f.FsID, f.MD5 = old.FsID, old.MD5
+}
+
+func scrub(t *testing.T, job config.Job, opts Options) *Report {
+	t.Helper()
+	report, err := Scrub(context.Background(), job, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestScrubSnapshot(t *testing.T) {
+	pan := fakepan.Setup(t)
+	config.BackUpConfig.Encryption.Passphrase = "photos"
+	dir := t.TempDir()
+	job := config.Job{Name: "photos", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_SNAPSHOT,
+		Encrypt: true, Compress: "gzip", Bundle: config.Bundle{MaxFileSize: "2KB"}}
+	writeFile(t, filepath.Join(dir, "big.txt"), strings.Repeat("big file\n", 1000))
+	writeFile(t, filepath.Join(dir, "small", "a.txt"), "a")
+	writeFile(t, filepath.Join(dir, "small", "b.txt"), "b")
+	ctx := context.Background()
+	m, _, err := snapshot.Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := scrub(t, job, Options{Limit: 1 << 20})
+	if report.Checked != 3 || len(report.Problems) != 0 || report.Bytes == 0 {
+		t.Fatalf("clean: %+v", report)
+	}
+	// 抽查比例很小时几乎不下载
+	if report := scrub(t, job, Options{Sample: 1e-9}); report.Checked != 0 {
+		t.Fatalf("sampled: %+v", report)
+	}
+
+	objects, _ := snapshot.Objects(job.Name)
+	var big, bundle string
+	for _, f := range m.Files {
+		obj, _ := snapshot.ObjectOf(objects, f)
+		if f.Path == "big.txt" {
+			big = obj.Path
+		} else {
+			bundle = obj.Path
+		}
+	}
+	damage(pan, big)
+	pan.Remove(bundle)
+	report = scrub(t, job, Options{})
+	if report.Checked != 3 || len(report.Problems) != 3 || report.Requeued != 3 || len(report.Failed) != 0 {
+		t.Fatalf("damaged: %+v", report)
+	}
+	kinds := make(map[string][]string)
+	for _, p := range report.Problems {
+		kinds[p.Kind] = append(kinds[p.Kind], p.Files...)
+	}
+	if len(kinds[MISMATCH]) != 1 || kinds[MISMATCH][0] != "big.txt" || len(kinds[MISSING]) != 2 {
+		t.Fatalf("problems: %+v", report.Problems)
+	}
+
+	// 下次快照重新上传, 之后校验通过
+	_, result, err := snapshot.Take(ctx, job)
+	if err != nil || result.Uploaded != 3 {
+		t.Fatalf("take: %+v %v", result, err)
+	}
+	if report := scrub(t, job, Options{}); report.Checked != 3 || len(report.Problems) != 0 {
+		t.Fatalf("after requeue: %+v", report)
+	}
+}
+
+func TestScrubParity(t *testing.T) {
+	pan := fakepan.Setup(t)
+	dir := t.TempDir()
+	job := config.Job{Name: "photos", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_SNAPSHOT,
+		Parity: config.Parity{ParityShards: 2, ShardSize: "4KB"}}
+	random := make([]byte, 32<<10)
+	rand.New(rand.NewSource(2)).Read(random)
+	writeFile(t, filepath.Join(dir, "big.bin"), string(random))
+	ctx := context.Background()
+	first, _, err := snapshot.Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := first.Files[0]
+
+	// 校验文件可以修复的损坏不重新上传
+	damage(pan, e.Object)
+	report := scrub(t, job, Options{})
+	if report.Checked != 1 || len(report.Repaired) != 1 || len(report.Problems) != 0 || report.Requeued != 0 {
+		t.Fatalf("repairable: %+v", report)
+	}
+
+	// 修复不了时标记损坏, 保留记录给旧快照
+	pan.Put(e.Object, []byte("gone"))
+	report = scrub(t, job, Options{})
+	if len(report.Repaired) != 0 || len(report.Problems) != 1 || report.Requeued != 1 {
+		t.Fatalf("damaged: %+v", report)
+	}
+	if _, result, err := snapshot.Take(ctx, job); err != nil || result.Uploaded != 1 {
+		t.Fatalf("take: %+v %v", result, err)
+	}
+	objects, _ := snapshot.Objects(job.Name)
+	old, ok := snapshot.ObjectOf(objects, e)
+	if !ok || !old.Damaged || old.ParityFsID == 0 || len(objects) != 2 {
+		t.Fatalf("old version: %+v, %d objects", old, len(objects))
+	}
+	if report := scrub(t, job, Options{}); report.Checked != 1 || len(report.Problems) != 0 {
+		t.Fatalf("after requeue: %+v", report)
+	}
+}
+
+func TestScrubRepository(t *testing.T) {
+	pan := fakepan.Setup(t)
+	dir := t.TempDir()
+	job := config.Job{Name: "vm", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_REPOSITORY}
+	random := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	writeFile(t, filepath.Join(dir, "disk.img"), string(random))
+	ctx := context.Background()
+	if _, _, err := snapshot.Take(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	packs, _ := snapshot.Packs(job.Name)
+	if len(packs) != 1 {
+		t.Fatalf("packs: %+v", packs)
+	}
+	for _, pk := range packs {
+		damage(pan, pk.Path)
+	}
+
+	report := scrub(t, job, Options{})
+	if len(report.Problems) != 1 || report.Problems[0].Kind != MISMATCH || report.Requeued != 1 {
+		t.Fatalf("damaged: %+v", report)
+	}
+	if files := report.Problems[0].Files; len(files) != 1 || files[0] != "disk.img" {
+		t.Fatalf("files: %v", files)
+	}
+	_, result, err := snapshot.Take(ctx, job)
+	if err != nil || result.Uploaded != 1 {
+		t.Fatalf("take: %+v %v", result, err)
+	}
+	// 旧的 pack 只剩下没有损坏的块
+	if report := scrub(t, job, Options{}); len(report.Problems) != 0 || len(report.Failed) != 0 {
+		t.Fatalf("after requeue: %+v", report)
+	}
+}
+
+func TestScrubSync(t *testing.T) {
+	pan := fakepan.Setup(t)
+	dir := t.TempDir()
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup"}
+	a := strings.Repeat("a", 8<<10)
+	writeFile(t, filepath.Join(dir, "a.txt"), a)
+	writeFile(t, filepath.Join(dir, "b.txt"), "b version 1")
+	ctx := context.Background()
+	if _, err := cloudsync.SyncJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	// 不是本任务上传的文件不检查
+	pan.Put("/apps/backup/other.txt", []byte("other"))
+	// 旧版本上传的文件没有 sha256, 只能校验前 4096 字节
+	b, _ := pan.Stat("/apps/backup/b.txt")
+	db.Client.HDel(ctx, cloudsync.UPLOAD_META, b.MD5)
+
+	// 损坏的位置在前 4096 字节之后
+	damage(pan, "/apps/backup/a.txt")
+	report := scrub(t, job, Options{})
+	if report.Checked != 1 || len(report.Problems) != 1 || report.Problems[0].Path != "/apps/backup/a.txt" || report.Requeued != 1 {
+		t.Fatalf("damaged: %+v", report)
+	}
+	if len(report.PrefixOnly) != 1 || report.PrefixOnly[0] != "/apps/backup/b.txt" {
+		t.Fatalf("prefix only: %v", report.PrefixOnly)
+	}
+	result, err := cloudsync.SyncJob(ctx, job)
+	if err != nil || result.Uploaded != 1 {
+		t.Fatalf("sync: %+v %v", result, err)
+	}
+	if data, _ := pan.Get("/apps/backup/a.txt"); string(data) != a {
+		t.Fatal("a.txt not uploaded again")
+	}
+}
+
+func TestScrubEmptyMember(t *testing.T) {
+	fakepan.Setup(t)
+	dir := t.TempDir()
+	job := config.Job{Name: "mail", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_SNAPSHOT,
+		Bundle: config.Bundle{MaxFileSize: "4KB"}}
+	writeFile(t, filepath.Join(dir, "empty.txt"), "")
+	writeFile(t, filepath.Join(dir, "a.txt"), "a")
+	ctx := context.Background()
+	m, _, err := snapshot.Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 旧版本把空文件作为长度为 0 的成员打包, 不能当作整个 tar 包校验
+	objects, _ := snapshot.Objects(job.Name)
+	a, _ := snapshot.ObjectOf(objects, m.Files[0])
+	empty, _ := snapshot.ObjectOf(objects, m.Files[1])
+	if m.Files[1].Path != "empty.txt" || a.Bundle == nil {
+		t.Fatalf("files: %+v", m.Files)
+	}
+	empty.Path, empty.FsID = a.Path, a.FsID
+	empty.Bundle = &snapshot.Member{ID: a.Bundle.ID, Offset: a.Bundle.Offset}
+	data, _ := json.Marshal(empty)
+	db.Client.HSet(ctx, snapshot.SNAPSHOT_OBJECTS+":"+job.Name, empty.SHA256, data)
+	if report := scrub(t, job, Options{}); report.Checked != 2 || len(report.Problems) != 0 || report.Requeued != 0 {
+		t.Fatalf("empty member: %+v", report)
+	}
+}
@@ -0,0 +1,216 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/cloudsync"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/metrics"
+	"github.com/wangxso/backuptool/upload"
+)
+
+// bundlesDir 是 tar 包在 targetDir 下的目录
+const bundlesDir = "bundles"
+
+// Member is where the content of a bundled object is: Length bytes at
+// Offset of the bundle, what was uploaded for the file after compression
+// and encryption, so it can be fetched alone with a range request.
+type Member struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// bundler collects small files of a snapshot into tar files, named by the
+// SHA-256 of their content, and uploads each when it is full. Every file is
+// compressed and encrypted on its own before it is added. The objects and
+// manifest entries of a bundle are only recorded after it is uploaded, a
+// bundle that fails to upload fails its files.
+type bundler struct {
+	job     config.Job
+	t       upload.Transform
+	size    int64
+	m       *Manifest
+	objects map[string]Object
+	result  *cloudsync.Result
+
+	f       *os.File
+	cw      *countWriter
+	tw      *tar.Writer
+	id      string
+	members map[string]Object
+	waiting []waiting
+}
+
+type waiting struct {
+	entry Entry
+	src   string
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func newBundler(job config.Job, t upload.Transform, m *Manifest, objects map[string]Object, result *cloudsync.Result) *bundler {
+	_, size := job.Bundle.Limits()
+	return &bundler{job: job, t: t, size: size, m: m, objects: objects, result: result, members: make(map[string]Object)}
+}
+
+// add bundles the file src of e, content already waiting in the bundle is
+// not added twice.
+func (b *bundler) add(ctx context.Context, e Entry, src string) error {
+	if _, ok := b.members[e.SHA256]; ok {
+		b.waiting = append(b.waiting, waiting{e, src})
+		return nil
+	}
+	if err := b.open(); err != nil {
+		return err
+	}
+	p, err := upload.Prepare(src, b.t)
+	if err != nil {
+		b.result.Fail(src, err)
+		return nil
+	}
+	defer p.Remove()
+	f, err := os.Open(p.Path)
+	if err != nil {
+		b.result.Fail(src, err)
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		b.result.Fail(src, err)
+		return nil
+	}
+	hdr := &tar.Header{
+		Name:    e.SHA256,
+		Mode:    0600,
+		Size:    info.Size(),
+		ModTime: e.ModTime.Truncate(time.Second),
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	offset := b.cw.n
+	// 写了一半的 tar 包不能再用, 读取失败时整个快照失败
+	if _, err := io.CopyN(b.tw, f, hdr.Size); err != nil {
+		return fmt.Errorf("bundle %s: %w", src, err)
+	}
+	b.members[e.SHA256] = Object{
+		SHA256:    e.SHA256,
+		Size:      e.Size,
+		Encrypted: len(b.t.Recipients) > 0,
+		Wraps:     p.Wraps,
+		Keys:      p.Wraps.KeyIDs(),
+		Codec:     p.Codec,
+		Bundle:    &Member{ID: b.id, Offset: offset, Length: hdr.Size},
+	}
+	b.waiting = append(b.waiting, waiting{e, src})
+	if b.cw.n >= b.size {
+		return b.flush(ctx)
+	}
+	return nil
+}
+
+func (b *bundler) open() error {
+	if b.f != nil {
+		return nil
+	}
+	f, err := os.CreateTemp(config.Get().General.TmpDir, "bundle-*.tar")
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	b.f, b.id = f, hex.EncodeToString(id)
+	b.cw = &countWriter{w: f}
+	b.tw = tar.NewWriter(b.cw)
+	return nil
+}
+
+// flush uploads the current bundle, if any, and records its files.
+func (b *bundler) flush(ctx context.Context) error {
+	if b.f == nil {
+		return nil
+	}
+	defer b.close()
+	if len(b.waiting) == 0 {
+		return nil
+	}
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	if err := b.f.Close(); err != nil {
+		return err
+	}
+	// tar 包的内容已经逐个压缩和加密, 整个包不再处理
+	target := path.Join(b.job.TargetDir, bundlesDir, b.id[:2], b.id+".tar")
+	logrus.Infof("[Snapshot %s] upload bundle %s: %d files", b.job.Name, target, len(b.members))
+	ret, err := upload.UploadFile(ctx, target, b.f.Name(), upload.OndupFail)
+	if err == nil && b.t.Parity.Enabled() {
+		ret.ParityPath, ret.ParityFsID, err = upload.UploadParity(ctx, ret.Path, b.f.Name(), b.t.Parity)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		for _, w := range b.waiting {
+			b.result.Fail(w.src, err)
+		}
+		return nil
+	}
+	created := time.Now()
+	saved := make(map[string]bool, len(b.members))
+	for _, w := range b.waiting {
+		obj := b.members[w.entry.SHA256]
+		obj.Path, obj.FsID, obj.MD5, obj.Created = ret.Path, ret.FsID, ret.MD5, created
+		obj.Parity, obj.ParityFsID = ret.ParityPath, ret.ParityFsID
+		if saved[obj.SHA256] {
+			metrics.FileDone(metrics.OpSkip, w.entry.Size)
+			b.result.Skipped++
+		} else {
+			if err := addObject(b.job.Name, b.objects, obj); err != nil {
+				b.result.Fail(w.src, err)
+				continue
+			}
+			saved[obj.SHA256] = true
+			b.result.Uploaded++
+		}
+		e := w.entry
+		e.Object, e.FsID, e.Keys = obj.Path, obj.FsID, obj.Keys
+		b.m.Files = append(b.m.Files, e)
+	}
+	return nil
+}
+
+// close drops the current bundle without uploading it.
+func (b *bundler) close() {
+	if b.f != nil {
+		b.f.Close()
+		os.Remove(b.f.Name())
+	}
+	b.f, b.cw, b.tw, b.id = nil, nil, nil, ""
+	b.members = make(map[string]Object)
+	b.waiting = nil
+}
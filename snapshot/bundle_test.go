@@ -0,0 +1,113 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/fakepan"
+)
+
+func bundleFiles(pan *fakepan.Server) []string {
+	var ret []string
+	for _, p := range pan.Files() {
+		if strings.HasPrefix(p, "/apps/backup/bundles/") {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func TestBundle(t *testing.T) {
+	pan := fakepan.Setup(t)
+	config.BackUpConfig.Encryption.Passphrase = "mail"
+	dir := t.TempDir()
+	job := config.Job{Name: "mail", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_SNAPSHOT,
+		Bundle: config.Bundle{MaxFileSize: "1KB", Size: "8KB"}}
+	for i := 0; i < 20; i++ {
+		writeFile(t, filepath.Join(dir, "cur", fmt.Sprintf("%02d.eml", i)), strings.Repeat(fmt.Sprint(i), 300))
+	}
+	// 和 cur/01.eml 内容相同
+	writeFile(t, filepath.Join(dir, "copy.eml"), strings.Repeat("1", 300))
+	writeFile(t, filepath.Join(dir, "big.bin"), strings.Repeat("x", 4096))
+	ctx := context.Background()
+
+	m, result, err := Take(ctx, job)
+	if err != nil || result.Uploaded != 21 || result.Skipped != 1 || len(m.Files) != 22 {
+		t.Fatalf("snapshot: %+v %v", result, err)
+	}
+	if !sort.SliceIsSorted(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path }) {
+		t.Fatal("manifest not sorted")
+	}
+	bundles := bundleFiles(pan)
+	if len(bundles) < 2 || len(bundles) > 5 {
+		t.Fatalf("%d bundles", len(bundles))
+	}
+	// 另外上传一次云端清单
+	if n := pan.Calls("upload"); n != len(bundles)+2 {
+		t.Fatalf("%d uploads for %d bundles, big.bin and the manifest", n, len(bundles))
+	}
+	objects, err := Objects("mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj, _ := ObjectOf(objects, entry(t, m, "big.bin")); obj.Bundle != nil {
+		t.Fatalf("big.bin bundled: %+v", obj)
+	}
+	for _, e := range m.Files {
+		obj, _ := ObjectOf(objects, e)
+		if e.Path == "big.bin" {
+			continue
+		}
+		if obj.Bundle == nil || e.Object != obj.Path {
+			t.Fatalf("%s: %+v", e.Path, obj)
+		}
+		// 每个文件都可以按偏移单独读取
+		data, _ := pan.Get(obj.Path)
+		want, _ := os.ReadFile(filepath.Join(dir, filepath.FromSlash(e.Path)))
+		if got := data[obj.Bundle.Offset : obj.Bundle.Offset+obj.Bundle.Length]; !bytes.Equal(got, want) {
+			t.Fatalf("%s at %d: %q", e.Path, obj.Bundle.Offset, got)
+		}
+	}
+	// 上传的是普通的 tar 包, 文件名是内容的 sha256
+	data, _ := pan.Get(bundles[0])
+	hdr, err := tar.NewReader(bytes.NewReader(data)).Next()
+	if err != nil || objects[hdr.Name].Bundle == nil {
+		t.Fatalf("tar: %+v %v", hdr, err)
+	}
+
+	// 删除 cur 之后, 只有 copy.eml 所在的包还被引用
+	os.RemoveAll(filepath.Join(dir, "cur"))
+	if _, _, err := Take(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	job.Retention.KeepLast = 1
+	plan, err := PlanPrune(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Prune(ctx, plan); err != nil {
+		t.Fatal(err)
+	}
+	left := bundleFiles(pan)
+	kept, _ := ObjectOf(objects, entry(t, m, "copy.eml"))
+	if len(left) != 1 || left[0] != kept.Path {
+		t.Fatalf("bundles left: %v, want %s", left, kept.Path)
+	}
+	objects, _ = Objects("mail")
+	for _, obj := range objects {
+		if obj.Bundle != nil && obj.Path != kept.Path {
+			t.Fatalf("object of deleted bundle left: %+v", obj)
+		}
+	}
+	if _, ok := objects[objectKey(kept.SHA256, kept.Encrypted)]; !ok {
+		t.Fatal("copy.eml object deleted")
+	}
+}
@@ -0,0 +1,45 @@
+package snapshot
+
+import "sort"
+
+// 文件在两个快照之间的变化
+const (
+	Added    = "added"
+	Removed  = "removed"
+	Modified = "modified"
+)
+
+// Change is a file that differs between two snapshots, Old is nil for an
+// added file and New for a removed one.
+type Change struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	Old  *Entry `json:"old,omitempty"`
+	New  *Entry `json:"new,omitempty"`
+}
+
+// Diff returns the changes from snapshot a to snapshot b sorted by path.
+// Files are compared by content, a file that was only touched is unchanged.
+func Diff(a, b *Manifest) []Change {
+	old := make(map[string]*Entry, len(a.Files))
+	for i := range a.Files {
+		old[a.Files[i].Path] = &a.Files[i]
+	}
+	changes := make([]Change, 0)
+	for i := range b.Files {
+		f := &b.Files[i]
+		prev, ok := old[f.Path]
+		delete(old, f.Path)
+		switch {
+		case !ok:
+			changes = append(changes, Change{Path: f.Path, Kind: Added, New: f})
+		case prev.SHA256 != f.SHA256:
+			changes = append(changes, Change{Path: f.Path, Kind: Modified, Old: prev, New: f})
+		}
+	}
+	for p, f := range old {
+		changes = append(changes, Change{Path: p, Kind: Removed, Old: f})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
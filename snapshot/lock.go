@@ -0,0 +1,180 @@
+package snapshot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/db"
+)
+
+const (
+	// SNAPSHOT_LOCK 是任务的快照锁, key 为 snapshot_lock:<job>, 值为 <操作>:<token>
+	SNAPSHOT_LOCK = "snapshot_lock"
+	// SNAPSHOT_READERS 是正在读取任务内容的恢复, key 为 snapshot_readers:<job>,
+	// member 为 token, score 为过期时间 (毫秒)
+	SNAPSHOT_READERS = "snapshot_readers"
+)
+
+// 持有任务锁的操作, 恢复只和删除或改写云端内容的 prune、rotate 冲突
+const (
+	opTake   = "take"
+	opPrune  = "prune"
+	opRotate = "rotate"
+)
+
+var (
+	// ErrLocked is returned when another process or run holds the lock of a job.
+	ErrLocked = errors.New("snapshot: another snapshot or prune of the job is running")
+	// ErrReading is returned by Prune and Rotate while a restore reads the job.
+	ErrReading = errors.New("snapshot: a restore of the job is running")
+)
+
+// lockTTL 是锁的过期时间, 持有期间每 lockTTL/3 续期, 进程崩溃后锁自动过期
+var lockTTL = time.Minute
+
+var (
+	// KEYS[1] 是锁, KEYS[2] 是读者; ARGV 为值、过期毫秒数、当前毫秒数和是否排斥读者
+	lockScript = redis.NewScript(`
+if ARGV[4] == "1" then
+	redis.call("zremrangebyscore", KEYS[2], "-inf", ARGV[3])
+	if redis.call("zcard", KEYS[2]) > 0 then return -1 end
+end
+if redis.call("set", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then return 1 end
+return 0`)
+	// 快照进行中也可以恢复, prune 和 rotate 进行中不能
+	readScript = redis.NewScript(`
+local v = redis.call("get", KEYS[1])
+if v and string.sub(v, 1, 5) ~= "take:" then return 0 end
+redis.call("zadd", KEYS[2], ARGV[3] + ARGV[2], ARGV[1])
+redis.call("pexpire", KEYS[2], ARGV[2])
+return 1`)
+	// 只有 token 相同时才续期或删除, 过期后被别人拿到的锁不受影响
+	refreshScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) end return 0`)
+	unlockScript  = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`)
+	// 已经过期被 prune 清掉的读者不能续期
+	refreshReadScript = redis.NewScript(`
+if not redis.call("zscore", KEYS[1], ARGV[1]) then return 0 end
+redis.call("zadd", KEYS[1], ARGV[3] + ARGV[2], ARGV[1])
+redis.call("pexpire", KEYS[1], ARGV[2])
+return 1`)
+)
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// lockJob takes the lock of job for op, shared by Take, Prune and Rotate so
+// that a prune from the command line cannot delete content a running
+// snapshot still references. Prune and Rotate also wait for the restores
+// registered by LockRead. The returned context is cancelled when the lock
+// is lost; unlock releases it.
+func lockJob(ctx context.Context, job, op string) (context.Context, func(), error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	value := op + ":" + token
+	k := key(SNAPSHOT_LOCK, job)
+	excludeReaders := "0"
+	if op != opTake {
+		excludeReaders = "1"
+	}
+	n, err := lockScript.Run(ctx, db.Client, []string{k, key(SNAPSHOT_READERS, job)},
+		value, lockTTL.Milliseconds(), nowMillis(), excludeReaders).Int()
+	if err != nil {
+		return nil, nil, err
+	}
+	switch n {
+	case -1:
+		return nil, nil, ErrReading
+	case 0:
+		return nil, nil, ErrLocked
+	}
+	ctx, unlock := hold(ctx, job, func() (int, error) {
+		return refreshScript.Run(context.Background(), db.Client, []string{k}, value, lockTTL.Milliseconds()).Int()
+	}, func() error {
+		return unlockScript.Run(context.Background(), db.Client, []string{k}, value).Err()
+	})
+	return ctx, unlock, nil
+}
+
+// LockRead registers a reader of the content of job, e.g. a restore, so
+// that Prune and Rotate do not delete or rewrite the content meanwhile.
+// Snapshots still run. It returns ErrLocked while a prune or rotate runs.
+// The returned context is cancelled when the registration is lost; unlock
+// releases it.
+func LockRead(ctx context.Context, job string) (context.Context, func(), error) {
+	if db.Client == nil {
+		return nil, nil, ErrNoRedis
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	k := key(SNAPSHOT_READERS, job)
+	n, err := readScript.Run(ctx, db.Client, []string{key(SNAPSHOT_LOCK, job), k},
+		token, lockTTL.Milliseconds(), nowMillis()).Int()
+	if err != nil {
+		return nil, nil, err
+	}
+	if n == 0 {
+		return nil, nil, ErrLocked
+	}
+	ctx, unlock := hold(ctx, job, func() (int, error) {
+		return refreshReadScript.Run(context.Background(), db.Client, []string{k}, token, lockTTL.Milliseconds(), nowMillis()).Int()
+	}, func() error {
+		return db.Client.ZRem(context.Background(), k, token).Err()
+	})
+	return ctx, unlock, nil
+}
+
+// hold refreshes a lock every lockTTL/3 until the returned unlock is
+// called, and cancels the returned context when refresh reports the lock
+// lost.
+func hold(ctx context.Context, job string, refresh func() (int, error), release func() error) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			n, err := refresh()
+			if err != nil {
+				// Redis 暂时不可用时下次再试, 锁在过期前仍然有效
+				logrus.Warnf("[Snapshot %s] refresh lock: %v", job, err)
+				continue
+			}
+			if n == 0 {
+				logrus.Errorf("[Snapshot %s] lock lost, stop", job)
+				cancel()
+				return
+			}
+		}
+	}()
+	unlock := func() {
+		close(done)
+		cancel()
+		if err := release(); err != nil {
+			logrus.Warnf("[Snapshot %s] unlock: %v", job, err)
+		}
+	}
+	return ctx, unlock
+}
@@ -0,0 +1,111 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/fakepan"
+)
+
+func TestLockJob(t *testing.T) {
+	fakepan.Setup(t)
+	dir := t.TempDir()
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup", Retention: config.Retention{KeepLast: 1}}
+	writeFile(t, filepath.Join(dir, "a.txt"), "v1")
+	ctx := context.Background()
+	if _, _, err := Take(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "a.txt"), "v2")
+	if _, _, err := Take(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanPrune(job)
+	if err != nil || len(plan.Remove) != 1 {
+		t.Fatalf("plan: %+v %v", plan, err)
+	}
+
+	// 快照进行中时命令行的清理被拒绝
+	_, unlock, err := lockJob(ctx, job.Name, opTake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Take(ctx, job); !errors.Is(err, ErrLocked) {
+		t.Fatalf("take while locked: %v", err)
+	}
+	if err := Prune(ctx, plan); !errors.Is(err, ErrLocked) {
+		t.Fatalf("prune while locked: %v", err)
+	}
+	// 锁过期后被别人拿到, 旧的持有者不能删除它
+	db.Client.Del(ctx, key(SNAPSHOT_LOCK, job.Name))
+	_, unlockOther, err := lockJob(ctx, job.Name, opTake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if n, _ := db.Client.Exists(ctx, key(SNAPSHOT_LOCK, job.Name)).Result(); n != 1 {
+		t.Fatal("unlock removed a lock held by someone else")
+	}
+	unlockOther()
+
+	// 计划之后有新的快照时计划作废
+	writeFile(t, filepath.Join(dir, "a.txt"), "v3")
+	if _, _, err := Take(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if err := Prune(ctx, plan); !errors.Is(err, ErrStalePlan) {
+		t.Fatalf("stale plan: %v", err)
+	}
+	if list, _ := List(job.Name); len(list) != 3 {
+		t.Fatalf("stale plan removed snapshots: %d left", len(list))
+	}
+}
+
+func TestLockRead(t *testing.T) {
+	fakepan.Setup(t)
+	dir := t.TempDir()
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup", Retention: config.Retention{KeepLast: 1}}
+	writeFile(t, filepath.Join(dir, "a.txt"), "v1")
+	ctx := context.Background()
+	if _, _, err := Take(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	// 恢复进行中可以快照, 不能清理
+	_, unlock, err := LockRead(ctx, job.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "a.txt"), "v2")
+	if _, _, err := Take(ctx, job); err != nil {
+		t.Fatalf("take while reading: %v", err)
+	}
+	plan, err := PlanPrune(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Prune(ctx, plan); !errors.Is(err, ErrReading) {
+		t.Fatalf("prune while reading: %v", err)
+	}
+	unlock()
+	if err := Prune(ctx, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	// 进程崩溃留下的读者过期后不再阻止清理
+	db.Client.ZAdd(ctx, key(SNAPSHOT_READERS, job.Name), &redis.Z{Score: float64(nowMillis() - 1), Member: "crashed"})
+	if _, unlock, err := lockJob(ctx, job.Name, opPrune); err != nil {
+		t.Fatalf("prune after the reader expired: %v", err)
+	} else {
+		// 清理进行中不能恢复
+		if _, _, err := LockRead(ctx, job.Name); !errors.Is(err, ErrLocked) {
+			t.Fatalf("read while pruning: %v", err)
+		}
+		unlock()
+	}
+}
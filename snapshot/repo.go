@@ -0,0 +1,429 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/chunker"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/download"
+	"github.com/wangxso/backuptool/upload"
+)
+
+const (
+	// REPO_CHUNKS 保存 repository 模式的块在哪个 pack 中, key 为 repo_chunks:<job>, field 为块的 sha256
+	REPO_CHUNKS = "repo_chunks"
+	// REPO_PACKS 保存已上传的 pack, key 为 repo_packs:<job>, field 为 pack ID
+	REPO_PACKS = "repo_packs"
+
+	// packsDir 是 pack 在 targetDir 下的目录
+	packsDir = "packs"
+)
+
+var (
+	// PackSize 一个 pack 达到这个大小后上传, 同一次快照的小块合并成少量的大文件
+	PackSize int64 = 16 << 20
+	// ChunkParams 是 repository 模式切块的大小, 修改后已有的块不再能去重
+	ChunkParams = chunker.DefaultParams
+
+	ErrMissingChunk = errors.New("chunk not in the repository")
+)
+
+// Chunk is where a chunk of a repository job is stored: Length bytes at
+// Offset of the content of a pack.
+type Chunk struct {
+	Pack   string `json:"pack"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// Pack is an uploaded pack file holding the chunks it lists one after
+// the other. Object describes the cloud file, its SHA256 is not set and
+// Size is the size of the chunks.
+type Pack struct {
+	ID string `json:"id"`
+	Object
+	Chunks []string `json:"chunks"`
+}
+
+// Chunks returns the chunk index of job by sha256.
+func Chunks(job string) (map[string]Chunk, error) {
+	if db.Client == nil {
+		return nil, ErrNoRedis
+	}
+	all, err := db.Client.HGetAll(db.Client.Context(), key(REPO_CHUNKS, job)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]Chunk, len(all))
+	for sum, data := range all {
+		var c Chunk
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			return nil, fmt.Errorf("chunk %s: %w", sum, err)
+		}
+		ret[sum] = c
+	}
+	return ret, nil
+}
+
+// Packs returns the packs of job by ID.
+func Packs(job string) (map[string]Pack, error) {
+	if db.Client == nil {
+		return nil, ErrNoRedis
+	}
+	all, err := db.Client.HGetAll(db.Client.Context(), key(REPO_PACKS, job)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]Pack, len(all))
+	for id, data := range all {
+		var p Pack
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			return nil, fmt.Errorf("pack %s: %w", id, err)
+		}
+		ret[id] = p
+	}
+	return ret, nil
+}
+
+// DropChunks removes the chunks sums from the index of job. The packs
+// holding them stay, the next snapshot stores the chunks in a new pack.
+func DropChunks(job string, sums ...string) error {
+	if db.Client == nil {
+		return ErrNoRedis
+	}
+	if len(sums) == 0 {
+		return nil
+	}
+	return db.Client.HDel(db.Client.Context(), key(REPO_CHUNKS, job), sums...).Err()
+}
+
+func savePack(job string, p Pack) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return db.Client.HSet(db.Client.Context(), key(REPO_PACKS, job), p.ID, data).Err()
+}
+
+// packer collects the new chunks of a snapshot into pack files and
+// uploads each when it is full. A chunk is only added to the index after
+// its pack is uploaded, so the index never points to missing content.
+type packer struct {
+	job     config.Job
+	t       upload.Transform
+	chunks  map[string]Chunk
+	packs   map[string]Pack
+	f       *os.File
+	pending map[string]Chunk
+	order   []string
+	size    int64
+	id      string
+}
+
+func newPacker(job config.Job, t upload.Transform) (*packer, error) {
+	chunks, err := Chunks(job.Name)
+	if err != nil {
+		return nil, err
+	}
+	packs, err := Packs(job.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &packer{job: job, t: t, chunks: chunks, packs: packs, pending: make(map[string]Chunk)}, nil
+}
+
+// has reports whether the chunk sum is stored, encrypted as the job wants.
+func (p *packer) has(sum string) bool {
+	if _, ok := p.pending[sum]; ok {
+		return true
+	}
+	c, ok := p.chunks[sum]
+	return ok && p.packs[c.Pack].Encrypted == p.job.Encrypt
+}
+
+// hasAll reports whether every chunk of e is stored.
+func (p *packer) hasAll(e Entry) bool {
+	for _, sum := range e.Chunks {
+		if !p.has(sum) {
+			return false
+		}
+	}
+	return true
+}
+
+// store splits the file src into chunks, adds the new ones to the pack and
+// returns the hash of the file, its chunks and how many were new.
+func (p *packer) store(ctx context.Context, src string) (string, []string, int, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	c, err := chunker.New(io.TeeReader(f, h), ChunkParams)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	var sums []string
+	fresh := 0
+	for {
+		data, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, 0, err
+		}
+		sum := sha256.Sum256(data)
+		id := hex.EncodeToString(sum[:])
+		sums = append(sums, id)
+		if p.has(id) {
+			continue
+		}
+		fresh++
+		if err := p.add(ctx, id, data); err != nil {
+			return "", nil, 0, err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), sums, fresh, nil
+}
+
+func (p *packer) add(ctx context.Context, sum string, data []byte) error {
+	if p.f == nil {
+		f, err := os.CreateTemp(config.Get().General.TmpDir, "pack-*")
+		if err != nil {
+			return err
+		}
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		p.f, p.id, p.size = f, hex.EncodeToString(id), 0
+	}
+	if _, err := p.f.Write(data); err != nil {
+		return err
+	}
+	p.pending[sum] = Chunk{Pack: p.id, Offset: p.size, Length: int64(len(data))}
+	p.order = append(p.order, sum)
+	p.size += int64(len(data))
+	if p.size >= PackSize {
+		return p.flush(ctx)
+	}
+	return nil
+}
+
+// flush uploads the current pack, if any, and records its chunks.
+func (p *packer) flush(ctx context.Context) error {
+	if p.f == nil {
+		return nil
+	}
+	defer p.close()
+	if err := p.f.Close(); err != nil {
+		return err
+	}
+	target := path.Join(p.job.TargetDir, packsDir, p.id[:2], p.id)
+	ret, err := upload.UploadTransformed(ctx, target, p.f.Name(), upload.OndupFail, p.t)
+	if err != nil {
+		return fmt.Errorf("pack %s: %w", p.id, err)
+	}
+	pack := Pack{
+		ID: p.id,
+		Object: Object{
+			Path:       ret.Path,
+			FsID:       ret.FsID,
+			MD5:        ret.MD5,
+			Size:       p.size,
+			Created:    time.Now(),
+			Encrypted:  len(p.t.Recipients) > 0,
+			Wraps:      ret.Wraps,
+			Keys:       ret.Wraps.KeyIDs(),
+			Codec:      ret.Codec,
+			Parity:     ret.ParityPath,
+			ParityFsID: ret.ParityFsID,
+		},
+		Chunks: p.order,
+	}
+	if err := savePack(p.job.Name, pack); err != nil {
+		return err
+	}
+	fields := make([]interface{}, 0, 2*len(p.order))
+	for _, sum := range p.order {
+		data, err := json.Marshal(p.pending[sum])
+		if err != nil {
+			return err
+		}
+		fields = append(fields, sum, data)
+	}
+	if err := db.Client.HSet(db.Client.Context(), key(REPO_CHUNKS, p.job.Name), fields...).Err(); err != nil {
+		return err
+	}
+	p.packs[pack.ID] = pack
+	for _, sum := range p.order {
+		p.chunks[sum] = p.pending[sum]
+	}
+	return nil
+}
+
+// close drops the current pack without uploading it.
+func (p *packer) close() {
+	if p.f != nil {
+		p.f.Close()
+		os.Remove(p.f.Name())
+	}
+	p.f, p.id, p.size = nil, "", 0
+	p.pending = make(map[string]Chunk)
+	p.order = nil
+}
+
+// Assembler rebuilds the files of a repository job from their chunks.
+// Each pack is downloaded once, into a temporary folder removed by Close;
+// a pack with damaged chunks is downloaded again with its parity and
+// repaired. It is safe for concurrent use.
+type Assembler struct {
+	job    string
+	dir    string
+	chunks map[string]Chunk
+	packs  map[string]Pack
+
+	mu       sync.Mutex
+	fetched  map[string]*fetchedPack
+	repaired map[string]*fetchedPack
+}
+
+type fetchedPack struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// NewAssembler returns an assembler of the files of job.
+func NewAssembler(job string) (*Assembler, error) {
+	chunks, err := Chunks(job)
+	if err != nil {
+		return nil, err
+	}
+	packs, err := Packs(job)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(config.Get().General.TmpDir, "packs-*")
+	if err != nil {
+		return nil, err
+	}
+	return &Assembler{
+		job:      job,
+		dir:      dir,
+		chunks:   chunks,
+		packs:    packs,
+		fetched:  make(map[string]*fetchedPack),
+		repaired: make(map[string]*fetchedPack),
+	}, nil
+}
+
+// Assemble writes the content of e to w, every chunk is checked against
+// its hash.
+func (a *Assembler) Assemble(ctx context.Context, e Entry, w io.Writer) error {
+	buf := new(bytes.Buffer)
+	for _, sum := range e.Chunks {
+		c, ok := a.chunks[sum]
+		if !ok {
+			return fmt.Errorf("%s: %w", sum, ErrMissingChunk)
+		}
+		err := a.chunk(ctx, sum, c, false, buf)
+		if err != nil && a.packs[c.Pack].ParityFsID != 0 && ctx.Err() == nil {
+			logrus.Warnf("[Restore %s] pack %s: %v, repair with parity", a.job, c.Pack, err)
+			err = a.chunk(ctx, sum, c, true, buf)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunk reads the chunk sum stored at c into buf.
+func (a *Assembler) chunk(ctx context.Context, sum string, c Chunk, repair bool, buf *bytes.Buffer) error {
+	local, err := a.pack(ctx, c.Pack, repair)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf.Reset()
+	if _, err := io.Copy(buf, io.NewSectionReader(f, c.Offset, c.Length)); err != nil {
+		return err
+	}
+	got := sha256.Sum256(buf.Bytes())
+	if int64(buf.Len()) != c.Length || hex.EncodeToString(got[:]) != sum {
+		return fmt.Errorf("chunk %s of pack %s: %w", sum, c.Pack, ErrMissingChunk)
+	}
+	return nil
+}
+
+// pack returns the local copy of the pack id, downloading it first, or
+// the copy repaired with its parity.
+func (a *Assembler) pack(ctx context.Context, id string, repair bool) (string, error) {
+	cache := a.fetched
+	if repair {
+		cache = a.repaired
+	}
+	a.mu.Lock()
+	f, ok := cache[id]
+	if !ok {
+		f = &fetchedPack{}
+		cache[id] = f
+	}
+	a.mu.Unlock()
+	f.once.Do(func() {
+		p, ok := a.packs[id]
+		if !ok {
+			f.err = fmt.Errorf("pack %s: %w", id, ErrMissingChunk)
+			return
+		}
+		if repair {
+			// 其他文件可能还在读取原来的副本, 修复后的副本另外保存
+			f.path = filepath.Join(a.dir, id+".repaired")
+			f.err = download.DownloadRepaired(ctx, uint64(p.FsID), uint64(p.ParityFsID), 0, 0, f.path, p.Encoding())
+			return
+		}
+		f.path = filepath.Join(a.dir, id)
+		f.err = download.DownloadObject(ctx, uint64(p.FsID), f.path, p.Encoding())
+	})
+	if f.err != nil {
+		// 下载失败时下一个文件重新下载
+		a.mu.Lock()
+		if cache[id] == f {
+			delete(cache, id)
+		}
+		a.mu.Unlock()
+	}
+	return f.path, f.err
+}
+
+// Close removes the downloaded packs.
+func (a *Assembler) Close() error {
+	return os.RemoveAll(a.dir)
+}
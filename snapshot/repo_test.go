@@ -0,0 +1,119 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangxso/backuptool/chunker"
+	"github.com/wangxso/backuptool/cloudsync"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/fakepan"
+)
+
+// smallChunks 缩小块和 pack, 测试数据不需要很大
+func smallChunks(t *testing.T) {
+	params, size := ChunkParams, PackSize
+	ChunkParams = chunker.Params{Min: 4 << 10, Avg: 16 << 10, Max: 64 << 10}
+	PackSize = 256 << 10
+	t.Cleanup(func() { ChunkParams, PackSize = params, size })
+}
+
+func packBytes(pan *fakepan.Server) int {
+	n := 0
+	for _, p := range pan.Files() {
+		if strings.HasPrefix(p, "/apps/backup/packs/") {
+			data, _ := pan.Get(p)
+			n += len(data)
+		}
+	}
+	return n
+}
+
+func TestRepository(t *testing.T) {
+	pan := fakepan.Setup(t)
+	smallChunks(t)
+	dir := t.TempDir()
+	job := config.Job{Name: "vm", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_REPOSITORY}
+	disk := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(disk)
+	writeFile(t, filepath.Join(dir, "disk.img"), string(disk))
+	writeFile(t, filepath.Join(dir, "copy.img"), string(disk))
+	writeFile(t, filepath.Join(dir, "empty"), "")
+	ctx := context.Background()
+
+	// copy.img 先上传, disk.img 和空文件没有新的块
+	first, result, err := Take(ctx, job)
+	if err != nil || result.Uploaded != 1 || result.Skipped != 2 {
+		t.Fatalf("first snapshot: %+v %v", result, err)
+	}
+	for _, p := range pan.Files() {
+		if !strings.HasPrefix(p, "/apps/backup/packs/") && !strings.HasPrefix(p, "/apps/backup/"+cloudsync.MANIFEST_DIR+"/") {
+			t.Fatalf("%s uploaded outside of the packs", p)
+		}
+	}
+	// 两个相同的文件只存一份
+	if n := packBytes(pan); n < len(disk) || n > len(disk)+len(disk)/10 {
+		t.Fatalf("packs hold %d bytes", n)
+	}
+	if e := entry(t, first, "disk.img"); !e.Chunked() || len(e.Chunks) < 16 {
+		t.Fatalf("disk.img: %d chunks", len(e.Chunks))
+	}
+
+	// 修改中间的几个字节, 只上传附近的块
+	copy(disk[500000:], "patched")
+	writeFile(t, filepath.Join(dir, "disk.img"), string(disk))
+	os.Chtimes(filepath.Join(dir, "disk.img"), time.Now(), time.Now().Add(time.Minute))
+	before := packBytes(pan)
+	second, result, err := Take(ctx, job)
+	if err != nil || result.Uploaded != 1 || result.Skipped != 2 {
+		t.Fatalf("second snapshot: %+v %v", result, err)
+	}
+	if n := packBytes(pan) - before; n == 0 || n > 3*ChunkParams.Max {
+		t.Fatalf("second snapshot uploaded %d bytes", n)
+	}
+
+	asm, err := NewAssembler("vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer asm.Close()
+	for _, m := range []*Manifest{first, second} {
+		var buf bytes.Buffer
+		e := entry(t, m, "disk.img")
+		if err := asm.Assemble(ctx, e, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if sum := sha256.Sum256(buf.Bytes()); hex.EncodeToString(sum[:]) != e.SHA256 {
+			t.Fatalf("snapshot %s: disk.img differs", m.ID)
+		}
+	}
+
+	// 删除文件后只保留最新的快照, 只有不再引用的 pack 被删除
+	os.Remove(filepath.Join(dir, "disk.img"))
+	os.Remove(filepath.Join(dir, "copy.img"))
+	if _, _, err := Take(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	job.Retention.KeepLast = 1
+	plan, err := PlanPrune(job)
+	if err != nil || len(plan.Remove) != 2 || len(plan.Packs) == 0 {
+		t.Fatalf("plan: %+v %v", plan, err)
+	}
+	if err := Prune(ctx, plan); err != nil {
+		t.Fatal(err)
+	}
+	if n := packBytes(pan); n != 0 {
+		t.Fatalf("%d bytes of packs left", n)
+	}
+	if chunks, _ := Chunks("vm"); len(chunks) != 0 {
+		t.Fatalf("%d chunks left in the index", len(chunks))
+	}
+}
@@ -0,0 +1,294 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/filemanager"
+)
+
+// Plan is what a prune deletes: the snapshots outside the retention rules
+// and the content that no retained snapshot references.
+type Plan struct {
+	Job    string
+	Keep   []*Manifest
+	Remove []*Manifest
+	// Reasons 记录每个保留的快照命中的规则, 例如 "last", "daily"
+	Reasons map[string][]string
+	Objects []Object
+	// Packs 是 repository 模式中所有块都不再被引用的 pack, 部分引用的 pack 保留
+	Packs []Pack
+
+	job config.Job
+	// latest 是计划时最新的快照, 清理前有新的快照时计划作废
+	latest string
+}
+
+// Bytes returns the size of the content the plan deletes.
+func (p *Plan) Bytes() int64 {
+	var size int64
+	for _, o := range p.Objects {
+		size += o.Size
+	}
+	for _, pk := range p.Packs {
+		size += pk.Size
+	}
+	return size
+}
+
+type bucketRule struct {
+	name  string
+	count int
+	key   func(m *Manifest) string
+}
+
+// Select splits list by the retention rules r. The newest keepLast
+// snapshots are kept, then for each daily, weekly, monthly and yearly rule
+// the newest snapshot of each of the latest N days, weeks, months or years
+// with a snapshot. An empty r keeps everything.
+func Select(list []*Manifest, r config.Retention) (keep, remove []*Manifest, reasons map[string][]string) {
+	sorted := append([]*Manifest(nil), list...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID > sorted[j].ID })
+	reasons = make(map[string][]string)
+	if r.Empty() {
+		for _, m := range sorted {
+			reasons[m.ID] = []string{"no retention"}
+		}
+		return sorted, nil, reasons
+	}
+
+	rules := []bucketRule{
+		{"daily", r.KeepDaily, func(m *Manifest) string { return m.Created.Local().Format("2006-01-02") }},
+		{"weekly", r.KeepWeekly, func(m *Manifest) string {
+			year, week := m.Created.Local().ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", r.KeepMonthly, func(m *Manifest) string { return m.Created.Local().Format("2006-01") }},
+		{"yearly", r.KeepYearly, func(m *Manifest) string { return m.Created.Local().Format("2006") }},
+	}
+	used := make([]int, len(rules))
+	last := make([]string, len(rules))
+	for i, m := range sorted {
+		if i < r.KeepLast {
+			reasons[m.ID] = append(reasons[m.ID], "last")
+		}
+		for j, rule := range rules {
+			if used[j] >= rule.count {
+				continue
+			}
+			// 从新到旧遍历, 每个时间段第一个遇到的就是最新的
+			if k := rule.key(m); k != last[j] {
+				last[j] = k
+				used[j]++
+				reasons[m.ID] = append(reasons[m.ID], rule.name)
+			}
+		}
+		if len(reasons[m.ID]) > 0 {
+			keep = append(keep, m)
+		} else {
+			remove = append(remove, m)
+		}
+	}
+	return keep, remove, reasons
+}
+
+// PlanPrune computes the prune of job without changing anything. Content
+// is deleted when no retained snapshot references it and it belongs to a
+// removed snapshot, or it is older than the newest snapshot, which is left
+// over from a cancelled run or an interrupted prune. Content uploaded by a
+// snapshot that is still running is never touched.
+func PlanPrune(job config.Job) (*Plan, error) {
+	list, err := List(job.Name)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := Objects(job.Name)
+	if err != nil {
+		return nil, err
+	}
+	packs, err := Packs(job.Name)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{Job: job.Name, job: job}
+	plan.Keep, plan.Remove, plan.Reasons = Select(list, job.Retention)
+
+	// 文件内容的 field 和块的 sha256 放在同一个集合中
+	referenced := make(map[string]bool)
+	for _, m := range plan.Keep {
+		for _, f := range m.Files {
+			if k, _, ok := f.lookup(objects); ok {
+				referenced[k] = true
+			} else {
+				// 找不到引用的版本时保留同一内容的所有版本
+				referenced[f.SHA256], referenced[objectKey(f.SHA256, true)] = true, true
+			}
+			for _, c := range f.Chunks {
+				referenced[c] = true
+			}
+		}
+	}
+	removed := make(map[string]bool)
+	for _, m := range plan.Remove {
+		for _, f := range m.Files {
+			if k, _, ok := f.lookup(objects); ok {
+				removed[k] = true
+			}
+			for _, c := range f.Chunks {
+				removed[c] = true
+			}
+		}
+	}
+	if len(list) == 0 {
+		return plan, nil
+	}
+	plan.latest = list[len(list)-1].ID
+	newest := list[len(list)-1].Created
+	unused := make(map[string]bool)
+	for sum, o := range objects {
+		if !referenced[sum] && (removed[sum] || o.Created.Before(newest)) {
+			unused[sum] = true
+		}
+	}
+	// tar 包中的文件全部不再引用时才删除整个包, 部分引用的包保留
+	bundleUsed := make(map[string]bool)
+	for sum, o := range objects {
+		if o.Bundle != nil && !unused[sum] {
+			bundleUsed[o.Path] = true
+		}
+	}
+	for sum := range unused {
+		if o := objects[sum]; o.Bundle == nil || !bundleUsed[o.Path] {
+			plan.Objects = append(plan.Objects, o)
+		}
+	}
+	sort.Slice(plan.Objects, func(i, j int) bool { return plan.Objects[i].Path < plan.Objects[j].Path })
+	for _, pk := range packs {
+		used, inRemoved := false, false
+		for _, c := range pk.Chunks {
+			used = used || referenced[c]
+			inRemoved = inRemoved || removed[c]
+		}
+		if !used && (inRemoved || pk.Created.Before(newest)) {
+			plan.Packs = append(plan.Packs, pk)
+		}
+	}
+	sort.Slice(plan.Packs, func(i, j int) bool { return plan.Packs[i].Path < plan.Packs[j].Path })
+	return plan, nil
+}
+
+// Prune carries plan out. The manifests are removed first, so a snapshot
+// never references deleted content; content that fails to delete stays in
+// the index and is picked up by the next prune. It holds the lock of the
+// job, see Take, and returns ErrStalePlan when a snapshot was taken after
+// the plan.
+func Prune(ctx context.Context, plan *Plan) error {
+	if db.Client == nil {
+		return ErrNoRedis
+	}
+	ctx, unlock, err := lockJob(ctx, plan.Job, opPrune)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	list, err := List(plan.Job)
+	if err != nil {
+		return err
+	}
+	if len(list) > 0 && list[len(list)-1].ID != plan.latest {
+		return ErrStalePlan
+	}
+	if len(plan.Remove) > 0 || len(plan.Objects) > 0 || len(plan.Packs) > 0 {
+		// 云端的清单同样去掉清理的快照和内容
+		defer writeState(ctx, plan.job)
+	}
+	for _, m := range plan.Remove {
+		if err := db.Client.HDel(ctx, key(SNAPSHOTS, plan.Job), m.ID).Err(); err != nil {
+			return err
+		}
+		logrus.Infof("[Prune %s] removed snapshot %s", plan.Job, m.ID)
+	}
+	if len(plan.Objects) == 0 && len(plan.Packs) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(plan.Objects)+len(plan.Packs))
+	// 同一个 tar 包中的文件共用一个路径
+	byPath := make(map[string][]string, len(plan.Objects))
+	for _, o := range plan.Objects {
+		if _, ok := byPath[o.Path]; !ok {
+			paths = append(paths, o.Path)
+		}
+		byPath[o.Path] = append(byPath[o.Path], o.SHA256)
+	}
+	packs := make(map[string]Pack, len(plan.Packs))
+	for _, pk := range plan.Packs {
+		paths = append(paths, pk.Path)
+		packs[pk.Path] = pk
+	}
+	// 校验文件和内容一起删除, 没有自己的索引
+	parities := make(map[string]bool)
+	for _, o := range plan.Objects {
+		parities[o.Parity] = true
+	}
+	for _, pk := range plan.Packs {
+		parities[pk.Parity] = true
+	}
+	delete(parities, "")
+	for p := range parities {
+		paths = append(paths, p)
+	}
+	var chunks map[string]Chunk
+	if len(packs) > 0 {
+		var err error
+		if chunks, err = Chunks(plan.Job); err != nil {
+			return err
+		}
+	}
+	deleted, err := filemanager.Delete(ctx, paths)
+	for _, p := range deleted {
+		var e error
+		if parities[p] {
+			continue
+		}
+		if pk, ok := packs[p]; ok {
+			// 先删除块的索引, 中断时 pack 记录还在, 下次清理再删除
+			// 重新上传到其他 pack 的块 (例如开启加密之后) 不删除
+			var own []string
+			for _, c := range pk.Chunks {
+				if chunks[c].Pack == pk.ID {
+					own = append(own, c)
+				}
+			}
+			if len(own) > 0 {
+				e = db.Client.HDel(ctx, key(REPO_CHUNKS, plan.Job), own...).Err()
+			}
+			if e == nil {
+				e = db.Client.HDel(ctx, key(REPO_PACKS, plan.Job), pk.ID).Err()
+			}
+		} else {
+			e = db.Client.HDel(ctx, key(SNAPSHOT_OBJECTS, plan.Job), byPath[p]...).Err()
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	logrus.Infof("[Prune %s] deleted %d of %d versions and packs", plan.Job, len(deleted), len(paths))
+	return err
+}
+
+// ApplyRetention prunes job by its retention rules, it does nothing when
+// the job has none.
+func ApplyRetention(ctx context.Context, job config.Job) (*Plan, error) {
+	if job.Retention.Empty() {
+		return nil, nil
+	}
+	plan, err := PlanPrune(job)
+	if err != nil {
+		return nil, err
+	}
+	return plan, Prune(ctx, plan)
+}
@@ -0,0 +1,138 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/fakepan"
+)
+
+func manifestsAt(times ...string) []*Manifest {
+	var list []*Manifest
+	for _, s := range times {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			panic(err)
+		}
+		list = append(list, &Manifest{ID: t.UTC().Format(idLayout), Created: t})
+	}
+	return list
+}
+
+func ids(list []*Manifest) []string {
+	ret := make([]string, 0, len(list))
+	for _, m := range list {
+		ret = append(ret, m.Created.Format("01-02 15:04"))
+	}
+	return ret
+}
+
+func TestSelect(t *testing.T) {
+	list := manifestsAt(
+		"2023-12-31 10:00",
+		"2024-01-01 09:00",
+		"2024-01-01 18:00",
+		"2024-01-02 09:00",
+		"2024-01-08 09:00",
+		"2024-02-01 09:00",
+		"2024-02-01 12:00",
+	)
+	cases := []struct {
+		r    config.Retention
+		keep []string
+	}{
+		{config.Retention{}, []string{"02-01 12:00", "02-01 09:00", "01-08 09:00", "01-02 09:00", "01-01 18:00", "01-01 09:00", "12-31 10:00"}},
+		{config.Retention{KeepLast: 2}, []string{"02-01 12:00", "02-01 09:00"}},
+		{config.Retention{KeepDaily: 3}, []string{"02-01 12:00", "01-08 09:00", "01-02 09:00"}},
+		{config.Retention{KeepWeekly: 2}, []string{"02-01 12:00", "01-08 09:00"}},
+		{config.Retention{KeepMonthly: 3}, []string{"02-01 12:00", "01-08 09:00", "12-31 10:00"}},
+		{config.Retention{KeepYearly: 5}, []string{"02-01 12:00", "12-31 10:00"}},
+		{config.Retention{KeepLast: 1, KeepMonthly: 2}, []string{"02-01 12:00", "01-08 09:00"}},
+	}
+	for _, tc := range cases {
+		keep, remove, _ := Select(list, tc.r)
+		got := ids(keep)
+		if len(got) != len(tc.keep) || len(keep)+len(remove) != len(list) {
+			t.Errorf("%+v: keep %v, want %v", tc.r, got, tc.keep)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.keep[i] {
+				t.Errorf("%+v: keep %v, want %v", tc.r, got, tc.keep)
+				break
+			}
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	pan := fakepan.Setup(t)
+	dir := t.TempDir()
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup", Retention: config.Retention{KeepLast: 1}}
+	ctx := context.Background()
+	writeFile(t, filepath.Join(dir, "same.txt"), "unchanged")
+	writeFile(t, filepath.Join(dir, "a.txt"), "v1")
+	first, _, err := Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "a.txt"), "v2!")
+	writeFile(t, filepath.Join(dir, "gone.txt"), "gone")
+	second, _, err := Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "gone.txt"))
+	writeFile(t, filepath.Join(dir, "a.txt"), "v3!!")
+	third, _, err := Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := PlanPrune(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Keep) != 1 || plan.Keep[0].ID != third.ID || len(plan.Remove) != 2 {
+		t.Fatalf("plan: keep %v, remove %v", ids(plan.Keep), ids(plan.Remove))
+	}
+	// a.txt 的 v1 和 v2, 以及 gone.txt
+	if len(plan.Objects) != 3 {
+		t.Fatalf("plan deletes %d versions: %+v", len(plan.Objects), plan.Objects)
+	}
+	// dry-run 不改变任何东西
+	if list, _ := List("docs"); len(list) != 3 {
+		t.Fatal("PlanPrune removed snapshots")
+	}
+
+	if err := Prune(ctx, plan); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := List("docs"); len(list) != 1 || list[0].ID != third.ID {
+		t.Fatalf("snapshots after prune: %v", ids(list))
+	}
+	for _, p := range []string{entry(t, first, "a.txt").Object, entry(t, second, "a.txt").Object, entry(t, second, "gone.txt").Object} {
+		if _, ok := pan.Get(p); ok {
+			t.Errorf("%s not deleted", p)
+		}
+	}
+	// 保留的快照引用的内容不删除, 包括第一次快照上传的 same.txt
+	for _, f := range third.Files {
+		if got, ok := pan.Get(f.Object); !ok || got == nil {
+			t.Errorf("%s: %s deleted", f.Path, f.Object)
+		}
+	}
+	if objects, _ := Objects("docs"); len(objects) != 2 {
+		t.Fatalf("objects after prune: %d", len(objects))
+	}
+
+	// 再次清理没有可删除的内容
+	plan, err = PlanPrune(job)
+	if err != nil || len(plan.Remove) != 0 || len(plan.Objects) != 0 {
+		t.Fatalf("second plan: %+v %v", plan, err)
+	}
+}
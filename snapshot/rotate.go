@@ -0,0 +1,144 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/cloudsync"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/download"
+)
+
+// headSize 读取旧对象文件头时下载的字节数, 足够容纳所有 stanza
+const headSize = 16 << 10
+
+// RotateResult is what Rotate did.
+type RotateResult struct {
+	Rotated int                   `json:"rotated"`
+	Failed  []cloudsync.FileError `json:"failed,omitempty"`
+}
+
+// Rotate wraps the file key of every encrypted version and pack of job
+// again for the configured recipients, with the configured identities.
+// Only the index is rewritten, the content stays in the cloud as it is and
+// restore uses the new wraps; the index is also written to the cloud
+// manifest, so the new wraps survive the loss of Redis. The header of the
+// cloud file still holds the old wraps, a leaked key can read the versions
+// uploaded before the rotation until they are pruned. Sync mode has no
+// index, its file keys are only in the headers, and is refused.
+func Rotate(ctx context.Context, job config.Job) (RotateResult, error) {
+	var result RotateResult
+	if !job.Snapshots() {
+		return result, fmt.Errorf("job %s: %s mode keeps the file keys only in the cloud files, rotating keys needs %s or %s mode",
+			job.Name, config.MODE_SYNC, config.MODE_SNAPSHOT, config.MODE_REPOSITORY)
+	}
+	if db.Client == nil {
+		return result, ErrNoRedis
+	}
+	ctx, unlock, err := lockJob(ctx, job.Name, opRotate)
+	if err != nil {
+		return result, err
+	}
+	defer unlock()
+	ring, err := crypt.LoadKeyring()
+	if err != nil {
+		return result, err
+	}
+	if len(ring.Identities) == 0 || len(ring.Recipients) == 0 {
+		return result, errors.New("rotating keys needs a key that decrypts and one to encrypt to")
+	}
+	objects, err := Objects(job.Name)
+	if err != nil {
+		return result, err
+	}
+	for sum, obj := range objects {
+		if !obj.Encrypted {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if !result.rotate(ctx, ring, &obj) {
+			continue
+		}
+		if err := saveObject(job.Name, sum, obj); err != nil {
+			return result, err
+		}
+		objects[sum] = obj
+	}
+	// repository 模式的 pack 同样处理, 块的密钥就是 pack 的密钥
+	packs, err := Packs(job.Name)
+	if err != nil {
+		return result, err
+	}
+	for _, pk := range packs {
+		if !pk.Encrypted {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if !result.rotate(ctx, ring, &pk.Object) {
+			continue
+		}
+		if err := savePack(job.Name, pk); err != nil {
+			return result, err
+		}
+	}
+
+	list, err := List(job.Name)
+	if err != nil {
+		return result, err
+	}
+	for _, m := range list {
+		for i, e := range m.Files {
+			if obj, ok := ObjectOf(objects, e); ok && obj.Encrypted {
+				m.Files[i].Keys = obj.Keys
+			}
+		}
+		if err := Save(m); err != nil {
+			return result, err
+		}
+	}
+	if result.Rotated > 0 {
+		if err := saveState(ctx, job); err != nil && !errors.Is(err, cloudsync.ErrManifestKey) {
+			return result, fmt.Errorf("write manifest: %w", err)
+		}
+	}
+	logrus.Infof("[Rotate %s] %d versions rewrapped for %v, %d failed", job.Name, result.Rotated, ring.KeyIDs(), len(result.Failed))
+	return result, nil
+}
+
+// rotate rewraps the file key of obj, it reports false when that failed.
+func (r *RotateResult) rotate(ctx context.Context, ring *crypt.Keyring, obj *Object) bool {
+	wraps := obj.Wraps
+	if len(wraps) == 0 {
+		// 轮换之前上传的对象没有记录 wraps, 读取云端的文件头
+		head, err := download.ReadHead(ctx, uint64(obj.FsID), headSize)
+		if err == nil {
+			wraps, err = crypt.ReadWraps(bytes.NewReader(head))
+		}
+		if err != nil {
+			r.fail(obj.Path, err)
+			return false
+		}
+	}
+	rotated, err := crypt.Rewrap(wraps, ring.Identities, ring.Recipients)
+	if err != nil {
+		r.fail(obj.Path, err)
+		return false
+	}
+	obj.Wraps, obj.Keys = rotated, rotated.KeyIDs()
+	r.Rotated++
+	return true
+}
+
+func (r *RotateResult) fail(path string, err error) {
+	logrus.Errorf("[Rotate] %s: %v", path, err)
+	r.Failed = append(r.Failed, cloudsync.FileError{Path: path, Error: err.Error()})
+}
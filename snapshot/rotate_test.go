@@ -0,0 +1,117 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/download"
+	"github.com/wangxso/backuptool/fakepan"
+)
+
+func TestRotate(t *testing.T) {
+	pan := fakepan.Setup(t)
+	keys := t.TempDir()
+	alice, _ := crypt.WriteIdentityFile(filepath.Join(keys, "alice"))
+	bob, _ := crypt.WriteIdentityFile(filepath.Join(keys, "bob"))
+	dir := t.TempDir()
+	job := config.Job{Name: "hr", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_SNAPSHOT, Encrypt: true}
+	writeFile(t, filepath.Join(dir, "a.txt"), "payroll")
+	writeFile(t, filepath.Join(dir, "b.txt"), "contracts")
+	ctx := context.Background()
+	// 签名云端清单的口令同样是接收者
+	config.BackUpConfig.Encryption.Passphrase = "hr"
+	secret, err := crypt.LoadKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 备份机只有 alice 的公钥
+	config.BackUpConfig.Encryption.Recipients = []string{alice.Recipient().String()}
+	m, _, err := Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := entry(t, m, "a.txt").Keys; !sameKeys(keys, secret.KeyID(), alice.Recipient().KeyID()) {
+		t.Fatalf("keys: %v", keys)
+	}
+	// 之前的版本没有记录 wraps, field 也是 sha256, 轮换时读取云端的文件头
+	objects, _ := Objects("hr")
+	sum := entry(t, m, "b.txt").SHA256
+	legacy := objects[objectKey(sum, true)]
+	legacy.Wraps = nil
+	db.Client.HDel(ctx, key(SNAPSHOT_OBJECTS, "hr"), objectKey(sum, true))
+	saveObject("hr", sum, legacy)
+
+	uploads, slices := pan.Calls("upload"), pan.Calls("superfile2")
+	config.BackUpConfig.Encryption.IdentityFile = filepath.Join(keys, "alice")
+	config.BackUpConfig.Encryption.Recipients = []string{bob.Recipient().String()}
+	result, err := Rotate(ctx, job)
+	if err != nil || result.Rotated != 2 || len(result.Failed) != 0 {
+		t.Fatalf("rotate: %+v %v", result, err)
+	}
+	// 只上传新的云端清单
+	if pan.Calls("upload") != uploads+1 || pan.Calls("superfile2") != slices {
+		t.Fatal("content uploaded again")
+	}
+	m, _ = Load("hr", m.ID)
+	objects, _ = Objects("hr")
+	// 只用 bob 的私钥解密
+	config.BackUpConfig.Encryption.IdentityFile = filepath.Join(keys, "bob")
+	config.BackUpConfig.Encryption.Passphrase = ""
+	for p, want := range map[string]string{"a.txt": "payroll", "b.txt": "contracts"} {
+		e := entry(t, m, p)
+		if !sameKeys(e.Keys, secret.KeyID(), bob.Recipient().KeyID()) {
+			t.Fatalf("%s keys: %v", p, e.Keys)
+		}
+		local := filepath.Join(t.TempDir(), p)
+		obj, _ := ObjectOf(objects, e)
+		if err := download.DownloadObject(ctx, uint64(e.FsID), local, obj.Encoding()); err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if got, _ := os.ReadFile(local); string(got) != want {
+			t.Fatalf("%s: %q", p, got)
+		}
+	}
+
+	// 新的 wraps 写入了云端清单, 丢失 Redis 后 bob 仍能恢复
+	dropState(t, "hr")
+	config.BackUpConfig.Encryption.Passphrase = "hr"
+	if _, err := RebuildState(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	config.BackUpConfig.Encryption.Passphrase = ""
+	objects, _ = Objects("hr")
+	a := entry(t, m, "a.txt")
+	local := filepath.Join(t.TempDir(), "a.txt")
+	obj, _ := ObjectOf(objects, a)
+	if err := download.DownloadObject(ctx, uint64(a.FsID), local, obj.Encoding()); err != nil {
+		t.Fatalf("after rebuild: %v", err)
+	}
+
+	// 同步模式没有索引, 不能只更新 wraps
+	sync := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/docs", Encrypt: true}
+	if _, err := Rotate(ctx, sync); err == nil {
+		t.Fatal("rotated a sync job")
+	}
+}
+
+func sameKeys(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[string]bool, len(got))
+	for _, k := range got {
+		seen[k] = true
+	}
+	for _, k := range want {
+		if !seen[k] {
+			return false
+		}
+	}
+	return true
+}
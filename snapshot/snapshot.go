@@ -0,0 +1,336 @@
+// Package snapshot backs a folder up as versioned snapshots: every run
+// records a manifest of the files with their hashes, changed content is
+// uploaded to a new versioned path and never overwrites an older version,
+// unchanged content is referenced by the new manifest.
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/download"
+)
+
+const (
+	// SNAPSHOTS 保存每个任务的快照清单, key 为 snapshots:<job>, field 为快照 ID
+	SNAPSHOTS = "snapshots"
+	// SNAPSHOT_OBJECTS 保存已上传的内容, key 为 snapshot_objects:<job>, field 为 sha256,
+	// 加密上传的内容 field 为 sha256 加 encryptedSuffix
+	SNAPSHOT_OBJECTS = "snapshot_objects"
+	// encryptedSuffix 区分同一内容的加密和未加密版本, 切换加密时不覆盖旧版本的记录
+	encryptedSuffix = ":enc"
+
+	// idLayout 是快照 ID 的时间格式, 按字符串排序即按时间排序
+	idLayout = "20060102T150405Z"
+	// Latest 可以代替快照 ID, 表示最新的快照
+	Latest = "latest"
+)
+
+var (
+	ErrNotFound = errors.New("snapshot not found")
+	ErrNoRedis  = errors.New("snapshots need Redis")
+	// ErrStalePlan 表示计划之后又有新的快照, 需要重新计划
+	ErrStalePlan = errors.New("a snapshot was taken after the prune was planned, plan again")
+)
+
+// Entry is a file of a snapshot.
+type Entry struct {
+	// Path 是相对源目录的路径, 以 / 分隔
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Mode    uint32    `json:"mode"`
+	SHA256  string    `json:"sha256"`
+	// Object 是内容在云端的路径, 内容相同的文件共用一个 Object
+	// repository 模式没有 Object, 内容为 Chunks 中的块按顺序拼接
+	Object string   `json:"object"`
+	FsID   int64    `json:"fsId"`
+	Chunks []string `json:"chunks,omitempty"`
+	// Keys 是可以解密 Object 的密钥, 未加密时为空
+	Keys []string `json:"keys,omitempty"`
+}
+
+// Manifest lists the files of a snapshot. A partial manifest misses the
+// files that failed to upload.
+type Manifest struct {
+	ID      string    `json:"id"`
+	Job     string    `json:"job"`
+	Source  string    `json:"source"`
+	Target  string    `json:"target"`
+	Created time.Time `json:"created"`
+	Partial bool      `json:"partial,omitempty"`
+	Files   []Entry   `json:"files"`
+}
+
+// Chunked reports whether e is stored as chunks, by a repository job.
+func (e Entry) Chunked() bool {
+	return e.Object == ""
+}
+
+// Size returns the total size of the files of m.
+func (m *Manifest) Size() int64 {
+	var size int64
+	for _, f := range m.Files {
+		size += f.Size
+	}
+	return size
+}
+
+// Object is uploaded content, shared by every entry with its hash.
+type Object struct {
+	SHA256  string    `json:"sha256"`
+	Path    string    `json:"path"`
+	FsID    int64     `json:"fsId"`
+	MD5     string    `json:"md5"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	// Encrypted 为 true 时云端保存的是密文, 下载后解密
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Wraps 是每个密钥加密的文件密钥, 轮换密钥时只更新这里, 不重新上传
+	Wraps crypt.Wraps `json:"wraps,omitempty"`
+	Keys  []string    `json:"keys,omitempty"`
+	// Codec 是上传前使用的压缩算法, 下载后解压
+	Codec string `json:"codec,omitempty"`
+	// Bundle 不为空时内容在 Path 这个 tar 包中, MD5 是整个 tar 包的 MD5
+	Bundle *Member `json:"bundle,omitempty"`
+	// Parity 是 Path 的 Reed-Solomon 校验文件, tar 包中的文件共用整个包的校验文件
+	Parity     string `json:"parity,omitempty"`
+	ParityFsID int64  `json:"parityFsId,omitempty"`
+	// Damaged 表示 scrub 发现云端内容损坏或丢失, 下次快照重新上传, 记录留给引用它的旧快照
+	Damaged bool `json:"damaged,omitempty"`
+}
+
+// Encoding returns how the content of o was transformed before upload.
+func (o Object) Encoding() download.Encoding {
+	return download.Encoding{Encrypted: o.Encrypted, Wraps: o.Wraps, Codec: o.Codec}
+}
+
+// objectKey returns the field of the content sum in SNAPSHOT_OBJECTS.
+func objectKey(sum string, encrypted bool) string {
+	if encrypted {
+		return sum + encryptedSuffix
+	}
+	return sum
+}
+
+// damagedKey is the field a damaged object moves to when its content is
+// uploaded again, the snapshots referencing it still find it by FsID.
+func damagedKey(field string, fsID int64) string {
+	return field + "@" + strconv.FormatInt(fsID, 10)
+}
+
+// findObject returns the undamaged content sum uploaded with or without
+// encryption.
+func findObject(objects map[string]Object, sum string, encrypted bool) (Object, bool) {
+	// 旧版本加密上传的内容 field 也是 sha256
+	for _, k := range []string{objectKey(sum, encrypted), sum} {
+		if o, ok := objects[k]; ok && o.Encrypted == encrypted && !o.Damaged {
+			return o, true
+		}
+	}
+	return Object{}, false
+}
+
+// lookup returns the field and the object e references, the version of its
+// content with the same FsID.
+func (e Entry) lookup(objects map[string]Object) (string, Object, bool) {
+	for _, field := range []string{objectKey(e.SHA256, true), e.SHA256} {
+		for _, k := range []string{field, damagedKey(field, e.FsID)} {
+			if o, ok := objects[k]; ok && o.FsID == e.FsID {
+				return k, o, true
+			}
+		}
+	}
+	return "", Object{}, false
+}
+
+// ObjectOf returns the object e references in objects, as returned by
+// Objects.
+func ObjectOf(objects map[string]Object, e Entry) (Object, bool) {
+	_, o, ok := e.lookup(objects)
+	return o, ok
+}
+
+func key(prefix, job string) string {
+	return prefix + ":" + job
+}
+
+// Save stores m in Redis.
+func Save(m *Manifest) error {
+	if db.Client == nil {
+		return ErrNoRedis
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return db.Client.HSet(db.Client.Context(), key(SNAPSHOTS, m.Job), m.ID, data).Err()
+}
+
+// Load returns the snapshot id of job, id may be Latest.
+func Load(job, id string) (*Manifest, error) {
+	if db.Client == nil {
+		return nil, ErrNoRedis
+	}
+	if id == Latest {
+		list, err := List(job)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) == 0 {
+			return nil, fmt.Errorf("job %s: %w", job, ErrNotFound)
+		}
+		return list[len(list)-1], nil
+	}
+	data, err := db.Client.HGet(db.Client.Context(), key(SNAPSHOTS, job), id).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("job %s snapshot %s: %w", job, id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", id, err)
+	}
+	return &m, nil
+}
+
+// At returns the newest snapshot of job taken at or before t.
+func At(job string, t time.Time) (*Manifest, error) {
+	list, err := List(job)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		if !list[i].Created.After(t) {
+			return list[i], nil
+		}
+	}
+	return nil, fmt.Errorf("job %s at %s: %w", job, t.Format(time.RFC3339), ErrNotFound)
+}
+
+// List returns the snapshots of job, oldest first.
+func List(job string) ([]*Manifest, error) {
+	if db.Client == nil {
+		return nil, ErrNoRedis
+	}
+	all, err := db.Client.HGetAll(db.Client.Context(), key(SNAPSHOTS, job)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Manifest, 0, len(all))
+	for id, data := range all {
+		var m Manifest
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", id, err)
+		}
+		ret = append(ret, &m)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret, nil
+}
+
+// Objects returns the uploaded content of job by its field, see ObjectOf.
+func Objects(job string) (map[string]Object, error) {
+	if db.Client == nil {
+		return nil, ErrNoRedis
+	}
+	all, err := db.Client.HGetAll(db.Client.Context(), key(SNAPSHOT_OBJECTS, job)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]Object, len(all))
+	for sum, data := range all {
+		var o Object
+		if err := json.Unmarshal([]byte(data), &o); err != nil {
+			return nil, fmt.Errorf("object %s: %w", sum, err)
+		}
+		ret[sum] = o
+	}
+	return ret, nil
+}
+
+func saveObject(job, field string, o Object) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return db.Client.HSet(db.Client.Context(), key(SNAPSHOT_OBJECTS, job), field, data).Err()
+}
+
+// addObject stores newly uploaded content in the index and in objects. The
+// other versions of the same content stay, older snapshots still reference
+// them.
+func addObject(job string, objects map[string]Object, o Object) error {
+	k := objectKey(o.SHA256, o.Encrypted)
+	// field 被占用时先把旧记录移走: 旧版本的加密内容 field 是 sha256, 移到加密的 field,
+	// 损坏的内容移到 damagedKey
+	if old, ok := objects[k]; ok && old.FsID != o.FsID {
+		to := objectKey(old.SHA256, old.Encrypted)
+		if _, used := objects[to]; used || to == k {
+			to = damagedKey(k, old.FsID)
+		}
+		if err := saveObject(job, to, old); err != nil {
+			return err
+		}
+		objects[to] = old
+	}
+	if err := saveObject(job, k, o); err != nil {
+		return err
+	}
+	objects[k] = o
+	return nil
+}
+
+// MarkDamaged marks the content fields of job damaged, so the next
+// snapshot hashes and uploads the files holding them again. It is used for
+// content found damaged or missing in the cloud. The records stay with their
+// encoding and parity for the snapshots referencing them, and prune deletes
+// the cloud files once none does.
+func MarkDamaged(job string, fields ...string) error {
+	if db.Client == nil {
+		return ErrNoRedis
+	}
+	for _, field := range fields {
+		data, err := db.Client.HGet(db.Client.Context(), key(SNAPSHOT_OBJECTS, job), field).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var o Object
+		if err := json.Unmarshal([]byte(data), &o); err != nil {
+			return fmt.Errorf("object %s: %w", field, err)
+		}
+		o.Damaged = true
+		if err := saveObject(job, field, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newID returns an unused snapshot ID for job from the current time.
+func newID(job string, now time.Time) (string, error) {
+	base := now.UTC().Format(idLayout)
+	id := base
+	for i := 2; ; i++ {
+		exists, err := db.Client.HExists(db.Client.Context(), key(SNAPSHOTS, job), id).Result()
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return id, nil
+		}
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+}
@@ -0,0 +1,190 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/download"
+	"github.com/wangxso/backuptool/fakepan"
+)
+
+func writeFile(t *testing.T, path string, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTakeVersionsAndDedupes(t *testing.T) {
+	pan := fakepan.Setup(t)
+	dir := t.TempDir()
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup"}
+	writeFile(t, filepath.Join(dir, "a.txt"), "version 1")
+	writeFile(t, filepath.Join(dir, "docs", "b.txt"), "b")
+	writeFile(t, filepath.Join(dir, "copy-of-a.txt"), "version 1")
+	ctx := context.Background()
+
+	first, result, err := Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 内容相同的文件只上传一次
+	if len(first.Files) != 3 || result.Uploaded != 2 || result.Skipped != 1 || first.Partial {
+		t.Fatalf("first snapshot: %d files, %+v", len(first.Files), result)
+	}
+	firstA := entry(t, first, "a.txt")
+	if got, _ := pan.Get(firstA.Object); string(got) != "version 1" {
+		t.Fatalf("object %s: %q", firstA.Object, got)
+	}
+	if entry(t, first, "copy-of-a.txt").Object != firstA.Object {
+		t.Fatal("identical content uploaded twice")
+	}
+
+	writeFile(t, filepath.Join(dir, "a.txt"), "version 2, longer")
+	os.Remove(filepath.Join(dir, "docs", "b.txt"))
+	writeFile(t, filepath.Join(dir, "new.txt"), "new")
+	second, result, err := Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Uploaded != 2 || result.Skipped != 1 {
+		t.Fatalf("second snapshot: %+v", result)
+	}
+	if second.ID == first.ID {
+		t.Fatal("snapshot ID reused")
+	}
+	// 旧版本不被覆盖
+	if got, _ := pan.Get(firstA.Object); string(got) != "version 1" {
+		t.Fatalf("old version overwritten: %q", got)
+	}
+	if got, _ := pan.Get(entry(t, second, "a.txt").Object); string(got) != "version 2, longer" {
+		t.Fatalf("new version: %q", got)
+	}
+
+	list, err := List("docs")
+	if err != nil || len(list) != 2 || list[0].ID != first.ID || list[1].ID != second.ID {
+		t.Fatalf("list: %v %v", list, err)
+	}
+	latest, err := Load("docs", Latest)
+	if err != nil || latest.ID != second.ID {
+		t.Fatalf("latest: %v %v", latest, err)
+	}
+
+	changes := Diff(first, second)
+	want := []Change{{Path: "a.txt", Kind: Modified}, {Path: "docs/b.txt", Kind: Removed}, {Path: "new.txt", Kind: Added}}
+	if len(changes) != len(want) {
+		t.Fatalf("diff: %+v", changes)
+	}
+	for i, c := range changes {
+		if c.Path != want[i].Path || c.Kind != want[i].Kind {
+			t.Errorf("change %d: got %s %s, want %s %s", i, c.Kind, c.Path, want[i].Kind, want[i].Path)
+		}
+	}
+}
+
+func TestTakeUnchangedUploadsNothing(t *testing.T) {
+	pan := fakepan.Setup(t)
+	config.BackUpConfig.Encryption.Passphrase = "docs"
+	dir := t.TempDir()
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup"}
+	writeFile(t, filepath.Join(dir, "a.txt"), "a")
+	if _, _, err := Take(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	uploads := pan.Calls("upload")
+	m, result, err := Take(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 只上传新的云端清单
+	if result.Uploaded != 0 || result.Skipped != 1 || len(m.Files) != 1 || pan.Calls("upload") != uploads+1 {
+		t.Fatalf("unchanged snapshot: %+v", result)
+	}
+	if changes := Diff(m, m); len(changes) != 0 {
+		t.Fatalf("diff with itself: %+v", changes)
+	}
+}
+
+func TestTakeEncryptToggled(t *testing.T) {
+	pan := fakepan.Setup(t)
+	config.BackUpConfig.Encryption.Passphrase = "docs"
+	dir := t.TempDir()
+	job := config.Job{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup", Retention: config.Retention{KeepLast: 1}}
+	writeFile(t, filepath.Join(dir, "a.txt"), "plain first")
+	ctx := context.Background()
+	plain, _, err := Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Encrypt = true
+	encrypted, result, err := Take(ctx, job)
+	if err != nil || result.Uploaded != 1 {
+		t.Fatalf("encrypted snapshot: %+v %v", result, err)
+	}
+
+	// 两个版本的记录都保留, 各自按自己的编码下载
+	objects, _ := Objects("docs")
+	if len(objects) != 2 {
+		t.Fatalf("%d objects", len(objects))
+	}
+	for _, m := range []*Manifest{plain, encrypted} {
+		e := entry(t, m, "a.txt")
+		obj, ok := ObjectOf(objects, e)
+		if !ok || obj.Encrypted != (m == encrypted) {
+			t.Fatalf("%s: %+v", m.ID, obj)
+		}
+		local := filepath.Join(t.TempDir(), "a.txt")
+		if err := download.DownloadObject(ctx, uint64(e.FsID), local, obj.Encoding()); err != nil {
+			t.Fatalf("%s: %v", m.ID, err)
+		}
+		if got, _ := os.ReadFile(local); string(got) != "plain first" {
+			t.Fatalf("%s: %q", m.ID, got)
+		}
+	}
+
+	// 未加密的版本不再被引用, 清理时删除
+	plan, err := PlanPrune(job)
+	if err != nil || len(plan.Objects) != 1 || plan.Objects[0].Encrypted {
+		t.Fatalf("plan: %+v %v", plan, err)
+	}
+	if err := Prune(ctx, plan); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pan.Get(entry(t, plain, "a.txt").Object); ok {
+		t.Fatal("plain version not deleted")
+	}
+	if objects, _ := Objects("docs"); len(objects) != 1 {
+		t.Fatalf("objects after prune: %+v", objects)
+	}
+}
+
+func TestVersionPath(t *testing.T) {
+	cases := map[string]string{
+		"a.txt":              "/apps/backup/a.20240102T150405Z.txt",
+		"docs/report.tar.gz": "/apps/backup/docs/report.tar.20240102T150405Z.gz",
+		"Makefile":           "/apps/backup/Makefile.20240102T150405Z",
+		".bashrc":            "/apps/backup/.bashrc.20240102T150405Z",
+	}
+	for rel, want := range cases {
+		if got := versionPath("/apps/backup", rel, "20240102T150405Z"); got != want {
+			t.Errorf("%s: got %s, want %s", rel, got, want)
+		}
+	}
+}
+
+func entry(t *testing.T, m *Manifest, p string) Entry {
+	t.Helper()
+	for _, f := range m.Files {
+		if f.Path == p {
+			return f
+		}
+	}
+	t.Fatalf("snapshot %s has no %s", m.ID, p)
+	return Entry{}
+}
@@ -0,0 +1,157 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/cloudsync"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/download"
+)
+
+// stateKeys 是快照任务只保存在 Redis 中的索引, 写入云端清单以便在新机器上恢复
+var stateKeys = []string{SNAPSHOTS, SNAPSHOT_OBJECTS, REPO_PACKS, REPO_CHUNKS}
+
+// writeState uploads the snapshot index of job to its manifest folder, see
+// cloudsync.WriteManifest. A failure is only logged, the index in Redis is
+// still complete.
+func writeState(ctx context.Context, job config.Job) {
+	if err := saveState(ctx, job); err != nil && !errors.Is(err, cloudsync.ErrManifestKey) {
+		logrus.Errorf("[Snapshot %s] write manifest: %v", job.Name, err)
+	}
+}
+
+func saveState(ctx context.Context, job config.Job) error {
+	m := &cloudsync.Manifest{State: make(map[string]map[string]string, len(stateKeys))}
+	for _, prefix := range stateKeys {
+		all, err := db.Client.HGetAll(ctx, key(prefix, job.Name)).Result()
+		if err != nil {
+			return err
+		}
+		if len(all) > 0 {
+			m.State[prefix] = all
+		}
+	}
+	if job.EncryptNames {
+		// 版本的路径可能包含过长的加密文件名, tar 包和 pack 的路径不加密
+		var paths []string
+		for _, data := range m.State[SNAPSHOT_OBJECTS] {
+			var o Object
+			if err := json.Unmarshal([]byte(data), &o); err != nil {
+				return err
+			}
+			paths = append(paths, o.Path)
+		}
+		var err error
+		if m.LongNames, err = crypt.LongNames(paths...); err != nil {
+			return err
+		}
+	}
+	return cloudsync.WriteManifest(ctx, job, m)
+}
+
+// Rebuilt is the result of RebuildState.
+type Rebuilt struct {
+	Manifest  string    `json:"manifest"`
+	Created   time.Time `json:"created"`
+	Snapshots int       `json:"snapshots"`
+	Objects   int       `json:"objects"`
+	Packs     int       `json:"packs"`
+	// Missing 是清单之后在云端被删除或修改的内容, 不恢复索引, 下次快照重新上传
+	Missing []string `json:"missing,omitempty"`
+}
+
+// RebuildState rebuilds the snapshot index of job in Redis from the newest
+// manifest in its cloud folder, e.g. on a new machine. Objects and packs
+// that are no longer in the cloud with the md5 the index recorded are left
+// out, with the chunks of those packs, so the next snapshot uploads them
+// again.
+func RebuildState(ctx context.Context, job config.Job) (*Rebuilt, error) {
+	if db.Client == nil {
+		return nil, ErrNoRedis
+	}
+	m, p, err := cloudsync.LoadManifest(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	if m.State[SNAPSHOTS] == nil {
+		return nil, fmt.Errorf("manifest %s has no snapshot index", p)
+	}
+	if err := crypt.SaveLongNames(m.LongNames); err != nil {
+		return nil, err
+	}
+	list, err := cloudsync.ListCloudFiles(ctx, job.TargetDir)
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]download.FileItem, len(list))
+	for _, v := range list {
+		byPath[v.Path] = v
+	}
+	present := func(p, md5 string) bool {
+		v, ok := byPath[p]
+		return ok && v.IsDir == 0 && v.MD5 == md5
+	}
+
+	ret := &Rebuilt{Manifest: p, Created: m.Created, Snapshots: len(m.State[SNAPSHOTS])}
+	missing := make(map[string]bool)
+	objects := m.State[SNAPSHOT_OBJECTS]
+	for sum, data := range objects {
+		var o Object
+		if err := json.Unmarshal([]byte(data), &o); err != nil {
+			return nil, fmt.Errorf("object %s: %w", sum, err)
+		}
+		if !present(o.Path, o.MD5) {
+			delete(objects, sum)
+			missing[o.Path] = true
+		}
+	}
+	packs := m.State[REPO_PACKS]
+	chunks := m.State[REPO_CHUNKS]
+	for id, data := range packs {
+		var pk Pack
+		if err := json.Unmarshal([]byte(data), &pk); err != nil {
+			return nil, fmt.Errorf("pack %s: %w", id, err)
+		}
+		if present(pk.Path, pk.MD5) {
+			continue
+		}
+		delete(packs, id)
+		missing[pk.Path] = true
+		// 只删除仍指向这个 pack 的块, 已经重新上传到其他 pack 的块保留
+		for _, sum := range pk.Chunks {
+			var c Chunk
+			if data, ok := chunks[sum]; ok && json.Unmarshal([]byte(data), &c) == nil && c.Pack == id {
+				delete(chunks, sum)
+			}
+		}
+	}
+	ret.Objects, ret.Packs = len(objects), len(packs)
+	for p := range missing {
+		ret.Missing = append(ret.Missing, p)
+	}
+	sort.Strings(ret.Missing)
+
+	for _, prefix := range stateKeys {
+		fields := make([]interface{}, 0, 2*len(m.State[prefix]))
+		for k, v := range m.State[prefix] {
+			fields = append(fields, k, v)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if err := db.Client.HSet(ctx, key(prefix, job.Name), fields...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	logrus.Infof("[Snapshot %s] rebuilt state from %s: %d snapshots, %d objects, %d packs, %d missing",
+		job.Name, p, ret.Snapshots, ret.Objects, ret.Packs, len(ret.Missing))
+	return ret, nil
+}
@@ -0,0 +1,108 @@
+package snapshot
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/fakepan"
+)
+
+// dropState removes the snapshot index of job from Redis, like a new machine.
+func dropState(t *testing.T, job string) {
+	t.Helper()
+	for _, prefix := range stateKeys {
+		db.Client.Del(context.Background(), key(prefix, job))
+	}
+	if list, _ := List(job); len(list) != 0 {
+		t.Fatal("state not dropped")
+	}
+}
+
+func TestRebuildStateBundles(t *testing.T) {
+	pan := fakepan.Setup(t)
+	config.BackUpConfig.Encryption.Passphrase = "mail"
+	dir := t.TempDir()
+	job := config.Job{Name: "mail", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_SNAPSHOT,
+		Encrypt: true, Bundle: config.Bundle{MaxFileSize: "1KB"}}
+	writeFile(t, filepath.Join(dir, "a.eml"), "a")
+	writeFile(t, filepath.Join(dir, "b.eml"), "b")
+	writeFile(t, filepath.Join(dir, "big.bin"), strings.Repeat("x", 4096))
+	ctx := context.Background()
+	first, _, err := Take(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, _ := Objects(job.Name)
+	big, _ := ObjectOf(objects, entry(t, first, "big.bin"))
+
+	dropState(t, job.Name)
+	pan.Remove(big.Path)
+	rebuilt, err := RebuildState(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.Snapshots != 1 || rebuilt.Objects != 2 || len(rebuilt.Missing) != 1 || rebuilt.Missing[0] != big.Path {
+		t.Fatalf("rebuilt: %+v", rebuilt)
+	}
+	if m, err := Load(job.Name, first.ID); err != nil || len(m.Files) != 3 {
+		t.Fatalf("snapshot %s: %v", first.ID, err)
+	}
+	// 云端缺少的内容重新上传, tar 包中的文件不变
+	_, result, err := Take(ctx, job)
+	if err != nil || result.Uploaded != 1 || result.Skipped != 2 {
+		t.Fatalf("take after rebuild: %+v %v", result, err)
+	}
+}
+
+func TestRebuildStateRepository(t *testing.T) {
+	pan := fakepan.Setup(t)
+	dir := t.TempDir()
+	// 内容不加密时清单也需要密钥签名
+	config.BackUpConfig.Encryption.Passphrase = "vm"
+	job := config.Job{Name: "vm", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_REPOSITORY}
+	random := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	writeFile(t, filepath.Join(dir, "disk.img"), string(random))
+	ctx := context.Background()
+	if _, _, err := Take(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	chunks, _ := Chunks(job.Name)
+
+	dropState(t, job.Name)
+	rebuilt, err := RebuildState(ctx, job)
+	if err != nil || rebuilt.Packs != 1 || len(rebuilt.Missing) != 0 {
+		t.Fatalf("rebuilt: %+v %v", rebuilt, err)
+	}
+	if got, _ := Chunks(job.Name); len(got) != len(chunks) {
+		t.Fatalf("%d chunks rebuilt, want %d", len(got), len(chunks))
+	}
+	_, result, err := Take(ctx, job)
+	if err != nil || result.Uploaded != 0 || result.Skipped != 1 {
+		t.Fatalf("take after rebuild: %+v %v", result, err)
+	}
+
+	// pack 在云端被删除时, 它的块不恢复, 下次快照重新上传
+	dropState(t, job.Name)
+	for _, p := range pan.Files() {
+		if strings.HasPrefix(p, "/apps/backup/packs/") {
+			pan.Remove(p)
+		}
+	}
+	rebuilt, err = RebuildState(ctx, job)
+	if err != nil || rebuilt.Packs != 0 || len(rebuilt.Missing) != 1 {
+		t.Fatalf("rebuilt without packs: %+v %v", rebuilt, err)
+	}
+	if got, _ := Chunks(job.Name); len(got) != 0 {
+		t.Fatalf("%d chunks of a missing pack rebuilt", len(got))
+	}
+	_, result, err = Take(ctx, job)
+	if err != nil || result.Uploaded != 1 {
+		t.Fatalf("take without packs: %+v %v", result, err)
+	}
+}
@@ -0,0 +1,291 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/cloudsync"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/metrics"
+	"github.com/wangxso/backuptool/parity"
+	"github.com/wangxso/backuptool/upload"
+	"github.com/wangxso/backuptool/utils"
+)
+
+// Take backs job.SourceDir up as a new snapshot under job.TargetDir.
+//
+// A file with the size and modification time of the previous snapshot is
+// not read again. Other files are hashed, content already uploaded by an
+// earlier snapshot is referenced, new content is uploaded next to the
+// original path with the snapshot ID in its name, e.g.
+// docs/report.20240102T150405Z.txt, with ondup=newcopy so nothing in the
+// cloud is ever overwritten.
+//
+// A job in repository mode splits changed files into content-defined
+// chunks instead and uploads only the chunks the repository does not
+// have yet, collected into pack files under targetDir/packs.
+//
+// A job with bundle.maxFileSize packs the new content of files up to that
+// size into tar files under targetDir/bundles instead of uploading each
+// alone, see Member.
+//
+// A file that fails is recorded in Result.Failed and the manifest is saved
+// as partial. When ctx is done or the program stops, no manifest is saved;
+// the uploaded content is reused by the next snapshot. It returns ErrLocked
+// while another snapshot or prune of the job is running.
+func Take(ctx context.Context, job config.Job) (*Manifest, cloudsync.Result, error) {
+	var result cloudsync.Result
+	if db.Client == nil {
+		return nil, result, ErrNoRedis
+	}
+	ctx, unlock, err := lockJob(ctx, job.Name, opTake)
+	if err != nil {
+		return nil, result, err
+	}
+	defer unlock()
+	if timeout := config.ParseDuration(job.Timeout, 0); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	id, err := newID(job.Name, start)
+	if err != nil {
+		return nil, result, err
+	}
+	previous := make(map[string]Entry)
+	if prev, err := Load(job.Name, Latest); err == nil {
+		for _, f := range prev.Files {
+			previous[f.Path] = f
+		}
+	}
+	objects, err := Objects(job.Name)
+	if err != nil {
+		return nil, result, err
+	}
+	t, names, err := cloudsync.JobTransform(job)
+	if err != nil {
+		return nil, result, err
+	}
+	t.Parity = parityParams(job)
+	var repo *packer
+	if job.Mode == config.MODE_REPOSITORY {
+		if repo, err = newPacker(job, t); err != nil {
+			return nil, result, err
+		}
+		defer repo.close()
+	}
+
+	m := &Manifest{
+		ID:      id,
+		Job:     job.Name,
+		Source:  job.SourceDir,
+		Target:  job.TargetDir,
+		Created: start,
+		Files:   make([]Entry, 0),
+	}
+	var bundles *bundler
+	maxBundled, _ := job.Bundle.Limits()
+	if job.Mode == config.MODE_SNAPSHOT && maxBundled > 0 {
+		bundles = newBundler(job, t, m, objects, &result)
+		defer bundles.close()
+	}
+	err = filepath.Walk(job.SourceDir, func(p string, info os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if cloudsync.Stopping() {
+			return cloudsync.ErrStopped
+		}
+		if err != nil {
+			if p == job.SourceDir {
+				return err
+			}
+			result.Fail(p, err)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			// 目录由文件路径隐含, 符号链接等不备份
+			return nil
+		}
+		result.Waiting++
+		rel, err := filepath.Rel(job.SourceDir, p)
+		if err != nil {
+			result.Fail(p, err)
+			return nil
+		}
+		entry := Entry{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Mode:    uint32(info.Mode().Perm()),
+		}
+
+		if repo != nil {
+			return takeChunked(ctx, repo, m, entry, previous, p, &result)
+		}
+		if prev, ok := previous[entry.Path]; ok && prev.Size == entry.Size && prev.ModTime.Equal(entry.ModTime) {
+			if obj, ok := ObjectOf(objects, prev); ok && obj.Encrypted == job.Encrypt && !obj.Damaged {
+				entry.SHA256, entry.Object, entry.FsID = prev.SHA256, prev.Object, prev.FsID
+				entry.Keys = obj.Keys
+				m.Files = append(m.Files, entry)
+				metrics.FileDone(metrics.OpSkip, entry.Size)
+				result.Skipped++
+				return nil
+			}
+		}
+		if entry.SHA256, err = HashFile(p); err != nil {
+			result.Fail(p, err)
+			return nil
+		}
+		// 开启加密后, 之前未加密上传的内容重新加密上传
+		obj, ok := findObject(objects, entry.SHA256, job.Encrypt)
+		if ok {
+			metrics.FileDone(metrics.OpSkip, entry.Size)
+			result.Skipped++
+		} else if bundles != nil && entry.Size > 0 && entry.Size <= maxBundled {
+			// 空文件不打包, 长度为 0 的范围无法下载
+			// 上传 tar 包之后再加入清单
+			return bundles.add(ctx, entry, p)
+		} else {
+			target := versionPath(job.TargetDir, entry.Path, id)
+			if names != nil {
+				if target, err = names.EncryptPath(job.TargetDir, versionPath("", entry.Path, id)); err != nil {
+					result.Fail(p, err)
+					return nil
+				}
+			}
+			logrus.Infof("[Snapshot %s] upload %s -> %s", job.Name, entry.Path, target)
+			ret, err := upload.UploadTransformed(ctx, target, p, upload.OndupNewcopy, t)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				result.Fail(p, err)
+				return nil
+			}
+			obj = Object{
+				SHA256:  entry.SHA256,
+				Path:    ret.Path,
+				FsID:    ret.FsID,
+				MD5:     ret.MD5,
+				Size:    entry.Size,
+				Created: time.Now(),
+				// 加密时 MD5 是密文的 MD5
+				Encrypted:  len(t.Recipients) > 0,
+				Wraps:      ret.Wraps,
+				Keys:       ret.Wraps.KeyIDs(),
+				Codec:      ret.Codec,
+				Parity:     ret.ParityPath,
+				ParityFsID: ret.ParityFsID,
+			}
+			if err := addObject(job.Name, objects, obj); err != nil {
+				result.Fail(p, err)
+				return nil
+			}
+			result.Uploaded++
+		}
+		entry.Object, entry.FsID, entry.Keys = obj.Path, obj.FsID, obj.Keys
+		m.Files = append(m.Files, entry)
+		return nil
+	})
+	if err == nil && repo != nil {
+		// 最后一个 pack 上传之后才保存清单
+		err = repo.flush(ctx)
+	}
+	if err == nil && bundles != nil {
+		err = bundles.flush(ctx)
+		// tar 包中的文件较晚加入清单, 按路径重新排序
+		sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	}
+	metrics.SyncSeconds.WithLabelValues(job.Name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		logrus.Warnf("[Snapshot %s] %v", job.Name, err)
+		return nil, result, err
+	}
+	m.Partial = len(result.Failed) > 0
+	if err := Save(m); err != nil {
+		return nil, result, err
+	}
+	writeState(ctx, job)
+	if !m.Partial {
+		metrics.LastSuccessfulSync.WithLabelValues(job.Name).SetToCurrentTime()
+	}
+	logrus.Infof("[Snapshot %s] %s: %d files, %d uploaded, %d unchanged, %d failed",
+		job.Name, id, len(m.Files), result.Uploaded, result.Skipped, len(result.Failed))
+	return m, result, nil
+}
+
+// takeChunked adds the file p to m as chunks of repo. A chunk that fails
+// to upload fails the whole snapshot, since the pack held chunks of other
+// files too.
+func takeChunked(ctx context.Context, repo *packer, m *Manifest, entry Entry, previous map[string]Entry, p string, result *cloudsync.Result) error {
+	if prev, ok := previous[entry.Path]; ok && prev.Chunked() && prev.Size == entry.Size && prev.ModTime.Equal(entry.ModTime) && repo.hasAll(prev) {
+		entry.SHA256, entry.Chunks = prev.SHA256, prev.Chunks
+		m.Files = append(m.Files, entry)
+		metrics.FileDone(metrics.OpSkip, entry.Size)
+		result.Skipped++
+		return nil
+	}
+	sum, chunks, fresh, err := repo.store(ctx, p)
+	if err != nil {
+		var pathErr *os.PathError
+		if ctx.Err() == nil && errors.As(err, &pathErr) && pathErr.Path == p {
+			// 本地文件读取失败只影响这个文件
+			result.Fail(p, err)
+			return nil
+		}
+		return err
+	}
+	entry.SHA256, entry.Chunks = sum, chunks
+	m.Files = append(m.Files, entry)
+	if fresh > 0 {
+		logrus.Infof("[Snapshot %s] %s: %d of %d chunks new", m.Job, entry.Path, fresh, len(chunks))
+		result.Uploaded++
+	} else {
+		metrics.FileDone(metrics.OpSkip, entry.Size)
+		result.Skipped++
+	}
+	return nil
+}
+
+// parityParams returns the parity job uploads, none when parityShards is
+// not set.
+func parityParams(job config.Job) parity.Params {
+	c := job.Parity
+	if c.ParityShards <= 0 {
+		return parity.Params{}
+	}
+	p := parity.DefaultParams
+	p.Parity = c.ParityShards
+	if c.DataShards > 0 {
+		p.Data = c.DataShards
+	}
+	p.ShardSize = int(config.ParseSize(c.ShardSize, int64(p.ShardSize)))
+	return p
+}
+
+// versionPath returns the remote path of rel in snapshot id.
+func versionPath(target, rel, id string) string {
+	dir, name := path.Split(rel)
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if stem == "" {
+		// .bashrc 这类文件没有扩展名
+		stem, ext = name, ""
+	}
+	return path.Join(target, dir, stem+"."+id+ext)
+}
+
+// HashFile returns the hex SHA-256 of the file p, as recorded in Entry.
+func HashFile(p string) (string, error) {
+	return utils.CalculateSHA256(p)
+}
@@ -0,0 +1,132 @@
+package upload
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/db"
+)
+
+const (
+	// UPLOAD_CHECKPOINTS 保存未完成的分片上传, field 为云端路径
+	UPLOAD_CHECKPOINTS = "upload_checkpoints"
+	// checkpointTTL 之后 uploadid 可能已失效, 重新上传
+	checkpointTTL = 24 * time.Hour
+	chunkDirName  = "backuptool-chunks"
+)
+
+// Checkpoint 记录一个分片上传的进度, 进程退出后可以跳过已上传的分片继续上传
+type Checkpoint struct {
+	TargetPath string    `json:"targetPath"`
+	SourcePath string    `json:"sourcePath"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	BlockList  string    `json:"blockList"`
+	UploadID   string    `json:"uploadId"`
+	Done       []int     `json:"done"`
+	Created    time.Time `json:"created"`
+	// Codec 是上传前压缩源文件的方式, 加密的上传不保存断点
+	Codec string `json:"codec,omitempty"`
+}
+
+// progressSet 记录已完成的分片, 分片并发上传
+type progressSet struct {
+	mu   sync.Mutex
+	done map[int]bool
+}
+
+func newProgressSet(done []int) *progressSet {
+	s := &progressSet{done: make(map[int]bool)}
+	for _, i := range done {
+		s.done[i] = true
+	}
+	return s
+}
+
+func (s *progressSet) has(i int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done[i]
+}
+
+func (s *progressSet) add(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done[i] = true
+}
+
+func (s *progressSet) list() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]int, 0, len(s.done))
+	for i := range s.done {
+		ret = append(ret, i)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// loadCheckpoint returns the checkpoint of want.TargetPath when it was
+// made from the same content of want.SourcePath, transformed the same way,
+// and is not expired.
+func loadCheckpoint(want *Checkpoint) *Checkpoint {
+	if db.Client == nil {
+		return nil
+	}
+	targetPath := want.TargetPath
+	data, err := db.Client.HGet(db.Client.Context(), UPLOAD_CHECKPOINTS, targetPath).Result()
+	if err != nil {
+		return nil
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal([]byte(data), &cp); err != nil {
+		return nil
+	}
+	if cp.SourcePath != want.SourcePath || cp.Size != want.Size || !cp.ModTime.Equal(want.ModTime) ||
+		cp.Codec != want.Codec || cp.BlockList != want.BlockList || time.Since(cp.Created) > checkpointTTL {
+		deleteCheckpoint(targetPath)
+		return nil
+	}
+	return &cp
+}
+
+func saveCheckpoint(cp *Checkpoint) {
+	if db.Client == nil {
+		return
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if err := db.Client.HSet(db.Client.Context(), UPLOAD_CHECKPOINTS, cp.TargetPath, data).Err(); err != nil {
+		logrus.Error("[Checkpoint] ", err)
+		return
+	}
+	logrus.Infof("[Checkpoint] %s: %d slices uploaded", cp.TargetPath, len(cp.Done))
+}
+
+func deleteCheckpoint(targetPath string) {
+	if db.Client == nil {
+		return
+	}
+	db.Client.HDel(db.Client.Context(), UPLOAD_CHECKPOINTS, targetPath)
+}
+
+// chunkDir 是分片临时文件所在的目录, 只存放本程序的分片, 可以整体删除
+func chunkDir() string {
+	return filepath.Join(config.Get().General.TmpDir, chunkDirName)
+}
+
+// CleanChunks removes every temporary chunk, it is called at startup and
+// after a clean shutdown to clean up after an interrupted upload. It must
+// not run while an upload may still be running.
+func CleanChunks() error {
+	return os.RemoveAll(chunkDir())
+}
@@ -0,0 +1,44 @@
+package upload_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wangxso/backuptool/auth"
+	"github.com/wangxso/backuptool/cassette/cassettetest"
+	"github.com/wangxso/backuptool/upload"
+)
+
+// TestReplayUpload parses responses in the shape Baidu returns them, see
+// testdata/upload.json.
+func TestReplayUpload(t *testing.T) {
+	cassettetest.Replay(t, "testdata/upload.json")
+	ctx := context.Background()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "replay.txt")
+	if err := os.WriteFile(src, []byte("backuptool replay\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	small := filepath.Join(dir, "small.txt")
+	if err := os.WriteFile(small, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	md5sum, err := upload.Upload(ctx, "/apps/backuptool/replay.txt", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md5sum != "7e5a4b1c0d8e6f1c2b3a4d5e6f708192" {
+		t.Fatalf("create md5: got %q", md5sum)
+	}
+
+	ret, err := upload.UploadSmallFile(ctx, auth.AccessToken(), "/apps/backuptool/small.txt", small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.FsID != 1023456789012399 || ret.MD5 != "5d41402abc4b2a76b9719d911017c592" || ret.Size != 5 || ret.Path != "/apps/backuptool/small.txt" {
+		t.Fatalf("pcs upload: %+v", ret)
+	}
+}
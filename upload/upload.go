@@ -8,27 +8,71 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
-	"log"
 	"mime/multipart"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/auth"
+	"github.com/wangxso/backuptool/codec"
 	"github.com/wangxso/backuptool/config"
-	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/handler"
+	"github.com/wangxso/backuptool/metrics"
 	openapiclient "github.com/wangxso/backuptool/openxpanapi"
+	"github.com/wangxso/backuptool/parity"
+	"github.com/wangxso/backuptool/progress"
 	"github.com/wangxso/backuptool/utils"
 )
 
 const (
 	chunkSize = 1024 * 1024 * 4 // 4MB
+
+	// PARITY_EXT 是校验文件在云端文件名之后加的扩展名
+	PARITY_EXT = ".par"
+)
+
+// 云端已有同名文件时的处理方式, 同 pcs 上传接口的 ondup 参数
+const (
+	OndupOverwrite = "overwrite"
+	// OndupNewcopy 保留云端文件, 新文件重命名为 name_YYYYMMDD_HHMMSS.ext
+	OndupNewcopy = "newcopy"
+	OndupFail    = "fail"
 )
 
+// rtype maps ondup to the rtype of precreate and create.
+func rtype(ondup string) int32 {
+	switch ondup {
+	case OndupOverwrite:
+		return 3
+	case OndupNewcopy:
+		return 1
+	}
+	return 0
+}
+
+// Result describes an uploaded file, Path is where it ended up, which
+// differs from the target path when ondup is OndupNewcopy.
+type Result struct {
+	Path string `json:"path"`
+	MD5  string `json:"md5"`
+	FsID int64  `json:"fsId"`
+	Size int64  `json:"size"`
+	// Wraps 加密上传时文件密钥的密文, 与云端文件头中的相同
+	Wraps crypt.Wraps `json:"wraps,omitempty"`
+	// Codec 上传前使用的压缩算法, 没有压缩时为空
+	Codec string `json:"codec,omitempty"`
+	// ParityPath 和 ParityFsID 是校验文件, 没有时为空
+	ParityPath string `json:"parityPath,omitempty"`
+	ParityFsID int64  `json:"parityFsId,omitempty"`
+}
+
 type precreateReturnType struct {
 	Path       string        `json:"path"`
 	Uploadid   string        `json:"uploadid"`
@@ -62,243 +106,669 @@ type UploadSmallFileReturn struct {
 	Size      int64  `json:"size"`
 }
 
-func PreCreateUpload(accessToken string, path string, isdir int32, size int32, autoinit int32, blockList string, rtype int32) precreateReturnType {
-	configuration := openapiclient.NewConfiguration()
+func PreCreateUpload(ctx context.Context, accessToken string, path string, isdir int32, size int32, autoinit int32, blockList string, rtype int32) (precreateReturnType, error) {
+	var response precreateReturnType
+	configuration := utils.APIConfiguration()
 	api_client := openapiclient.NewAPIClient(configuration)
-	_, r, err := api_client.FileuploadApi.Xpanfileprecreate(context.Background()).AccessToken(accessToken).Path(path).Isdir(isdir).Size(size).Autoinit(autoinit).BlockList(blockList).Rtype(rtype).Execute()
-	if err != nil {
-		logrus.Error("Error when calling `FileuploadApi.Xpanfileprecreate``: ", err)
-		logrus.Error("Full HTTP response: ", r)
-	}
+	ctx, cancel := context.WithTimeout(ctx, config.RequestTimeout())
+	defer cancel()
+	_, r, err := api_client.FileuploadApi.Xpanfileprecreate(ctx).AccessToken(accessToken).Path(path).Isdir(isdir).Size(size).Autoinit(autoinit).BlockList(blockList).Rtype(rtype).Execute()
 	// response from `Xpanfileprecreate`: Fileprecreateresponse
-	// logrus.Info("Response from `FileuploadApi.Xpanfileprecreate`: ", resp)
-
-	bodyBytes, err := ioutil.ReadAll(r.Body)
+	bodyBytes, err := utils.ReadResponseBody(r, err)
 	if err != nil {
-		logrus.Error("err: ", r)
+		logrus.Error("Error when calling `FileuploadApi.Xpanfileprecreate``: ", err)
+		return response, err
 	}
-	var response precreateReturnType
-	err = json.Unmarshal(bodyBytes, &response)
-	if err != nil {
-		log.Fatal(err)
+	if err = utils.DecodeJSON("xpanfileprecreate", bodyBytes, &response); err != nil {
+		return response, err
 	}
-	return response
+	metrics.ObserveErrno("precreate", response.Errno)
+	return response, handler.FromErrno(response.Errno, "")
 }
 
-func UploadSlice(accessToken string, partseq string, path_ string, uploadid string, type_ string, file *os.File) error {
-	configuration := openapiclient.NewConfiguration()
+func UploadSlice(ctx context.Context, accessToken string, partseq string, path_ string, uploadid string, type_ string, file *os.File) error {
+	configuration := utils.APIConfiguration()
 	//configuration.Debug = true
 	api_client := openapiclient.NewAPIClient(configuration)
-	_, r, err := api_client.FileuploadApi.Pcssuperfile2(context.Background()).AccessToken(accessToken).Partseq(partseq).Path(path_).Uploadid(uploadid).Type_(type_).File(file).Execute()
+	start := time.Now()
+	defer func() {
+		metrics.SliceUploadSeconds.Observe(time.Since(start).Seconds())
+	}()
+	ctx, cancel := context.WithTimeout(ctx, config.TransferTimeout())
+	defer cancel()
+	_, r, err := api_client.FileuploadApi.Pcssuperfile2(ctx).AccessToken(accessToken).Partseq(partseq).Path(path_).Uploadid(uploadid).Type_(type_).File(file).Execute()
+	// response from `Pcssuperfile2`: {"md5": "...", "request_id": ...} or {"error_code": ..., "error_msg": "..."}
+	bodyBytes, err := utils.ReadResponseBody(r, err)
 	if err != nil {
 		logrus.Error("Error when calling `FileuploadApi.Pcssuperfile2``: ", err)
-		logrus.Error("Full HTTP response: ", r)
-	}
-	// response from `Pcssuperfile2`: string
-	// logrus.Info("Response from `FileuploadApi.Pcssuperfile2`: ", resp)
-
-	_, err = io.ReadAll(r.Body)
-	if err != nil {
-		logrus.Error("err: ", r)
+		return err
 	}
-	defer deleteOneChunks(filepath.Base(path_))
+	err = handler.DecodeErrno(bodyBytes)
+	metrics.ObserveErrno("superfile2", handler.Errno(err))
 	return err
 }
 
-func UploadCreate(accessToken string, path string, isdir int32, size int32, uploadid string, blockList string, rtype int32) createFileReturnType {
-	configuration := openapiclient.NewConfiguration()
+func UploadCreate(ctx context.Context, accessToken string, path string, isdir int32, size int32, uploadid string, blockList string, rtype int32) (createFileReturnType, error) {
+	var response createFileReturnType
+	configuration := utils.APIConfiguration()
 	api_client := openapiclient.NewAPIClient(configuration)
-	_, r, err := api_client.FileuploadApi.Xpanfilecreate(context.Background()).AccessToken(accessToken).Path(path).Isdir(isdir).Size(size).Uploadid(uploadid).BlockList(blockList).Rtype(rtype).Execute()
+	ctx, cancel := context.WithTimeout(ctx, config.RequestTimeout())
+	defer cancel()
+	_, r, err := api_client.FileuploadApi.Xpanfilecreate(ctx).AccessToken(accessToken).Path(path).Isdir(isdir).Size(size).Uploadid(uploadid).BlockList(blockList).Rtype(rtype).Execute()
+	// response from `Xpanfilecreate`: Filecreateresponse
+	bodyBytes, err := utils.ReadResponseBody(r, err)
 	if err != nil {
 		logrus.Error("Error when calling `FileuploadApi.Xpanfilecreate``: ", err)
-		logrus.Error("Full HTTP response: ", r)
+		return response, err
 	}
-	// response from `Xpanfilecreate`: Filecreateresponse
-	// logrus.Info("Response from `FileuploadApi.Xpanfilecreate`: ", resp)
+	if err = utils.DecodeJSON("xpanfilecreate", bodyBytes, &response); err != nil {
+		return response, err
+	}
+	metrics.ObserveErrno("create", response.Errno)
+	return response, handler.FromErrno(response.Errno, "")
+}
 
-	bodyBytes, err := io.ReadAll(r.Body)
+// spiltFile writes filePath in chunkSize slices <name>.<n> into dir.
+func spiltFile(filePath, dir string) (*sliceWriter, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
-		logrus.Error("err: ", r)
+		return nil, err
+	}
+	defer file.Close()
+	w := &sliceWriter{dir: dir, name: filepath.Base(filePath)}
+	if _, err := io.Copy(w, file); err != nil {
+		w.Close()
+		return nil, err
 	}
+	return w, w.Close()
+}
 
-	var response createFileReturnType
-	err = json.Unmarshal(bodyBytes, &response)
-	if err != nil {
-		log.Fatal(err)
+// sliceWriter cuts what is written to it into chunkSize slices
+// <name>.<n> in dir and records their md5, so transformed content goes
+// to the slices without another temporary copy.
+type sliceWriter struct {
+	dir, name string
+	blockList []string
+	size      int64
+	f         *os.File
+	h         hash.Hash
+	n         int
+}
+
+func (w *sliceWriter) path(i int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s.%d", w.name, i))
+}
+
+func (w *sliceWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.f == nil {
+			f, err := os.Create(w.path(len(w.blockList)))
+			if err != nil {
+				return written, err
+			}
+			w.f, w.h, w.n = f, md5.New(), 0
+		}
+		k := len(p)
+		if k > chunkSize-w.n {
+			k = chunkSize - w.n
+		}
+		if _, err := w.f.Write(p[:k]); err != nil {
+			return written, err
+		}
+		w.h.Write(p[:k])
+		w.n += k
+		w.size += int64(k)
+		written += k
+		p = p[k:]
+		if w.n == chunkSize {
+			if err := w.closeSlice(); err != nil {
+				return written, err
+			}
+		}
 	}
-	return response
+	return written, nil
 }
 
-func spiltFile(filePath string) ([]string, int, error) {
-	file, err := os.Open(filePath)
-	blockList := make([]string, 0)
-	if err != nil {
-		return nil, 0, err
+func (w *sliceWriter) closeSlice() error {
+	err := w.f.Close()
+	w.blockList = append(w.blockList, hex.EncodeToString(w.h.Sum(nil)))
+	w.f = nil
+	return err
+}
+
+// Close finishes the last slice.
+func (w *sliceWriter) Close() error {
+	if w.f == nil {
+		return nil
 	}
-	stat, _ := file.Stat()
-	size := stat.Size()
-	filename := stat.Name()
-	buffer := make([]byte, chunkSize)
-	chunkCount := 0
+	return w.closeSlice()
+}
+
+// reader reads the slices of w in order.
+func (w *sliceWriter) reader() io.ReadCloser {
+	return &slicesReader{w: w}
+}
+
+type slicesReader struct {
+	w *sliceWriter
+	i int
+	f *os.File
+}
+
+func (r *slicesReader) Read(p []byte) (int, error) {
 	for {
-		readBytes, err := file.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
+		if r.f == nil {
+			if r.i == len(r.w.blockList) {
+				return 0, io.EOF
 			}
-			return nil, int(size), err
-		}
-		chunkFileName := fmt.Sprintf("%s.%d", filename, chunkCount)
-		chunkFilePath := filepath.Join(config.BackUpConfig.General.TmpDir, chunkFileName)
-		chunkFile, err := os.Create(chunkFilePath)
-		if err != nil {
-			return nil, int(size), err
+			f, err := os.Open(r.w.path(r.i))
+			if err != nil {
+				return 0, err
+			}
+			r.f = f
+			r.i++
 		}
-		md5str := md5.Sum(buffer[:readBytes])
-		blockList = append(blockList, hex.EncodeToString(md5str[:]))
-		// logrus.Infof(hex.EncodeToString(md5str[:]))
-		_, err = chunkFile.Write(buffer[:readBytes])
-		if err != nil {
-			return nil, int(size), err
+		n, err := r.f.Read(p)
+		if err == io.EOF {
+			r.f.Close()
+			r.f = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
 		}
-		chunkFile.Close()
-		chunkCount++
+		return n, err
 	}
-	return blockList, int(size), nil
 }
 
-func deleteOneChunks(fileName string) error {
-
-	// 构造分片文件名
-	chunkFilePath := filepath.Join(config.BackUpConfig.General.TmpDir, fileName)
-	// logrus.Info("delete file", chunkFileName)
-	// 尝试删除分片文件
-	err := os.Remove(chunkFilePath)
-	if os.IsNotExist(err) {
-		return err
+func (r *slicesReader) Close() error {
+	if r.f == nil {
+		return nil
 	}
-	return nil
+	return r.f.Close()
+}
+
+func UploadSmallFile(ctx context.Context, accessToken, path, filePath string) (UploadSmallFileReturn, error) {
+	return uploadSmallFile(ctx, accessToken, path, filePath, OndupOverwrite)
 }
 
-func UploadSmallFile(accessToken, path, filePath string) (UploadSmallFileReturn, error) {
+func uploadSmallFile(ctx context.Context, accessToken, path, filePath, ondup string) (UploadSmallFileReturn, error) {
 	var ret UploadSmallFileReturn
-	host := "https://d.pcs.baidu.com"
-	uri := fmt.Sprintf("%s/rest/2.0/pcs/file?method=upload&", host)
+	uri := fmt.Sprintf("%s/rest/2.0/pcs/file?method=upload&", config.PcsURL())
 	// 读取文件上传
 
 	params := url.Values{}
-	params.Set("ondup", "overwrite")
+	params.Set("ondup", ondup)
 	params.Set("path", path)
 	params.Set("access_token", accessToken)
 	uri += params.Encode()
 	file, err := os.Open(filePath)
 	if err != nil {
-		panic(err.Error())
+		return ret, err
 	}
 	defer file.Close()
-	// stat, _ := file.Stat()
-	// filename := stat.Name()
 	body := new(bytes.Buffer)
 	writer := multipart.NewWriter(body)
 	part, err := writer.CreateFormFile("file", "file")
+	if err != nil {
+		return ret, err
+	}
 	contentType := writer.FormDataContentType()
 	headers := map[string]string{
-		"Host":         host,
 		"Content-Type": contentType,
 	}
+	if _, err = io.Copy(part, file); err != nil {
+		return ret, err
+	}
+	if err = writer.Close(); err != nil {
+		return ret, err
+	}
+	tr := progress.Start(progress.KindUpload, path, int64(body.Len()))
+	ctx, cancel := context.WithTimeout(ctx, config.TransferTimeout())
+	defer cancel()
+	respBody, _, err := utils.SendHTTPRequest(ctx, uri, body, headers)
+	if err != nil {
+		tr.Finish(err)
+		return ret, err
+	}
+	tr.Add(tr.Total)
+	tr.Finish(nil)
+	if err = utils.DecodeJSON("pcs upload", []byte(respBody), &ret); err != nil {
+		return ret, err
+	}
+	err = handler.DecodeErrno([]byte(respBody))
+	metrics.ObserveErrno("upload", handler.Errno(err))
+	if err != nil {
+		return ret, err
+	}
+	metrics.FileDone(metrics.OpUpload, ret.Size)
+	logrus.Info(ret)
+	return ret, nil
+}
+
+// Upload uploads a file from the sourcePath to the targetPath.
+//
+// Parameters:
+// - targetPath: the path where the file will be uploaded.
+// - sourcePath: the path of the file to be uploaded.
+// Return type(s): None.
+//
+// When the upload fails or ctx is cancelled, the uploaded slices are saved
+// as a checkpoint and the next Upload of the same file skips them.
+func Upload(ctx context.Context, targetPath, sourcePath string) (string, error) {
+	resp, err := uploadSlices(ctx, targetPath, sourcePath, OndupOverwrite)
+	return resp.MD5, err
+}
+
+// UploadFile uploads sourcePath to targetPath, files up to 4MB use the
+// single request upload API, larger files are uploaded in slices. Both are
+// retried, see handler.Retry.
+func UploadFile(ctx context.Context, targetPath, sourcePath, ondup string) (Result, error) {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return Result{}, err
+	}
+	if info.Size() > chunkSize {
+		resp, err := uploadSlices(ctx, targetPath, sourcePath, ondup)
+		if err != nil {
+			return Result{}, err
+		}
+		return resp.result(), nil
+	}
+	return uploadSmall(ctx, targetPath, sourcePath, ondup)
+}
+
+func (resp createFileReturnType) result() Result {
+	return Result{Path: resp.Path, MD5: resp.MD5, FsID: resp.FsID, Size: int64(resp.Size)}
+}
+
+// uploadSmall uploads sourcePath with the single request upload API and
+// retries.
+func uploadSmall(ctx context.Context, targetPath, sourcePath, ondup string) (Result, error) {
+	var ret UploadSmallFileReturn
+	err := handler.Retry(ctx, "upload", func() error {
+		var err error
+		ret, err = uploadSmallFile(ctx, auth.AccessToken(), targetPath, sourcePath, ondup)
+		return err
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Path: ret.Path, MD5: ret.MD5, FsID: ret.FsID, Size: ret.Size}, nil
+}
+
+// Transform is what is done to a file before it is uploaded, compression
+// first, then encryption. Parity of the result is uploaded next to it.
+type Transform struct {
+	// Codec 为空时不压缩, 已经压缩过的文件也不压缩
+	Codec      string
+	Recipients []crypt.Recipient
+	// Parity 不为空时同时上传校验文件 <path>.par, 保护的是上传的内容
+	Parity parity.Params
+}
+
+// Empty reports whether t uploads files as they are.
+func (t Transform) Empty() bool {
+	return t.Codec == codec.NONE && len(t.Recipients) == 0
+}
+
+// UploadEncrypted encrypts sourcePath for recipients and uploads it, see
+// UploadTransformed.
+func UploadEncrypted(ctx context.Context, targetPath, sourcePath, ondup string, recipients []crypt.Recipient) (Result, error) {
+	return UploadTransformed(ctx, targetPath, sourcePath, ondup, Transform{Recipients: recipients})
+}
+
+// UploadTransformed compresses and encrypts sourcePath as t says and
+// uploads the result like UploadFile, so large files are still sent in
+// slices. The returned MD5 and size are those of what was uploaded, Codec
+// is empty when the file was not worth compressing.
+//
+// The transformed content is written straight into the slices, no other
+// temporary copy is made. An interrupted compressed upload resumes from
+// its checkpoint like Upload; an encrypted one starts over, since every
+// upload encrypts with a new file key.
+func UploadTransformed(ctx context.Context, targetPath, sourcePath, ondup string, t Transform) (Result, error) {
+	c, err := useCodec(sourcePath, t.Codec)
+	if err != nil {
+		return Result{}, fmt.Errorf("compress %s: %w", sourcePath, err)
+	}
+	if c == codec.NONE && len(t.Recipients) == 0 {
+		return uploadPlain(ctx, targetPath, sourcePath, ondup, t.Parity)
+	}
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return Result{}, err
+	}
+	dir, err := sliceDir()
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.RemoveAll(dir)
+	s, wraps, compressed, err := splitTransformed(sourcePath, dir, c, t.Recipients)
+	if err == nil && c != codec.NONE && compressed >= info.Size() {
+		// 压缩后没有变小, 不压缩重新写分片
+		c = codec.NONE
+		if len(t.Recipients) == 0 {
+			return uploadPlain(ctx, targetPath, sourcePath, ondup, t.Parity)
+		}
+		s, wraps, _, err = splitTransformed(sourcePath, dir, c, t.Recipients)
+	}
 	if err != nil {
-		panic(err.Error())
+		return Result{}, fmt.Errorf("transform %s: %w", sourcePath, err)
+	}
 
+	var ret Result
+	if s.size <= chunkSize {
+		ret, err = uploadSmall(ctx, targetPath, s.path(0), ondup)
+	} else {
+		var cp *Checkpoint
+		// 加密每次使用新的文件密钥, 分片不同, 不保存断点
+		if len(t.Recipients) == 0 {
+			cp = &Checkpoint{SourcePath: sourcePath, Size: info.Size(), ModTime: info.ModTime(), Codec: c}
+		}
+		var resp createFileReturnType
+		resp, err = uploadSplit(ctx, targetPath, ondup, s, cp)
+		ret = resp.result()
 	}
-	_, err = io.Copy(part, file)
 	if err != nil {
-		panic(err.Error())
+		return Result{}, err
+	}
+	ret.Wraps, ret.Codec = wraps, c
+	if t.Parity.Enabled() {
+		r := s.reader()
+		defer r.Close()
+		ret.ParityPath, ret.ParityFsID, err = uploadParity(ctx, ret.Path, s.name, r, s.size, t.Parity)
+	}
+	return ret, err
+}
+
+// splitTransformed writes sourcePath transformed into slices in dir, see
+// transform.
+func splitTransformed(sourcePath, dir, c string, recipients []crypt.Recipient) (*sliceWriter, crypt.Wraps, int64, error) {
+	s := &sliceWriter{dir: dir, name: filepath.Base(sourcePath)}
+	wraps, compressed, err := transform(s, sourcePath, c, recipients)
+	if cerr := s.Close(); err == nil {
+		err = cerr
+	}
+	return s, wraps, compressed, err
+}
+
+// uploadPlain uploads sourcePath as it is and its parity.
+func uploadPlain(ctx context.Context, targetPath, sourcePath, ondup string, p parity.Params) (Result, error) {
+	ret, err := UploadFile(ctx, targetPath, sourcePath, ondup)
+	if err == nil && p.Enabled() {
+		ret.ParityPath, ret.ParityFsID, err = UploadParity(ctx, ret.Path, sourcePath, p)
+	}
+	return ret, err
+}
 
+// UploadParity uploads the parity of the local copy sourcePath of the
+// cloud file remotePath to remotePath.par and returns where it is.
+func UploadParity(ctx context.Context, remotePath, sourcePath string, p parity.Params) (string, int64, error) {
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return "", 0, err
 	}
-	err = writer.Close()
+	defer f.Close()
+	info, err := f.Stat()
 	if err != nil {
-		panic(err.Error())
+		return "", 0, err
+	}
+	return uploadParity(ctx, remotePath, filepath.Base(sourcePath), f, info.Size(), p)
+}
 
+// uploadParity uploads the parity of r, size bytes of the cloud file
+// remotePath, to remotePath.par.
+func uploadParity(ctx context.Context, remotePath, name string, r io.Reader, size int64, p parity.Params) (string, int64, error) {
+	if err := os.MkdirAll(chunkDir(), 0700); err != nil {
+		return "", 0, err
 	}
-	respBody, _, err := utils.SendHTTPRequest(uri, body, headers)
+	tmp, err := os.CreateTemp(chunkDir(), name+".par-*")
 	if err != nil {
-		return ret, err
+		return "", 0, err
 	}
-	if err = json.Unmarshal([]byte(respBody), &ret); err != nil {
-		logrus.Error("[msg: unmarshal filemetas body failed] err:", err.Error())
-		return ret, errors.New("unmarshal filemetas body failed,body")
+	defer os.Remove(tmp.Name())
+	err = parity.Encode(tmp, r, size, p)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
 	}
-	logrus.Info(ret)
-	return ret, nil
+	if err != nil {
+		return "", 0, fmt.Errorf("parity %s: %w", remotePath, err)
+	}
+	ret, err := UploadFile(ctx, remotePath+PARITY_EXT, tmp.Name(), OndupOverwrite)
+	if err != nil {
+		return "", 0, fmt.Errorf("parity %s: %w", remotePath, err)
+	}
+	return ret.Path, ret.FsID, nil
 }
 
-func deleteChunks(fileName string) error {
-	// 分片计数器
-	chunkCount := 0
+// Prepared is a file transformed for upload, see Prepare.
+type Prepared struct {
+	// Path 是要上传的文件, t 为空时就是源文件
+	Path  string
+	Wraps crypt.Wraps
+	// Codec 为空时没有压缩
+	Codec string
+	temp  string
+}
 
-	for {
-		// 构造分片文件名
-		chunkFileName := fmt.Sprintf("%s.%d", fileName, chunkCount)
-		chunkFilePath := filepath.Join(config.BackUpConfig.General.TmpDir, chunkFileName)
-		// logrus.Info("delete file", chunkFileName)
-		// 尝试删除分片文件
-		err := os.Remove(chunkFilePath)
-		if err != nil {
-			// 如果分片文件不存在，则表示已删除完所有分片
-			if os.IsNotExist(err) {
-				break
+// Remove deletes the temporary file of p.
+func (p Prepared) Remove() {
+	if p.temp != "" {
+		os.Remove(p.temp)
+	}
+}
+
+// Prepare compresses and encrypts sourcePath as t says into one temporary
+// file, the caller uploads p.Path and calls p.Remove afterwards.
+func Prepare(sourcePath string, t Transform) (Prepared, error) {
+	p := Prepared{Path: sourcePath}
+	c, err := useCodec(sourcePath, t.Codec)
+	if err != nil {
+		return p, fmt.Errorf("compress %s: %w", sourcePath, err)
+	}
+	if c == codec.NONE && len(t.Recipients) == 0 {
+		return p, nil
+	}
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return p, err
+	}
+	if err := os.MkdirAll(chunkDir(), 0700); err != nil {
+		return p, err
+	}
+	f, err := os.CreateTemp(chunkDir(), filepath.Base(sourcePath)+".t-*")
+	if err != nil {
+		return p, err
+	}
+	p.temp = f.Name()
+	wraps, compressed, err := transform(f, sourcePath, c, t.Recipients)
+	if err == nil && c != codec.NONE && compressed >= info.Size() {
+		// 压缩后没有变小, 不压缩重新写
+		c = codec.NONE
+		if len(t.Recipients) == 0 {
+			f.Close()
+			p.Remove()
+			return Prepared{Path: sourcePath}, nil
+		}
+		if err = f.Truncate(0); err == nil {
+			if _, err = f.Seek(0, io.SeekStart); err == nil {
+				wraps, _, err = transform(f, sourcePath, c, t.Recipients)
 			}
-			return err
 		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		p.Remove()
+		return Prepared{}, fmt.Errorf("transform %s: %w", sourcePath, err)
+	}
+	p.Path, p.Wraps, p.Codec = p.temp, wraps, c
+	return p, nil
+}
 
-		chunkCount++
+// useCodec returns c, or NONE when sourcePath is already compressed.
+func useCodec(sourcePath, c string) (string, error) {
+	if c == codec.NONE {
+		return c, nil
+	}
+	if skip, err := codec.Skip(sourcePath); err != nil || skip {
+		return codec.NONE, err
 	}
+	return c, nil
+}
 
-	return nil
+// transform writes sourcePath compressed with c and encrypted for
+// recipients to w, compression first. It returns the wrapped file key and
+// the size after compression, before encryption.
+func transform(w io.Writer, sourcePath, c string, recipients []crypt.Recipient) (crypt.Wraps, int64, error) {
+	in, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer in.Close()
+	var wraps crypt.Wraps
+	var enc io.WriteCloser
+	if len(recipients) > 0 {
+		if enc, wraps, err = crypt.NewWriterWraps(w, recipients...); err != nil {
+			return nil, 0, err
+		}
+		w = enc
+	}
+	counted := &countWriter{w: w}
+	var dst io.Writer = counted
+	var zw io.WriteCloser
+	if c != codec.NONE {
+		if zw, err = codec.NewWriter(counted, c); err != nil {
+			return nil, 0, err
+		}
+		dst = zw
+	}
+	if _, err := io.Copy(dst, in); err != nil {
+		return nil, 0, err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return wraps, counted.n, nil
 }
 
-// Upload uploads a file from the sourcePath to the targetPath.
-//
-// Parameters:
-// - targetPath: the path where the file will be uploaded.
-// - sourcePath: the path of the file to be uploaded.
-// Return type(s): None.
-func Upload(targetPath, sourcePath string) (string, error) {
-	// Get the Redis client from the db package
-	redisCli := db.Client
+type countWriter struct {
+	w io.Writer
+	n int64
+}
 
-	// Get the access code from Redis
-	accessCode, _ := redisCli.Get(redisCli.Context(), "AccessCode").Result()
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
 
-	// Initialize variables
-	isDir := int32(0)
-	autoInit := int32(1)
+// sliceDir creates the chunk directory of one upload, files of the same
+// name uploaded at the same time do not overwrite each other's slices.
+func sliceDir() (string, error) {
+	if err := os.MkdirAll(chunkDir(), 0700); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(chunkDir(), "upload-*")
+}
 
+func uploadSlices(ctx context.Context, targetPath, sourcePath, ondup string) (createFileReturnType, error) {
+	var resp createFileReturnType
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return resp, err
+	}
+	dir, err := sliceDir()
+	if err != nil {
+		return resp, err
+	}
+	// Clean up the chunks
+	defer os.RemoveAll(dir)
 	// Split the file into blocks
-	blockList, size, err := spiltFile(sourcePath)
+	s, err := spiltFile(sourcePath, dir)
 	if err != nil {
 		logrus.Error("[UploadSpiltFile]", err)
-		panic(err.Error())
+		return resp, err
 	}
+	return uploadSplit(ctx, targetPath, ondup, s, &Checkpoint{SourcePath: sourcePath, Size: info.Size(), ModTime: info.ModTime()})
+}
+
+// uploadSplit uploads the slices of s to targetPath. want describes the
+// source of the slices, the upload resumes from a checkpoint matching it
+// and saves one when it fails; with want nil no checkpoint is used.
+func uploadSplit(ctx context.Context, targetPath, ondup string, s *sliceWriter, want *Checkpoint) (createFileReturnType, error) {
+	var resp createFileReturnType
+	// Initialize variables
+	isDir := int32(0)
+	autoInit := int32(1)
+	blockList, size := s.blockList, s.size
 
 	// Convert the blockList to JSON and store it as a string
 	blockListByte, err := json.Marshal(blockList)
-	blockListStr := string(blockListByte)
 	if err != nil {
 		logrus.Error("[BlockListMarshal] ", err)
-		panic(err.Error())
+		return resp, err
 	}
+	blockListStr := string(blockListByte)
 
-	// Pre-create the upload
-	preCreateResp := PreCreateUpload(accessCode, targetPath, isDir, int32(size), autoInit, string(blockListStr), 3)
+	var cp *Checkpoint
+	if want != nil {
+		want.TargetPath, want.BlockList = targetPath, blockListStr
+		cp = loadCheckpoint(want)
+	}
+	if cp != nil {
+		logrus.Infof("[Upload] resume %s, %d/%d slices uploaded", targetPath, len(cp.Done), len(blockList))
+	} else {
+		// Pre-create the upload
+		var preCreateResp precreateReturnType
+		err = handler.Retry(ctx, "precreate", func() error {
+			preCreateResp, err = PreCreateUpload(ctx, auth.AccessToken(), targetPath, isDir, int32(size), autoInit, string(blockListStr), rtype(ondup))
+			return err
+		})
+		if err != nil {
+			return resp, err
+		}
+		cp = &Checkpoint{TargetPath: targetPath, BlockList: blockListStr}
+		if want != nil {
+			cp.SourcePath, cp.Size, cp.ModTime, cp.Codec = want.SourcePath, want.Size, want.ModTime, want.Codec
+		}
+		cp.UploadID, cp.Created = preCreateResp.Uploadid, time.Now()
+	}
+	done := newProgressSet(cp.Done)
+	tr := progress.Start(progress.KindUpload, targetPath, int64(size))
+	// 任一分片失败时取消其余分片
+	sliceCtx, cancelSlices := context.WithCancel(ctx)
+	defer cancelSlices()
 	var wg sync.WaitGroup
 	errChan := make(chan error, len(blockList))
 	for i := 0; i < len(blockList); i++ {
-		slicePath := fmt.Sprintf("%s.%d", filepath.Base(sourcePath), i)
-		slicePath = filepath.Join(config.BackUpConfig.General.TmpDir, slicePath)
+		slicePath := s.path(i)
+		if done.has(i) {
+			if stat, err := os.Stat(slicePath); err == nil {
+				tr.Add(stat.Size())
+			}
+			continue
+		}
 
 		wg.Add(1)
-		go UploadSliceAsync(&wg, accessCode, targetPath, preCreateResp.Uploadid, slicePath, i, len(blockList), errChan)
+		go func(i int) {
+			defer wg.Done()
+			if err := uploadSlice(sliceCtx, tr, targetPath, cp.UploadID, slicePath, i, len(blockList)); err != nil {
+				errChan <- err
+				return
+			}
+			done.add(i)
+		}(i)
 	}
 	go func() {
 		wg.Wait()
@@ -307,38 +777,65 @@ func Upload(targetPath, sourcePath string) (string, error) {
 
 	var uploadErr error
 	for err := range errChan {
-		if err != nil {
+		if err != nil && uploadErr == nil {
 			uploadErr = err
-			break
+			cancelSlices()
 		}
 	}
-
-	resp := UploadCreate(accessCode, targetPath, isDir, int32(size), preCreateResp.Uploadid, blockListStr, 3)
-	if resp.Errno == 0 {
-		// 上传成功
-		return resp.MD5, uploadErr
+	if uploadErr != nil {
+		tr.Finish(uploadErr)
+		cp.Done = done.list()
+		if want != nil && len(cp.Done) > 0 {
+			saveCheckpoint(cp)
+		}
+		return resp, uploadErr
 	}
 
-	// Clean up the chunks
-	defer deleteChunks(filepath.Base(sourcePath))
-	return "", nil
-}
-
-func UploadSliceAsync(wg *sync.WaitGroup, accessCode, targetPath, uploadID, slicePath string, index int, length int, errChan chan<- error) {
-	defer wg.Done()
-
-	file, err := os.Open(slicePath)
+	err = handler.Retry(ctx, "create", func() error {
+		resp, err = UploadCreate(ctx, auth.AccessToken(), targetPath, isDir, int32(size), cp.UploadID, blockListStr, rtype(ondup))
+		return err
+	})
+	tr.Finish(err)
 	if err != nil {
-		errChan <- err
-		return
+		// 分片丢失时 uploadid 已不可用, 下次重新上传, 其他错误保留进度
+		cp.Done = done.list()
+		if errors.Is(err, handler.ErrPcsSliceMissing) || errors.Is(err, handler.ErrPcsSliceLost) {
+			deleteCheckpoint(targetPath)
+		} else if want != nil {
+			saveCheckpoint(cp)
+		}
+		return resp, err
 	}
-	defer file.Close()
+	deleteCheckpoint(targetPath)
+	// 上传成功
+	metrics.FileDone(metrics.OpUpload, int64(size))
+	return resp, nil
+}
 
-	err = UploadSlice(accessCode, strconv.Itoa(index), targetPath, uploadID, "tmpfile", file)
+// uploadSlice uploads one slice with retries.
+func uploadSlice(ctx context.Context, tr *progress.Transfer, targetPath, uploadID, slicePath string, index int, length int) error {
+	queue := metrics.QueueDepth.WithLabelValues(metrics.QueueUploadSlices)
+	queue.Inc()
+	defer queue.Dec()
+
+	var sliceSize int64
+	err := handler.Retry(ctx, "superfile2", func() error {
+		// 上传时 file 会被关闭, 每次重试重新打开
+		file, err := os.Open(slicePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if stat, err := file.Stat(); err == nil {
+			sliceSize = stat.Size()
+		}
+		return UploadSlice(ctx, auth.AccessToken(), strconv.Itoa(index), targetPath, uploadID, "tmpfile", file)
+	})
 	if err != nil {
-		errChan <- err
-		return
+		return err
 	}
+	tr.Add(sliceSize)
 
 	logrus.Infof("[UploadSlice] %d/%d\n", index, length)
+	return nil
 }
@@ -0,0 +1,146 @@
+package upload_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wangxso/backuptool/auth"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/fakepan"
+	"github.com/wangxso/backuptool/upload"
+)
+
+// writeRandomFile writes size random bytes to dir/name.
+func writeRandomFile(t *testing.T, dir, name string, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestUploadSmallFile(t *testing.T) {
+	pan := fakepan.Setup(t)
+	dir := t.TempDir()
+	data := writeRandomFile(t, dir, "a.txt", 1024)
+	src := filepath.Join(dir, "a.txt")
+
+	ret, err := upload.UploadSmallFile(context.Background(), auth.AccessToken(), "/apps/backup/a.txt", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := pan.Get("/apps/backup/a.txt")
+	if !ok || !bytes.Equal(got, data) {
+		t.Fatal("uploaded content differs")
+	}
+	if f, _ := pan.Stat("/apps/backup/a.txt"); ret.MD5 != f.MD5 {
+		t.Fatalf("md5: got %s, want %s", ret.MD5, f.MD5)
+	}
+}
+
+func TestUploadSlices(t *testing.T) {
+	pan := fakepan.Setup(t)
+	dir := t.TempDir()
+	data := writeRandomFile(t, dir, "big.bin", 9*1024*1024)
+
+	md5sum, err := upload.Upload(context.Background(), "/apps/backup/big.bin", filepath.Join(dir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := pan.Get("/apps/backup/big.bin")
+	if !ok || !bytes.Equal(got, data) {
+		t.Fatal("uploaded content differs")
+	}
+	if f, _ := pan.Stat("/apps/backup/big.bin"); md5sum != f.MD5 {
+		t.Fatalf("md5: got %s, want %s", md5sum, f.MD5)
+	}
+	if n := pan.Calls("superfile2"); n != 3 {
+		t.Fatalf("superfile2 calls: got %d, want 3", n)
+	}
+	// 上传完成后分片和分片目录被删除
+	chunks, _ := filepath.Glob(filepath.Join(config.BackUpConfig.General.TmpDir, "*", "*"))
+	if len(chunks) != 0 {
+		t.Fatalf("chunks left: %v", chunks)
+	}
+}
+
+func TestUploadSameNameConcurrently(t *testing.T) {
+	pan := fakepan.Setup(t)
+	// 不同目录中的同名文件同时上传, 分片不能互相覆盖
+	want := make([][]byte, 2)
+	srcs := make([]string, 2)
+	for i := range srcs {
+		dir := t.TempDir()
+		want[i] = writeRandomFile(t, dir, "disk.img", (5+i)*1024*1024)
+		srcs[i] = filepath.Join(dir, "disk.img")
+	}
+	errs := make(chan error, len(srcs))
+	for i, src := range srcs {
+		go func(i int, src string) {
+			_, err := upload.Upload(context.Background(), fmt.Sprintf("/apps/backup/%d/disk.img", i), src)
+			errs <- err
+		}(i, src)
+	}
+	for range srcs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range srcs {
+		if got, _ := pan.Get(fmt.Sprintf("/apps/backup/%d/disk.img", i)); !bytes.Equal(got, want[i]) {
+			t.Fatalf("disk.img %d differs", i)
+		}
+	}
+}
+
+func TestUploadRefreshesExpiredToken(t *testing.T) {
+	pan := fakepan.Setup(t)
+	dir := t.TempDir()
+	data := writeRandomFile(t, dir, "big.bin", 5*1024*1024)
+	pan.ExpireToken()
+
+	if _, err := upload.Upload(context.Background(), "/apps/backup/big.bin", filepath.Join(dir, "big.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := pan.Get("/apps/backup/big.bin"); !bytes.Equal(got, data) {
+		t.Fatal("uploaded content differs")
+	}
+	if auth.AccessToken() != pan.AccessToken() {
+		t.Fatal("access token was not refreshed")
+	}
+}
+
+func TestUploadFileNewcopy(t *testing.T) {
+	pan := fakepan.Setup(t)
+	dir := t.TempDir()
+	for _, size := range []int{1024, 5 * 1024 * 1024} {
+		first := writeRandomFile(t, dir, "v1", size)
+		second := writeRandomFile(t, dir, "v2", size+1)
+		target := fmt.Sprintf("/apps/backup/%d.bin", size)
+
+		ret1, err := upload.UploadFile(context.Background(), target, filepath.Join(dir, "v1"), upload.OndupNewcopy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret2, err := upload.UploadFile(context.Background(), target, filepath.Join(dir, "v2"), upload.OndupNewcopy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret1.Path != target || ret2.Path == target {
+			t.Fatalf("%d bytes: paths %s and %s", size, ret1.Path, ret2.Path)
+		}
+		if got, _ := pan.Get(ret1.Path); !bytes.Equal(got, first) {
+			t.Fatalf("%d bytes: first copy overwritten", size)
+		}
+		if got, _ := pan.Get(ret2.Path); !bytes.Equal(got, second) {
+			t.Fatalf("%d bytes: second copy differs", size)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package upload_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wangxso/backuptool/codec"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/fakepan"
+	"github.com/wangxso/backuptool/faultinject"
+	"github.com/wangxso/backuptool/upload"
+)
+
+func TestUploadConvergesUnderFaults(t *testing.T) {
+	cases := map[string][]*faultinject.Rule{
+		"latency":      {{Kind: faultinject.Latency, Latency: 10 * time.Millisecond, Rate: 0.5}},
+		"reset":        {{Kind: faultinject.Reset, Rate: 0.4}},
+		"reset-after":  {{Kind: faultinject.ResetAfter, Rate: 0.4}},
+		"server-error": {{Kind: faultinject.ServerError, Rate: 0.4}},
+		"truncate":     {{Kind: faultinject.Truncate, Rate: 0.4}},
+		"rate-limit":   {{Kind: faultinject.Errno, Errno: 31034, Rate: 0.4}},
+	}
+	for name, rules := range cases {
+		t.Run(name, func(t *testing.T) {
+			pan := fakepan.Setup(t)
+			t.Cleanup(faultinject.FastRetry())
+			dir := t.TempDir()
+			files := map[string][]byte{
+				"small.txt": writeRandomFile(t, dir, "small.txt", 1024),
+				"big.bin":   writeRandomFile(t, dir, "big.bin", 9*1024*1024),
+			}
+			tr, restore, err := faultinject.Install(7, rules...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(restore)
+
+			for name, data := range files {
+				// 一次上传可能因为 uploadid 失效而失败, 重新上传必须收敛
+				var err error
+				for i := 0; i < 5; i++ {
+					if _, err = upload.Upload(context.Background(), "/apps/backup/"+name, filepath.Join(dir, name)); err == nil {
+						break
+					}
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if got, _ := pan.Get("/apps/backup/" + name); !bytes.Equal(got, data) {
+					t.Fatalf("%s: uploaded content differs", name)
+				}
+			}
+			if tr.Injected(rules[0].Kind) == 0 {
+				t.Fatal("no fault injected")
+			}
+		})
+	}
+}
+
+func TestUploadResumesFromCheckpoint(t *testing.T) {
+	pan := fakepan.Setup(t)
+	t.Cleanup(faultinject.FastRetry())
+	dir := t.TempDir()
+	data := writeRandomFile(t, dir, "big.bin", 9*1024*1024)
+	src := filepath.Join(dir, "big.bin")
+
+	// 第三个分片一直失败
+	_, restore, err := faultinject.Install(1, &faultinject.Rule{
+		API:   "superfile2",
+		Kind:  faultinject.ServerError,
+		Match: func(req *http.Request) bool { return req.URL.Query().Get("partseq") == "2" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upload.Upload(context.Background(), "/apps/backup/big.bin", src); err == nil {
+		t.Fatal("upload succeeded while a slice kept failing")
+	}
+	restore()
+	if n, _ := db.Client.HLen(context.Background(), upload.UPLOAD_CHECKPOINTS).Result(); n != 1 {
+		t.Fatalf("checkpoints: got %d, want 1", n)
+	}
+
+	precreates, slices := pan.Calls("precreate"), pan.Calls("superfile2")
+	if _, err := upload.Upload(context.Background(), "/apps/backup/big.bin", src); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := pan.Get("/apps/backup/big.bin"); !bytes.Equal(got, data) {
+		t.Fatal("uploaded content differs")
+	}
+	if n := pan.Calls("precreate") - precreates; n != 0 {
+		t.Fatalf("resumed upload called precreate %d times", n)
+	}
+	if n := pan.Calls("superfile2") - slices; n != 1 {
+		t.Fatalf("resumed upload sent %d slices, want 1", n)
+	}
+	if n, _ := db.Client.HLen(context.Background(), upload.UPLOAD_CHECKPOINTS).Result(); n != 0 {
+		t.Fatalf("checkpoint left after upload: %d", n)
+	}
+}
+
+func TestUploadTransformedResumesFromCheckpoint(t *testing.T) {
+	pan := fakepan.Setup(t)
+	t.Cleanup(faultinject.FastRetry())
+	// 每 1KB 一半随机一半为 0, 压缩后仍有多个分片
+	data := make([]byte, 16*1024*1024)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < len(data); i += 1024 {
+		rnd.Read(data[i : i+512])
+	}
+	src := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	failSlice := func() func() {
+		_, restore, err := faultinject.Install(1, &faultinject.Rule{
+			API:   "superfile2",
+			Kind:  faultinject.ServerError,
+			Match: func(req *http.Request) bool { return req.URL.Query().Get("partseq") == "1" },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return restore
+	}
+	ctx := context.Background()
+	gz := upload.Transform{Codec: codec.GZIP}
+
+	// 压缩结果不变, 断点按源文件和压缩方式保存
+	restore := failSlice()
+	if _, err := upload.UploadTransformed(ctx, "/apps/backup/disk.img", src, upload.OndupOverwrite, gz); err == nil {
+		t.Fatal("upload succeeded while a slice kept failing")
+	}
+	restore()
+	if n, _ := db.Client.HLen(ctx, upload.UPLOAD_CHECKPOINTS).Result(); n != 1 {
+		t.Fatalf("checkpoints: got %d, want 1", n)
+	}
+	precreates, slices := pan.Calls("precreate"), pan.Calls("superfile2")
+	ret, err := upload.UploadTransformed(ctx, "/apps/backup/disk.img", src, upload.OndupOverwrite, gz)
+	if err != nil || ret.Codec != codec.GZIP {
+		t.Fatalf("resume: %+v %v", ret, err)
+	}
+	if n := pan.Calls("precreate") - precreates; n != 0 {
+		t.Fatalf("resumed upload called precreate %d times", n)
+	}
+	if n := pan.Calls("superfile2") - slices; n != 1 {
+		t.Fatalf("resumed upload sent %d slices, want 1", n)
+	}
+	stored, _ := pan.Get("/apps/backup/disk.img")
+	r, _, err := codec.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); !bytes.Equal(got, data) {
+		t.Fatal("uploaded content differs")
+	}
+
+	// 加密每次不同, 不保存断点
+	key, _ := crypt.FromPassphrase("disk")
+	restore = failSlice()
+	defer restore()
+	enc := upload.Transform{Codec: codec.GZIP, Recipients: []crypt.Recipient{key}}
+	if _, err := upload.UploadTransformed(ctx, "/apps/backup/disk.img.enc", src, upload.OndupOverwrite, enc); err == nil {
+		t.Fatal("upload succeeded while a slice kept failing")
+	}
+	if n, _ := db.Client.HLen(ctx, upload.UPLOAD_CHECKPOINTS).Result(); n != 0 {
+		t.Fatalf("checkpoints of an encrypted upload: %d", n)
+	}
+}
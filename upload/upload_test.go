@@ -8,21 +8,37 @@ import (
 
 	"github.com/karrick/godirwalk"
 	"github.com/sirupsen/logrus"
-	"github.com/wangxso/backuptool/config"
 	"github.com/wangxso/backuptool/utils"
 )
 
+// benchDir creates a folder with some small files to walk.
+func benchDir(b *testing.B) string {
+	dir := b.TempDir()
+	for i := 0; i < 200; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%d", i%10))
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(sub, fmt.Sprintf("f%d.txt", i)), []byte(fmt.Sprint(i)), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return dir
+}
+
 func BenchmarkCountFiles(b *testing.B) {
+	dir := benchDir(b)
+	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		config.LoadConfig("/Users/wangxs/backuptool/config.yaml")
-		logrus.Info(countFiles(config.BackUpConfig.General.SyncDir))
+		logrus.Info(countFiles(dir))
 	}
 }
 
 func BenchmarkGodirWalk(b *testing.B) {
+	dir := benchDir(b)
+	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		config.LoadConfig("/Users/wangxs/backuptool/config.yaml")
-		walkDir(config.BackUpConfig.General.SyncDir)
+		walkDir(dir)
 	}
 }
 
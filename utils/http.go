@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/config"
+	openapiclient "github.com/wangxso/backuptool/openxpanapi"
+)
+
+var (
+	httpClientMu sync.Mutex
+	httpClient   *http.Client
+
+	// WrapTransport, when set, wraps the transport of every client built by
+	// NewHTTPClient, e.g. to inject faults or record requests in tests.
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+)
+
+// NewHTTPClient builds a pooled client from c. TLS certificates are
+// verified unless InsecureSkipVerify is set. The client has no overall
+// timeout, callers bound each request with a context deadline.
+func NewHTTPClient(c config.HTTPConfig) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if c.Proxy != "" {
+		proxyURL, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP.proxy: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read HTTP.caFile: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("HTTP.caFile contains no certificate")
+		}
+		tlsConf.RootCAs = pool
+	}
+	if c.InsecureSkipVerify {
+		logrus.Warn("[HTTP] TLS certificate verification is disabled")
+		tlsConf.InsecureSkipVerify = true
+	}
+
+	maxIdle := c.MaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = 16
+	}
+	dialer := &net.Dialer{
+		Timeout:   config.ParseDuration(c.DialTimeout, 30*time.Second),
+		KeepAlive: config.ParseDuration(c.KeepAlive, 30*time.Second),
+	}
+	tr := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConf,
+		TLSHandshakeTimeout:   config.ParseDuration(c.TLSHandshakeTimeout, 10*time.Second),
+		ResponseHeaderTimeout: config.ParseDuration(c.ResponseHeaderTimeout, 60*time.Second),
+		IdleConnTimeout:       config.ParseDuration(c.IdleConnTimeout, 90*time.Second),
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdle,
+		DisableKeepAlives:     c.DisableKeepAlives,
+		ForceAttemptHTTP2:     true,
+	}
+	var rt http.RoundTripper = tr
+	if WrapTransport != nil {
+		rt = WrapTransport(tr)
+	}
+	return &http.Client{Transport: rt}, nil
+}
+
+// LoadHTTPClient rebuilds the shared client from the HTTP section of the
+// config, the previous client is kept when the config is invalid.
+func LoadHTTPClient() error {
+	client, err := NewHTTPClient(config.Get().HTTP)
+	if err != nil {
+		return err
+	}
+	httpClientMu.Lock()
+	old := httpClient
+	httpClient = client
+	httpClientMu.Unlock()
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+	return nil
+}
+
+// HTTPClient returns the client shared by every request to the cloud.
+func HTTPClient() *http.Client {
+	httpClientMu.Lock()
+	client := httpClient
+	httpClientMu.Unlock()
+	if client != nil {
+		return client
+	}
+	if err := LoadHTTPClient(); err != nil {
+		// 配置错误时仍然校验证书, 只是不使用代理和自定义 CA
+		logrus.Error("[HTTP] ", err)
+		client, _ = NewHTTPClient(config.HTTPConfig{})
+		httpClientMu.Lock()
+		httpClient = client
+		httpClientMu.Unlock()
+		return client
+	}
+	return HTTPClient()
+}
+
+// APIConfiguration returns an openxpanapi configuration that uses the
+// shared HTTP client and the base URLs from config.
+func APIConfiguration() *openapiclient.Configuration {
+	configuration := openapiclient.NewConfiguration()
+	configuration.HTTPClient = HTTPClient()
+	for i := range configuration.Servers {
+		configuration.Servers[i].URL = apiBaseURL(configuration.Servers[i].URL)
+	}
+	for _, servers := range configuration.OperationServers {
+		for i := range servers {
+			servers[i].URL = apiBaseURL(servers[i].URL)
+		}
+	}
+	return configuration
+}
+
+// apiBaseURL maps a generated default server to the configured one.
+func apiBaseURL(server string) string {
+	switch server {
+	case config.DEFAULT_PAN_URL:
+		return config.PanURL()
+	case config.DEFAULT_PCS_URL:
+		return config.PcsURL()
+	case config.DEFAULT_OAUTH_URL:
+		return config.OAuthURL()
+	}
+	return server
+}
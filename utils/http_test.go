@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wangxso/backuptool/config"
+)
+
+func TestHTTPClientVerifiesTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client, err := NewHTTPClient(config.HTTPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(server.URL); err == nil {
+		t.Fatal("self-signed certificate was accepted")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	client, err = NewHTTPClient(config.HTTPConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("custom CA not trusted: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("ok"))
+	}))
+	defer proxy.Close()
+
+	client, err := NewHTTPClient(config.HTTPConfig{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://pan.example.com/rest/2.0/xpan/nas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if proxied != "http://pan.example.com/rest/2.0/xpan/nas" {
+		t.Fatalf("request did not go through the proxy: %q", proxied)
+	}
+
+	if _, err := NewHTTPClient(config.HTTPConfig{CAFile: "/nonexistent/ca.pem"}); err == nil {
+		t.Fatal("missing caFile accepted")
+	}
+}
+
+func TestAPIConfigurationBaseURLs(t *testing.T) {
+	saved := config.BackUpConfig.API
+	defer func() { config.BackUpConfig.API = saved }()
+	config.BackUpConfig.API.PanURL = "http://127.0.0.1:8000/"
+	config.BackUpConfig.API.PcsURL = "http://127.0.0.1:8001"
+
+	configuration := APIConfiguration()
+	for op, want := range map[string]string{
+		"MultimediafileApiService.Xpanfilelistall": "http://127.0.0.1:8000",
+		"FileuploadApiService.Pcssuperfile2":       "http://127.0.0.1:8001",
+		"AuthApiService.OauthTokenCode2token":      config.DEFAULT_OAUTH_URL,
+	} {
+		if got := configuration.OperationServers[op][0].URL; got != want {
+			t.Errorf("%s: got %s, want %s", op, got, want)
+		}
+	}
+}
@@ -2,17 +2,25 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
-	"crypto/tls"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
+
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/handler"
 )
 
 type Request struct {
@@ -36,12 +44,12 @@ func CalculateMD5(path string) (string, error) {
 	}(file)
 	size := 4096
 	stat, err := file.Stat()
-	if int(stat.Size()) < size {
-		size = int(stat.Size())
-	}
 	if err != nil {
 		return "", err
 	}
+	if int(stat.Size()) < size {
+		size = int(stat.Size())
+	}
 	buffer := make([]byte, size)
 	_, err = io.ReadFull(file, buffer)
 
@@ -54,16 +62,28 @@ func CalculateMD5(path string) (string, error) {
 	return md5sum, nil
 }
 
-func DoHTTPRequest(url string, body io.Reader, headers map[string]string) (string, int, error) {
-	timeout := 10 * time.Second
-	retryTimes := 3
-	tr := &http.Transport{
-		MaxIdleConnsPerHost: -1,
-		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+// CalculateSHA256 returns the hex sha256 of the whole file, unlike
+// CalculateMD5.
+func CalculateSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
-	httpClient := &http.Client{Transport: tr}
-	httpClient.Timeout = timeout
-	req, err := http.NewRequest("POST", url, body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DoHTTPRequest posts body to url with the shared client, the whole call
+// including its retries is bounded by General.requestTimeout.
+func DoHTTPRequest(ctx context.Context, url string, body io.Reader, headers map[string]string) (string, int, error) {
+	retryTimes := 3
+	ctx, cancel := context.WithTimeout(ctx, config.RequestTimeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		return "", 0, err
 	}
@@ -74,11 +94,11 @@ func DoHTTPRequest(url string, body io.Reader, headers map[string]string) (strin
 
 	var resp *http.Response
 	for i := 1; i <= retryTimes; i++ {
-		resp, err = httpClient.Do(req)
+		resp, err = HTTPClient().Do(req)
 		if err == nil {
 			break
 		}
-		if i == retryTimes {
+		if i == retryTimes || ctx.Err() != nil {
 			return "", 0, err
 		}
 	}
@@ -88,23 +108,16 @@ func DoHTTPRequest(url string, body io.Reader, headers map[string]string) (strin
 	if err != nil {
 		return "", resp.StatusCode, err
 	}
-	return string(respBody), resp.StatusCode, nil
+	return string(respBody), resp.StatusCode, statusError(resp, respBody)
 }
 
 // for superfile2
-func SendHTTPRequest(url string, body io.Reader, headers map[string]string) (string, int, error) {
-	timeout := 120 * time.Second
+func SendHTTPRequest(ctx context.Context, url string, body io.Reader, headers map[string]string) (string, int, error) {
 	retryTimes := 3
 	postData, _ := io.ReadAll(body)
 	var resp *http.Response
 	for i := 1; i <= retryTimes; i++ {
-		tr := &http.Transport{
-			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
-			MaxIdleConnsPerHost: -1,
-		}
-		httpClient := &http.Client{Transport: tr}
-		httpClient.Timeout = timeout
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(postData))
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(postData))
 		if err != nil {
 			return "", 0, err
 		}
@@ -112,11 +125,11 @@ func SendHTTPRequest(url string, body io.Reader, headers map[string]string) (str
 		for k, v := range headers {
 			req.Header.Add(k, v)
 		}
-		resp, err = httpClient.Do(req)
+		resp, err = HTTPClient().Do(req)
 		if err == nil {
 			break
 		}
-		if i == retryTimes {
+		if i == retryTimes || ctx.Err() != nil {
 			return "", 0, err
 		}
 	}
@@ -126,20 +139,13 @@ func SendHTTPRequest(url string, body io.Reader, headers map[string]string) (str
 		return "", resp.StatusCode, err
 	}
 
-	return string(respBody), resp.StatusCode, nil
+	return string(respBody), resp.StatusCode, statusError(resp, respBody)
 }
 
 // for download
-func Do2HTTPRequest(url string, body io.Reader, headers map[string]string) (string, int, error) {
-	// timeout := 500 * time.Second
+func Do2HTTPRequest(ctx context.Context, url string, body io.Reader, headers map[string]string) (string, int, error) {
 	retryTimes := 3
-	tr := &http.Transport{
-		MaxIdleConnsPerHost: -1,
-		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
-	}
-	httpClient := &http.Client{Transport: tr}
-	// httpClient.Timeout = timeout
-	req, err := http.NewRequest("POST", url, body)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		return "", 0, err
 	}
@@ -150,11 +156,11 @@ func Do2HTTPRequest(url string, body io.Reader, headers map[string]string) (stri
 
 	var resp *http.Response
 	for i := 1; i <= retryTimes; i++ {
-		resp, err = httpClient.Do(req)
+		resp, err = HTTPClient().Do(req)
 		if err == nil {
 			break
 		}
-		if i == retryTimes {
+		if i == retryTimes || ctx.Err() != nil {
 			return "", 0, err
 		}
 	}
@@ -164,7 +170,7 @@ func Do2HTTPRequest(url string, body io.Reader, headers map[string]string) (stri
 	if err != nil {
 		return "", resp.StatusCode, err
 	}
-	return string(respBody), resp.StatusCode, nil
+	return string(respBody), resp.StatusCode, statusError(resp, respBody)
 }
 
 func isDir(path string) bool {
@@ -198,3 +204,166 @@ func GenerateRequestID() (uint64, error) {
 	}
 	return id, nil
 }
+
+// ReadResponseBody reads the body of a response returned by the openxpanapi
+// client. The generated client turns non-2xx statuses into errors, but Baidu
+// puts the errno in the JSON body of those responses, so the body is returned
+// whenever it holds JSON and err only when there is nothing to decode.
+func ReadResponseBody(r *http.Response, err error) ([]byte, error) {
+	if r == nil || r.Body == nil {
+		if err == nil {
+			err = errors.New("empty response")
+		}
+		return nil, err
+	}
+	body, readErr := io.ReadAll(r.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+	if err != nil && !json.Valid(body) {
+		if se := statusError(r, body); se != nil {
+			return nil, se
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// statusError returns a handler.StatusError for a 5xx or 429 response
+// without an errno body, so that it is retried like a network error.
+func statusError(r *http.Response, body []byte) error {
+	if r.StatusCode < 500 && r.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+	if json.Valid(body) {
+		return nil
+	}
+	return handler.StatusError{StatusCode: r.StatusCode, Status: r.Status}
+}
+
+// DecodeJSON unmarshals the body of an api response into v. Baidu answers
+// with an HTML page during maintenance, so the start of the body is kept in
+// the error to make that visible in the logs.
+func DecodeJSON(api string, body []byte, v interface{}) error {
+	err := json.Unmarshal(body, v)
+	if err == nil {
+		return nil
+	}
+	snippet := string(body)
+	if len(snippet) > 128 {
+		snippet = snippet[:128] + "..."
+	}
+	return fmt.Errorf("%s: unexpected response %q: %w", api, snippet, err)
+}
+
+// StallWatch cancels a context when a transfer makes no progress for a
+// while, so a stuck connection does not block forever while a slow but
+// moving transfer is never cut off.
+type StallWatch struct {
+	timer   *time.Timer
+	timeout time.Duration
+	cancel  context.CancelFunc
+}
+
+// WithStallTimeout returns a context that is cancelled when nothing has been
+// read through the watch's Reader for timeout. Call Stop when done.
+func WithStallTimeout(ctx context.Context, timeout time.Duration) (context.Context, *StallWatch) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &StallWatch{
+		timer:   time.AfterFunc(timeout, cancel),
+		timeout: timeout,
+		cancel:  cancel,
+	}
+}
+
+// Reader wraps r so that every successful read resets the stall timer.
+func (w *StallWatch) Reader(r io.Reader) io.Reader {
+	return &stallReader{r: r, w: w}
+}
+
+func (w *StallWatch) Stop() {
+	w.timer.Stop()
+	w.cancel()
+}
+
+type stallReader struct {
+	r io.Reader
+	w *StallWatch
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.w.timer.Reset(s.w.timeout)
+	}
+	return n, err
+}
+
+// Limiter caps the bytes per second read through its readers, all of
+// them together. A nil Limiter does not limit.
+type Limiter struct {
+	rate int64
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewLimiter returns a limiter of bytesPerSecond, nil when it is not
+// positive.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{rate: bytesPerSecond}
+}
+
+// Reader wraps r so reads wait for their share of the bandwidth, waiting
+// stops when ctx is done.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+// wait 读取了 n 字节之后等待, 按速率推迟下一次读取的时间
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// 每次最多读取 1/10 秒的量, 速度更平稳
+	if max := r.l.rate/10 + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.wait(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
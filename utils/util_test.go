@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangxso/backuptool/config"
+)
+
+type slowReader struct {
+	delay time.Duration
+	r     io.Reader
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p[:1])
+}
+
+func TestStallWatch(t *testing.T) {
+	// 每次读取都有进展, 总时间超过 timeout 也不应被取消
+	ctx, w := WithStallTimeout(context.Background(), 50*time.Millisecond)
+	r := w.Reader(&slowReader{delay: 10 * time.Millisecond, r: strings.NewReader("0123456789")})
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("moving transfer was cancelled: %v", ctx.Err())
+	}
+	w.Stop()
+
+	// 没有任何进展时应被取消
+	ctx, w = WithStallTimeout(context.Background(), 20*time.Millisecond)
+	defer w.Stop()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stalled transfer was not cancelled")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	if r := strings.NewReader("x"); NewLimiter(0).Reader(context.Background(), r) != r {
+		t.Fatal("no limit should not wrap the reader")
+	}
+	// 两个读取共用 20 KB/s, 一共 6 KB 至少需要 0.3 秒 (第一次读取不等待)
+	l := NewLimiter(20 << 10)
+	start := time.Now()
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := io.Copy(io.Discard, l.Reader(context.Background(), strings.NewReader(strings.Repeat("x", 3<<10))))
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("6 KB at 20 KB/s took %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := NewLimiter(1).Reader(ctx, strings.NewReader("0123456789"))
+	if _, err := io.ReadAll(r); err != context.Canceled {
+		t.Fatalf("cancelled read: %v", err)
+	}
+}
+
+func TestDoHTTPRequestTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	saved := config.BackUpConfig.General.RequestTimeout
+	defer func() { config.BackUpConfig.General.RequestTimeout = saved }()
+	config.BackUpConfig.General.RequestTimeout = "50ms"
+
+	start := time.Now()
+	if _, _, err := DoHTTPRequest(context.Background(), srv.URL, nil, nil); err == nil {
+		t.Fatal("request outlived General.requestTimeout")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("timed out after %s", d)
+	}
+}
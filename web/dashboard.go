@@ -0,0 +1,259 @@
+package web
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wangxso/backuptool/auth"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/crypt"
+	"github.com/wangxso/backuptool/db"
+	"github.com/wangxso/backuptool/download"
+	"github.com/wangxso/backuptool/jobs"
+	"github.com/wangxso/backuptool/progress"
+	"github.com/wangxso/backuptool/restore"
+	"github.com/wangxso/backuptool/snapshot"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// registerDashboard 注册页面和页面使用的 JSON 接口
+func registerDashboard(r *gin.RouterGroup) {
+	sub, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+	r.StaticFS("/ui", http.FS(sub))
+	r.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/ui/")
+	})
+
+	api := r.Group("/api")
+	api.GET("/auth/status", AuthStatusHandler)
+	api.POST("/jobs/:name/cancel", RequireWrite(), CancelJobHandler)
+	api.GET("/jobs", JobsHandler)
+	api.POST("/jobs/:name/run", RequireWrite(), RunJobHandler)
+	api.GET("/transfers", TransfersHandler)
+	api.GET("/history", HistoryHandler)
+	api.GET("/files", FilesHandler)
+	api.GET("/snapshots", SnapshotsHandler)
+	api.GET("/restore", RestoreStatusHandler)
+	api.POST("/restore", RequireWrite(), RestoreHandler)
+	api.POST("/restore/cancel", RequireWrite(), CancelRestoreHandler)
+}
+
+func AuthStatusHandler(c *gin.Context) {
+	redisCli := db.Client
+	ttl, err := redisCli.TTL(redisCli.Context(), "AccessCode").Result()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	// TTL 为负数表示 key 不存在
+	loggedIn := ttl > 0
+	resp := gin.H{
+		"loggedIn": loggedIn,
+	}
+	if loggedIn {
+		resp["expiresAt"] = time.Now().Add(ttl)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func JobsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"jobs": jobs.List(),
+	})
+}
+
+func RunJobHandler(c *gin.Context) {
+	// 同步可能耗时很久, 在后台执行, 结果通过 /api/history 查看
+	// 不能使用请求的 context, 请求结束后同步仍需继续, 通过 /cancel 停止
+	err := jobs.Start(context.Background(), c.Param("name"))
+	switch {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+	case errors.Is(err, jobs.ErrJobRunning):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+	case errors.Is(err, jobs.ErrStopping):
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": err.Error(),
+		})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "started",
+		})
+	}
+}
+
+func CancelJobHandler(c *gin.Context) {
+	err := jobs.Cancel(c.Param("name"))
+	switch {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+	case err != nil:
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "cancelling",
+		})
+	}
+}
+
+func TransfersHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"transfers": progress.List(),
+	})
+}
+
+func HistoryHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	runs, err := jobs.History(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"history": runs,
+	})
+}
+
+func FilesHandler(c *gin.Context) {
+	dir := c.DefaultQuery("dir", "/")
+	resp, err := download.GetFileList(c.Request.Context(), auth.AccessToken(), dir, "name", "0", "0", 1000, 0)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	// 加密的文件名显示为原名, path 保持云端路径用于浏览
+	for i := range resp.List {
+		resp.List[i].ServerFileName = crypt.DisplayName(resp.List[i].ServerFileName)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"dir":  dir,
+		"list": resp.List,
+	})
+}
+
+// snapshotSummary 是快照列表中的一项, 不含文件清单
+type snapshotSummary struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Partial bool      `json:"partial,omitempty"`
+	Files   int       `json:"files"`
+	Size    int64     `json:"size"`
+}
+
+func SnapshotsHandler(c *gin.Context) {
+	list, err := snapshot.List(c.Query("job"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	ret := make([]snapshotSummary, 0, len(list))
+	for _, m := range list {
+		ret = append(ret, snapshotSummary{ID: m.ID, Created: m.Created, Partial: m.Partial, Files: len(m.Files), Size: m.Size()})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"snapshots": ret,
+	})
+}
+
+// RestoreHandler starts a restore in the background, the body is a
+// restore.Options, e.g. {"job":"docs","at":"2024-01-02T15:04:05+08:00","globs":["*.txt"],"target":"/tmp/docs"}.
+func RestoreHandler(c *gin.Context) {
+	var opts restore.Options
+	if err := c.ShouldBindJSON(&opts); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if opts.Target != "" {
+		if err := restore.CheckTarget(opts.Target, restoreRoots(opts.Job)); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+	err := restore.Start(opts)
+	switch {
+	case errors.Is(err, snapshot.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+	case errors.Is(err, restore.ErrRunning):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "started",
+		})
+	}
+}
+
+// restoreRoots 是 Web.restoreRoots 加上任务的源目录
+func restoreRoots(job string) []string {
+	c := config.Get()
+	roots := append([]string(nil), c.Web.RestoreRoots...)
+	for _, j := range config.GetJobs() {
+		if j.Name == job && j.SourceDir != "" {
+			roots = append(roots, j.SourceDir)
+		}
+	}
+	return roots
+}
+
+func RestoreStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"restore": restore.Current(),
+	})
+}
+
+func CancelRestoreHandler(c *gin.Context) {
+	if err := restore.Cancel(c.Request.Context()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "cancelled",
+	})
+}
@@ -0,0 +1,82 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wangxso/backuptool/config"
+	"github.com/wangxso/backuptool/fakepan"
+	"github.com/wangxso/backuptool/jobs"
+)
+
+func TestDashboardAPI(t *testing.T) {
+	fakepan.Setup(t)
+	dir := t.TempDir()
+	config.BackUpConfig.Jobs = []config.Job{{Name: "docs", SourceDir: dir, TargetDir: "/apps/backup", Mode: config.MODE_SNAPSHOT}}
+	jobs.Load()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerRoutes(r)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodGet, "/", ""); w.Code != http.StatusFound || w.Header().Get("Location") != "/ui/" {
+		t.Fatalf("GET /: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := do(http.MethodGet, "/ui/", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<html") {
+		t.Fatalf("GET /ui/: %d", w.Code)
+	}
+
+	var status struct {
+		LoggedIn bool `json:"loggedIn"`
+	}
+	w := do(http.MethodGet, "/api/auth/status", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || !status.LoggedIn {
+		t.Fatalf("auth status: %s", w.Body)
+	}
+	var list struct {
+		Jobs []jobs.Status `json:"jobs"`
+	}
+	w = do(http.MethodGet, "/api/jobs", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Jobs) != 1 || list.Jobs[0].Name != "docs" {
+		t.Fatalf("jobs: %s", w.Body)
+	}
+	if w := do(http.MethodPost, "/api/jobs/nope/run", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("run unknown job: %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/api/jobs/nope/cancel", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("cancel unknown job: %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/api/jobs/docs/cancel", ""); w.Code != http.StatusConflict {
+		t.Fatalf("cancel idle job: %d", w.Code)
+	}
+	for _, path := range []string{"/api/history", "/api/transfers", "/api/snapshots?job=docs", "/api/restore"} {
+		if w := do(http.MethodGet, path, ""); w.Code != http.StatusOK {
+			t.Errorf("GET %s: %d %s", path, w.Code, w.Body)
+		}
+	}
+
+	// 恢复的目标必须在任务的源目录或 restoreRoots 之下
+	if w := do(http.MethodPost, "/api/restore", "{"); w.Code != http.StatusBadRequest {
+		t.Fatalf("restore with a bad body: %d", w.Code)
+	}
+	outside := `{"job":"docs","target":"` + filepath.ToSlash(t.TempDir()) + `"}`
+	if w := do(http.MethodPost, "/api/restore", outside); w.Code != http.StatusForbidden {
+		t.Fatalf("restore outside the roots: %d %s", w.Code, w.Body)
+	}
+	inside := `{"job":"docs","target":"` + filepath.ToSlash(filepath.Join(dir, "restored")) + `"}`
+	if w := do(http.MethodPost, "/api/restore", inside); w.Code != http.StatusNotFound {
+		t.Fatalf("restore without snapshots: %d %s", w.Code, w.Body)
+	}
+}
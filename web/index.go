@@ -1,25 +1,80 @@
 package web
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sync"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 	"github.com/wangxso/backuptool/auth"
 	"github.com/wangxso/backuptool/cloudsync"
 	"github.com/wangxso/backuptool/config"
 	"github.com/wangxso/backuptool/db"
 )
 
-func StartWeb() {
+var (
+	serverMu sync.Mutex
+	server   *http.Server
+)
+
+// StartWeb serves the HTTP API until the server fails or Shutdown is called.
+func StartWeb() error {
 	r := gin.Default()
-	r.GET("/sync/status", UploadStatus)
-	r.GET("/sync", SyncFolder)
-	r.GET("/auth", Auth)
-	r.GET("/login", AuthLogin)
-	r.GET("/cache", CacheFileMD5Handler)
+	registerRoutes(r)
+
+	tlsConf, err := tlsConfig()
+	if err != nil {
+		return fmt.Errorf("[TLS] %w", err)
+	}
+	serverMu.Lock()
+	server = &http.Server{
+		Addr:      listenAddr(),
+		Handler:   r,
+		TLSConfig: tlsConf,
+	}
+	serverMu.Unlock()
+	if tlsConf != nil {
+		logrus.Info("Listening on https://", server.Addr)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		logrus.Info("Listening on http://", server.Addr)
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// registerRoutes 注册所有接口, 修改状态的接口只接受同源的 POST
+func registerRoutes(r *gin.Engine) {
+	r.HandleMethodNotAllowed = true
 	r.GET("/alive", AliveHandler)
-	r.Run("0.0.0.0:8080")
+
+	authorized := r.Group("/", SameOrigin(), Authenticate())
+	authorized.GET("/sync/status", UploadStatus)
+	authorized.GET("/auth", Auth)
+	authorized.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	authorized.POST("/sync", RequireWrite(), SyncFolder)
+	authorized.POST("/login", RequireWrite(), AuthLogin)
+	authorized.POST("/cache", RequireWrite(), CacheFileMD5Handler)
+	registerDashboard(authorized)
+}
+
+// Shutdown stops accepting connections and waits for the active requests
+// until ctx is done.
+func Shutdown(ctx context.Context) error {
+	serverMu.Lock()
+	s := server
+	serverMu.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.Shutdown(ctx)
 }
 
 func AliveHandler(c *gin.Context) {
@@ -30,22 +85,42 @@ func AliveHandler(c *gin.Context) {
 }
 
 func Auth(c *gin.Context) {
-	appKey := config.BackUpConfig.BaiduDisk.AppKey
-	deviceId := config.BackUpConfig.BaiduDisk.SecretKey
-	url := fmt.Sprintf("http://openapi.baidu.com/oauth/2.0/authorize?response_type=code&client_id=%s&redirect_uri=oob&scope=basic,netdisk&device_id=%s", appKey, deviceId)
+	baidu := config.Get().BaiduDisk
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {baidu.AppKey},
+		"redirect_uri":  {"oob"},
+		"scope":         {"basic,netdisk"},
+	}
+	// 不要把 SecretKey 放进授权链接, device_id 是应用的 AppID
+	if deviceId := baidu.DeviceId; deviceId != "" {
+		q.Set("device_id", deviceId)
+	}
+	link := config.OAuthURL() + "/oauth/2.0/authorize?" + q.Encode()
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Please visit",
-		"url":     url,
+		"url":     link,
 	})
 }
 
 func AuthLogin(c *gin.Context) {
-	code := c.Query("code")
-	resp := auth.Login(code)
+	code := c.PostForm("code")
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "missing code",
+		})
+		return
+	}
+	resp, err := auth.Login(c.Request.Context(), code)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	// 不要在响应中返回 access token 和 refresh token
 	c.JSON(http.StatusOK, gin.H{
 		"message": "success",
-		"token":   resp.AccessToken,
-		"refresh": resp.RefreshToken,
 		"scope":   resp.Scope,
 		"expires": resp.ExpiresIn,
 	})
@@ -59,14 +134,17 @@ func CacheFileMD5Handler(c *gin.Context) {
 }
 
 func SyncFolder(c *gin.Context) {
-	err := cloudsync.SyncFolder()
+	result, err := cloudsync.SyncFolder(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": err.Error(),
+			"error":  err.Error(),
+			"result": result,
 		})
+		return
 	}
 	c.JSON(http.StatusOK, gin.H{
 		"message": "success",
+		"result":  result,
 	})
 }
 
@@ -78,6 +156,7 @@ func UploadStatus(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
 		})
+		return
 	}
 	uploadedFileList := make([]string, 0)
 	unuploadFileList := make([]string, 0)
@@ -0,0 +1,65 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wangxso/backuptool/config"
+)
+
+func TestStateChangingRoutesRequirePost(t *testing.T) {
+	config.BackUpConfig.Web.Tokens = nil
+	config.BackUpConfig.Web.Users = nil
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registerRoutes(r)
+
+	for _, path := range []string{"/sync", "/login", "/cache"} {
+		req := httptest.NewRequest(http.MethodGet, path+"?code=x", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s: got %d, want 405", path, w.Code)
+		}
+	}
+
+	// 授权码从表单中读取
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("code="))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "missing code") {
+		t.Fatalf("POST /login without code: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAuthURLDeviceID(t *testing.T) {
+	saved := config.BackUpConfig.BaiduDisk
+	defer func() { config.BackUpConfig.BaiduDisk = saved }()
+	config.BackUpConfig.BaiduDisk.AppKey = "app-key"
+	config.BackUpConfig.BaiduDisk.SecretKey = "secret-key"
+	config.BackUpConfig.BaiduDisk.DeviceId = "12345678"
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	Auth(c)
+	var resp struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(resp.URL, "secret-key") {
+		t.Fatalf("secret key in %s", resp.URL)
+	}
+	if !strings.Contains(resp.URL, "device_id=12345678") || !strings.Contains(resp.URL, "client_id=app-key") {
+		t.Fatalf("auth url: %s", resp.URL)
+	}
+}
@@ -0,0 +1,154 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wangxso/backuptool/config"
+)
+
+const (
+	DEFAULT_LISTEN = "0.0.0.0:8080"
+
+	roleKey   = "role"
+	roleAdmin = "admin"
+	roleRead  = "readonly"
+)
+
+// Authenticate checks the bearer token or basic auth credentials against
+// the Web section of the config and stores the caller's role in the context.
+// With no credentials configured only loopback clients are accepted.
+func Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webConfig := config.Get().Web
+		if len(webConfig.Tokens) == 0 && len(webConfig.Users) == 0 {
+			if isLoopback(c.Request.RemoteAddr) {
+				c.Set(roleKey, roleAdmin)
+				c.Next()
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "no credentials configured, only local access is allowed",
+			})
+			return
+		}
+
+		role, ok := checkCredentials(c.Request)
+		if !ok {
+			// 让浏览器弹出登录框, 方便直接使用页面
+			c.Header("WWW-Authenticate", `Basic realm="backuptool"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "unauthorized",
+			})
+			return
+		}
+		c.Set(roleKey, role)
+		c.Next()
+	}
+}
+
+// RequireWrite rejects callers that authenticated with a read-only credential.
+func RequireWrite() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString(roleKey) != roleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "read-only credential",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// SameOrigin rejects state-changing requests a browser sends from another
+// site, e.g. a form on a foreign page posting to the dashboard with the
+// cached basic auth credentials. Clients that are not browsers send
+// neither Sec-Fetch-Site nor Origin and pass.
+func SameOrigin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if !sameOrigin(c.Request) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "cross-site request",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+func sameOrigin(req *http.Request) bool {
+	// 新的浏览器都带 Sec-Fetch-Site, 旧的浏览器只带 Origin, 和 Host 比较
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
+
+func checkCredentials(req *http.Request) (string, bool) {
+	webConfig := config.Get().Web
+	header := req.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token := strings.TrimPrefix(header, "Bearer ")
+		for _, t := range webConfig.Tokens {
+			if t.Token != "" && secureEqual(token, t.Token) {
+				return role(t.ReadOnly), true
+			}
+		}
+		return "", false
+	}
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	for _, u := range webConfig.Users {
+		if u.Username != "" && secureEqual(username, u.Username) && secureEqual(password, u.Password) {
+			return role(u.ReadOnly), true
+		}
+	}
+	return "", false
+}
+
+func role(readOnly bool) string {
+	if readOnly {
+		return roleRead
+	}
+	return roleAdmin
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func listenAddr() string {
+	if listen := config.Get().Web.Listen; listen != "" {
+		return listen
+	}
+	return DEFAULT_LISTEN
+}
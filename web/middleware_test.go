@@ -0,0 +1,121 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wangxso/backuptool/config"
+)
+
+func newTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	g := r.Group("/", Authenticate())
+	g.GET("/read", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	g.GET("/write", RequireWrite(), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	return r
+}
+
+func doRequest(r http.Handler, path, remote string, setup func(*http.Request)) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remote
+	if setup != nil {
+		setup(req)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestAuthenticateWithoutCredentials(t *testing.T) {
+	config.BackUpConfig.Web.Tokens = nil
+	config.BackUpConfig.Web.Users = nil
+	r := newTestRouter()
+
+	if code := doRequest(r, "/write", "127.0.0.1:1234", nil); code != http.StatusOK {
+		t.Fatalf("loopback request: got %d, want 200", code)
+	}
+	if code := doRequest(r, "/read", "192.168.1.10:1234", nil); code != http.StatusForbidden {
+		t.Fatalf("remote request: got %d, want 403", code)
+	}
+}
+
+func TestAuthenticateRoles(t *testing.T) {
+	config.BackUpConfig.Web.Tokens = []config.WebToken{
+		{Token: "admin-token"},
+		{Token: "viewer-token", ReadOnly: true},
+	}
+	config.BackUpConfig.Web.Users = []config.WebUser{
+		{Username: "viewer", Password: "secret", ReadOnly: true},
+	}
+	defer func() {
+		config.BackUpConfig.Web.Tokens = nil
+		config.BackUpConfig.Web.Users = nil
+	}()
+	r := newTestRouter()
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	cases := []struct {
+		name  string
+		path  string
+		setup func(*http.Request)
+		want  int
+	}{
+		{"no credentials", "/read", nil, http.StatusUnauthorized},
+		{"wrong token", "/read", bearer("nope"), http.StatusUnauthorized},
+		{"admin read", "/read", bearer("admin-token"), http.StatusOK},
+		{"admin write", "/write", bearer("admin-token"), http.StatusOK},
+		{"viewer read", "/read", bearer("viewer-token"), http.StatusOK},
+		{"viewer write", "/write", bearer("viewer-token"), http.StatusForbidden},
+		{"basic read", "/read", func(req *http.Request) { req.SetBasicAuth("viewer", "secret") }, http.StatusOK},
+		{"basic wrong password", "/read", func(req *http.Request) { req.SetBasicAuth("viewer", "x") }, http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		if code := doRequest(r, tc.path, "10.0.0.2:5555", tc.setup); code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, code, tc.want)
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(SameOrigin())
+	r.GET("/read", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	r.POST("/write", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	cases := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{"curl", http.MethodPost, nil, http.StatusOK},
+		{"dashboard", http.MethodPost, map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://example.com"}, http.StatusOK},
+		{"foreign form", http.MethodPost, map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "http://evil.test"}, http.StatusForbidden},
+		{"same site subdomain", http.MethodPost, map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{"old browser", http.MethodPost, map[string]string{"Origin": "http://example.com"}, http.StatusOK},
+		{"old browser foreign", http.MethodPost, map[string]string{"Origin": "http://evil.test"}, http.StatusForbidden},
+		{"opaque origin", http.MethodPost, map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"foreign read", http.MethodGet, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusOK},
+	}
+	for _, tc := range cases {
+		path := "/write"
+		if tc.method == http.MethodGet {
+			path = "/read"
+		}
+		req := httptest.NewRequest(tc.method, path, nil)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+(function () {
+  "use strict";
+
+  var currentDir = "/";
+
+  function $(id) {
+    return document.getElementById(id);
+  }
+
+  function get(url) {
+    return fetch(url, { credentials: "same-origin" }).then(function (resp) {
+      return resp.json().then(function (data) {
+        if (!resp.ok) {
+          throw new Error(data.error || resp.statusText);
+        }
+        return data;
+      });
+    });
+  }
+
+  function post(url, body) {
+    return fetch(url, { method: "POST", credentials: "same-origin", body: body }).then(function (resp) {
+      return resp.json();
+    });
+  }
+
+  var escapes = { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" };
+
+  function text(s) {
+    return (s == null ? "" : String(s)).replace(/[&<>"']/g, function (c) {
+      return escapes[c];
+    });
+  }
+
+  function time(t) {
+    if (!t || t.indexOf("0001-") === 0) {
+      return "-";
+    }
+    return new Date(t).toLocaleString();
+  }
+
+  function size(n) {
+    var units = ["B", "KB", "MB", "GB", "TB"];
+    var i = 0;
+    while (n >= 1024 && i < units.length - 1) {
+      n /= 1024;
+      i++;
+    }
+    return n.toFixed(i === 0 ? 0 : 1) + " " + units[i];
+  }
+
+  function loadAuth() {
+    get("/api/auth/status").then(function (data) {
+      var badge = $("auth-badge");
+      if (data.loggedIn) {
+        badge.textContent = "已登录";
+        badge.className = "badge ok";
+        $("auth-text").textContent = "已登录, 令牌有效期至 " + time(data.expiresAt);
+      } else {
+        badge.textContent = "未登录";
+        badge.className = "badge bad";
+        $("auth-text").textContent = "未登录, 请先获取授权链接, 在百度页面授权后把授权码填到下面";
+      }
+    }).catch(function (err) {
+      $("auth-text").innerHTML = '<span class="error">' + text(err.message) + "</span>";
+    });
+  }
+
+  function loadJobs() {
+    get("/api/jobs").then(function (data) {
+      var rows = data.jobs.map(function (j) {
+        var last = "-";
+        if (j.lastRun) {
+          last = time(j.lastRun.start) + (j.lastRun.error ? ' <span class="error">失败</span>' : " 成功");
+        }
+        var btn = j.running
+          ? '<button data-cancel="' + text(j.name) + '">取消</button>'
+          : '<button data-job="' + text(j.name) + '">立即同步</button>';
+        return "<tr><td>" + text(j.name) + "</td><td>" + text(j.sourceDir) + "</td><td>" + text(j.targetDir) +
+          "</td><td>" + text(j.interval || "手动") + "</td><td>" + last + "</td><td>" + time(j.nextRun) +
+          "</td><td>" + btn + "</td></tr>";
+      });
+      $("jobs-body").innerHTML = rows.join("");
+    });
+  }
+
+  function loadTransfers() {
+    get("/api/transfers").then(function (data) {
+      if (!data.transfers.length) {
+        $("transfers-body").innerHTML = '<p class="muted">没有正在进行的传输</p>';
+        return;
+      }
+      var items = data.transfers.map(function (t) {
+        var state = t.finished ? (t.error ? '<span class="error">' + text(t.error) + "</span>" : "完成") : t.percent.toFixed(1) + "%";
+        return '<div class="transfer"><div>' + (t.kind === "upload" ? "上传 " : "下载 ") + text(t.name) +
+          " (" + size(t.done) + " / " + size(t.total) + ") " + state + "</div>" +
+          '<div class="bar"><div style="width:' + Math.min(t.percent, 100) + '%"></div></div></div>';
+      });
+      $("transfers-body").innerHTML = items.join("");
+    });
+  }
+
+  function loadHistory() {
+    get("/api/history?limit=20").then(function (data) {
+      var rows = data.history.map(function (r) {
+        var res = r.result || {};
+        var failed = res.failed || [];
+        var result = "上传 " + (res.uploaded || 0) + ", 跳过 " + (res.skipped || 0) + ", 待下载 " + (res.downloaded || 0);
+        if (r.error) {
+          result = '<span class="error">' + text(r.error) + "</span>";
+        } else if (failed.length) {
+          result += '<br><span class="error">失败 ' + failed.length + ": " +
+            failed.slice(0, 5).map(function (f) { return text(f.path) + " (" + text(f.error) + ")"; }).join(", ") +
+            (failed.length > 5 ? " ..." : "") + "</span>";
+        }
+        return "<tr><td>" + text(r.job) + "</td><td>" + time(r.start) + "</td><td>" + text(r.duration) +
+          "</td><td>" + result + "</td></tr>";
+      });
+      $("history-body").innerHTML = rows.join("") || '<tr><td colspan="4" class="muted">暂无记录</td></tr>';
+    });
+  }
+
+  function loadFiles(dir) {
+    get("/api/files?dir=" + encodeURIComponent(dir)).then(function (data) {
+      currentDir = dir;
+      $("files-dir").textContent = dir;
+      var rows = (data.list || []).map(function (f) {
+        var name = f.isdir
+          ? '<a class="dir" data-dir="' + text(f.path) + '">' + text(f.server_filename) + "/</a>"
+          : text(f.server_filename);
+        return "<tr><td>" + name + "</td><td>" + (f.isdir ? "-" : size(f.size)) + "</td><td>" +
+          new Date(f.server_mtime * 1000).toLocaleString() + "</td></tr>";
+      });
+      $("files-body").innerHTML = rows.join("") || '<tr><td colspan="3" class="muted">空目录</td></tr>';
+    }).catch(function (err) {
+      $("files-body").innerHTML = '<tr><td colspan="3" class="error">' + text(err.message) + "</td></tr>";
+    });
+  }
+
+  $("auth-url").addEventListener("click", function () {
+    get("/auth").then(function (data) {
+      var a = $("auth-link");
+      a.href = data.url;
+      a.textContent = "打开百度授权页面";
+    });
+  });
+
+  $("login-form").addEventListener("submit", function (e) {
+    e.preventDefault();
+    var code = $("auth-code").value.trim();
+    if (!code) {
+      return;
+    }
+    post("/login", new URLSearchParams({ code: code })).then(function (data) {
+      if (data.error) {
+        throw new Error(data.error);
+      }
+      $("auth-code").value = "";
+      loadAuth();
+    }).catch(function (err) {
+      $("auth-text").innerHTML = '<span class="error">' + text(err.message) + "</span>";
+    });
+  });
+
+  $("jobs-body").addEventListener("click", function (e) {
+    var name = e.target.getAttribute("data-job");
+    if (name) {
+      post("/api/jobs/" + encodeURIComponent(name) + "/run").then(loadJobs);
+    }
+    var cancel = e.target.getAttribute("data-cancel");
+    if (cancel) {
+      post("/api/jobs/" + encodeURIComponent(cancel) + "/cancel").then(loadJobs);
+    }
+  });
+
+  $("files-body").addEventListener("click", function (e) {
+    var dir = e.target.getAttribute("data-dir");
+    if (dir) {
+      loadFiles(dir);
+    }
+  });
+
+  $("files-up").addEventListener("click", function () {
+    var parent = currentDir.replace(/\/[^\/]*\/?$/, "") || "/";
+    loadFiles(parent);
+  });
+
+  loadAuth();
+  loadJobs();
+  loadTransfers();
+  loadHistory();
+  loadFiles(currentDir);
+
+  setInterval(loadTransfers, 2000);
+  setInterval(function () {
+    loadJobs();
+    loadHistory();
+  }, 10000);
+})();
@@ -0,0 +1,156 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wangxso/backuptool/config"
+)
+
+// reloadCheckInterval 两次检查证书文件是否更新的最小间隔
+var reloadCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate and client CA pool from disk and
+// reloads them when the files change, so rotated certificates are picked up
+// without restarting the server.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	caPool    *x509.CertPool
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		modTimes: make(map[string]time.Time),
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) files() []string {
+	files := []string{cr.certFile, cr.keyFile}
+	if cr.caFile != "" {
+		files = append(files, cr.caFile)
+	}
+	return files
+}
+
+// load 读取证书和 CA, 调用方需要持有锁或在初始化时调用
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if cr.caFile != "" {
+		pem, err := os.ReadFile(cr.caFile)
+		if err != nil {
+			return fmt.Errorf("read client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate found in client CA file " + cr.caFile)
+		}
+	}
+	for _, f := range cr.files() {
+		if stat, err := os.Stat(f); err == nil {
+			cr.modTimes[f] = stat.ModTime()
+		}
+	}
+	cr.cert = &cert
+	cr.caPool = pool
+	return nil
+}
+
+// maybeReload reloads the files if any of them changed since the last load.
+// A broken rotation keeps serving the previous certificate.
+func (cr *certReloader) maybeReload() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.lastCheck) < reloadCheckInterval {
+		return
+	}
+	cr.lastCheck = time.Now()
+	changed := false
+	for _, f := range cr.files() {
+		stat, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if !stat.ModTime().Equal(cr.modTimes[f]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := cr.load(); err != nil {
+		logrus.Error("[TLS] reload certificate failed, keep using the old one: ", err)
+		return
+	}
+	logrus.Info("[TLS] certificate reloaded")
+}
+
+func (cr *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	cr.maybeReload()
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.cert, cr.caPool
+}
+
+// tlsConfig builds the server TLS config from the Web.tls section, it
+// returns nil when TLS is not configured.
+func tlsConfig() (*tls.Config, error) {
+	tlsConf := config.Get().Web.TLS
+	if tlsConf.CertFile == "" && tlsConf.KeyFile == "" {
+		if tlsConf.ClientCAFile != "" {
+			return nil, errors.New("Web.tls.clientCAFile requires certFile and keyFile")
+		}
+		return nil, nil
+	}
+	if tlsConf.CertFile == "" || tlsConf.KeyFile == "" {
+		return nil, errors.New("Web.tls needs both certFile and keyFile")
+	}
+	cr, err := newCertReloader(tlsConf.CertFile, tlsConf.KeyFile, tlsConf.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth := tls.NoClientCert
+	if tlsConf.ClientCAFile != "" {
+		clientAuth = tls.RequireAndVerifyClientCert
+		if tlsConf.ClientCertOptional {
+			clientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	// 每次握手都取最新的证书和 CA, 以支持证书轮换
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, pool := cr.current()
+		return &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{*cert},
+			ClientAuth:   clientAuth,
+			ClientCAs:    pool,
+		}, nil
+	}
+	return base, nil
+}